@@ -0,0 +1,169 @@
+package data_types
+
+import (
+	"fmt"
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/go-faster/jx"
+	"strconv"
+)
+
+var _ IColumn = &BoolColumn{}
+
+// BoolColumn is the BOOLEAN column. bool doesn't satisfy constraints.Ordered
+// so it can't reuse the generic Column.
+type BoolColumn struct {
+	data   []bool
+	valids []bool
+	name   string
+}
+
+func boolBuilder(name string, data any, sizeAndCap ...int64) (IColumn, error) {
+	col := &BoolColumn{name: name}
+	if data == nil {
+		col.InitializeData(sizeAndCap...)
+		return col, nil
+	}
+	err := col.ValidateData(data)
+	if err != nil {
+		return nil, err
+	}
+	col.data = data.([]bool)
+	col.valids = make([]bool, len(col.data))
+	FastFillArray(col.valids, true)
+	return col, nil
+}
+
+func (c *BoolColumn) InitializeData(sizeAndCap ...int64) {
+	var size int64 = 1000
+	if len(sizeAndCap) > 0 {
+		size = sizeAndCap[0]
+	}
+	cap := size * 2
+	if len(sizeAndCap) > 1 {
+		cap = sizeAndCap[1]
+	}
+	if cap < size {
+		cap = size
+	}
+	c.data = make([]bool, size, cap)
+	c.valids = make([]bool, size, cap)
+}
+
+func (c *BoolColumn) AppendNulls(size int64) {
+	c.data = append(c.data, make([]bool, size)...)
+	c.valids = append(c.valids, make([]bool, size)...)
+}
+
+func (c *BoolColumn) GetLength() int64 {
+	return int64(len(c.data))
+}
+
+func (c *BoolColumn) AppendFromJson(dec *jx.Decoder) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (c *BoolColumn) Less(i int32, j int32) bool {
+	return (!c.valids[i] && c.valids[j]) || (c.valids[i] && c.valids[j] && (!c.data[i] || c.data[j]))
+}
+
+func (c *BoolColumn) ValidateData(data any) error {
+	if _, ok := data.([]bool); !ok {
+		return fmt.Errorf("invalid data type")
+	}
+	return nil
+}
+
+func (c *BoolColumn) ArrowDataType() arrow.DataType {
+	return arrow.FixedWidthTypes.Boolean
+}
+
+func (c *BoolColumn) Append(data any) error {
+	err := c.ValidateData(data)
+	if err != nil {
+		return err
+	}
+	lenBefore := c.GetLength()
+	_data := data.([]bool)
+	c.data = append(c.data, _data...)
+	c.valids = append(c.valids, make([]bool, len(_data))...)
+	FastFillArray(c.valids[lenBefore:], true)
+	return nil
+}
+
+func (c *BoolColumn) AppendOne(val any) error {
+	if v, ok := val.(bool); ok {
+		c.data = append(c.data, v)
+		c.valids = append(c.valids, true)
+		return nil
+	}
+	return fmt.Errorf("invalid data type")
+}
+
+func (c *BoolColumn) AppendByMask(data any, mask []byte) error {
+	err := c.ValidateData(data)
+	if err != nil {
+		return err
+	}
+	c.data, c.valids, err = appendByMask(c.data, c.valids, data.([]bool), mask)
+	return err
+}
+
+func (c *BoolColumn) WriteToBatch(batch array.Builder) error {
+	batch.(*array.BooleanBuilder).AppendValues(c.data, c.valids)
+	return nil
+}
+
+func (c *BoolColumn) GetName() string {
+	return c.name
+}
+
+func (c *BoolColumn) GetTypeName() string {
+	return DATA_TYPE_NAME_BOOL
+}
+
+func (c *BoolColumn) GetVal(i int64) any {
+	return c.data[i]
+}
+
+func (c *BoolColumn) ParseFromStr(s string) error {
+	val, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	c.data = append(c.data, val)
+	c.valids = append(c.valids, true)
+	return nil
+}
+
+func (c *BoolColumn) GetData() any {
+	return c.data
+}
+
+func (c *BoolColumn) GetValids() []bool {
+	return c.valids
+}
+
+func (c *BoolColumn) setValids(valids []bool) {
+	c.valids = valids
+}
+
+func (c *BoolColumn) GetMinMax() (any, any) {
+	if c.GetLength() == 0 {
+		return nil, nil
+	}
+	seen := false
+	_min, _max := true, false
+	for i, v := range c.data {
+		if !c.valids[i] {
+			continue
+		}
+		seen = true
+		_min = _min && v
+		_max = _max || v
+	}
+	if !seen {
+		return nil, nil
+	}
+	return _min, _max
+}
@@ -0,0 +1,165 @@
+package data_types
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Cast converts the column data ([]int64, []uint64, []float64, []string or []bool)
+// to the data of the column type typeName (any of the DataTypes names)
+func Cast(data any, typeName string) (any, error) {
+	builder, ok := DataTypes[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", typeName)
+	}
+	col, err := builder("", nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch col.GetTypeName() {
+	case DATA_TYPE_NAME_INT64:
+		return castSlice(data, castToInt64)
+	case DATA_TYPE_NAME_UINT64:
+		return castSlice(data, castToUint64)
+	case DATA_TYPE_NAME_FLOAT64:
+		return castSlice(data, castToFloat64)
+	case DATA_TYPE_NAME_STRING:
+		return castSlice(data, castToString)
+	case DATA_TYPE_NAME_BOOL:
+		return castSlice(data, castToBool)
+	}
+	return nil, fmt.Errorf("unsupported cast to %s", typeName)
+}
+
+func castSlice[T any](data any, cast func(v any) (T, error)) ([]T, error) {
+	var (
+		res []T
+		err error
+	)
+	castAll := func(n int, get func(i int) any) {
+		res = make([]T, n)
+		for i := 0; i < n && err == nil; i++ {
+			res[i], err = cast(get(i))
+			if err != nil {
+				err = fmt.Errorf("row %d: %w", i, err)
+			}
+		}
+	}
+	switch d := data.(type) {
+	case []int64:
+		castAll(len(d), func(i int) any { return d[i] })
+	case []uint64:
+		castAll(len(d), func(i int) any { return d[i] })
+	case []float64:
+		castAll(len(d), func(i int) any { return d[i] })
+	case []string:
+		castAll(len(d), func(i int) any { return d[i] })
+	case []bool:
+		castAll(len(d), func(i int) any { return d[i] })
+	default:
+		return nil, fmt.Errorf("unsupported data type: %T", data)
+	}
+	return res, err
+}
+
+func castToInt64(v any) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("%d overflows Int64", v)
+		}
+		return int64(v), nil
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not an Int64", v)
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unsupported value %T", v)
+}
+
+func castToUint64(v any) (uint64, error) {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return 0, fmt.Errorf("%d is negative", v)
+		}
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || v < 0 || v >= math.MaxUint64 {
+			return 0, fmt.Errorf("%v is not an UInt64", v)
+		}
+		return uint64(v), nil
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unsupported value %T", v)
+}
+
+func castToFloat64(v any) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unsupported value %T", v)
+}
+
+func castToString(v any) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %T", v)
+}
+
+func castToBool(v any) (bool, error) {
+	switch v := v.(type) {
+	case int64:
+		return v != 0, nil
+	case uint64:
+		return v != 0, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		return strconv.ParseBool(v)
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("unsupported value %T", v)
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/apache/arrow/go/v14/arrow/array"
 	"github.com/go-faster/jx"
 	"golang.org/x/exp/constraints"
-	"slices"
 )
 
 type IArrowAppender[T constraints.Ordered] interface {
@@ -48,6 +47,14 @@ func (c *Column[T]) GetData() any {
 	return c.data
 }
 
+func (c *Column[T]) GetValids() []bool {
+	return c.valids
+}
+
+func (c *Column[T]) setValids(valids []bool) {
+	c.valids = valids
+}
+
 func (c *Column[T]) InitializeData(sizeAndCap ...int64) {
 	var size int64 = 1000
 	if len(sizeAndCap) > 0 {
@@ -65,10 +72,25 @@ func (c *Column[T]) InitializeData(sizeAndCap ...int64) {
 }
 
 func (c *Column[T]) GetMinMax() (any, any) {
-	if c.GetLength() == 0 {
+	var _min, _max T
+	seen := false
+	for i, v := range c.data {
+		// the nulls and NaN are not compared
+		if !c.valids[i] || v != v {
+			continue
+		}
+		if !seen || v < _min {
+			_min = v
+		}
+		if !seen || v > _max {
+			_max = v
+		}
+		seen = true
+	}
+	if !seen {
 		return nil, nil
 	}
-	return slices.Min(c.data), slices.Max(c.data)
+	return _min, _max
 }
 
 func (c *Column[T]) AppendNulls(size int64) {
@@ -126,36 +148,8 @@ func (c *Column[T]) AppendByMask(data any, mask []byte) error {
 	if err != nil {
 		return err
 	}
-	_data := data.([]T)
-	if len(mask) != (len(_data)+7)/8 {
-		return fmt.Errorf("invalid mask length")
-	}
-
-	startIdx := 0
-	endIdx := 0
-	for i := 0; i < len(mask)*8; i++ {
-		if mask[i/8]&(1<<(i%8)) != 0 {
-			endIdx = i + 1
-			continue
-		}
-		if startIdx == endIdx {
-			startIdx++
-			endIdx++
-			continue
-		}
-		c.data = append(c.data, _data[startIdx:endIdx]...)
-		k := len(c.valids)
-		c.valids = append(c.valids, make([]bool, endIdx-startIdx)...)
-		FastFillArray(c.valids[k:], true)
-		startIdx = endIdx
-	}
-	if startIdx != endIdx {
-		c.data = append(c.data, _data[startIdx:]...)
-		k := len(c.valids)
-		c.valids = append(c.valids, make([]bool, len(_data[startIdx:]))...)
-		FastFillArray(c.valids[k:], true)
-	}
-	return nil
+	c.data, c.valids, err = appendByMask(c.data, c.valids, data.([]T), mask)
+	return err
 
 	/*u64Mask := unsafe.Slice((*uint64)(unsafe.Pointer(&mask[0])), len(mask)/8)
 
@@ -263,6 +257,40 @@ func (c *Column[T]) AppendByMask(data any, mask []byte) error {
 	return nil
 }*/
 
+// appendByMask appends the values of src selected by the bit mask to data
+// and marks them as valid
+func appendByMask[T any](data []T, valids []bool, src []T, mask []byte) ([]T, []bool, error) {
+	if len(mask) != (len(src)+7)/8 {
+		return data, valids, fmt.Errorf("invalid mask length")
+	}
+
+	startIdx := 0
+	endIdx := 0
+	for i := 0; i < len(mask)*8; i++ {
+		if mask[i/8]&(1<<(i%8)) != 0 {
+			endIdx = i + 1
+			continue
+		}
+		if startIdx == endIdx {
+			startIdx++
+			endIdx++
+			continue
+		}
+		data = append(data, src[startIdx:endIdx]...)
+		k := len(valids)
+		valids = append(valids, make([]bool, endIdx-startIdx)...)
+		FastFillArray(valids[k:], true)
+		startIdx = endIdx
+	}
+	if startIdx != endIdx {
+		data = append(data, src[startIdx:]...)
+		k := len(valids)
+		valids = append(valids, make([]bool, len(src[startIdx:]))...)
+		FastFillArray(valids[k:], true)
+	}
+	return data, valids, nil
+}
+
 func (c *Column[T]) WriteToBatch(batch array.Builder) error {
 	c.getBuilder(batch).AppendValues(c.data, c.valids)
 	return nil
@@ -19,6 +19,8 @@ func WrapToColumn(name string, data any) (IColumn, error) {
 		return float64Builder(name, data)
 	case []string:
 		return strBuilder(name, data)
+	case []bool:
+		return boolBuilder(name, data)
 	}
 	return nil, fmt.Errorf("unsupported data type: %T", data)
 }
@@ -27,6 +29,7 @@ const DATA_TYPE_NAME_INT64 = "INT8"
 const DATA_TYPE_NAME_UINT64 = "UBIGINT"
 const DATA_TYPE_NAME_FLOAT64 = "FLOAT8"
 const DATA_TYPE_NAME_STRING = "VARCHAR"
+const DATA_TYPE_NAME_BOOL = "BOOLEAN"
 const DATA_TYPE_NAME_UNKNOWN = "UNKNOWN"
 
 var DataTypes = map[string]ColumnBuilder{
@@ -49,6 +52,11 @@ var DataTypes = map[string]ColumnBuilder{
 	"BPCHAR":  strBuilder,
 	"TEXT":    strBuilder,
 
+	"Bool":    boolBuilder,
+	"BOOLEAN": boolBuilder,
+	"BOOL":    boolBuilder,
+	"LOGICAL": boolBuilder,
+
 	/*"UHUGEINT":  UInt64{},
 	"UINTEGER":  UInt64{},
 	"USMALLINT": UInt64{},
@@ -76,9 +84,6 @@ var DataTypes = map[string]ColumnBuilder{
 	"BYTEA":                    Blob{},
 	"BINARY":                   Blob{},
 	"VARBINARY":                Blob{},
-	"BOOLEAN":                  Boolean{},
-	"BOOL":                     Boolean{},
-	"LOGICAL":                  Boolean{},
 	"DATE":                     Date{},
 	"DECIMAL":                  Decimal{},
 	"NUMERIC":                  Decimal{},
@@ -108,6 +113,7 @@ type IColumn interface {
 	GetVal(i int64) any
 	ParseFromStr(s string) error
 	GetData() any
+	GetValids() []bool
 	GetMinMax() (any, any)
 }
 
@@ -0,0 +1,94 @@
+package data_types
+
+import (
+	"fmt"
+	"github.com/apache/arrow/go/v14/arrow"
+)
+
+// typeNames maps the aliases of DataTypes to the canonical column type names
+var typeNames = map[string]string{}
+
+// arrowTypes maps the arrow types of the columns to the canonical column type names
+var arrowTypes = map[arrow.Type]string{}
+
+func init() {
+	for name, builder := range DataTypes {
+		col, err := builder("", nil, 0, 0)
+		if err != nil {
+			continue
+		}
+		typeNames[name] = col.GetTypeName()
+		arrowTypes[col.ArrowDataType().ID()] = col.GetTypeName()
+	}
+	// parquet files written by DuckDB may have the strings as binary
+	arrowTypes[arrow.LARGE_STRING] = DATA_TYPE_NAME_STRING
+}
+
+// NormalizeTypeName returns the canonical column type name (INT8, UBIGINT, FLOAT8, VARCHAR or BOOLEAN)
+// of any of the DataTypes names. ok is false for the unsupported types.
+func NormalizeTypeName(typeName string) (string, bool) {
+	name, ok := typeNames[typeName]
+	return name, ok
+}
+
+// ArrowTypeName returns the canonical column type name of the arrow type.
+// ok is false for the unsupported types.
+func ArrowTypeName(dt arrow.DataType) (string, bool) {
+	name, ok := arrowTypes[dt.ID()]
+	return name, ok
+}
+
+// DataTypeOf returns the arrow type of the column type typeName, nil for the unknown types
+func DataTypeOf(typeName string) arrow.DataType {
+	builder, ok := DataTypes[typeName]
+	if !ok {
+		return nil
+	}
+	col, err := builder("", nil, 0, 0)
+	if err != nil {
+		return nil
+	}
+	return col.ArrowDataType()
+}
+
+func isNumeric(typeName string) bool {
+	return typeName == DATA_TYPE_NAME_INT64 || typeName == DATA_TYPE_NAME_UINT64 ||
+		typeName == DATA_TYPE_NAME_FLOAT64
+}
+
+// WidenType returns the type both column types convert to without a data loss beyond the float precision:
+//
+//	INT8 + UBIGINT -> FLOAT8, INT8 + FLOAT8 -> FLOAT8, UBIGINT + FLOAT8 -> FLOAT8
+//	numeric + VARCHAR -> VARCHAR (the last resort)
+//
+// ok is false if the types can't be reconciled (e.g. BOOLEAN and any other type).
+func WidenType(a, b string) (string, bool) {
+	switch {
+	case a == b:
+		return a, true
+	case isNumeric(a) && isNumeric(b):
+		return DATA_TYPE_NAME_FLOAT64, true
+	case isNumeric(a) && b == DATA_TYPE_NAME_STRING:
+		return b, true
+	case a == DATA_TYPE_NAME_STRING && isNumeric(b):
+		return a, true
+	}
+	return "", false
+}
+
+// CastColumn converts the column to the type typeName keeping its nulls
+func CastColumn(col IColumn, typeName string) (IColumn, error) {
+	if col.GetTypeName() == typeName {
+		return col, nil
+	}
+	data, err := Cast(col.GetData(), typeName)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", col.GetName(), err)
+	}
+	res, err := WrapToColumn(col.GetName(), data)
+	if err != nil {
+		return nil, err
+	}
+	res.(interface{ setValids([]bool) }).setValids(append([]bool(nil), col.GetValids()...))
+	return res, nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type deleteRequest struct {
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+	Where string          `json:"where"`
+}
+
+// parseDeleteTime parses a time of a delete request: a RFC3339 string or unix ns
+func parseDeleteTime(name string, data json.RawMessage) (int64, error) {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return 0, utils.NewGigapiError(http.StatusBadRequest, "invalid "+name)
+		}
+		return t.UnixNano(), nil
+	}
+	ns, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, utils.NewGigapiError(http.StatusBadRequest, "invalid "+name)
+	}
+	return ns, nil
+}
+
+// DeleteHandler deletes the rows of the time range matching the predicate and returns
+// the deleted rows per partition:
+// POST /gigapi/delete/{db}/{table} {"from": "2025-01-01T00:00:00Z", "to": 1735776000000000000, "where": "user_id = 'u1'"}
+func DeleteHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	var req deleteRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return utils.NewGigapiError(http.StatusBadRequest, "invalid delete request: "+err.Error())
+	}
+	if req.From == nil || req.To == nil {
+		return utils.NewGigapiError(http.StatusBadRequest, "from and to are required")
+	}
+	from, err := parseDeleteTime("from", req.From)
+	if err != nil {
+		return err
+	}
+	to, err := parseDeleteTime("to", req.To)
+	if err != nil {
+		return err
+	}
+	partitions, err := repository.DeleteRows(vars["db"], vars["table"], service.DeleteRequest{
+		From:      from,
+		To:        to,
+		Predicate: req.Where,
+	})
+	if err != nil {
+		return err
+	}
+	var rows int64
+	for _, p := range partitions {
+		rows += p.RowsDeleted
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database":     vars["db"],
+		"table":        vars["table"],
+		"rows_deleted": rows,
+		"partitions":   partitions,
+	})
+}
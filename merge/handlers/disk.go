@@ -0,0 +1,11 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"net/http"
+)
+
+// GetDiskStatusHandler returns the disk watermarks and the usage of the volumes: GET /gigapi/disk
+func GetDiskStatusHandler(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, repository.GetDiskStatus())
+}
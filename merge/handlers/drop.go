@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"net/http"
+)
+
+// DropDatabaseHandler drops all the tables of a database: DELETE /gigapi/drop/{db}
+func DropDatabaseHandler(w http.ResponseWriter, r *http.Request) error {
+	db := API.GetPathParams(r)["db"]
+	tables, err := repository.DropDatabase(db)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database": db,
+		"tables":   tables,
+	})
+}
+
+// DropTableHandler drops a table: DELETE /gigapi/drop/{db}/{table}
+func DropTableHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	err := repository.DropTable(vars["db"], vars["table"])
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DropPartitionsHandler drops the hive partition folders of a table and returns them:
+// DELETE /gigapi/partitions/{db}/{table}?partition=date=2025-04-10&partition=date=2025-04-11/hour=10
+func DropPartitionsHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	partitions, err := repository.DropPartitions(vars["db"], vars["table"], r.URL.Query()["partition"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database":   vars["db"],
+		"table":      vars["table"],
+		"partitions": partitions,
+	})
+}
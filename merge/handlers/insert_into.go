@@ -3,8 +3,11 @@ package handlers
 import (
 	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gigapi/gigapi/v2/merge/parsers"
 	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/merge/service"
 	"github.com/gigapi/gigapi/v2/modules"
 	"github.com/gigapi/gigapi/v2/utils"
 	"io"
@@ -35,6 +38,9 @@ func InsertIntoHandler(w http.ResponseWriter, r *http.Request) error {
 	if precision != "" {
 		ctx = context.WithValue(ctx, "precision", precision)
 	}
+	if table := r.URL.Query().Get("table"); table != "" {
+		ctx = context.WithValue(ctx, "table", table)
+	}
 
 	if err != nil {
 		return err
@@ -55,6 +61,32 @@ func InsertIntoHandler(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	quarantined, err := storeParsed(database, res)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(storedStatus(w, quarantined, http.StatusNoContent))
+	return nil
+}
+
+// QuarantinedHeader lists the quarantined batches of a write as "<db>/<table>/<id>: <reason>", one per value
+const QuarantinedHeader = "X-Gigapi-Quarantined"
+
+// storedStatus sets the QuarantinedHeader values of the quarantined batches of a write
+// and returns the status of the response: 202 if a batch was quarantined, status otherwise
+func storedStatus(w http.ResponseWriter, quarantined []*service.QuarantinedError, status int) int {
+	for _, q := range quarantined {
+		w.Header().Add(QuarantinedHeader, fmt.Sprintf("%s/%s/%s: %s", q.Database, q.Table, q.Id, q.Reason))
+	}
+	if len(quarantined) > 0 {
+		return http.StatusAccepted
+	}
+	return status
+}
+
+// storeParsed stores every parsed chunk and waits until the data is saved.
+// It returns the chunks diverted to the quarantine of their table.
+func storeParsed(database string, res chan *parsers.ParserResponse) ([]*service.QuarantinedError, error) {
 	var promises []utils.Promise[int32]
 	for _res := range res {
 		if _res.Error != nil {
@@ -62,20 +94,25 @@ func InsertIntoHandler(w http.ResponseWriter, r *http.Request) error {
 				for range res {
 				}
 			}()
-			return _res.Error
+			return nil, _res.Error
 		}
 		_database := database
 		if _database == "" {
-			database = _res.Database
+			_database = _res.Database
 		}
-		promises = append(promises, repository.Store(_database, _res.Table, _res.Data))
+		promises = append(promises, repository.StoreTagged(_database, _res.Table, _res.Data, _res.Tags))
 	}
+	var quarantined []*service.QuarantinedError
 	for _, p := range promises {
-		_, err = p.Get()
+		_, err := p.Get()
+		var q *service.QuarantinedError
+		if errors.As(err, &q) {
+			quarantined = append(quarantined, q)
+			continue
+		}
 		if err != nil {
-			return err
+			return quarantined, err
 		}
 	}
-	w.WriteHeader(http.StatusNoContent)
-	return nil
+	return quarantined, nil
 }
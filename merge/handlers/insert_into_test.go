@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/quarantine"
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testRoot points the root folder of the configuration to a temp folder with an empty catalog
+func testRoot(t *testing.T) {
+	prev := config.Config
+	config.Config = &config.Configuration{Gigapi: config.GigapiConfiguration{Root: t.TempDir(), SaveTimeoutS: 1}}
+	t.Cleanup(func() {
+		config.Config = prev
+	})
+	conn, cancel, err := utils.ConnectDuckDB(repository.CatalogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	err = repository.CreateDuckDBTablesTable(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertQuarantined(t *testing.T) {
+	testRoot(t)
+	defer repository.DropTable("db", "weather")
+	insert := func(line string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/gigapi/insert?db=db", strings.NewReader(line))
+		w := httptest.NewRecorder()
+		err := InsertIntoHandler(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := insert("weather,location=a value=12 1700000000000000000\n")
+	if w.Code != http.StatusNoContent || w.Header().Get(QuarantinedHeader) != "" {
+		t.Fatalf("expected the batch to be stored, got %d %v", w.Code, w.Header())
+	}
+
+	// a string in the numeric column is quarantined, the client is told so
+	w = insert("weather,location=a value=\"12\" 1700000000000000001\n")
+	quarantined := w.Header().Values(QuarantinedHeader)
+	if w.Code != http.StatusAccepted || len(quarantined) != 1 ||
+		!strings.HasPrefix(quarantined[0], "db/weather/") || !strings.Contains(quarantined[0], "`value`") {
+		t.Fatalf("expected the batch to be quarantined, got %d %v", w.Code, quarantined)
+	}
+	entries, err := quarantine.List("db", "weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(quarantined[0], "db/weather/"+entries[0].Id+": ") {
+		t.Fatalf("expected the header to name the quarantined batch, got %v and %+v", quarantined, entries)
+	}
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"net/http"
+)
+
+// GetMergePlanHandler returns the merges the planner would run now, per partition and level,
+// without running them: GET /gigapi/merge/plan/{db}/{table}
+func GetMergePlanHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	plan, err := repository.GetMergePlan(vars["db"], vars["table"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database": vars["db"],
+		"table":    vars["table"],
+		"levels":   plan,
+	})
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"github.com/gigapi/gigapi/v2/merge/parsers"
+	"github.com/gigapi/gigapi/v2/utils"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OTLPHandler creates the OTLP/HTTP receiver of a signal (metrics, logs or traces).
+// Both `application/x-protobuf` and `application/json` payloads are accepted.
+func OTLPHandler(signal string) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				return utils.NewGigapiError(http.StatusBadRequest, "invalid gzip payload: "+err.Error())
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		isJSON := strings.HasPrefix(contentType, "application/json")
+		if !isJSON && !strings.HasPrefix(contentType, "application/x-protobuf") {
+			return utils.NewGigapiError(http.StatusUnsupportedMediaType,
+				"unsupported content type: "+contentType)
+		}
+
+		parser := &parsers.OTLPParser{Signal: signal, JSON: isJSON}
+		res, err := parser.Parse(body)
+		if err != nil {
+			return utils.NewGigapiError(http.StatusBadRequest, err.Error())
+		}
+		quarantined, err := storeParsed(getDatabase(r), res)
+		if err != nil {
+			return err
+		}
+		status := storedStatus(w, quarantined, http.StatusOK)
+
+		// The export response has no fields set, so it's empty in protobuf and `{}` in JSON
+		if isJSON {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte("{}"))
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(status)
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/parsers"
+	"github.com/gigapi/gigapi/v2/utils"
+	"github.com/golang/snappy"
+	"io"
+	"net/http"
+)
+
+// PromWriteHandler accepts Prometheus remote_write requests
+// (snappy-compressed protobuf WriteRequest)
+func PromWriteHandler(w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc == "" || enc == "snappy" {
+		body, err = snappy.Decode(nil, body)
+		if err != nil {
+			return utils.NewGigapiError(http.StatusBadRequest, "invalid snappy payload: "+err.Error())
+		}
+	}
+
+	res, err := (&parsers.PromRemoteWriteParser{}).Parse(body)
+	if err != nil {
+		return utils.NewGigapiError(http.StatusBadRequest, err.Error())
+	}
+	quarantined, err := storeParsed(getDatabase(r), res)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(storedStatus(w, quarantined, http.StatusNoContent))
+	return nil
+}
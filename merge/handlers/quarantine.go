@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gigapi/gigapi/v2/merge/quarantine"
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/utils"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+func quarantineError(err error) error {
+	if errors.Is(err, quarantine.ErrNotFound) {
+		return utils.NewGigapiError(http.StatusNotFound, err.Error())
+	}
+	return err
+}
+
+// ListQuarantineHandler lists the quarantined batches: GET /gigapi/quarantine/{db}/{table}
+func ListQuarantineHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	entries, err := quarantine.List(vars["db"], vars["table"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, entries)
+}
+
+// InspectQuarantineHandler returns the entry and the first rows of the batch:
+// GET /gigapi/quarantine/{db}/{table}/{id}?limit=100
+func InspectQuarantineHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	limit := 100
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(strLimit)
+		if err != nil || limit < 0 {
+			return utils.NewGigapiError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+	entry, err := quarantine.Get(vars["db"], vars["table"], vars["id"])
+	if err != nil {
+		return quarantineError(err)
+	}
+	data, err := quarantine.GetData(vars["db"], vars["table"], vars["id"])
+	if err != nil {
+		return quarantineError(err)
+	}
+	rows := make([]map[string]any, min(int(entry.Rows), limit))
+	for i := range rows {
+		rows[i] = make(map[string]any, len(data))
+	}
+	for name, col := range data {
+		switch col := col.(type) {
+		case []int64:
+			fillRows(rows, name, col)
+		case []uint64:
+			fillRows(rows, name, col)
+		case []float64:
+			for i := range rows {
+				// JSON has no NaN and Inf
+				if math.IsNaN(col[i]) || math.IsInf(col[i], 0) {
+					rows[i][name] = strconv.FormatFloat(col[i], 'g', -1, 64)
+					continue
+				}
+				rows[i][name] = col[i]
+			}
+		case []string:
+			fillRows(rows, name, col)
+		case []bool:
+			fillRows(rows, name, col)
+		}
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"entry": entry,
+		"rows":  rows,
+	})
+}
+
+func fillRows[T any](rows []map[string]any, name string, col []T) {
+	for i := range rows {
+		rows[i][name] = col[i]
+	}
+}
+
+// ReplayQuarantineHandler stores the quarantined batch into the table:
+// POST /gigapi/quarantine/{db}/{table}/{id}/replay {"cast": {"column": "Float64"}}
+func ReplayQuarantineHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	var req struct {
+		Cast map[string]string `json:"cast"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return utils.NewGigapiError(http.StatusBadRequest, "invalid replay request: "+err.Error())
+	}
+	err = repository.ReplayQuarantined(vars["db"], vars["table"], vars["id"], req.Cast)
+	if err != nil {
+		return quarantineError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// PurgeQuarantineHandler deletes one quarantined batch: DELETE /gigapi/quarantine/{db}/{table}/{id}
+// or all of them: DELETE /gigapi/quarantine/{db}/{table}
+func PurgeQuarantineHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	if id := vars["id"]; id != "" {
+		err := quarantine.Remove(vars["db"], vars["table"], id)
+		if err != nil {
+			return quarantineError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	purged, err := quarantine.Purge(vars["db"], vars["table"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
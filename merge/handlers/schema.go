@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"net/http"
+)
+
+// GetSchemaHandler returns the columns of the table from its schema registry: GET /gigapi/schema/{db}/{table}
+func GetSchemaHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	columns, err := repository.GetTableSchema(vars["db"], vars["table"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database": vars["db"],
+		"table":    vars["table"],
+		"columns":  columns,
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseSnapshotTime returns the unix time in ns of the at (RFC3339 or unix ns) or ago (duration) parameter,
+// now if none is set
+func parseSnapshotTime(r *http.Request) (int64, error) {
+	q := r.URL.Query()
+	if at := q.Get("at"); at != "" {
+		if ns, err := strconv.ParseInt(at, 10, 64); err == nil {
+			return ns, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return 0, utils.NewGigapiError(http.StatusBadRequest, "invalid at")
+		}
+		return t.UnixNano(), nil
+	}
+	if ago := q.Get("ago"); ago != "" {
+		d, err := time.ParseDuration(ago)
+		if err != nil || d < 0 {
+			return 0, utils.NewGigapiError(http.StatusBadRequest, "invalid ago")
+		}
+		return time.Now().Add(-d).UnixNano(), nil
+	}
+	return time.Now().UnixNano(), nil
+}
+
+// ListSnapshotsHandler lists the retained snapshots of the partitions:
+// GET /gigapi/snapshots/{db}/{table}?partition=date=2025-01-01/hour=10
+func ListSnapshotsHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	snapshots, err := repository.GetSnapshots(vars["db"], vars["table"], r.URL.Query().Get("partition"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database":   vars["db"],
+		"table":      vars["table"],
+		"partitions": snapshots,
+	})
+}
+
+// ResolveSnapshotHandler returns the files of the table at a time:
+// GET /gigapi/snapshots/{db}/{table}/resolve?at=2025-01-01T10:00:00Z|ago=1h&partition=...&version=12
+func ResolveSnapshotHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	q := r.URL.Query()
+	at, err := parseSnapshotTime(r)
+	if err != nil {
+		return err
+	}
+	var version *uint64
+	if strVersion := q.Get("version"); strVersion != "" {
+		if q.Get("partition") == "" {
+			return utils.NewGigapiError(http.StatusBadRequest, "version requires a partition")
+		}
+		v, err := strconv.ParseUint(strVersion, 10, 64)
+		if err != nil {
+			return utils.NewGigapiError(http.StatusBadRequest, "invalid version")
+		}
+		version = &v
+	}
+	files, err := repository.ResolveSnapshot(vars["db"], vars["table"], at, q.Get("partition"), version)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"database":   vars["db"],
+		"table":      vars["table"],
+		"at":         time.Unix(0, at).UTC().Format(time.RFC3339Nano),
+		"partitions": files,
+	})
+}
+
+// PinSnapshotHandler keeps the snapshot of the table at a time and its files for ttl_s seconds:
+// POST /gigapi/snapshots/{db}/{table}/pin?at=...|ago=...&ttl_s=300
+func PinSnapshotHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	at, err := parseSnapshotTime(r)
+	if err != nil {
+		return err
+	}
+	ttlS := 300
+	if strTTL := r.URL.Query().Get("ttl_s"); strTTL != "" {
+		ttlS, err = strconv.Atoi(strTTL)
+		if err != nil || ttlS <= 0 {
+			return utils.NewGigapiError(http.StatusBadRequest, "invalid ttl_s")
+		}
+	}
+	id, expires, err := repository.PinSnapshot(vars["db"], vars["table"], at, time.Duration(ttlS)*time.Second)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{
+		"id":      id,
+		"at":      time.Unix(0, at).UTC().Format(time.RFC3339Nano),
+		"expires": expires.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// UnpinSnapshotHandler releases a pin: DELETE /gigapi/snapshots/{db}/{table}/pin/{id}
+func UnpinSnapshotHandler(w http.ResponseWriter, r *http.Request) error {
+	vars := API.GetPathParams(r)
+	err := repository.UnpinSnapshot(vars["db"], vars["table"], vars["id"])
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
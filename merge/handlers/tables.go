@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gigapi/gigapi/v2/merge/repository"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
+)
+
+// tableDefinition is the JSON representation of a table in the tables API
+type tableDefinition struct {
+	Database       string               `json:"database"`
+	Name           string               `json:"name"`
+	Engine         string               `json:"engine,omitempty"`
+	Columns        []shared.TableColumn `json:"columns,omitempty"`
+	OrderBy        []string             `json:"order_by,omitempty"`
+	TimestampField string               `json:"timestamp_field,omitempty"`
+	PartitionBy    [][2]string          `json:"partition_by,omitempty"`
+	AutoTimestamp  *bool                `json:"auto_timestamp,omitempty"`
+	// Compaction is the merge policy of the table. The omitted settings come from the configuration.
+	Compaction *shared.CompactionPolicy `json:"compaction,omitempty"`
+	// BloomFilterColumns are the string columns indexed with bloom filters in metadata.json
+	BloomFilterColumns []string `json:"bloom_filter_columns,omitempty"`
+	// Retention is the retention policy of the table. The configured policy is used if omitted.
+	Retention *shared.RetentionPolicy `json:"retention,omitempty"`
+}
+
+func table2Definition(t *shared.Table) *tableDefinition {
+	autoTimestamp := t.AutoTimestamp
+	return &tableDefinition{
+		Database:           t.Database,
+		Name:               t.Name,
+		Engine:             t.Engine,
+		Columns:            t.Columns,
+		OrderBy:            t.OrderBy,
+		TimestampField:     t.TimestampField,
+		PartitionBy:        t.PartitionExpressions,
+		AutoTimestamp:      &autoTimestamp,
+		Compaction:         t.Compaction,
+		BloomFilterColumns: t.BloomFilterColumns,
+		Retention:          t.Retention,
+	}
+}
+
+// CreateTableHandler defines a table: POST /gigapi/create/{db}/{table}
+func CreateTableHandler(w http.ResponseWriter, r *http.Request) error {
+	def := &tableDefinition{}
+	err := json.NewDecoder(r.Body).Decode(def)
+	if err != nil {
+		return utils.NewGigapiError(http.StatusBadRequest, "invalid table definition: "+err.Error())
+	}
+	vars := API.GetPathParams(r)
+	if db := getDatabase(r); db != "" {
+		def.Database = db
+	}
+	if name := vars["table"]; name != "" {
+		def.Name = name
+	}
+	table := &shared.Table{
+		Database:             def.Database,
+		Name:                 def.Name,
+		Engine:               def.Engine,
+		Columns:              def.Columns,
+		OrderBy:              def.OrderBy,
+		TimestampField:       def.TimestampField,
+		PartitionExpressions: def.PartitionBy,
+		AutoTimestamp:        def.AutoTimestamp == nil || *def.AutoTimestamp,
+		Compaction:           def.Compaction,
+		BloomFilterColumns:   def.BloomFilterColumns,
+		Retention:            def.Retention,
+	}
+	err = repository.CreateTable(table)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, table2Definition(table))
+}
+
+// GetTablesHandler lists the defined tables: GET /gigapi/tables/{db}
+// or returns one definition: GET /gigapi/tables/{db}/{table}
+func GetTablesHandler(w http.ResponseWriter, r *http.Request) error {
+	db := getDatabase(r)
+	name := API.GetPathParams(r)["table"]
+	tables, err := repository.GetTableDefinitions(db)
+	if err != nil {
+		return err
+	}
+	defs := make([]*tableDefinition, 0, len(tables))
+	for _, t := range tables {
+		if name != "" && t.Name != name {
+			continue
+		}
+		defs = append(defs, table2Definition(t))
+	}
+	if name == "" {
+		return writeJSON(w, http.StatusOK, defs)
+	}
+	if len(defs) == 0 {
+		return utils.NewGigapiError(http.StatusNotFound, "table "+db+"."+name+" is not defined")
+	}
+	return writeJSON(w, http.StatusOK, defs[0])
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(body)
+	return err
+}
@@ -0,0 +1,106 @@
+package iceberg
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// avroEncoder encodes the values of the Avro binary encoding.
+// The records are encoded field by field in the order of their schema.
+type avroEncoder struct {
+	buf []byte
+}
+
+func (e *avroEncoder) long(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *avroEncoder) int(v int32) {
+	e.long(int64(v))
+}
+
+func (e *avroEncoder) bytes(v []byte) {
+	e.long(int64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *avroEncoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+// union writes the branch index of a union value
+func (e *avroEncoder) union(branch int) {
+	e.long(int64(branch))
+}
+
+// optionalLong writes a ["null", "long"] union
+func (e *avroEncoder) optionalLong(v *int64) {
+	if v == nil {
+		e.union(0)
+		return
+	}
+	e.union(1)
+	e.long(*v)
+}
+
+// array writes the items of an array in one block
+func (e *avroEncoder) array(n int, item func(i int)) {
+	if n > 0 {
+		e.long(int64(n))
+		for i := 0; i < n; i++ {
+			item(i)
+		}
+	}
+	e.long(0)
+}
+
+// writeAvroFile writes the records with the schema into an Avro object container file
+// and returns its length. The file is written to a temporary file and renamed.
+func writeAvroFile(name string, schema string, meta map[string]string, records [][]byte) (int64, error) {
+	sync := make([]byte, 16)
+	_, err := rand.Read(sync)
+	if err != nil {
+		return 0, err
+	}
+	header := &avroEncoder{buf: []byte{'O', 'b', 'j', 1}}
+	meta["avro.schema"] = schema
+	meta["avro.codec"] = "null"
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	header.array(len(keys), func(i int) {
+		header.string(keys[i])
+		header.bytes([]byte(meta[keys[i]]))
+	})
+	header.buf = append(header.buf, sync...)
+
+	var size int
+	for _, r := range records {
+		size += len(r)
+	}
+	block := &avroEncoder{buf: header.buf}
+	if len(records) > 0 {
+		block.long(int64(len(records)))
+		block.long(int64(size))
+		for _, r := range records {
+			block.buf = append(block.buf, r...)
+		}
+		block.buf = append(block.buf, sync...)
+	}
+
+	tmp := name + ".tmp"
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return 0, err
+	}
+	err = os.WriteFile(tmp, block.buf, 0644)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(block.buf)), os.Rename(tmp, name)
+}
@@ -0,0 +1,585 @@
+package iceberg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/google/uuid"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exporter maintains the Iceberg v2 metadata of a hive table in the metadata folder of the table.
+// Every Batch of the partition indexes is committed as a snapshot once the index applied it.
+// On start the current files of the partition indexes are committed as an overwrite of the previous snapshot.
+type Exporter struct {
+	t        *shared.Table
+	dir      string
+	columns  func() []shared.TableColumn
+	m        sync.Mutex
+	queue    []*change
+	notify   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// the state of the worker
+	meta      *tableMetadata
+	version   int
+	spec      partitionSpec
+	files     map[string]*dataFile
+	manifests []*manifest
+	// snapshotManifests are the manifests of the snapshots committed since the start
+	snapshotManifests map[int64][]string
+	// rewrite is set if the manifests must be rewritten from the live files
+	rewrite bool
+}
+
+// NewExporter creates the exporter of the table. columns returns the current columns of the table.
+func NewExporter(t *shared.Table, columns func() []shared.TableColumn) *Exporter {
+	return &Exporter{
+		t:                 t,
+		dir:               filepath.Join(t.Path, "metadata"),
+		columns:           columns,
+		notify:            make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+		files:             make(map[string]*dataFile),
+		snapshotManifests: make(map[int64][]string),
+	}
+}
+
+func (e *Exporter) Run() {
+	go e.run()
+}
+
+// Stop commits the queued changes and stops the exporter
+func (e *Exporter) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
+	<-e.done
+}
+
+func (e *Exporter) enqueue(c *change) {
+	e.m.Lock()
+	e.queue = append(e.queue, c)
+	e.m.Unlock()
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Exporter) logf(format string, args ...any) {
+	fmt.Printf("Iceberg export of %s.%s: %s\n", e.t.Database, e.t.Name, fmt.Sprintf(format, args...))
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	err := e.bootstrap()
+	if err != nil {
+		e.logf("%v", err)
+	}
+	for {
+		select {
+		case <-e.notify:
+			e.process()
+		case <-e.stop:
+			e.process()
+			return
+		}
+	}
+}
+
+func (e *Exporter) process() {
+	e.m.Lock()
+	queue := e.queue
+	e.queue = nil
+	e.m.Unlock()
+	for _, c := range queue {
+		// the changes failed to be applied to the index are not exported
+		if _, err := c.promise.Get(); err != nil {
+			continue
+		}
+		adds := make([]*dataFile, len(c.add))
+		for i, entry := range c.add {
+			adds[i] = &dataFile{path: entry.Path, values: c.values, entry: entry}
+		}
+		err := e.commit(adds, c.rm, false)
+		if err != nil {
+			e.logf("%v", err)
+		}
+	}
+}
+
+// bootstrap loads the last metadata file and commits the files of the partition indexes
+func (e *Exporter) bootstrap() error {
+	err := e.load()
+	if err != nil {
+		e.logf("%v, a new table metadata is written", err)
+		e.meta, e.version = nil, 0
+	}
+	if e.meta == nil {
+		e.meta = e.newMetadata()
+	}
+
+	var adds []*dataFile
+	err = filepath.WalkDir(e.t.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(e.t.Path, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var values [][2]string
+		for _, folder := range strings.Split(filepath.ToSlash(rel), "/") {
+			k, v, ok := strings.Cut(folder, "=")
+			if !ok {
+				return filepath.SkipDir
+			}
+			values = append(values, [2]string{k, v})
+		}
+		entries, err := index.ReadPartition(e.t, p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			adds = append(adds, &dataFile{path: entry.Path, values: values, entry: entry})
+		}
+		return nil
+	})
+	if err != nil {
+		e.rewrite = true
+		return err
+	}
+	return e.commit(adds, nil, true)
+}
+
+func (e *Exporter) newMetadata() *tableMetadata {
+	return &tableMetadata{
+		FormatVersion:   2,
+		TableUUID:       uuid.NewString(),
+		Location:        fileURI(e.t.Path),
+		LastPartitionId: firstPartitionFieldId - 1,
+		SortOrders:      []sortOrder{{OrderId: 0, Fields: []any{}}},
+		Properties:      map[string]string{},
+		Schemas:         []schema{},
+		PartitionSpecs:  []partitionSpec{},
+		Snapshots:       []snapshot{},
+		SnapshotLog:     []snapshotLogEntry{},
+		MetadataLog:     []metadataLogEntry{},
+	}
+}
+
+func (e *Exporter) metadataFile(version int) string {
+	return filepath.Join(e.dir, fmt.Sprintf("v%d.metadata.json", version))
+}
+
+// load reads the metadata file of version-hint.text
+func (e *Exporter) load() error {
+	hint, err := os.ReadFile(filepath.Join(e.dir, "version-hint.text"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.version, err = strconv.Atoi(strings.TrimSpace(string(hint)))
+	if err != nil {
+		return fmt.Errorf("invalid version-hint.text: %w", err)
+	}
+	data, err := os.ReadFile(e.metadataFile(e.version))
+	if err != nil {
+		return err
+	}
+	meta := &tableMetadata{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return fmt.Errorf("%s: %w", e.metadataFile(e.version), err)
+	}
+	if meta.Properties == nil {
+		meta.Properties = map[string]string{}
+	}
+	// the metadata written before the URIs has the bare location
+	meta.Location = fileURI(meta.Location)
+	e.meta = meta
+	return nil
+}
+
+// updateSpec derives the partition spec from the current schema. The fields of the previous specs keep their ids.
+// A changed spec becomes the default spec and the manifests are rewritten with it.
+func (e *Exporter) updateSpec() {
+	spec := partitionSpecOf(e.t, e.meta.currentSchema())
+	for i := range spec.Fields {
+		f := &spec.Fields[i]
+		f.FieldId = 0
+		for _, s := range e.meta.PartitionSpecs {
+			for _, prev := range s.Fields {
+				if prev.SourceId == f.SourceId && prev.Transform == f.Transform && prev.Name == f.Name {
+					f.FieldId = prev.FieldId
+				}
+			}
+		}
+		if f.FieldId == 0 {
+			e.meta.LastPartitionId++
+			f.FieldId = e.meta.LastPartitionId
+		}
+	}
+	for _, s := range e.meta.PartitionSpecs {
+		if s.SpecId == e.meta.DefaultSpecId && specFieldsEqual(s.Fields, spec.Fields) {
+			spec.SpecId = s.SpecId
+			e.spec = spec
+			return
+		}
+	}
+	for _, s := range e.meta.PartitionSpecs {
+		spec.SpecId = max(spec.SpecId, s.SpecId+1)
+	}
+	e.meta.PartitionSpecs = append(e.meta.PartitionSpecs, spec)
+	e.meta.DefaultSpecId = spec.SpecId
+	e.spec = spec
+	e.rewrite = true
+}
+
+func specFieldsEqual(a, b []partitionField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].SourceId != b[i].SourceId || a[i].FieldId != b[i].FieldId ||
+			a[i].Name != b[i].Name || a[i].Transform != b[i].Transform {
+			return false
+		}
+	}
+	return true
+}
+
+// commit commits the added and removed files as a snapshot. Known added files and unknown removed files are ignored.
+// If full is set, the files of the snapshot are the added files and a snapshot is committed even without changes.
+func (e *Exporter) commit(adds []*dataFile, rms []string, full bool) error {
+	meta := e.meta
+	hadSnapshot := meta.CurrentSnapshotId != nil
+	meta.updateSchema(e.columns())
+	e.updateSpec()
+
+	var added, removed []*dataFile
+	if full {
+		e.files = make(map[string]*dataFile)
+		e.rewrite = true
+	}
+	for _, f := range adds {
+		if _, ok := e.files[f.path]; !ok {
+			e.files[f.path] = f
+			added = append(added, f)
+		}
+	}
+	for _, p := range rms {
+		if f, ok := e.files[p]; ok {
+			delete(e.files, p)
+			removed = append(removed, f)
+		}
+	}
+	if !full && len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	if full && !hadSnapshot && len(added) == 0 {
+		// an empty table without snapshots
+		return e.writeMetadata()
+	}
+
+	now := time.Now()
+	seq := meta.LastSequenceNumber + 1
+	snap := &snapshot{
+		SnapshotId:       rand.Int63n(1<<62) + 1,
+		ParentSnapshotId: meta.CurrentSnapshotId,
+		SequenceNumber:   seq,
+		TimestampMs:      now.UnixMilli(),
+		SchemaId:         meta.CurrentSchemaId,
+	}
+	snap.ManifestList = fileURI(filepath.Join(e.dir, fmt.Sprintf("snap-%d-%s.avro", snap.SnapshotId, uuid.NewString())))
+	s := meta.currentSchema()
+	manifestId := uuid.NewString()
+	manifestName := func(i int) string {
+		return filepath.Join(e.dir, fmt.Sprintf("%s-m%d.avro", manifestId, i))
+	}
+	// the files are committed by this snapshot unless they belong to a committed snapshot
+	isNew := func(f *dataFile) bool {
+		return f.seq == 0 || f.seq > meta.LastSequenceNumber
+	}
+	for _, f := range e.files {
+		if isNew(f) {
+			f.snapshotId, f.seq = snap.SnapshotId, seq
+		}
+	}
+
+	var manifests []*manifest
+	if e.rewrite || len(e.manifests) >= maxManifests() {
+		var entries []manifestEntry
+		for _, f := range e.files {
+			status := int32(statusExisting)
+			if f.snapshotId == snap.SnapshotId {
+				status = statusAdded
+			}
+			entries = append(entries, manifestEntry{status: status, file: f})
+		}
+		if !full {
+			for _, f := range removed {
+				entries = append(entries, manifestEntry{status: statusDeleted, file: f})
+			}
+		}
+		if len(entries) > 0 {
+			m, err := writeManifest(manifestName(0), &e.spec, s, snap.SnapshotId, seq, entries)
+			if err != nil {
+				e.rewrite = true
+				return err
+			}
+			manifests = append(manifests, m)
+		}
+	} else {
+		removedFrom := make(map[*manifest][]*dataFile)
+		for _, f := range removed {
+			removedFrom[f.manifest] = append(removedFrom[f.manifest], f)
+		}
+		for _, m := range e.manifests {
+			rm, ok := removedFrom[m]
+			if !ok {
+				// the manifests of the deletions of the previous snapshot are not carried over
+				if len(m.files) > 0 {
+					manifests = append(manifests, m)
+				}
+				continue
+			}
+			var entries []manifestEntry
+			for _, f := range m.files {
+				if _, ok := e.files[f.path]; ok {
+					entries = append(entries, manifestEntry{status: statusExisting, file: f})
+				}
+			}
+			for _, f := range rm {
+				entries = append(entries, manifestEntry{status: statusDeleted, file: f})
+			}
+			rewritten, err := writeManifest(manifestName(len(manifests)), &e.spec, s, snap.SnapshotId, seq, entries)
+			if err != nil {
+				e.rewrite = true
+				return err
+			}
+			manifests = append(manifests, rewritten)
+		}
+		if len(added) > 0 {
+			entries := make([]manifestEntry, len(added))
+			for i, f := range added {
+				entries[i] = manifestEntry{status: statusAdded, file: f}
+			}
+			m, err := writeManifest(manifestName(len(manifests)), &e.spec, s, snap.SnapshotId, seq, entries)
+			if err != nil {
+				e.rewrite = true
+				return err
+			}
+			manifests = append(manifests, m)
+		}
+	}
+	_, err := writeManifestList(localPath(snap.ManifestList), snap, manifests)
+	if err != nil {
+		e.rewrite = true
+		return err
+	}
+
+	snap.Summary = e.summary(added, removed, full, hadSnapshot)
+	meta.Snapshots = append(meta.Snapshots, *snap)
+	meta.SnapshotLog = append(meta.SnapshotLog, snapshotLogEntry{TimestampMs: snap.TimestampMs, SnapshotId: snap.SnapshotId})
+	meta.CurrentSnapshotId = &snap.SnapshotId
+	meta.Refs = map[string]snapshotRef{"main": {SnapshotId: snap.SnapshotId, Type: "branch"}}
+	meta.LastSequenceNumber = seq
+	paths := make([]string, len(manifests))
+	for i, m := range manifests {
+		paths[i] = m.path
+		for _, f := range m.files {
+			f.manifest = m
+		}
+	}
+	e.snapshotManifests[snap.SnapshotId] = paths
+	e.manifests = manifests
+	e.rewrite = false
+	return e.writeMetadata()
+}
+
+// summary returns the summary of the snapshot
+func (e *Exporter) summary(added, removed []*dataFile, full bool, hadSnapshot bool) map[string]string {
+	var addedRows, removedRows, addedSize, removedSize, totalRows, totalSize int64
+	for _, f := range added {
+		addedRows += f.entry.RowCount
+		addedSize += f.entry.SizeBytes
+	}
+	for _, f := range removed {
+		removedRows += f.entry.RowCount
+		removedSize += f.entry.SizeBytes
+	}
+	for _, f := range e.files {
+		totalRows += f.entry.RowCount
+		totalSize += f.entry.SizeBytes
+	}
+	operation := "overwrite"
+	switch {
+	case full && !hadSnapshot, !full && len(removed) == 0:
+		operation = "append"
+	case full:
+	case len(added) == 0:
+		operation = "delete"
+	case addedRows == removedRows:
+		operation = "replace"
+	}
+	res := map[string]string{
+		"operation":              operation,
+		"added-data-files":       strconv.Itoa(len(added)),
+		"deleted-data-files":     strconv.Itoa(len(removed)),
+		"added-records":          strconv.FormatInt(addedRows, 10),
+		"deleted-records":        strconv.FormatInt(removedRows, 10),
+		"added-files-size":       strconv.FormatInt(addedSize, 10),
+		"removed-files-size":     strconv.FormatInt(removedSize, 10),
+		"total-data-files":       strconv.Itoa(len(e.files)),
+		"total-records":          strconv.FormatInt(totalRows, 10),
+		"total-files-size":       strconv.FormatInt(totalSize, 10),
+		"total-delete-files":     "0",
+		"total-position-deletes": "0",
+		"total-equality-deletes": "0",
+	}
+	return res
+}
+
+// writeMetadata writes the next metadata file and version-hint.text,
+// then removes the expired snapshots and the metadata files above the retention
+func (e *Exporter) writeMetadata() error {
+	meta := e.meta
+	keep := retainedSnapshots()
+	if e.version > 0 {
+		meta.MetadataLog = append(meta.MetadataLog, metadataLogEntry{
+			TimestampMs:  meta.LastUpdatedMs,
+			MetadataFile: fileURI(e.metadataFile(e.version)),
+		})
+	}
+	meta.LastUpdatedMs = time.Now().UnixMilli()
+	var obsolete []string
+	if len(meta.MetadataLog) > keep {
+		for _, l := range meta.MetadataLog[:len(meta.MetadataLog)-keep] {
+			obsolete = append(obsolete, localPath(l.MetadataFile))
+		}
+		meta.MetadataLog = meta.MetadataLog[len(meta.MetadataLog)-keep:]
+	}
+	expired := false
+	if len(meta.Snapshots) > keep {
+		expired = true
+		for _, s := range meta.Snapshots[:len(meta.Snapshots)-keep] {
+			obsolete = append(obsolete, localPath(s.ManifestList))
+			delete(e.snapshotManifests, s.SnapshotId)
+		}
+		meta.Snapshots = meta.Snapshots[len(meta.Snapshots)-keep:]
+		retained := make(map[int64]bool, len(meta.Snapshots))
+		for _, s := range meta.Snapshots {
+			retained[s.SnapshotId] = true
+		}
+		var log []snapshotLogEntry
+		for _, l := range meta.SnapshotLog {
+			if retained[l.SnapshotId] {
+				log = append(log, l)
+			}
+		}
+		meta.SnapshotLog = log
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = writeFile(e.metadataFile(e.version+1), data)
+	if err != nil {
+		return err
+	}
+	e.version++
+	err = writeFile(filepath.Join(e.dir, "version-hint.text"), []byte(strconv.Itoa(e.version)))
+	if err != nil {
+		return err
+	}
+
+	if expired {
+		obsolete = append(obsolete, e.orphanManifests()...)
+	}
+	for _, name := range obsolete {
+		err = os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			e.logf("%v", err)
+		}
+	}
+	return nil
+}
+
+// orphanManifests returns the manifests of the metadata folder not used by the retained snapshots.
+// The manifests of the snapshots committed before the start are unknown, so nothing is returned
+// until they are expired.
+func (e *Exporter) orphanManifests() []string {
+	used := make(map[string]bool)
+	for _, s := range e.meta.Snapshots {
+		paths, ok := e.snapshotManifests[s.SnapshotId]
+		if !ok {
+			return nil
+		}
+		for _, p := range paths {
+			used[p] = true
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(e.dir, "*-m*.avro"))
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, name := range names {
+		if !used[name] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// fileURI returns the file:// URI of the absolute local path, as the readers resolve the bare paths
+// against the location of the table. The URIs, e.g. of the files tiered to S3, are returned as is.
+func fileURI(name string) string {
+	if strings.Contains(name, "://") {
+		return name
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return "file://" + filepath.ToSlash(name)
+}
+
+// localPath returns the local path of a file:// URI or of a bare path
+func localPath(uri string) string {
+	return filepath.FromSlash(strings.TrimPrefix(uri, "file://"))
+}
+
+func writeFile(name string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(name+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
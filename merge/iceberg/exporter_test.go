@@ -0,0 +1,402 @@
+package iceberg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// avroDecoder decodes the Avro binary encoding of the values of a JSON schema
+type avroDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *avroDecoder) take(n int) []byte {
+	if n < 0 || n > len(d.buf) {
+		d.err = fmt.Errorf("%d bytes expected, %d left", n, len(d.buf))
+		d.buf = nil
+		return nil
+	}
+	res := d.buf[:n]
+	d.buf = d.buf[n:]
+	return res
+}
+
+func (d *avroDecoder) long() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint")
+		d.buf = nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *avroDecoder) bytes() []byte {
+	return d.take(int(d.long()))
+}
+
+// blocks calls fn for every item of the blocks of an array or a map
+func (d *avroDecoder) blocks(fn func()) {
+	for d.err == nil {
+		n := d.long()
+		if n == 0 {
+			return
+		}
+		if n < 0 {
+			n = -n
+			d.long()
+		}
+		for i := int64(0); i < n && d.err == nil; i++ {
+			fn()
+		}
+	}
+}
+
+func (d *avroDecoder) value(schema any) any {
+	switch s := schema.(type) {
+	case string:
+		switch s {
+		case "null":
+			return nil
+		case "boolean":
+			b := d.take(1)
+			return len(b) == 1 && b[0] == 1
+		case "int", "long":
+			return d.long()
+		case "string":
+			return string(d.bytes())
+		case "bytes":
+			return d.bytes()
+		}
+	case []any:
+		branch := d.long()
+		if branch < 0 || branch >= int64(len(s)) {
+			d.err = fmt.Errorf("invalid union branch %d", branch)
+			return nil
+		}
+		return d.value(s[branch])
+	case map[string]any:
+		switch s["type"] {
+		case "record":
+			res := make(map[string]any)
+			for _, f := range s["fields"].([]any) {
+				field := f.(map[string]any)
+				res[field["name"].(string)] = d.value(field["type"])
+			}
+			return res
+		case "array":
+			res := []any{}
+			d.blocks(func() {
+				res = append(res, d.value(s["items"]))
+			})
+			return res
+		}
+	}
+	d.err = fmt.Errorf("unsupported schema %v", schema)
+	return nil
+}
+
+// readAvroFile decodes the Avro object container file and returns its metadata and its records
+func readAvroFile(t *testing.T, name string) (map[string]string, []map[string]any) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &avroDecoder{buf: data}
+	if magic := d.take(4); !bytes.Equal(magic, []byte{'O', 'b', 'j', 1}) {
+		t.Fatalf("%s: invalid magic %v", name, magic)
+	}
+	meta := make(map[string]string)
+	d.blocks(func() {
+		k := string(d.bytes())
+		meta[k] = string(d.bytes())
+	})
+	sync := d.take(16)
+	if meta["avro.codec"] != "null" {
+		t.Fatalf("%s: unexpected codec %q", name, meta["avro.codec"])
+	}
+	var schema any
+	err = json.Unmarshal([]byte(meta["avro.schema"]), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	for len(d.buf) > 0 && d.err == nil {
+		n := d.long()
+		size := d.long()
+		block := &avroDecoder{buf: d.take(int(size))}
+		for i := int64(0); i < n; i++ {
+			records = append(records, block.value(schema).(map[string]any))
+		}
+		if block.err == nil && len(block.buf) > 0 {
+			block.err = fmt.Errorf("%d bytes left in the block", len(block.buf))
+		}
+		if block.err != nil {
+			t.Fatalf("%s: %v", name, block.err)
+		}
+		if !bytes.Equal(d.take(16), sync) {
+			t.Fatalf("%s: invalid sync marker", name)
+		}
+	}
+	if d.err != nil {
+		t.Fatalf("%s: %v", name, d.err)
+	}
+	return meta, records
+}
+
+// readTableMetadata reads the metadata file of version-hint.text
+func readTableMetadata(t *testing.T, table *shared.Table) *tableMetadata {
+	dir := filepath.Join(table.Path, "metadata")
+	hint, err := os.ReadFile(filepath.Join(dir, "version-hint.text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("v%s.metadata.json", hint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &tableMetadata{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// liveFiles returns the manifest entries of the live files of the current snapshot by file_path
+// and the paths of the deleted files
+func liveFiles(t *testing.T, meta *tableMetadata) (map[string]map[string]any, []string) {
+	var current *snapshot
+	for i := range meta.Snapshots {
+		if meta.CurrentSnapshotId != nil && meta.Snapshots[i].SnapshotId == *meta.CurrentSnapshotId {
+			current = &meta.Snapshots[i]
+		}
+	}
+	if current == nil {
+		t.Fatal("no current snapshot")
+	}
+	if !strings.HasPrefix(current.ManifestList, "file:///") {
+		t.Fatalf("expected a file URI, got the manifest list %s", current.ManifestList)
+	}
+	listMeta, manifests := readAvroFile(t, strings.TrimPrefix(current.ManifestList, "file://"))
+	if listMeta["snapshot-id"] != strconv.FormatInt(current.SnapshotId, 10) ||
+		listMeta["sequence-number"] != strconv.FormatInt(current.SequenceNumber, 10) {
+		t.Fatalf("unexpected manifest list metadata %v", listMeta)
+	}
+	live := make(map[string]map[string]any)
+	var deleted []string
+	for _, m := range manifests {
+		manifestPath := m["manifest_path"].(string)
+		if !strings.HasPrefix(manifestPath, "file:///") {
+			t.Fatalf("expected a file URI, got the manifest %s", manifestPath)
+		}
+		name := strings.TrimPrefix(manifestPath, "file://")
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["manifest_length"] != stat.Size() {
+			t.Fatalf("manifest_length %v, the file has %d bytes", m["manifest_length"], stat.Size())
+		}
+		manifestMeta, entries := readAvroFile(t, name)
+		if manifestMeta["format-version"] != "2" || manifestMeta["content"] != "data" {
+			t.Fatalf("unexpected manifest metadata %v", manifestMeta)
+		}
+		var added, existing, removed int64
+		for _, e := range entries {
+			file := e["data_file"].(map[string]any)
+			switch e["status"] {
+			case int64(statusAdded):
+				added++
+			case int64(statusExisting):
+				existing++
+			case int64(statusDeleted):
+				removed++
+				deleted = append(deleted, file["file_path"].(string))
+				continue
+			}
+			live[file["file_path"].(string)] = file
+		}
+		if m["added_files_count"] != added || m["existing_files_count"] != existing || m["deleted_files_count"] != removed {
+			t.Fatalf("unexpected counts of the manifest list %v, the manifest has %d/%d/%d",
+				m, added, existing, removed)
+		}
+	}
+	slices.Sort(deleted)
+	return live, deleted
+}
+
+func TestExporterRoundTrip(t *testing.T) {
+	table := &shared.Table{
+		Database:       "db",
+		Name:           "test",
+		Path:           t.TempDir(),
+		Engine:         "HiveMerge",
+		TimestampField: "time",
+		PartitionExpressions: [][2]string{
+			{"date", "toDate(time)"},
+			{"hour", "toHour(time)"},
+		},
+	}
+	columns := func() []shared.TableColumn {
+		return []shared.TableColumn{
+			{Name: "time", Type: data_types.DATA_TYPE_NAME_INT64},
+			{Name: "host", Type: data_types.DATA_TYPE_NAME_STRING},
+		}
+	}
+	values := [][2]string{{"date", "2025-01-01"}, {"hour", "10"}}
+	dir := filepath.Join(table.Path, "date=2025-01-01", "hour=10")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	entry := func(name string, rows int64, host string) *shared.IndexEntry {
+		return &shared.IndexEntry{
+			Path:       filepath.Join(dir, name),
+			RowCount:   rows,
+			SizeBytes:  rows * 100,
+			Min:        map[string]any{"time": hour + 1, "host": host},
+			Max:        map[string]any{"time": hour + rows, "host": host},
+			NullCounts: map[string]int64{"time": 0, "host": 1},
+		}
+	}
+	a, b, c := entry("a.1.parquet", 2, "a"), entry("b.1.parquet", 3, "b"), entry("c.2.parquet", 5, "a")
+
+	idx, err := index.NewJSONIndexForPartition(table, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	_, err = idx.Batch([]*shared.IndexEntry{a}, nil).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewExporter(table, columns)
+	exporter.Run()
+	// the changes are exported once the files of the index are committed
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(table.Path, "metadata", "version-hint.text")); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the exporter didn't commit the files of the index")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	exported := exporter.WrapIndex(idx, values)
+	_, err = exported.Batch([]*shared.IndexEntry{b}, nil).Get()
+	if err == nil {
+		_, err = exported.Batch([]*shared.IndexEntry{c}, []string{a.Path, b.Path}).Get()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.Stop()
+	idx.Stop()
+
+	meta := readTableMetadata(t, table)
+	if meta.Location != "file://"+table.Path {
+		t.Fatalf("expected the location file://%s, got %s", table.Path, meta.Location)
+	}
+	var operations []string
+	for _, s := range meta.Snapshots {
+		operations = append(operations, s.Summary["operation"])
+	}
+	if !slices.Equal(operations, []string{"append", "append", "replace"}) {
+		t.Fatalf("unexpected operations %v", operations)
+	}
+	live, deleted := liveFiles(t, meta)
+	if !slices.Equal(deleted, []string{"file://" + a.Path, "file://" + b.Path}) {
+		t.Fatalf("unexpected deleted files %v", deleted)
+	}
+	file, ok := live["file://"+c.Path]
+	if !ok || len(live) != 1 {
+		t.Fatalf("expected the live file %s, got %v", c.Path, live)
+	}
+	partition := file["partition"].(map[string]any)
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	if partition["date"] != day || partition["hour"] != hour {
+		t.Fatalf("unexpected partition %v", partition)
+	}
+	if file["record_count"] != int64(5) || file["file_size_in_bytes"] != int64(500) || file["file_format"] != "PARQUET" {
+		t.Fatalf("unexpected data file %v", file)
+	}
+	ids := make(map[string]int64)
+	for _, f := range meta.currentSchema().Fields {
+		ids[f.Name] = int64(f.Id)
+	}
+	nulls := make(map[int64]int64)
+	for _, kv := range file["null_value_counts"].([]any) {
+		kv := kv.(map[string]any)
+		nulls[kv["key"].(int64)] = kv["value"].(int64)
+	}
+	if len(nulls) != 2 || nulls[ids["host"]] != 1 || nulls[ids["time"]] != 0 {
+		t.Fatalf("unexpected null counts %v", nulls)
+	}
+	bounds := func(name string) map[int64][]byte {
+		res := make(map[int64][]byte)
+		for _, kv := range file[name].([]any) {
+			kv := kv.(map[string]any)
+			res[kv["key"].(int64)] = kv["value"].([]byte)
+		}
+		return res
+	}
+	lower, upper := bounds("lower_bounds"), bounds("upper_bounds")
+	if int64(binary.LittleEndian.Uint64(lower[ids["time"]])) != hour+1 ||
+		int64(binary.LittleEndian.Uint64(upper[ids["time"]])) != hour+5 ||
+		string(lower[ids["host"]]) != "a" || string(upper[ids["host"]]) != "a" {
+		t.Fatalf("unexpected bounds %v %v", lower, upper)
+	}
+
+	// the restart commits the files of the index as an overwrite
+	exporter = NewExporter(table, columns)
+	exporter.Run()
+	exporter.Stop()
+	meta = readTableMetadata(t, table)
+	if op := meta.Snapshots[len(meta.Snapshots)-1].Summary["operation"]; op != "overwrite" {
+		t.Fatalf("expected an overwrite at the restart, got %s", op)
+	}
+	for _, l := range meta.MetadataLog {
+		if !strings.HasPrefix(l.MetadataFile, "file:///") {
+			t.Fatalf("expected a file URI, got the metadata file %s", l.MetadataFile)
+		}
+	}
+	live, _ = liveFiles(t, meta)
+	if _, ok := live["file://"+c.Path]; !ok || len(live) != 1 {
+		t.Fatalf("expected the live file %s after the restart, got %v", c.Path, live)
+	}
+}
+
+func TestFileURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"/data/db/t/date=2025-01-01/a.2.parquet", "file:///data/db/t/date=2025-01-01/a.2.parquet"},
+		{"file:///data/a.parquet", "file:///data/a.parquet"},
+		{"s3://bucket/db/t/a.3.parquet", "s3://bucket/db/t/a.3.parquet"},
+	}
+	for _, test := range tests {
+		if uri := fileURI(test.name); uri != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.name, test.expected, uri)
+		}
+		if !strings.HasPrefix(test.name, "s3://") && localPath(fileURI(test.name)) != strings.TrimPrefix(test.name, "file://") {
+			t.Fatalf("%s: unexpected local path %s", test.name, localPath(fileURI(test.name)))
+		}
+	}
+}
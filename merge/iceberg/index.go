@@ -0,0 +1,32 @@
+package iceberg
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+)
+
+// change is a Batch of a partition index
+type change struct {
+	values  [][2]string
+	add     []*shared.IndexEntry
+	rm      []string
+	promise utils.Promise[int32]
+}
+
+// exportedIndex is the index of a partition exporting its changes to the Iceberg metadata of the table
+type exportedIndex struct {
+	shared.Index
+	values   [][2]string
+	exporter *Exporter
+}
+
+// WrapIndex returns the index of the partition with the values exporting its changes with the exporter
+func (e *Exporter) WrapIndex(idx shared.Index, values [][2]string) shared.Index {
+	return &exportedIndex{Index: idx, values: values, exporter: e}
+}
+
+func (i *exportedIndex) Batch(add []*shared.IndexEntry, rm []string) utils.Promise[int32] {
+	res := i.Index.Batch(add, rm)
+	i.exporter.enqueue(&change{values: i.values, add: add, rm: rm, promise: res})
+	return res
+}
@@ -0,0 +1,290 @@
+package iceberg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"strconv"
+)
+
+// The status of a manifest entry
+const (
+	statusExisting = 0
+	statusAdded    = 1
+	statusDeleted  = 2
+)
+
+// dataFile is a parquet file of the table
+type dataFile struct {
+	path   string
+	values [][2]string
+	entry  *shared.IndexEntry
+	// snapshotId and seq are the snapshot and the sequence number adding the file, 0 until it is committed
+	snapshotId int64
+	seq        int64
+	manifest   *manifest
+}
+
+// manifest is a manifest file of the current snapshot
+type manifest struct {
+	path       string
+	length     int64
+	specId     int
+	seq        int64
+	minSeq     int64
+	snapshotId int64
+
+	added, existing, deleted             int32
+	addedRows, existingRows, deletedRows int64
+
+	// files are the live files of the manifest
+	files map[string]*dataFile
+}
+
+type manifestEntry struct {
+	status int32
+	file   *dataFile
+}
+
+func avroField(name string, tp any, id int, optional bool) map[string]any {
+	res := map[string]any{"name": name, "type": tp, "field-id": id}
+	if optional {
+		res["type"] = []any{"null", tp}
+		res["default"] = nil
+	}
+	return res
+}
+
+// avroMap is an Iceberg map with int keys, stored as an array of key/value records
+func avroMap(keyId, valueId int, valueType string) map[string]any {
+	return map[string]any{
+		"type":        "array",
+		"logicalType": "map",
+		"items": map[string]any{
+			"type": "record",
+			"name": fmt.Sprintf("k%d_v%d", keyId, valueId),
+			"fields": []any{
+				avroField("key", "int", keyId, false),
+				avroField("value", valueType, valueId, false),
+			},
+		},
+	}
+}
+
+func manifestSchema(spec *partitionSpec) string {
+	partition := make([]any, len(spec.Fields))
+	for i, f := range spec.Fields {
+		partition[i] = avroField(f.Name, f.typ, f.FieldId, true)
+	}
+	dataFile := map[string]any{
+		"type": "record",
+		"name": "r2",
+		"fields": []any{
+			avroField("content", "int", 134, false),
+			avroField("file_path", "string", 100, false),
+			avroField("file_format", "string", 101, false),
+			avroField("partition", map[string]any{"type": "record", "name": "r102", "fields": partition}, 102, false),
+			avroField("record_count", "long", 103, false),
+			avroField("file_size_in_bytes", "long", 104, false),
+			avroField("null_value_counts", avroMap(121, 122, "long"), 110, true),
+			avroField("lower_bounds", avroMap(126, 127, "bytes"), 125, true),
+			avroField("upper_bounds", avroMap(129, 130, "bytes"), 128, true),
+		},
+	}
+	res, _ := json.Marshal(map[string]any{
+		"type": "record",
+		"name": "manifest_entry",
+		"fields": []any{
+			avroField("status", "int", 0, false),
+			avroField("snapshot_id", "long", 1, true),
+			avroField("sequence_number", "long", 3, true),
+			avroField("file_sequence_number", "long", 4, true),
+			avroField("data_file", dataFile, 2, false),
+		},
+	})
+	return string(res)
+}
+
+var manifestListSchema = func() string {
+	summary := map[string]any{
+		"type": "record",
+		"name": "r508",
+		"fields": []any{
+			avroField("contains_null", "boolean", 509, false),
+			avroField("contains_nan", "boolean", 518, true),
+			avroField("lower_bound", "bytes", 510, true),
+			avroField("upper_bound", "bytes", 511, true),
+		},
+	}
+	res, _ := json.Marshal(map[string]any{
+		"type": "record",
+		"name": "manifest_file",
+		"fields": []any{
+			avroField("manifest_path", "string", 500, false),
+			avroField("manifest_length", "long", 501, false),
+			avroField("partition_spec_id", "int", 502, false),
+			avroField("content", "int", 517, false),
+			avroField("sequence_number", "long", 515, false),
+			avroField("min_sequence_number", "long", 516, false),
+			avroField("added_snapshot_id", "long", 503, false),
+			avroField("added_files_count", "int", 504, false),
+			avroField("existing_files_count", "int", 505, false),
+			avroField("deleted_files_count", "int", 506, false),
+			avroField("added_rows_count", "long", 512, false),
+			avroField("existing_rows_count", "long", 513, false),
+			avroField("deleted_rows_count", "long", 514, false),
+			avroField("partitions", map[string]any{"type": "array", "items": summary, "element-id": 508}, 507, true),
+		},
+	})
+	return string(res)
+}()
+
+// encodeManifestEntry encodes the entry of the file. The deleted entries belong to the snapshot snapshotId.
+func encodeManifestEntry(spec *partitionSpec, s *schema, snapshotId int64, e manifestEntry) []byte {
+	enc := &avroEncoder{}
+	enc.int(e.status)
+	if e.status != statusDeleted {
+		snapshotId = e.file.snapshotId
+	}
+	enc.optionalLong(&snapshotId)
+	enc.optionalLong(&e.file.seq)
+	enc.optionalLong(&e.file.seq)
+
+	entry := e.file.entry
+	enc.int(0)
+	enc.string(fileURI(e.file.path))
+	enc.string("PARQUET")
+	for _, v := range spec.partitionValues(e.file.values) {
+		switch v := v.(type) {
+		case int64:
+			enc.union(1)
+			enc.long(v)
+		case string:
+			enc.union(1)
+			enc.string(v)
+		default:
+			enc.union(0)
+		}
+	}
+	enc.long(entry.RowCount)
+	enc.long(entry.SizeBytes)
+
+	var nullCounts [][2]int64
+	var lower, upper []int
+	for i, f := range s.Fields {
+		if n, ok := entry.NullCounts[f.Name]; ok {
+			nullCounts = append(nullCounts, [2]int64{int64(f.Id), n})
+		}
+		if _, ok := boundOf(entry.Min[f.Name], f.Type); ok {
+			lower = append(lower, i)
+		}
+		if _, ok := boundOf(entry.Max[f.Name], f.Type); ok {
+			upper = append(upper, i)
+		}
+	}
+	if len(nullCounts) == 0 {
+		enc.union(0)
+	} else {
+		enc.union(1)
+		enc.array(len(nullCounts), func(i int) {
+			enc.int(int32(nullCounts[i][0]))
+			enc.long(nullCounts[i][1])
+		})
+	}
+	bounds := func(fields []int, values map[string]any) {
+		if len(fields) == 0 {
+			enc.union(0)
+			return
+		}
+		enc.union(1)
+		enc.array(len(fields), func(i int) {
+			f := s.Fields[fields[i]]
+			bound, _ := boundOf(values[f.Name], f.Type)
+			enc.int(int32(f.Id))
+			enc.bytes(bound)
+		})
+	}
+	bounds(lower, entry.Min)
+	bounds(upper, entry.Max)
+	return enc.buf
+}
+
+// writeManifest writes the entries into a manifest file of the snapshot
+func writeManifest(name string, spec *partitionSpec, s *schema, snapshotId int64, seq int64,
+	entries []manifestEntry) (*manifest, error) {
+	res := &manifest{
+		path:       name,
+		specId:     spec.SpecId,
+		seq:        seq,
+		minSeq:     seq,
+		snapshotId: snapshotId,
+		files:      make(map[string]*dataFile),
+	}
+	records := make([][]byte, len(entries))
+	for i, e := range entries {
+		records[i] = encodeManifestEntry(spec, s, snapshotId, e)
+		switch e.status {
+		case statusAdded:
+			res.added++
+			res.addedRows += e.file.entry.RowCount
+		case statusExisting:
+			res.existing++
+			res.existingRows += e.file.entry.RowCount
+			res.minSeq = min(res.minSeq, e.file.seq)
+		case statusDeleted:
+			res.deleted++
+			res.deletedRows += e.file.entry.RowCount
+			continue
+		}
+		res.files[e.file.path] = e.file
+	}
+	schemaJSON, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	specJSON, err := json.Marshal(spec.Fields)
+	if err != nil {
+		return nil, err
+	}
+	res.length, err = writeAvroFile(name, manifestSchema(spec), map[string]string{
+		"schema":            string(schemaJSON),
+		"schema-id":         strconv.Itoa(s.SchemaId),
+		"partition-spec":    string(specJSON),
+		"partition-spec-id": strconv.Itoa(spec.SpecId),
+		"format-version":    "2",
+		"content":           "data",
+	}, records)
+	return res, err
+}
+
+// writeManifestList writes the manifest list of the snapshot
+func writeManifestList(name string, snap *snapshot, manifests []*manifest) (int64, error) {
+	records := make([][]byte, len(manifests))
+	for i, m := range manifests {
+		enc := &avroEncoder{}
+		enc.string(fileURI(m.path))
+		enc.long(m.length)
+		enc.int(int32(m.specId))
+		enc.int(0)
+		enc.long(m.seq)
+		enc.long(m.minSeq)
+		enc.long(m.snapshotId)
+		enc.int(m.added)
+		enc.int(m.existing)
+		enc.int(m.deleted)
+		enc.long(m.addedRows)
+		enc.long(m.existingRows)
+		enc.long(m.deletedRows)
+		enc.union(0)
+		records[i] = enc.buf
+	}
+	meta := map[string]string{
+		"snapshot-id":     strconv.FormatInt(snap.SnapshotId, 10),
+		"sequence-number": strconv.FormatInt(snap.SequenceNumber, 10),
+		"format-version":  "2",
+	}
+	if snap.ParentSnapshotId != nil {
+		meta["parent-snapshot-id"] = strconv.FormatInt(*snap.ParentSnapshotId, 10)
+	}
+	return writeAvroFile(name, manifestListSchema, meta, records)
+}
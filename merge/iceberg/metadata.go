@@ -0,0 +1,313 @@
+package iceberg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	dayNs  = int64(24 * time.Hour)
+	hourNs = int64(time.Hour)
+
+	// firstPartitionFieldId is the id of the first partition field, as in the Iceberg implementations
+	firstPartitionFieldId = 1000
+)
+
+type schemaField struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Type     string `json:"type"`
+}
+
+type schema struct {
+	Type     string        `json:"type"`
+	SchemaId int           `json:"schema-id"`
+	Fields   []schemaField `json:"fields"`
+}
+
+type partitionField struct {
+	SourceId  int    `json:"source-id"`
+	FieldId   int    `json:"field-id"`
+	Name      string `json:"name"`
+	Transform string `json:"transform"`
+
+	// folder is the hive folder name of the partition value
+	folder string
+	// hourOf is the folder of the date of an hour partition
+	hourOf string
+	typ    string
+}
+
+type partitionSpec struct {
+	SpecId int              `json:"spec-id"`
+	Fields []partitionField `json:"fields"`
+}
+
+type snapshot struct {
+	SnapshotId       int64             `json:"snapshot-id"`
+	ParentSnapshotId *int64            `json:"parent-snapshot-id,omitempty"`
+	SequenceNumber   int64             `json:"sequence-number"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	ManifestList     string            `json:"manifest-list"`
+	Summary          map[string]string `json:"summary"`
+	SchemaId         int               `json:"schema-id"`
+}
+
+type snapshotLogEntry struct {
+	TimestampMs int64 `json:"timestamp-ms"`
+	SnapshotId  int64 `json:"snapshot-id"`
+}
+
+type metadataLogEntry struct {
+	TimestampMs  int64  `json:"timestamp-ms"`
+	MetadataFile string `json:"metadata-file"`
+}
+
+type snapshotRef struct {
+	SnapshotId int64  `json:"snapshot-id"`
+	Type       string `json:"type"`
+}
+
+type sortOrder struct {
+	OrderId int   `json:"order-id"`
+	Fields  []any `json:"fields"`
+}
+
+// tableMetadata is an Iceberg v2 table metadata file
+type tableMetadata struct {
+	FormatVersion      int                    `json:"format-version"`
+	TableUUID          string                 `json:"table-uuid"`
+	Location           string                 `json:"location"`
+	LastSequenceNumber int64                  `json:"last-sequence-number"`
+	LastUpdatedMs      int64                  `json:"last-updated-ms"`
+	LastColumnId       int                    `json:"last-column-id"`
+	CurrentSchemaId    int                    `json:"current-schema-id"`
+	Schemas            []schema               `json:"schemas"`
+	DefaultSpecId      int                    `json:"default-spec-id"`
+	PartitionSpecs     []partitionSpec        `json:"partition-specs"`
+	LastPartitionId    int                    `json:"last-partition-id"`
+	DefaultSortOrderId int                    `json:"default-sort-order-id"`
+	SortOrders         []sortOrder            `json:"sort-orders"`
+	Properties         map[string]string      `json:"properties"`
+	CurrentSnapshotId  *int64                 `json:"current-snapshot-id,omitempty"`
+	Refs               map[string]snapshotRef `json:"refs,omitempty"`
+	Snapshots          []snapshot             `json:"snapshots"`
+	SnapshotLog        []snapshotLogEntry     `json:"snapshot-log"`
+	MetadataLog        []metadataLogEntry     `json:"metadata-log"`
+}
+
+func (m *tableMetadata) currentSchema() *schema {
+	for i := range m.Schemas {
+		if m.Schemas[i].SchemaId == m.CurrentSchemaId {
+			return &m.Schemas[i]
+		}
+	}
+	return nil
+}
+
+// icebergType returns the Iceberg type of a column type. UBIGINT is exported as long.
+func icebergType(tp string) (string, bool) {
+	switch tp {
+	case data_types.DATA_TYPE_NAME_INT64, data_types.DATA_TYPE_NAME_UINT64:
+		return "long", true
+	case data_types.DATA_TYPE_NAME_FLOAT64:
+		return "double", true
+	case data_types.DATA_TYPE_NAME_STRING:
+		return "string", true
+	case data_types.DATA_TYPE_NAME_BOOL:
+		return "boolean", true
+	}
+	return "", false
+}
+
+// updateSchema makes the columns the current schema. The field ids of the known columns are kept,
+// a column with a new type gets a new id. A new schema is added if the columns changed.
+func (m *tableMetadata) updateSchema(columns []shared.TableColumn) {
+	cur := m.currentSchema()
+	ids := make(map[[2]string]int)
+	for _, s := range m.Schemas {
+		for _, f := range s.Fields {
+			ids[[2]string{f.Name, f.Type}] = f.Id
+		}
+	}
+	next := schema{Type: "struct", Fields: []schemaField{}}
+	for _, c := range columns {
+		tp, ok := icebergType(c.Type)
+		if !ok {
+			continue
+		}
+		id, ok := ids[[2]string{c.Name, tp}]
+		if !ok {
+			m.LastColumnId++
+			id = m.LastColumnId
+		}
+		next.Fields = append(next.Fields, schemaField{Id: id, Name: c.Name, Type: tp})
+	}
+	if cur != nil && fieldsEqual(cur.Fields, next.Fields) {
+		return
+	}
+	next.SchemaId = 0
+	for _, s := range m.Schemas {
+		next.SchemaId = max(next.SchemaId, s.SchemaId+1)
+	}
+	m.Schemas = append(m.Schemas, next)
+	m.CurrentSchemaId = next.SchemaId
+	m.Properties["schema.name-mapping.default"] = nameMapping(m.Schemas)
+}
+
+func fieldsEqual(a, b []schemaField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nameMapping maps the column names to the field ids, as the parquet files have no field ids.
+// A name is mapped to its id in the latest schema having it.
+func nameMapping(schemas []schema) string {
+	type mapping struct {
+		FieldId int      `json:"field-id"`
+		Names   []string `json:"names"`
+	}
+	seen := make(map[string]bool)
+	res := []mapping{}
+	for i := len(schemas) - 1; i >= 0; i-- {
+		for _, f := range schemas[i].Fields {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				res = append(res, mapping{FieldId: f.Id, Names: []string{f.Name}})
+			}
+		}
+	}
+	data, _ := json.Marshal(res)
+	return string(data)
+}
+
+var (
+	timeExpression   = regexp.MustCompile(`^\s*(toDate|toHour)\(\s*([A-Za-z_][A-Za-z0-9_]*)\s*\)\s*$`)
+	columnExpression = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*$`)
+)
+
+// partitionSpecOf derives the partition spec from the hive partitioning of the table.
+// The date folders are day buckets of the timestamp (truncate[1 day in ns] of the long column),
+// the hour folders following a date folder are hour buckets, the folders of a string column are identity partitions.
+// The other folders are left out of the spec. The field ids are assigned by the exporter.
+func partitionSpecOf(t *shared.Table, s *schema) partitionSpec {
+	expressions := t.PartitionExpressions
+	if len(expressions) == 0 {
+		// the tables without partition expressions split the batches by day only,
+		// their hour folder is the hour of the first row of the day in the batch
+		expressions = [][2]string{{"date", "toDate(" + t.GetTimestampField() + ")"}}
+	}
+	fields := make(map[string]schemaField)
+	for _, f := range s.Fields {
+		fields[f.Name] = f
+	}
+	res := partitionSpec{Fields: []partitionField{}}
+	var dateFolder string
+	for _, e := range expressions {
+		field := partitionField{Name: e[0], folder: e[0]}
+		if m := timeExpression.FindStringSubmatch(e[1]); m != nil {
+			source, ok := fields[m[2]]
+			if !ok || source.Type != "long" {
+				continue
+			}
+			field.SourceId, field.typ = source.Id, "long"
+			if m[1] == "toDate" {
+				field.Transform = fmt.Sprintf("truncate[%d]", dayNs)
+				dateFolder = e[0]
+			} else if dateFolder != "" {
+				field.Transform = fmt.Sprintf("truncate[%d]", hourNs)
+				field.hourOf = dateFolder
+			} else {
+				continue
+			}
+		} else if m := columnExpression.FindStringSubmatch(e[1]); m != nil {
+			source, ok := fields[m[1]]
+			if !ok || source.Type != "string" {
+				continue
+			}
+			field.SourceId, field.typ, field.Transform = source.Id, "string", "identity"
+		} else {
+			continue
+		}
+		if f, ok := fields[field.Name]; ok && (field.Transform != "identity" || f.Id != field.SourceId) {
+			field.Name += "_part"
+		}
+		res.Fields = append(res.Fields, field)
+	}
+	return res
+}
+
+// partitionValues returns the values of the partition fields of the hive partition, nil for an unknown value
+func (p *partitionSpec) partitionValues(values [][2]string) []any {
+	folders := make(map[string]string, len(values))
+	for _, v := range values {
+		folders[v[0]] = v[1]
+	}
+	day := func(folder string) (int64, bool) {
+		d, err := time.Parse("2006-01-02", folders[folder])
+		return d.UnixNano(), err == nil
+	}
+	res := make([]any, len(p.Fields))
+	for i, f := range p.Fields {
+		value, ok := folders[f.folder]
+		if !ok {
+			continue
+		}
+		switch {
+		case f.Transform == "identity":
+			res[i] = value
+		case f.hourOf != "":
+			d, ok := day(f.hourOf)
+			hour, err := strconv.Atoi(value)
+			if ok && err == nil {
+				res[i] = d + int64(hour)*hourNs
+			}
+		default:
+			if d, ok := day(f.folder); ok {
+				res[i] = d
+			}
+		}
+	}
+	return res
+}
+
+// boundOf returns the single-value serialization of a min/max value of a field
+func boundOf(v any, tp string) ([]byte, bool) {
+	switch v := v.(type) {
+	case int64:
+		if tp == "long" {
+			return binary.LittleEndian.AppendUint64(nil, uint64(v)), true
+		}
+	case float64:
+		if tp == "double" && !math.IsNaN(v) {
+			return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)), true
+		}
+	case string:
+		if tp == "string" {
+			return []byte(v), true
+		}
+	case bool:
+		if tp == "boolean" {
+			if v {
+				return []byte{1}, true
+			}
+			return []byte{0}, true
+		}
+	}
+	return nil, false
+}
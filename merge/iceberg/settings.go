@@ -0,0 +1,31 @@
+package iceberg
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"strconv"
+)
+
+// Enabled returns GIGAPI_ICEBERG_EXPORT: if the Iceberg metadata of the hive tables is maintained
+func Enabled() bool {
+	res, _ := strconv.ParseBool(utils.GetEnv("GIGAPI_ICEBERG_EXPORT", "false"))
+	return res
+}
+
+// retainedSnapshots returns GIGAPI_ICEBERG_SNAPSHOTS: the number of snapshots and metadata files kept
+func retainedSnapshots() int {
+	res, err := strconv.Atoi(utils.GetEnv("GIGAPI_ICEBERG_SNAPSHOTS", ""))
+	if err != nil || res <= 0 {
+		return 100
+	}
+	return res
+}
+
+// maxManifests returns GIGAPI_ICEBERG_MAX_MANIFESTS: the number of manifests of a snapshot
+// above which the live files are rewritten into one manifest
+func maxManifests() int {
+	res, err := strconv.Atoi(utils.GetEnv("GIGAPI_ICEBERG_MAX_MANIFESTS", ""))
+	if err != nil || res <= 0 {
+		return 100
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+package index
+
+import (
+	"encoding/json"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"math"
+)
+
+// jsonColumnStats are the statistics of a column of a file in metadata.json.
+// Min and Max are omitted if the column has no values or if they can't be represented in JSON (NaN, Inf).
+type jsonColumnStats struct {
+	Type      string              `json:"type,omitempty"`
+	Min       json.RawMessage     `json:"min,omitempty"`
+	Max       json.RawMessage     `json:"max,omitempty"`
+	NullCount int64               `json:"null_count"`
+	Bloom     *shared.BloomFilter `json:"bloom,omitempty"`
+}
+
+// statsType returns the data type name of a min/max value
+func statsType(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return data_types.DATA_TYPE_NAME_INT64
+	case uint64:
+		return data_types.DATA_TYPE_NAME_UINT64
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ""
+		}
+		return data_types.DATA_TYPE_NAME_FLOAT64
+	case string:
+		return data_types.DATA_TYPE_NAME_STRING
+	case bool:
+		return data_types.DATA_TYPE_NAME_BOOL
+	}
+	return ""
+}
+
+func columnStats2JSON(entry *shared.IndexEntry) map[string]*jsonColumnStats {
+	if entry.NullCounts == nil {
+		return nil
+	}
+	res := make(map[string]*jsonColumnStats, len(entry.NullCounts))
+	for name, nulls := range entry.NullCounts {
+		stats := &jsonColumnStats{NullCount: nulls, Bloom: entry.BloomFilters[name]}
+		_min, _max := entry.Min[name], entry.Max[name]
+		tp := statsType(_min)
+		if tp != "" && tp == statsType(_max) {
+			stats.Type = tp
+			stats.Min, _ = json.Marshal(_min)
+			stats.Max, _ = json.Marshal(_max)
+		}
+		res[name] = stats
+	}
+	return res
+}
+
+func unmarshalStat[T any](data json.RawMessage) (any, bool) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err == nil
+}
+
+// decodeStat decodes a min/max value of the data type
+func decodeStat(tp string, data json.RawMessage) (any, bool) {
+	switch tp {
+	case data_types.DATA_TYPE_NAME_INT64:
+		return unmarshalStat[int64](data)
+	case data_types.DATA_TYPE_NAME_UINT64:
+		return unmarshalStat[uint64](data)
+	case data_types.DATA_TYPE_NAME_FLOAT64:
+		return unmarshalStat[float64](data)
+	case data_types.DATA_TYPE_NAME_STRING:
+		return unmarshalStat[string](data)
+	case data_types.DATA_TYPE_NAME_BOOL:
+		return unmarshalStat[bool](data)
+	}
+	return nil, false
+}
+
+func json2ColumnStats(columns map[string]*jsonColumnStats, entry *shared.IndexEntry) {
+	if columns == nil {
+		return
+	}
+	entry.NullCounts = make(map[string]int64, len(columns))
+	for name, stats := range columns {
+		entry.NullCounts[name] = stats.NullCount
+		if stats.Bloom != nil {
+			if entry.BloomFilters == nil {
+				entry.BloomFilters = make(map[string]*shared.BloomFilter)
+			}
+			entry.BloomFilters[name] = stats.Bloom
+		}
+		if len(stats.Min) == 0 || len(stats.Max) == 0 {
+			continue
+		}
+		_min, minOk := decodeStat(stats.Type, stats.Min)
+		_max, maxOk := decodeStat(stats.Type, stats.Max)
+		if minOk && maxOk {
+			entry.Min[name], entry.Max[name] = _min, _max
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/metadata"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataFile is the content of a metadata.json
+type metadataFile struct {
+	ParquetSizeBytes int64
+	RowCount         int64
+	MinTime          int64
+	MaxTime          int64
+	WALSequence      uint64
+	DropQueue        []string
+	Files            []*jsonIndexEntry
+}
+
+// readMetadata reads the metadata.json of the partition folder with its journal replayed
+func readMetadata(dir string) (*metadataFile, error) {
+	_, err := os.Stat(path.Join(dir, "metadata.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = os.Stat(path.Join(dir, journalFile))
+	}
+	if err != nil {
+		return nil, err
+	}
+	J := &JSONIndex{t: &shared.Table{}, idxPath: dir, entries: &sync.Map{}}
+	err = J.populate()
+	if err != nil {
+		return nil, err
+	}
+	res := &metadataFile{
+		ParquetSizeBytes: J.parquetSizeBytes,
+		RowCount:         J.rowCount,
+		MinTime:          J.minTime,
+		MaxTime:          J.maxTime,
+		WALSequence:      J.walSequence,
+		DropQueue:        J.dropQueue,
+	}
+	J.entries.Range(func(key, value any) bool {
+		res.Files = append(res.Files, value.(*jsonIndexEntry))
+		return true
+	})
+	return res, nil
+}
+
+// ParquetEntry builds the index entry of the parquet file from its footer.
+// The min and max of tsField are read from the column statistics.
+func ParquetEntry(name string, tsField string) (*shared.IndexEntry, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := file.OpenParquetFile(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	meta := reader.MetaData()
+	entry := &shared.IndexEntry{
+		Path:      name,
+		SizeBytes: stat.Size(),
+		RowCount:  meta.NumRows,
+		ChunkTime: stat.ModTime().UnixNano(),
+		Min:       map[string]any{},
+		Max:       map[string]any{},
+	}
+	col := meta.Schema.ColumnIndexByName(tsField)
+	if col < 0 {
+		return entry, nil
+	}
+	for i := 0; i < reader.NumRowGroups(); i++ {
+		chunk, err := meta.RowGroup(i).ColumnChunk(col)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := chunk.Statistics()
+		if err != nil {
+			return nil, err
+		}
+		int64Stats, ok := stats.(*metadata.Int64Statistics)
+		if !ok || !int64Stats.HasMinMax() {
+			continue
+		}
+		if _, ok := entry.Min[tsField]; !ok {
+			entry.Min[tsField], entry.Max[tsField] = int64Stats.Min(), int64Stats.Max()
+			continue
+		}
+		entry.Min[tsField] = min(entry.Min[tsField].(int64), int64Stats.Min())
+		entry.Max[tsField] = max(entry.Max[tsField].(int64), int64Stats.Max())
+	}
+	return entry, nil
+}
+
+// partitionFiles returns the absolute paths of the parquet files of the partition folder
+func partitionFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".parquet") {
+			res = append(res, filepath.Join(dir, e.Name()))
+		}
+	}
+	return res, nil
+}
+
+// CheckPartition compares the metadata.json of the partition folder with its parquet files:
+// the indexed files must exist and match the row count, the size and the min/max time of their footers,
+// the files must be indexed, and the totals of metadata.json must match the entries.
+// The files tiered to S3 (s3:// paths) are counted in the totals only.
+// It returns the discrepancies found.
+func CheckPartition(t *shared.Table, dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := partitionFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	md, err := readMetadata(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if len(files) == 0 {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("metadata.json is missing, %d parquet files are not indexed", len(files))}, nil
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("metadata.json is corrupted: %v", err)}, nil
+	}
+
+	var problems []string
+	if intents, _ := filepath.Glob(filepath.Join(dir, "*.merge.json")); len(intents) > 0 {
+		problems = append(problems, fmt.Sprintf("%d interrupted merges, recovered at the next start", len(intents)))
+	}
+	onDisk := make(map[string]bool, len(files))
+	for _, f := range files {
+		onDisk[f] = true
+	}
+	dropped := make(map[string]bool, len(md.DropQueue))
+	for _, f := range md.DropQueue {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		dropped[abs] = true
+	}
+
+	tsField := t.GetTimestampField()
+	indexed := make(map[string]bool, len(md.Files))
+	var (
+		rowCount, sizeBytes int64
+		minTime, maxTime    int64
+	)
+	for i, e := range md.Files {
+		name := filepath.Base(e.Path)
+		indexed[e.Path] = true
+		rowCount += e.RowCount
+		sizeBytes += e.SizeBytes
+		if i == 0 {
+			minTime, maxTime = e.MinTime, e.MaxTime
+		} else {
+			minTime, maxTime = min(minTime, e.MinTime), max(maxTime, e.MaxTime)
+		}
+		if strings.HasPrefix(e.Path, "s3://") {
+			continue
+		}
+		if !onDisk[e.Path] {
+			problems = append(problems, fmt.Sprintf("%s: indexed but missing", name))
+			continue
+		}
+		footer, err := ParquetEntry(e.Path, tsField)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable: %v", name, err))
+			continue
+		}
+		if footer.RowCount != e.RowCount {
+			problems = append(problems, fmt.Sprintf("%s: row_count %d, the footer has %d", name, e.RowCount, footer.RowCount))
+		}
+		if footer.SizeBytes != e.SizeBytes {
+			problems = append(problems, fmt.Sprintf("%s: size_bytes %d, the file has %d", name, e.SizeBytes, footer.SizeBytes))
+		}
+		if footerMin, ok := footer.Min[tsField].(int64); ok && footerMin != e.MinTime {
+			problems = append(problems, fmt.Sprintf("%s: min_time %d, the footer has %d", name, e.MinTime, footerMin))
+		}
+		if footerMax, ok := footer.Max[tsField].(int64); ok && footerMax != e.MaxTime {
+			problems = append(problems, fmt.Sprintf("%s: max_time %d, the footer has %d", name, e.MaxTime, footerMax))
+		}
+	}
+	for _, f := range files {
+		if !indexed[f] && !dropped[f] {
+			problems = append(problems, fmt.Sprintf("%s: not indexed", filepath.Base(f)))
+		}
+	}
+	if md.RowCount != rowCount {
+		problems = append(problems, fmt.Sprintf("row_count %d, the files sum up to %d", md.RowCount, rowCount))
+	}
+	if md.ParquetSizeBytes != sizeBytes {
+		problems = append(problems, fmt.Sprintf("parquet_size_bytes %d, the files sum up to %d", md.ParquetSizeBytes, sizeBytes))
+	}
+	if len(md.Files) > 0 && (md.MinTime != minTime || md.MaxTime != maxTime) {
+		problems = append(problems, fmt.Sprintf("time range [%d, %d], the files cover [%d, %d]",
+			md.MinTime, md.MaxTime, minTime, maxTime))
+	}
+	return problems, nil
+}
+
+// RebuildPartition rewrites the metadata.json of the partition from the footers of its parquet files.
+// The files of the drop queue are left out and kept in the queue, the WAL sequence and the files
+// tiered to S3 are kept if the previous metadata.json is readable. The previous metadata.json, journal and history
+// are renamed with a .<unix time> suffix. The unreadable parquet files are left out,
+// like in the recovery, and returned with their error.
+func RebuildPartition(t *shared.Table, values [][2]string) ([]string, error) {
+	folders := []string{t.Path}
+	for _, v := range values {
+		folders = append(folders, fmt.Sprintf("%s=%s", v[0], v[1]))
+	}
+	dir, err := filepath.Abs(path.Join(folders...))
+	if err != nil {
+		return nil, err
+	}
+	if intents, _ := filepath.Glob(filepath.Join(dir, "*.merge.json")); len(intents) > 0 {
+		return nil, fmt.Errorf("%d interrupted merges, start the server once to recover them", len(intents))
+	}
+	files, err := partitionFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		walSequence uint64
+		dropQueue   []string
+		entries     []*shared.IndexEntry
+	)
+	dropped := make(map[string]bool)
+	if md, err := readMetadata(dir); err == nil {
+		walSequence = md.WALSequence
+		previous, err := ReadPartition(t, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range previous {
+			if strings.HasPrefix(e.Path, "s3://") {
+				entries = append(entries, e)
+			}
+		}
+		for _, f := range md.DropQueue {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(abs); err == nil {
+				dropped[abs] = true
+				dropQueue = append(dropQueue, f)
+			}
+		}
+	}
+	for _, name := range []string{"metadata.json", journalFile, historyFile} {
+		old := path.Join(dir, name)
+		if _, err := os.Stat(old); err == nil {
+			err = os.Rename(old, fmt.Sprintf("%s.%d", old, time.Now().Unix()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var skipped []string
+	for _, f := range files {
+		if dropped[f] {
+			continue
+		}
+		entry, err := ParquetEntry(f, t.GetTimestampField())
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", filepath.Base(f), err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ChunkTime < entries[j].ChunkTime
+	})
+	if len(entries) > 0 {
+		entries[len(entries)-1].WALSequence = walSequence
+	}
+
+	idx, err := NewJSONIndexForPartition(t, values)
+	if err != nil {
+		return skipped, err
+	}
+	idx.Run()
+	defer idx.Stop()
+	_, err = idx.Batch(entries, nil).Get()
+	if err != nil {
+		return skipped, err
+	}
+	if len(dropQueue) > 0 {
+		_, err = idx.AddToDropQueue(dropQueue).Get()
+	}
+	return skipped, err
+}
@@ -0,0 +1,183 @@
+package index
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testValues = [][2]string{{"date", "2025-01-01"}}
+
+func testTable(t *testing.T) *shared.Table {
+	return &shared.Table{Database: "db", Name: "test", Path: t.TempDir(), TimestampField: "time"}
+}
+
+func testDir(table *shared.Table) string {
+	return filepath.Join(table.Path, "date=2025-01-01")
+}
+
+// writeParquet writes a parquet file of the time column into the partition folder
+func writeParquet(t *testing.T, table *shared.Table, name string, times ...int64) string {
+	err := os.MkdirAll(testDir(table), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	values := make([]string, len(times))
+	for i, ts := range times {
+		values[i] = fmt.Sprint(ts)
+	}
+	res := filepath.Join(testDir(table), name)
+	_, err = conn.Exec(fmt.Sprintf("COPY (SELECT unnest([%s])::BIGINT AS time) TO '%s' (FORMAT 'parquet')",
+		strings.Join(values, ","), res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// openTestIndex opens and runs the index of the partition, stopped at the end of the test
+func openTestIndex(t *testing.T, table *shared.Table) shared.Index {
+	idx, err := NewJSONIndexForPartition(table, testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	return idx
+}
+
+func parquetEntries(t *testing.T, names ...string) []*shared.IndexEntry {
+	var res []*shared.IndexEntry
+	for _, name := range names {
+		entry, err := ParquetEntry(name, "time")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+// entryPaths returns the sorted paths of the entries
+func entryPaths(entries []*shared.IndexEntry) []string {
+	res := make([]string, len(entries))
+	for i, e := range entries {
+		res[i] = e.Path
+	}
+	slices.Sort(res)
+	return res
+}
+
+func TestCheckPartition(t *testing.T) {
+	table := testTable(t)
+	a := writeParquet(t, table, "a.1.parquet", 1, 2)
+	b := writeParquet(t, table, "b.1.parquet", 3)
+	tiered := &shared.IndexEntry{Path: "s3://bucket/db/test/date=2025-01-01/t.2.parquet", RowCount: 4, SizeBytes: 100,
+		Min: map[string]any{"time": int64(1)}, Max: map[string]any{"time": int64(2)}}
+	idx := openTestIndex(t, table)
+	_, err := idx.Batch(append(parquetEntries(t, a, b), tiered), nil).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+
+	problems, err := CheckPartition(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problem, got %v", problems)
+	}
+
+	os.Remove(b)
+	writeParquet(t, table, "a.1.parquet", 1, 2, 5)
+	writeParquet(t, table, "c.1.parquet", 6)
+	problems, err = CheckPartition(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"a.1.parquet: row_count 2, the footer has 3",
+		"a.1.parquet: max_time 2, the footer has 5",
+		"b.1.parquet: indexed but missing",
+		"c.1.parquet: not indexed",
+	}
+	for _, e := range expected {
+		if !slices.Contains(problems, e) {
+			t.Fatalf("expected %q in %v", e, problems)
+		}
+	}
+	for _, p := range problems {
+		if strings.Contains(p, "t.2.parquet") {
+			t.Fatalf("the tiered file is checked: %v", problems)
+		}
+	}
+}
+
+func TestRebuildPartition(t *testing.T) {
+	table := testTable(t)
+	a := writeParquet(t, table, "a.1.parquet", 1, 2)
+	b := writeParquet(t, table, "b.1.parquet", 3)
+	dropped := writeParquet(t, table, "d.1.parquet", 4)
+	tiered := &shared.IndexEntry{Path: "s3://bucket/db/test/date=2025-01-01/t.2.parquet", RowCount: 4, SizeBytes: 100,
+		Min: map[string]any{"time": int64(1)}, Max: map[string]any{"time": int64(2)}}
+	idx := openTestIndex(t, table)
+	_, err := idx.Batch(append(parquetEntries(t, a), tiered), nil).Get()
+	if err == nil {
+		_, err = idx.AddToDropQueue([]string{dropped}).Get()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	// b is corrupted, the rebuild indexes the other files
+	err = os.WriteFile(b, []byte("not a parquet file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := writeParquet(t, table, "c.2.parquet", 5, 6)
+
+	skipped, err := RebuildPartition(table, testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || !strings.HasPrefix(skipped[0], "b.1.parquet: ") {
+		t.Fatalf("expected b.1.parquet to be skipped, got %v", skipped)
+	}
+	entries, err := ReadPartition(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{a, c, tiered.Path}
+	slices.Sort(expected)
+	if paths := entryPaths(entries); !slices.Equal(paths, expected) {
+		t.Fatalf("expected the entries %v, got %v", expected, paths)
+	}
+	md, err := readMetadata(testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(md.DropQueue, []string{dropped}) || md.RowCount != 8 {
+		t.Fatalf("unexpected metadata: drop queue %v, row_count %d", md.DropQueue, md.RowCount)
+	}
+	backups, _ := filepath.Glob(filepath.Join(testDir(table), "metadata.json.*"))
+	if len(backups) != 1 {
+		t.Fatalf("expected the previous metadata.json to be kept, got %v", backups)
+	}
+	problems, err := CheckPartition(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(problems, []string{"b.1.parquet: not indexed"}) {
+		t.Fatalf("unexpected problems after the rebuild: %v", problems)
+	}
+}
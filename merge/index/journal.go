@@ -0,0 +1,98 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// journalFile is the append-only journal of the changes of metadata.json since its last checkpoint
+const journalFile = "metadata.journal"
+
+// The checkpoint interval is capped below the 30s after which the merged files are removed,
+// so metadata.json never lists removed files for long.
+const (
+	defaultCheckpointS = 5
+	maxCheckpointS     = 20
+)
+
+// checkpointInterval returns GIGAPI_METADATA_CHECKPOINT_S: the max interval between
+// the checkpoints of the journal into metadata.json
+func checkpointInterval() time.Duration {
+	s, err := strconv.Atoi(utils.GetEnv("GIGAPI_METADATA_CHECKPOINT_S", ""))
+	if err != nil || s <= 0 {
+		s = defaultCheckpointS
+	}
+	return time.Duration(min(s, maxCheckpointS)) * time.Second
+}
+
+// journalRecord is a line of the journal. Replaying a record is idempotent,
+// as the records already in the checkpoint are replayed if the journal was not truncated after it.
+type journalRecord struct {
+	Add          []*jsonIndexEntry `json:"add,omitempty"`
+	Rm           []string          `json:"rm,omitempty"`
+	WALSequence  uint64            `json:"wal_sequence,omitempty"`
+	DropQueueAdd []string          `json:"drop_queue_add,omitempty"`
+	DropQueueRm  []string          `json:"drop_queue_rm,omitempty"`
+	// Version and Time are the version of the index created by the change and its unix time in ns
+	Version uint64 `json:"version,omitempty"`
+	Time    int64  `json:"time,omitempty"`
+	// HistoryFrom and HistoryFromTime are the oldest retained version and its time after an expiration
+	HistoryFrom     uint64 `json:"history_from,omitempty"`
+	HistoryFromTime int64  `json:"history_from_time,omitempty"`
+}
+
+// readJournal calls fn for every complete record of the journal.
+// It returns the length of the complete records, a torn last record is left out.
+func readJournal(name string, fn func(rec *journalRecord) error) (int64, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		rec := &journalRecord{}
+		err = json.Unmarshal(bytes.TrimSpace(line), rec)
+		if err != nil {
+			return size, fmt.Errorf("%s: corrupted record at %d: %w", name, size, err)
+		}
+		err = fn(rec)
+		if err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+	}
+}
+
+// appendJournal appends the marshalled records to the journal
+func appendJournal(name string, records []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(records)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
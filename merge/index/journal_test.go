@@ -0,0 +1,203 @@
+package index
+
+import (
+	"encoding/json"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testEntry returns the entry of a file of the partition, without the file
+func testEntry(table *shared.Table, name string, rows int64, minTime, maxTime int64, walSequence uint64) *shared.IndexEntry {
+	return &shared.IndexEntry{
+		Path:        filepath.Join(testDir(table), name),
+		RowCount:    rows,
+		SizeBytes:   rows * 10,
+		Min:         map[string]any{"time": minTime},
+		Max:         map[string]any{"time": maxTime},
+		WALSequence: walSequence,
+	}
+}
+
+// journalLines returns the marshalled journal records
+func journalLines(t *testing.T, records ...*journalRecord) []byte {
+	var res []byte
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(append(res, data...), '\n')
+	}
+	return res
+}
+
+// jsonEntries converts the entries to the entries of the journal records
+func jsonEntries(t *testing.T, table *shared.Table, entries ...*shared.IndexEntry) []*jsonIndexEntry {
+	res, err := (&JSONIndex{t: table}).entry2JEntry(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// checkpointTestIndex checkpoints the entries into metadata.json
+func checkpointTestIndex(t *testing.T, table *shared.Table, entries ...*shared.IndexEntry) {
+	err := os.MkdirAll(testDir(table), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := openTestIndex(t, table)
+	_, err = idx.Batch(entries, nil).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+}
+
+func TestReplayTornJournal(t *testing.T) {
+	table := testTable(t)
+	a := testEntry(table, "a.1.parquet", 2, 1, 2, 1)
+	checkpointTestIndex(t, table, a)
+	b := testEntry(table, "b.1.parquet", 3, 3, 5, 2)
+	records := journalLines(t,
+		&journalRecord{Add: jsonEntries(t, table, b), WALSequence: 2, Version: 2, Time: 1},
+		&journalRecord{DropQueueAdd: []string{a.Path}})
+	torn := []byte(`{"add":[{"id":9,"path":"c.1.par`)
+	name := filepath.Join(testDir(table), journalFile)
+	err := os.WriteFile(name, append(records, torn...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewJSONIndexForPartition(table, testValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := entryPaths(idx.List()); !slices.Equal(paths, []string{a.Path, b.Path}) {
+		t.Fatalf("unexpected entries after the replay: %v", paths)
+	}
+	if dq := idx.GetDropQueue(); !slices.Equal(dq, []string{a.Path}) {
+		t.Fatalf("unexpected drop queue after the replay: %v", dq)
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(records)) {
+		t.Fatalf("expected the torn record to be truncated: %d bytes, expected %d", stat.Size(), len(records))
+	}
+
+	// the index appends its next records after the complete ones
+	idx.Run()
+	c := testEntry(table, "c.1.parquet", 1, 6, 6, 3)
+	_, err = idx.Batch([]*shared.IndexEntry{c}, nil).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadPartition(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := entryPaths(entries); !slices.Equal(paths, []string{a.Path, b.Path, c.Path}) {
+		t.Fatalf("unexpected entries after the next change: %v", paths)
+	}
+	idx.Stop()
+}
+
+func TestReplayCheckpointedJournal(t *testing.T) {
+	table := testTable(t)
+	a := testEntry(table, "a.1.parquet", 2, 1, 2, 1)
+	b := testEntry(table, "b.1.parquet", 3, 3, 5, 2)
+	c := testEntry(table, "c.2.parquet", 5, 1, 5, 2)
+	checkpointTestIndex(t, table, a, b)
+	idx := openTestIndex(t, table)
+	_, err := idx.Batch([]*shared.IndexEntry{c}, []string{a.Path, b.Path}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	expected, err := readMetadata(testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checkpoint raced with the writes of the records: metadata.json has all of them
+	// and the journal has them again, from before the checkpoint of a and b
+	records := journalLines(t,
+		&journalRecord{Add: jsonEntries(t, table, a, b), WALSequence: 2, Version: 1, Time: 1},
+		&journalRecord{Add: jsonEntries(t, table, c), Rm: []string{a.Path, b.Path}, WALSequence: 2, Version: 2, Time: 2},
+		&journalRecord{DropQueueAdd: []string{a.Path, b.Path}},
+		&journalRecord{DropQueueAdd: []string{a.Path, b.Path}})
+	err = os.WriteFile(filepath.Join(testDir(table), journalFile), records, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// the second run replays the checkpoint of the first one
+		idx := openTestIndex(t, table)
+		if paths := entryPaths(idx.List()); !slices.Equal(paths, []string{c.Path}) {
+			t.Fatalf("unexpected entries after the replay: %v", paths)
+		}
+		if dq := idx.GetDropQueue(); len(dq) != 2 {
+			t.Fatalf("expected no duplicate in the drop queue, got %v", dq)
+		}
+		if version := idx.(*JSONIndex).version; version != 2 {
+			t.Fatalf("expected the version 2, got %d", version)
+		}
+		idx.Stop()
+		md, err := readMetadata(testDir(table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.RowCount != expected.RowCount || md.ParquetSizeBytes != expected.ParquetSizeBytes ||
+			md.MinTime != 1 || md.MaxTime != 5 || md.WALSequence != 2 {
+			t.Fatalf("expected the metadata %+v, got %+v", expected, md)
+		}
+		if _, err := os.Stat(filepath.Join(testDir(table), journalFile)); !os.IsNotExist(err) {
+			t.Fatalf("expected the journal to be removed by the checkpoint: %v", err)
+		}
+	}
+}
+
+func TestGetWALSequence(t *testing.T) {
+	table := testTable(t)
+	checkpointTestIndex(t, table, testEntry(table, "a.1.parquet", 2, 1, 2, 5))
+	// the journal of another partition has a greater sequence not checkpointed yet
+	dir := filepath.Join(table.Path, "date=2025-01-02")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := journalLines(t,
+		&journalRecord{Add: jsonEntries(t, table, testEntry(table, "b.1.parquet", 1, 3, 3, 7)), WALSequence: 7, Version: 1},
+		&journalRecord{WALSequence: 9, Version: 2})
+	// the torn record is not taken into account
+	torn := []byte(`{"wal_sequence":12,"vers`)
+	err = os.WriteFile(filepath.Join(dir, journalFile), append(records, torn...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := GetWALSequence(table.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 9 {
+		t.Fatalf("expected the wal sequence 9, got %d", seq)
+	}
+
+	os.Remove(filepath.Join(dir, journalFile))
+	seq, err = GetWALSequence(table.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 5 {
+		t.Fatalf("expected the wal sequence 5 of metadata.json, got %d", seq)
+	}
+	seq, err = GetWALSequence(filepath.Join(table.Path, "missing"))
+	if err != nil || seq != 0 {
+		t.Fatalf("expected no sequence for a missing table, got %d, %v", seq, err)
+	}
+}
@@ -3,27 +3,37 @@ package index
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gigapi/gigapi/v2/merge/shared"
 	"github.com/gigapi/gigapi/v2/utils"
 	jsoniter "github.com/json-iterator/go"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type jsonIndexEntry struct {
-	Id          uint32 `json:"id"`
-	Path        string `json:"path"`
-	SizeBytes   int64  `json:"size_bytes"`
-	RowCount    int64  `json:"row_count"`
-	ChunkTime   int64  `json:"chunk_time"`
-	MinTime     int64  `json:"min_time"`
-	MaxTime     int64  `json:"max_time"`
-	Range       string `json:"range"`
-	Type        string `json:"type"`
-	_marshalled string `json:"-"`
+	Id        uint32 `json:"id"`
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	RowCount  int64  `json:"row_count"`
+	ChunkTime int64  `json:"chunk_time"`
+	MinTime   int64  `json:"min_time"`
+	MaxTime   int64  `json:"max_time"`
+	Range     string `json:"range"`
+	Type      string `json:"type"`
+	// Endpoint is the S3 endpoint of a file tiered to S3
+	Endpoint string `json:"endpoint,omitempty"`
+	// Columns are the statistics of the columns of the file
+	Columns     map[string]*jsonColumnStats `json:"columns,omitempty"`
+	_marshalled string                      `json:"-"`
 }
 
 type JSONIndex struct {
@@ -44,6 +54,22 @@ type JSONIndex struct {
 	rowCount         int64
 	minTime          int64
 	maxTime          int64
+	walSequence      uint64
+
+	// version is the version of the index, incremented by every change of its files
+	version uint64
+	// history are the retained versions after historyFrom, the oldest resolvable version
+	history         []*historyEntry
+	historyFrom     uint64
+	historyFromTime int64
+
+	// pending are the marshalled journal records of the changes not written yet
+	pending []byte
+	// journaled is set if the journal has changes not checkpointed into metadata.json
+	journaled bool
+	// hasCheckpoint is set once metadata.json exists
+	hasCheckpoint bool
+	done          chan struct{}
 }
 
 func NewJSONIndex(t *shared.Table) (shared.Index, error) {
@@ -79,17 +105,42 @@ func (J *JSONIndex) AddToDropQueue(files []string) utils.Promise[int32] {
 	J.m.Lock()
 	defer J.m.Unlock()
 
-	J.dropQueue = append(J.dropQueue, files...)
+	J.addToDropQueue(files)
+	return J.record(&journalRecord{DropQueueAdd: files})
+}
+
+func (J *JSONIndex) RmFromDropQueue(files []string) utils.Promise[int32] {
+	J.m.Lock()
+	defer J.m.Unlock()
+
+	if !J.rmFromDropQueue(files) {
+		return utils.Fulfilled[int32](nil, 0)
+	}
+	return J.record(&journalRecord{DropQueueRm: files})
+}
+
+// record queues the journal record of a change. The promise is fulfilled once the record is written.
+func (J *JSONIndex) record(rec *journalRecord) utils.Promise[int32] {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return utils.Fulfilled[int32](err, 0)
+	}
+	J.pending = append(append(J.pending, data...), '\n')
 	p := utils.New[int32]()
 	J.promises = append(J.promises, p)
 	J.doUpdate()
 	return p
 }
 
-func (J *JSONIndex) RmFromDropQueue(files []string) utils.Promise[int32] {
-	J.m.Lock()
-	defer J.m.Unlock()
+func (J *JSONIndex) addToDropQueue(files []string) {
+	for _, file := range files {
+		if !slices.Contains(J.dropQueue, file) {
+			J.dropQueue = append(J.dropQueue, file)
+		}
+	}
+}
 
+func (J *JSONIndex) rmFromDropQueue(files []string) bool {
 	updated := false
 	for i := len(J.dropQueue) - 1; i >= 0; i-- {
 		for _, file := range files {
@@ -102,22 +153,24 @@ func (J *JSONIndex) RmFromDropQueue(files []string) utils.Promise[int32] {
 			break
 		}
 	}
-
-	if !updated {
-		return utils.Fulfilled[int32](nil, 0)
-	}
-
-	p := utils.New[int32]()
-	J.promises = append(J.promises, p)
-	J.doUpdate()
-	return p
+	return updated
 }
 
 func (J *JSONIndex) GetDropQueue() []string {
 	return J.dropQueue
 }
 
+// populate loads the last checkpoint and replays the journal over it
 func (J *JSONIndex) populate() error {
+	err := J.populateCheckpoint()
+	if err != nil {
+		return err
+	}
+	J.populateHistory()
+	return J.replayJournal()
+}
+
+func (J *JSONIndex) populateCheckpoint() error {
 	if _, err := os.Stat(path.Join(J.idxPath, "metadata.json")); os.IsNotExist(err) {
 		return nil
 	}
@@ -127,6 +180,9 @@ func (J *JSONIndex) populate() error {
 		return err
 	}
 	defer f.Close()
+	J.hasCheckpoint = true
+	// the history of an index without versions starts now
+	J.historyFromTime = time.Now().UnixNano()
 
 	iter := jsoniter.Parse(jsoniter.ConfigDefault, f, 4096)
 	iter.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
@@ -147,7 +203,16 @@ func (J *JSONIndex) populate() error {
 		case "max_time":
 			J.maxTime = iterator.ReadInt64()
 		case "wal_sequence":
-			iterator.Skip()
+			J.walSequence = iterator.ReadUint64()
+		case "version":
+			J.version = iterator.ReadUint64()
+		case "history_from":
+			J.historyFrom = iterator.ReadUint64()
+		case "history_from_time":
+			J.historyFromTime = iterator.ReadInt64()
+		case "history":
+			// the history of the checkpoints written before metadata.history.json
+			iterator.ReadVal(&J.history)
 		case "files":
 			err = J.populateFiles(iterator)
 			if err != nil {
@@ -165,6 +230,43 @@ func (J *JSONIndex) populate() error {
 	return nil
 }
 
+// replayJournal applies the journal records. A torn last record of an interrupted write is truncated.
+func (J *JSONIndex) replayJournal() error {
+	name := path.Join(J.idxPath, journalFile)
+	size, err := readJournal(name, J.apply)
+	if err != nil {
+		return err
+	}
+	J.journaled = size > 0
+	if stat, err := os.Stat(name); err == nil && stat.Size() > size {
+		return os.Truncate(name, size)
+	}
+	return nil
+}
+
+func (J *JSONIndex) apply(rec *journalRecord) error {
+	for _, e := range rec.Add {
+		_marshalled, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		e._marshalled = string(_marshalled)
+		J.lastId = max(J.lastId, e.Id)
+	}
+	J.add(rec.Add)
+	J.walSequence = max(J.walSequence, rec.WALSequence)
+	removed := J.rm(rec.Rm)
+	// the changes already in the checkpoint are replayed without their version
+	if rec.Version > J.version {
+		J.version = rec.Version
+		J.history = append(J.history, newHistoryEntry(rec.Version, rec.Time, rec.Add, removed))
+	}
+	J.pruneHistory(rec.HistoryFrom, rec.HistoryFromTime)
+	J.addToDropQueue(rec.DropQueueAdd)
+	J.rmFromDropQueue(rec.DropQueueRm)
+	return nil
+}
+
 func (J *JSONIndex) populateFiles(iter *jsoniter.Iterator) error {
 	for iter.ReadArray() {
 		e := &jsonIndexEntry{}
@@ -190,14 +292,19 @@ func (J *JSONIndex) Batch(add []*shared.IndexEntry, rm []string) utils.Promise[i
 	J.m.Lock()
 	defer J.m.Unlock()
 	J.add(_add)
+	var walSequence uint64
+	for _, entry := range add {
+		walSequence = max(walSequence, entry.WALSequence)
+	}
+	J.walSequence = max(J.walSequence, walSequence)
 	removed := J.rm(rm)
-	if len(_add) == 0 && !removed {
+	if len(_add) == 0 && len(removed) == 0 {
 		return utils.Fulfilled(nil, int32(0))
 	}
-	p := utils.New[int32]()
-	J.promises = append(J.promises, p)
-	J.doUpdate()
-	return p
+	J.version++
+	now := time.Now().UnixNano()
+	J.history = append(J.history, newHistoryEntry(J.version, now, _add, removed))
+	return J.record(&journalRecord{Add: _add, Rm: rm, WALSequence: walSequence, Version: J.version, Time: now})
 }
 
 func (J *JSONIndex) entry2JEntry(entries []*shared.IndexEntry) ([]*jsonIndexEntry, error) {
@@ -207,11 +314,12 @@ func (J *JSONIndex) entry2JEntry(entries []*shared.IndexEntry) ([]*jsonIndexEntr
 		var (
 			minTime, maxTime int64
 		)
-		if _, ok := entry.Min["__timestamp"]; ok {
-			minTime = entry.Min["__timestamp"].(int64)
+		tsField := J.t.GetTimestampField()
+		if v, ok := entry.Min[tsField].(int64); ok {
+			minTime = v
 		}
-		if _, ok := entry.Max["__timestamp"]; ok {
-			maxTime = entry.Max["__timestamp"].(int64)
+		if v, ok := entry.Max[tsField].(int64); ok {
+			maxTime = v
 		}
 		_entry := &jsonIndexEntry{
 			Id:        id,
@@ -223,6 +331,8 @@ func (J *JSONIndex) entry2JEntry(entries []*shared.IndexEntry) ([]*jsonIndexEntr
 			MaxTime:   maxTime,
 			Range:     "1h",
 			Type:      "compacted",
+			Endpoint:  entry.Endpoint,
+			Columns:   columnStats2JSON(entry),
 		}
 		_marshalled, err := json.Marshal(_entry)
 		if err != nil {
@@ -236,10 +346,17 @@ func (J *JSONIndex) entry2JEntry(entries []*shared.IndexEntry) ([]*jsonIndexEntr
 
 func (J *JSONIndex) add(entries []*jsonIndexEntry) {
 	for _, entry := range entries {
+		// an entry added again replaces the previous one
+		J.rm([]string{entry.Path})
+		empty := true
+		J.entries.Range(func(key, value any) bool {
+			empty = false
+			return false
+		})
 		J.rowCount += entry.RowCount
 		J.parquetSizeBytes += entry.SizeBytes
 		J.entries.Store(entry.Path, entry)
-		if entry.Id == 1 {
+		if empty {
 			J.minTime = entry.MinTime
 			J.maxTime = entry.MaxTime
 			continue
@@ -287,15 +404,16 @@ func (J *JSONIndex) recalcMax() {
 	})
 }
 
-func (J *JSONIndex) rm(path []string) bool {
-	rm := false
+// rm removes the entries of the paths and returns the removed ones
+func (J *JSONIndex) rm(path []string) []*jsonIndexEntry {
+	var res []*jsonIndexEntry
 	for _, entry := range path {
 		e, ok := J.entries.Load(entry)
 		if !ok {
 			continue
 		}
 		_e := e.(*jsonIndexEntry)
-		rm = true
+		res = append(res, _e)
 		J.rowCount -= _e.RowCount
 		J.parquetSizeBytes -= _e.SizeBytes
 		J.entries.Delete(entry)
@@ -306,36 +424,67 @@ func (J *JSONIndex) rm(path []string) bool {
 			J.recalcMax()
 		}
 	}
-	return rm
+	return res
 }
 
-func (J *JSONIndex) flush() {
+// flush writes the pending changes to the journal, or checkpoints the whole index into metadata.json
+// if checkpoint is set or metadata.json doesn't exist yet
+func (J *JSONIndex) flush(checkpoint bool) {
 	J.m.Lock()
 	J.updateCtx, J.doUpdate = context.WithCancel(context.Background())
-	var entries []string
-	dropQueue := J.dropQueue
-	parquetSizeBytes := J.parquetSizeBytes
+	pending := J.pending
+	J.pending = nil
 	promises := J.promises
 	J.promises = nil
+	J.m.Unlock()
+
+	var err error
+	if checkpoint || !J.hasCheckpoint {
+		err = J.checkpoint()
+		if err != nil && len(pending) > 0 {
+			fmt.Printf("Checkpoint of %s failed: %v\n", J.idxPath, err)
+			// the changes are kept in the journal until the next checkpoint
+			err = appendJournal(path.Join(J.idxPath, journalFile), pending)
+			J.journaled = J.journaled || err == nil
+		}
+	} else if len(pending) > 0 {
+		err = appendJournal(path.Join(J.idxPath, journalFile), pending)
+		J.journaled = J.journaled || err == nil
+	}
+	for _, p := range promises {
+		p.Done(0, err)
+	}
+}
+
+// checkpoint rewrites metadata.json with the whole index and truncates the journal
+func (J *JSONIndex) checkpoint() error {
+	J.m.Lock()
+	var entries []string
+	dropQueue := append([]string{}, J.dropQueue...)
+	parquetSizeBytes := J.parquetSizeBytes
 	rowCount := J.rowCount
 	minTime := J.minTime
 	maxTime := J.maxTime
+	walSequence := J.walSequence
+	version, historyFrom, historyFromTime := J.version, J.historyFrom, J.historyFromTime
+	history, err := json.Marshal(J.history)
 	J.entries.Range(func(key, value any) bool {
 		entries = append(entries, value.(*jsonIndexEntry)._marshalled)
 		return true
 	})
 	J.m.Unlock()
-
-	onErr := func(err error) {
-		for _, p := range promises {
-			p.Done(0, err)
-		}
+	if err != nil {
+		return err
+	}
+	// the history is written first, the versions after the version of metadata.json are ignored
+	err = writeHistory(J.idxPath, history)
+	if err != nil {
+		return err
 	}
 
 	f, err := os.Create(path.Join(J.idxPath, "metadata.json.bak"))
 	if err != nil {
-		onErr(err)
-		return
+		return err
 	}
 	defer f.Close()
 
@@ -365,7 +514,19 @@ func (J *JSONIndex) flush() {
 
 	stream.WriteMore()
 	stream.WriteObjectField("wal_sequence")
-	stream.WriteInt64(0)
+	stream.WriteUint64(walSequence)
+
+	stream.WriteMore()
+	stream.WriteObjectField("version")
+	stream.WriteUint64(version)
+
+	stream.WriteMore()
+	stream.WriteObjectField("history_from")
+	stream.WriteUint64(historyFrom)
+
+	stream.WriteMore()
+	stream.WriteObjectField("history_from_time")
+	stream.WriteInt64(historyFromTime)
 
 	stream.WriteMore()
 	stream.WriteObjectField("drop_queue")
@@ -395,42 +556,64 @@ func (J *JSONIndex) flush() {
 	stream.WriteObjectEnd()
 
 	if stream.Error != nil {
-		onErr(stream.Error)
-		return
+		return stream.Error
 	}
 
 	err = stream.Flush()
 	if err != nil {
-		onErr(err)
-		return
+		return err
 	}
 
 	// Rename the backup file to the actual metadata file
 	err = os.Rename(path.Join(J.idxPath, "metadata.json.bak"), path.Join(J.idxPath, "metadata.json"))
 	if err != nil {
-		onErr(err)
-		return
+		return err
 	}
+	J.hasCheckpoint = true
 
-	onErr(nil)
+	// the records of the changes made after the snapshot are still pending and replayed idempotently
+	err = os.Remove(path.Join(J.idxPath, journalFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	J.journaled = false
+	return nil
 }
 
 func (J *JSONIndex) Run() {
+	J.done = make(chan struct{})
 	go func() {
+		defer close(J.done)
+		ticker := time.NewTicker(checkpointInterval())
+		defer ticker.Stop()
 		for {
 			select {
 			case <-J.updateCtx.Done():
-
-				J.flush()
+				J.flush(false)
+			case <-ticker.C:
+				J.expire()
+				if J.journaled {
+					J.flush(true)
+				}
 			case <-J.workCtx.Done():
+				J.m.Lock()
+				dirty := len(J.pending) > 0 || len(J.promises) > 0
+				J.m.Unlock()
+				if dirty || J.journaled {
+					J.flush(true)
+				}
 				return
 			}
 		}
 	}()
 }
 
+// Stop checkpoints the pending changes and stops the index
 func (J *JSONIndex) Stop() {
 	J.stop()
+	if J.done != nil {
+		<-J.done
+	}
 }
 
 func (J *JSONIndex) Get(path string) *shared.IndexEntry {
@@ -438,13 +621,102 @@ func (J *JSONIndex) Get(path string) *shared.IndexEntry {
 	if e == nil {
 		return nil
 	}
-	_e := e.(*jsonIndexEntry)
-	return &shared.IndexEntry{
-		Path:      _e.Path,
-		SizeBytes: _e.SizeBytes,
-		RowCount:  _e.RowCount,
-		ChunkTime: _e.ChunkTime,
-		Min:       map[string]any{"__timestamp": _e.MinTime},
-		Max:       map[string]any{"__timestamp": _e.MaxTime},
+	return J.jEntry2Entry(e.(*jsonIndexEntry))
+}
+
+func (J *JSONIndex) List() []*shared.IndexEntry {
+	var res []*shared.IndexEntry
+	J.entries.Range(func(key, value any) bool {
+		res = append(res, J.jEntry2Entry(value.(*jsonIndexEntry)))
+		return true
+	})
+	return res
+}
+
+func (J *JSONIndex) jEntry2Entry(e *jsonIndexEntry) *shared.IndexEntry {
+	res := &shared.IndexEntry{
+		Path:      e.Path,
+		SizeBytes: e.SizeBytes,
+		RowCount:  e.RowCount,
+		ChunkTime: e.ChunkTime,
+		Min:       map[string]any{},
+		Max:       map[string]any{},
+		Endpoint:  e.Endpoint,
+	}
+	json2ColumnStats(e.Columns, res)
+	res.Min[J.t.GetTimestampField()] = e.MinTime
+	res.Max[J.t.GetTimestampField()] = e.MaxTime
+	return res
+}
+
+// GetWALSequence returns the greatest wal_sequence of the partition indexes and their journals of the table
+func GetWALSequence(tablePath string) (uint64, error) {
+	var res uint64
+	err := filepath.WalkDir(tablePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && d.Name() == journalFile {
+			// a corrupted journal is reported by the recovery, the sequence of its readable records is used
+			readJournal(p, func(rec *journalRecord) error {
+				res = max(res, rec.WALSequence)
+				return nil
+			})
+			return nil
+		}
+		if d.IsDir() || d.Name() != "metadata.json" {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		iter := jsoniter.Parse(jsoniter.ConfigDefault, f, 4096)
+		iter.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
+			if s != "wal_sequence" {
+				iterator.Skip()
+				return true
+			}
+			res = max(res, iterator.ReadUint64())
+			return false
+		})
+		if iter.Error != nil && !errors.Is(iter.Error, io.EOF) {
+			return fmt.Errorf("%s: %w", p, iter.Error)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// ReadPartitionIndex loads the index of the partition folder without running it, to read its files and snapshots.
+// Unlike the index, it leaves a torn last record of the journal in place, as the journal may be written meanwhile.
+func ReadPartitionIndex(t *shared.Table, dir string) (shared.Index, error) {
+	idx := &JSONIndex{
+		t:       t,
+		idxPath: dir,
+		entries: &sync.Map{},
+	}
+	err := idx.populateCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	idx.populateHistory()
+	_, err = readJournal(path.Join(dir, journalFile), idx.apply)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// ReadPartition returns the entries of the metadata.json and the journal of the partition folder
+func ReadPartition(t *shared.Table, dir string) ([]*shared.IndexEntry, error) {
+	idx, err := ReadPartitionIndex(t, dir)
+	if err != nil {
+		return nil, err
 	}
+	return idx.List(), nil
 }
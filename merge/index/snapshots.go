@@ -0,0 +1,321 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"github.com/google/uuid"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The replaced versions are retained at least 30s for the readers listing the files just before a merge
+const (
+	defaultSnapshotRetentionS = 600
+	minSnapshotRetentionS     = 30
+)
+
+// snapshotRetention returns GIGAPI_SNAPSHOT_RETENTION_S: how long the replaced versions of the partitions
+// stay resolvable and their files are kept
+func snapshotRetention() time.Duration {
+	s, err := strconv.Atoi(utils.GetEnv("GIGAPI_SNAPSHOT_RETENTION_S", ""))
+	if err != nil || s < 0 {
+		s = defaultSnapshotRetentionS
+	}
+	return time.Duration(max(s, minSnapshotRetentionS)) * time.Second
+}
+
+// historyEntry is a version of the index: the files it added and the entries it removed
+type historyEntry struct {
+	Version uint64            `json:"version"`
+	Time    int64             `json:"time"`
+	Add     []string          `json:"add,omitempty"`
+	Rm      []*jsonIndexEntry `json:"rm,omitempty"`
+}
+
+func newHistoryEntry(version uint64, time int64, add []*jsonIndexEntry, rm []*jsonIndexEntry) *historyEntry {
+	res := &historyEntry{Version: version, Time: time}
+	for _, e := range add {
+		res.Add = append(res.Add, e.Path)
+	}
+	for _, e := range rm {
+		// the statistics of the columns are not kept
+		_e := *e
+		_e.Columns = nil
+		res.Rm = append(res.Rm, &_e)
+	}
+	return res
+}
+
+// historyFile keeps the retained versions of the partition as of the last checkpoint of metadata.json,
+// the versions after it are in the journal
+const historyFile = "metadata.history.json"
+
+// writeHistory writes the marshalled history into the history file of the partition folder
+func writeHistory(dir string, history []byte) error {
+	name := path.Join(dir, historyFile)
+	err := os.WriteFile(name+".tmp", history, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// populateHistory loads the history of the checkpoint. The versions of the history file
+// not in the checkpoint, e.g. of a previous index of a rebuilt partition, are left out.
+// A lost history can't resolve the versions before the checkpoint anymore.
+func (J *JSONIndex) populateHistory() {
+	data, err := os.ReadFile(path.Join(J.idxPath, historyFile))
+	var history []*historyEntry
+	if err == nil {
+		err = json.Unmarshal(data, &history)
+	}
+	if err == nil {
+		J.history = J.history[:0]
+		for _, h := range history {
+			if h.Version > J.historyFrom && h.Version <= J.version {
+				J.history = append(J.history, h)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Unreadable %s of %s: %v\n", historyFile, J.idxPath, err)
+		J.history = nil
+	}
+	if uint64(len(J.history)) != J.version-J.historyFrom {
+		J.history = nil
+		J.historyFrom, J.historyFromTime = J.version, time.Now().UnixNano()
+	}
+}
+
+// pinsFile keeps the pins of the table in the table folder, so they survive the restarts
+const pinsFile = "pins.json"
+
+type pin struct {
+	At      int64     `json:"at"`
+	Expires time.Time `json:"expires"`
+}
+
+// pins are the pinned times of the tables by table path and pin id
+var pins = struct {
+	sync.Mutex
+	byTable map[string]map[string]pin
+}{byTable: make(map[string]map[string]pin)}
+
+// tablePins returns the pins of the table, loaded from its pins file on first use. pins must be locked.
+func tablePins(tablePath string) map[string]pin {
+	res, ok := pins.byTable[tablePath]
+	if ok {
+		return res
+	}
+	res = make(map[string]pin)
+	data, err := os.ReadFile(filepath.Join(tablePath, pinsFile))
+	if err == nil {
+		err = json.Unmarshal(data, &res)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Unreadable %s of %s: %v\n", pinsFile, tablePath, err)
+		res = make(map[string]pin)
+	}
+	pins.byTable[tablePath] = res
+	return res
+}
+
+// savePins writes the pins of the table into its pins file. pins must be locked.
+func savePins(tablePath string) error {
+	name := filepath.Join(tablePath, pinsFile)
+	if len(pins.byTable[tablePath]) == 0 {
+		err := os.Remove(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(pins.byTable[tablePath])
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(name+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Pin keeps the snapshots of the table at the unix time in ns at resolvable for ttl.
+// It returns the id of the pin and its expiration time.
+func Pin(t *shared.Table, at int64, ttl time.Duration) (string, time.Time, error) {
+	pins.Lock()
+	defer pins.Unlock()
+	id := uuid.NewString()
+	p := pin{At: at, Expires: time.Now().Add(ttl)}
+	tablePins(t.Path)[id] = p
+	err := savePins(t.Path)
+	if err != nil {
+		delete(pins.byTable[t.Path], id)
+		return "", time.Time{}, err
+	}
+	return id, p.Expires, nil
+}
+
+// Unpin releases the pin. It returns false if the pin is unknown or expired.
+func Unpin(t *shared.Table, id string) bool {
+	pins.Lock()
+	defer pins.Unlock()
+	p, ok := tablePins(t.Path)[id]
+	if !ok {
+		return false
+	}
+	delete(pins.byTable[t.Path], id)
+	err := savePins(t.Path)
+	if err != nil {
+		fmt.Printf("Failed to save the pins of %s: %v\n", t.Path, err)
+	}
+	return p.Expires.After(time.Now())
+}
+
+// pinnedSince returns the oldest pinned time of the table
+func pinnedSince(tablePath string) (int64, bool) {
+	pins.Lock()
+	defer pins.Unlock()
+	var (
+		res     int64
+		found   bool
+		expired bool
+	)
+	for id, p := range tablePins(tablePath) {
+		if p.Expires.Before(time.Now()) {
+			delete(pins.byTable[tablePath], id)
+			expired = true
+			continue
+		}
+		if !found || p.At < res {
+			res, found = p.At, true
+		}
+	}
+	if expired {
+		err := savePins(tablePath)
+		if err != nil {
+			fmt.Printf("Failed to save the pins of %s: %v\n", tablePath, err)
+		}
+	}
+	return res, found
+}
+
+// pruneHistory drops the history up to the version, which becomes the oldest resolvable one
+func (J *JSONIndex) pruneHistory(version uint64, time int64) {
+	if version <= J.historyFrom {
+		return
+	}
+	i := 0
+	for i < len(J.history) && J.history[i].Version <= version {
+		i++
+	}
+	J.history = append([]*historyEntry{}, J.history[i:]...)
+	J.historyFrom, J.historyFromTime = version, time
+}
+
+// expire prunes the versions replaced before the retention and the pins,
+// and removes the dropped files no retained version references
+func (J *JSONIndex) expire() {
+	cutoff := time.Now().Add(-snapshotRetention()).UnixNano()
+	if at, ok := pinnedSince(J.t.Path); ok {
+		cutoff = min(cutoff, at)
+	}
+
+	J.m.Lock()
+	rec := &journalRecord{}
+	// a version replaced at the cutoff is not needed to resolve the snapshots after it
+	for _, h := range J.history {
+		if h.Time > cutoff {
+			break
+		}
+		rec.HistoryFrom, rec.HistoryFromTime = h.Version, h.Time
+	}
+	J.pruneHistory(rec.HistoryFrom, rec.HistoryFromTime)
+	referenced := make(map[string]bool)
+	for _, h := range J.history {
+		for _, e := range h.Rm {
+			referenced[e.Path] = true
+		}
+	}
+	var drop []string
+	for _, name := range J.dropQueue {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			continue
+		}
+		if _, indexed := J.entries.Load(abs); !referenced[abs] && !indexed {
+			drop = append(drop, name)
+		}
+	}
+	J.m.Unlock()
+
+	var dropped []string
+	for _, name := range drop {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Failed to remove the dropped file %s: %v\n", name, err)
+			continue
+		}
+		dropped = append(dropped, name)
+	}
+	if rec.HistoryFrom == 0 && len(dropped) == 0 {
+		return
+	}
+	J.m.Lock()
+	defer J.m.Unlock()
+	if J.rmFromDropQueue(dropped) {
+		rec.DropQueueRm = dropped
+	}
+	J.record(rec)
+}
+
+func (J *JSONIndex) Snapshots() []*shared.Snapshot {
+	J.m.Lock()
+	defer J.m.Unlock()
+	res := []*shared.Snapshot{{Version: J.historyFrom, Time: J.historyFromTime}}
+	for _, h := range J.history {
+		s := &shared.Snapshot{Version: h.Version, Time: h.Time, Added: h.Add}
+		for _, e := range h.Rm {
+			s.Removed = append(s.Removed, e.Path)
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func (J *JSONIndex) ResolveSnapshot(version uint64) ([]*shared.IndexEntry, error) {
+	J.m.Lock()
+	defer J.m.Unlock()
+	if version > J.version {
+		return nil, fmt.Errorf("unknown version %d of %s", version, J.idxPath)
+	}
+	if version < J.historyFrom {
+		return nil, fmt.Errorf("%w: version %d of %s", shared.ErrSnapshotExpired, version, J.idxPath)
+	}
+	files := make(map[string]*jsonIndexEntry)
+	J.entries.Range(func(key, value any) bool {
+		files[key.(string)] = value.(*jsonIndexEntry)
+		return true
+	})
+	// the versions after the snapshot are rolled back
+	for i := len(J.history) - 1; i >= 0 && J.history[i].Version > version; i-- {
+		for _, name := range J.history[i].Add {
+			delete(files, name)
+		}
+		for _, e := range J.history[i].Rm {
+			files[e.Path] = e
+		}
+	}
+	res := make([]*shared.IndexEntry, 0, len(files))
+	for _, e := range files {
+		res = append(res, J.jEntry2Entry(e))
+	}
+	return res, nil
+}
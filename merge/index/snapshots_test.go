@@ -0,0 +1,216 @@
+package index
+
+import (
+	"encoding/json"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// resolvedPaths returns the sorted paths of the files of the version
+func resolvedPaths(t *testing.T, idx shared.Index, version uint64) []string {
+	entries, err := idx.ResolveSnapshot(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entryPaths(entries)
+}
+
+func TestResolveSnapshot(t *testing.T) {
+	table := testTable(t)
+	err := os.MkdirAll(testDir(table), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testEntry(table, "a.1.parquet", 2, 1, 2, 1)
+	b := testEntry(table, "b.1.parquet", 3, 3, 5, 2)
+	c := testEntry(table, "c.2.parquet", 5, 1, 5, 2)
+	idx := openTestIndex(t, table)
+	for _, batch := range []struct {
+		add []*shared.IndexEntry
+		rm  []string
+	}{
+		{[]*shared.IndexEntry{a}, nil},
+		{[]*shared.IndexEntry{b}, nil},
+		{[]*shared.IndexEntry{c}, []string{a.Path, b.Path}},
+	} {
+		_, err = idx.Batch(batch.add, batch.rm).Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[uint64][]string{
+		0: nil,
+		1: {a.Path},
+		2: {a.Path, b.Path},
+		3: {c.Path},
+	}
+	check := func(idx shared.Index) {
+		for version, files := range expected {
+			if paths := resolvedPaths(t, idx, version); !slices.Equal(paths, files) {
+				t.Fatalf("version %d: expected the files %v, got %v", version, files, paths)
+			}
+		}
+		if _, err := idx.ResolveSnapshot(4); err == nil {
+			t.Fatal("expected an error for an unknown version")
+		}
+		// the removed entries keep their statistics but the columns
+		entries, _ := idx.ResolveSnapshot(2)
+		for _, e := range entries {
+			if e.RowCount == 0 || e.Min["time"] == int64(0) {
+				t.Fatalf("unexpected rolled back entry %+v", e)
+			}
+		}
+	}
+	check(idx)
+	idx.Stop()
+
+	// the history is kept out of metadata.json and reloaded with it
+	data, err := os.ReadFile(filepath.Join(testDir(table), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md map[string]any
+	err = json.Unmarshal(data, &md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := md["history"]; ok {
+		t.Fatal("expected no history in metadata.json")
+	}
+	idx = openTestIndex(t, table)
+	check(idx)
+	idx.Stop()
+	readIdx, err := ReadPartitionIndex(table, testDir(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readIdx)
+
+	// a lost history only resolves the current version
+	err = os.Remove(filepath.Join(testDir(table), historyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = openTestIndex(t, table)
+	defer idx.Stop()
+	if paths := resolvedPaths(t, idx, 3); !slices.Equal(paths, []string{c.Path}) {
+		t.Fatalf("unexpected files of the current version: %v", paths)
+	}
+	if _, err := idx.ResolveSnapshot(2); err == nil {
+		t.Fatal("expected the versions of the lost history to be expired")
+	}
+}
+
+// ageHistory moves the times of the versions of the index to the times
+func ageHistory(idx shared.Index, times ...time.Time) {
+	J := idx.(*JSONIndex)
+	J.m.Lock()
+	defer J.m.Unlock()
+	for i, h := range J.history {
+		h.Time = times[i].UnixNano()
+	}
+}
+
+func TestExpireKeepsReferencedFiles(t *testing.T) {
+	table := testTable(t)
+	a := writeParquet(t, table, "a.1.parquet", 1, 2)
+	b := writeParquet(t, table, "b.1.parquet", 3)
+	c := writeParquet(t, table, "c.2.parquet", 1, 2, 3)
+	idx := openTestIndex(t, table)
+	defer idx.Stop()
+	_, err := idx.Batch(parquetEntries(t, a, b), nil).Get()
+	if err == nil {
+		_, err = idx.Batch(parquetEntries(t, c), []string{a, b}).Get()
+	}
+	if err == nil {
+		_, err = idx.AddToDropQueue([]string{a, b}).Get()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	J := idx.(*JSONIndex)
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	// the merge is within the retention: its version references the merged files
+	J.expire()
+	if !exists(a) || !exists(b) || len(J.GetDropQueue()) != 2 {
+		t.Fatal("expected the files of the retained version to be kept")
+	}
+
+	// a pin before the merge keeps the version of the merge
+	now := time.Now()
+	ageHistory(idx, now.Add(-3*time.Hour), now.Add(-time.Hour))
+	id, _, err := Pin(table, now.Add(-2*time.Hour).UnixNano(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	J.expire()
+	if !exists(a) || !exists(b) {
+		t.Fatal("expected the files of the pinned version to be kept")
+	}
+	if snapshots := J.Snapshots(); snapshots[0].Version != 1 || len(snapshots) != 2 {
+		t.Fatalf("expected the versions after the pin to be kept, got %+v", snapshots)
+	}
+
+	if !Unpin(table, id) {
+		t.Fatal("expected the pin to be released")
+	}
+	J.expire()
+	if exists(a) || exists(b) || len(J.GetDropQueue()) != 0 {
+		t.Fatal("expected the files of the expired versions to be removed")
+	}
+	if !exists(c) {
+		t.Fatal("expected the indexed file to be kept")
+	}
+	if _, err := J.ResolveSnapshot(1); err == nil {
+		t.Fatal("expected the version 1 to be expired")
+	}
+}
+
+func TestPinsPersisted(t *testing.T) {
+	table := testTable(t)
+	at := time.Now().Add(-time.Hour).UnixNano()
+	id, expires, err := Pin(table, at, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := Pin(table, at-1, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a restart loads the pins from the table folder
+	forgetPins := func() {
+		pins.Lock()
+		delete(pins.byTable, table.Path)
+		pins.Unlock()
+	}
+	forgetPins()
+	since, ok := pinnedSince(table.Path)
+	if !ok || since != at {
+		t.Fatalf("expected the pinned time %d, got %d %v", at, since, ok)
+	}
+	forgetPins()
+	if Unpin(table, expired) {
+		t.Fatal("expected the expired pin to be removed")
+	}
+	pins.Lock()
+	p, ok := tablePins(table.Path)[id]
+	pins.Unlock()
+	if !ok || !p.Expires.Equal(expires) {
+		t.Fatalf("expected the pin %s to expire at %v, got %+v", id, expires, p)
+	}
+	if !Unpin(table, id) {
+		t.Fatal("expected the pin to be released")
+	}
+	if _, err := os.Stat(filepath.Join(table.Path, pinsFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected no pins file without pins: %v", err)
+	}
+}
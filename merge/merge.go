@@ -3,6 +3,7 @@ package merge
 import (
 	"github.com/gigapi/gigapi-config/config"
 	"github.com/gigapi/gigapi/v2/merge/handlers"
+	"github.com/gigapi/gigapi/v2/merge/parsers"
 	"github.com/gigapi/gigapi/v2/merge/repository"
 	"github.com/gigapi/gigapi/v2/merge/utils"
 	"github.com/gigapi/gigapi/v2/modules"
@@ -18,28 +19,32 @@ func Init(api modules.Api) {
 	if err != nil {
 		panic(err)
 	}
-	conn, cancel, err := utils.ConnectDuckDB(config.Config.Gigapi.Root + "/ddb.db")
+	err = initCatalog()
 	if err != nil {
 		panic(err)
 	}
-	defer cancel()
 
-	_, err = conn.Exec("INSTALL json; LOAD json;")
+	err = repository.InitRegistry()
 	if err != nil {
 		panic(err)
 	}
 
-	err = repository.CreateDuckDBTablesTable(conn)
+	InitHandlers(api)
+}
+
+func initCatalog() error {
+	conn, cancel, err := utils.ConnectDuckDB(repository.CatalogPath())
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer cancel()
 
-	err = repository.InitRegistry(conn)
+	_, err = conn.Exec("INSTALL json; LOAD json;")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	InitHandlers(api)
+	return repository.CreateDuckDBTablesTable(conn)
 }
 
 func InitHandlers(api modules.Api) {
@@ -77,6 +82,133 @@ func InitHandlers(api modules.Api) {
 		Methods: []string{"POST"},
 		Handler: handlers.InsertIntoHandler,
 	})
+
+	// Prometheus remote_write endpoint
+	api.RegisterRoute(&modules.Route{
+		Path:    "/api/v1/prom/write",
+		Methods: []string{"POST"},
+		Handler: handlers.PromWriteHandler,
+	})
+
+	// OTLP/HTTP receiver
+	api.RegisterRoute(&modules.Route{
+		Path:    "/v1/metrics",
+		Methods: []string{"POST"},
+		Handler: handlers.OTLPHandler(parsers.OTLPSignalMetrics),
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/v1/logs",
+		Methods: []string{"POST"},
+		Handler: handlers.OTLPHandler(parsers.OTLPSignalLogs),
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/v1/traces",
+		Methods: []string{"POST"},
+		Handler: handlers.OTLPHandler(parsers.OTLPSignalTraces),
+	})
+	// Table definitions
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/create/{db}/{table}",
+		Methods: []string{"POST"},
+		Handler: handlers.CreateTableHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/tables/{db}",
+		Methods: []string{"GET"},
+		Handler: handlers.GetTablesHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/tables/{db}/{table}",
+		Methods: []string{"GET"},
+		Handler: handlers.GetTablesHandler,
+	})
+	// Quarantined batches
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/quarantine/{db}/{table}",
+		Methods: []string{"GET"},
+		Handler: handlers.ListQuarantineHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/quarantine/{db}/{table}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.PurgeQuarantineHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/quarantine/{db}/{table}/{id}",
+		Methods: []string{"GET"},
+		Handler: handlers.InspectQuarantineHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/quarantine/{db}/{table}/{id}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.PurgeQuarantineHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/quarantine/{db}/{table}/{id}/replay",
+		Methods: []string{"POST"},
+		Handler: handlers.ReplayQuarantineHandler,
+	})
+	// Schema registry
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/schema/{db}/{table}",
+		Methods: []string{"GET"},
+		Handler: handlers.GetSchemaHandler,
+	})
+	// Merge planner dry run
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/merge/plan/{db}/{table}",
+		Methods: []string{"GET"},
+		Handler: handlers.GetMergePlanHandler,
+	})
+	// Deletes
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/delete/{db}/{table}",
+		Methods: []string{"POST"},
+		Handler: handlers.DeleteHandler,
+	})
+	// Drops
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/drop/{db}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.DropDatabaseHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/drop/{db}/{table}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.DropTableHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/partitions/{db}/{table}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.DropPartitionsHandler,
+	})
+	// Disk watermarks
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/disk",
+		Methods: []string{"GET"},
+		Handler: handlers.GetDiskStatusHandler,
+	})
+	// Partition snapshots
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/snapshots/{db}/{table}",
+		Methods: []string{"GET"},
+		Handler: handlers.ListSnapshotsHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/snapshots/{db}/{table}/resolve",
+		Methods: []string{"GET"},
+		Handler: handlers.ResolveSnapshotHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/snapshots/{db}/{table}/pin",
+		Methods: []string{"POST"},
+		Handler: handlers.PinSnapshotHandler,
+	})
+	api.RegisterRoute(&modules.Route{
+		Path:    "/gigapi/snapshots/{db}/{table}/pin/{id}",
+		Methods: []string{"DELETE"},
+		Handler: handlers.UnpinSnapshotHandler,
+	})
 	api.RegisterRoute(&modules.Route{
 		Path:    "/health",
 		Methods: []string{"GET"},
@@ -54,6 +54,10 @@ func getSchemaId(fields models.Fields, tags models.Tags) uint64 {
 			tp = 2
 		case float64:
 			tp = 3
+		case bool:
+			tp = 4
+		case uint64:
+			tp = 5
 		}
 		hash := city.CH64(append([]byte(k), tp))
 		determs[0] = determs[0] + hash
@@ -75,6 +79,8 @@ func appendData(data *map[string]any, k string, v any) {
 			(*data)[k] = []float64{v.(float64)}
 		case bool:
 			(*data)[k] = []bool{v.(bool)}
+		case uint64:
+			(*data)[k] = []uint64{v.(uint64)}
 		}
 		return
 	}
@@ -87,6 +93,8 @@ func appendData(data *map[string]any, k string, v any) {
 		(*data)[k] = append((*data)[k].([]float64), v.(float64))
 	case bool:
 		(*data)[k] = append((*data)[k].([]bool), v.(bool))
+	case uint64:
+		(*data)[k] = append((*data)[k].([]uint64), v.(uint64))
 	}
 }
 
@@ -99,6 +107,7 @@ func (l *LineProtoParser) parse(scanner *bufio.Scanner, res chan *ParserResponse
 		table    string
 		schemaId uint64
 		data     map[string]any = make(map[string]any)
+		tags     []string
 	)
 	send := func() {
 		database := ""
@@ -107,8 +116,9 @@ func (l *LineProtoParser) parse(scanner *bufio.Scanner, res chan *ParserResponse
 			database = databaseTable[0]
 			table = databaseTable[1]
 		}
-		res <- &ParserResponse{Database: database, Table: table, Data: data}
+		res <- &ParserResponse{Database: database, Table: table, Data: data, Tags: tags}
 		data = make(map[string]any)
+		tags = nil
 		table = ""
 		schemaId = 0
 	}
@@ -143,6 +153,12 @@ func (l *LineProtoParser) parse(scanner *bufio.Scanner, res chan *ParserResponse
 			if _schemaId != schemaId && schemaId != 0 {
 				send()
 			}
+			if tags == nil {
+				// the points of a batch share the tag keys
+				for _, t := range p.Tags() {
+					tags = append(tags, string(t.Key))
+				}
+			}
 			schemaId = _schemaId
 			for k, v := range fields {
 				appendData(&data, k, v)
@@ -166,6 +182,11 @@ func (l *LineProtoParser) parse(scanner *bufio.Scanner, res chan *ParserResponse
 	}
 }
 
+func init() {
+	// `u`-suffixed unsigned integer fields are rejected by the parser unless enabled
+	models.EnableUintSupport()
+}
+
 var _ = func() int {
 	RegisterParser("", func(fieldNames []string, fieldTypes []string) IParser {
 		return &LineProtoParser{}
@@ -1,6 +1,7 @@
 package parsers
 
 import (
+	"github.com/gigapi/gigapi/v2/merge/data_types"
 	"github.com/influxdata/influxdb/models"
 	"testing"
 )
@@ -52,3 +53,64 @@ func TestGetSchemaId(t *testing.T) {
 			id1, getSchemaId(fields, tags))
 	}
 }
+
+func TestParseFieldTypes(t *testing.T) {
+	res, err := (&LineProtoParser{}).Parse(
+		[]byte("system,host=a up=true,uptime=5u,load=1.5,procs=2i 1700000000000000000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []*ParserResponse
+	for r := range res {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		responses = append(responses, r)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(responses))
+	}
+	expected := map[string]string{
+		"up":     data_types.DATA_TYPE_NAME_BOOL,
+		"uptime": data_types.DATA_TYPE_NAME_UINT64,
+		"load":   data_types.DATA_TYPE_NAME_FLOAT64,
+		"procs":  data_types.DATA_TYPE_NAME_INT64,
+		"host":   data_types.DATA_TYPE_NAME_STRING,
+		"time":   data_types.DATA_TYPE_NAME_INT64,
+	}
+	for name, tp := range expected {
+		col, err := data_types.WrapToColumn(name, responses[0].Data[name])
+		if err != nil {
+			t.Fatalf("column %s: %v", name, err)
+		}
+		if col.GetTypeName() != tp {
+			t.Fatalf("column %s: expected %s, got %s", name, tp, col.GetTypeName())
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	res, err := (&LineProtoParser{}).Parse([]byte(
+		"cpu,host=a,region=eu usage=1 1700000000000000000\n" +
+			"cpu,host=b,region=us usage=2 1700000000000000001\n" +
+			"mem free=3 1700000000000000002\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags [][]string
+	for r := range res {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		tags = append(tags, r.Tags)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(tags))
+	}
+	if len(tags[0]) != 2 || tags[0][0] != "host" || tags[0][1] != "region" {
+		t.Fatalf("expected [host region] tags, got %v", tags[0])
+	}
+	if len(tags[1]) != 0 {
+		t.Fatalf("expected no tags, got %v", tags[1])
+	}
+}
@@ -1,90 +1,291 @@
 package parsers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/go-faster/city"
+	"github.com/go-faster/jx"
 	"io"
+	"time"
+	"unsafe"
 )
 
-type NDJSONParser struct {
-	fields map[string]string
-	lines  map[string]any
+// NDJSONMaxChunkBytes is the amount of input bytes collected before the parsed
+// rows are sent to the storage as a set of ParserResponse chunks.
+var NDJSONMaxChunkBytes = 10 * 1024 * 1024
+
+// NDJSONMaxLineBytes is the longest single line the parser accepts.
+var NDJSONMaxLineBytes = 10 * 1024 * 1024
+
+const (
+	ndjsonKindString byte = iota + 1
+	ndjsonKindNumber
+	ndjsonKindBool
+)
+
+type ndjsonValue struct {
+	kind  byte
+	str   string
+	i64   int64
+	f64   float64
+	isInt bool
+	b     bool
+}
+
+// ndjsonBatch collects the rows sharing the same set of keys and value kinds.
+// Numeric columns start as []int64 and are widened to []float64 once
+// a non-integer value of the key appears.
+type ndjsonBatch struct {
+	data map[string]any
+	size int
 }
 
-var notImplementedErr = fmt.Errorf("not implemented")
+type NDJSONParser struct {
+	table     string
+	precision string
+	batches   map[uint64]*ndjsonBatch
+	order     []uint64
+}
 
 func (N *NDJSONParser) Parse(data []byte) (chan *ParserResponse, error) {
 	return N.ParseReader(nil, bytes.NewReader(data))
 }
 
 func (N *NDJSONParser) ParseReader(ctx context.Context, r io.Reader) (chan *ParserResponse, error) {
-	return nil, notImplementedErr
-	//TODO
-	/*scanner := bufio.NewScanner(r)
-	scanner.Split(bufio.ScanLines)
+	N.precision = "ns"
+	if ctx != nil && ctx.Value("precision") != nil {
+		N.precision = ctx.Value("precision").(string)
+	}
+	if ctx != nil && ctx.Value("table") != nil {
+		N.table = ctx.Value("table").(string)
+	}
+	if N.table == "" {
+		return nil, fmt.Errorf("table name is required for NDJSON input")
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), NDJSONMaxLineBytes)
 	N.resetLines()
 	res := make(chan *ParserResponse)
 	go func() {
 		defer close(res)
 		bytesParsed := 0
-		linesLen := 0
+		lineNo := 0
 		for scanner.Scan() {
-			err := N.parseLine(scanner.Bytes())
+			lineNo++
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			err := N.parseLine(line)
 			if err != nil {
-				res <- &ParserResponse{Error: err}
+				res <- &ParserResponse{Error: fmt.Errorf("line %d: %w", lineNo, err)}
 				return
 			}
-			bytesParsed += len(scanner.Bytes())
-			linesLen++
-			if bytesParsed >= 10*1024*1024 {
-				res <- &ParserResponse{Data: N.lines}
-				N.resetLines()
+			bytesParsed += len(line)
+			if bytesParsed >= NDJSONMaxChunkBytes {
+				N.send(res)
 				bytesParsed = 0
-				linesLen = 0
 			}
 		}
-		if linesLen > 0 {
-			res <- &ParserResponse{Data: N.lines}
-			N.resetLines()
+		if err := scanner.Err(); err != nil {
+			res <- &ParserResponse{Error: err}
+			return
 		}
+		N.send(res)
 	}()
-	return res, nil*/
+	return res, nil
+}
+
+func (N *NDJSONParser) send(res chan *ParserResponse) {
+	for _, id := range N.order {
+		res <- &ParserResponse{Table: N.table, Data: N.batches[id].data}
+	}
+	N.resetLines()
 }
 
 func (N *NDJSONParser) resetLines() {
-	// TODO
-	/*N.lines = make(map[string]any)
-	for k, v := range N.fields {
-		N.lines[k] = data_types.DataTypes[v].MakeStore()
-	}*/
+	N.batches = make(map[uint64]*ndjsonBatch)
+	N.order = nil
 }
 
 func (N *NDJSONParser) parseLine(line []byte) error {
-	// TODO
-	/*d := jx.DecodeBytes(line)
-	return d.Obj(func(d *jx.Decoder, key string) error {
-		tp, ok := N.fields[key]
-		if !ok {
-			return fmt.Errorf("field %s not found", key)
+	row := make(map[string]ndjsonValue)
+	var ts int64
+	hasTs := false
+	d := jx.DecodeBytes(line)
+	err := d.Obj(func(d *jx.Decoder, key string) error {
+		if key == "time" {
+			var err error
+			ts, hasTs, err = N.parseTime(d)
+			if err != nil {
+				return fmt.Errorf("invalid time: %w", err)
+			}
+			return nil
 		}
-		var err error
-		N.lines[key], err = data_types.DataTypes[tp].ParseJson(d, N.lines[key])
+		v, ok, err := parseNDJSONValue(d)
 		if err != nil {
-			return fmt.Errorf("invalid data for field %s: %w", key, err)
+			return fmt.Errorf("invalid value of %q: %w", key, err)
+		}
+		if ok {
+			row[key] = v
+		} else {
+			delete(row, key)
 		}
 		return nil
-	})*/
-	return notImplementedErr
+	})
+	if err != nil {
+		return err
+	}
+	if !hasTs {
+		ts = time.Now().UnixNano()
+	}
+
+	id := getNDJSONSchemaId(row)
+	batch, ok := N.batches[id]
+	if !ok {
+		batch = &ndjsonBatch{data: map[string]any{"time": []int64{}}}
+		N.batches[id] = batch
+		N.order = append(N.order, id)
+	}
+	for k, v := range row {
+		batch.append(k, v)
+	}
+	batch.data["time"] = append(batch.data["time"].([]int64), ts)
+	batch.size++
+	return nil
 }
 
-var _ = func() int {
-	/*RegisterParser("application/x-ndjson", func(fieldNames []string, fieldTypes []string) IParser {
-		fields := make(map[string]string)
-		for i, name := range fieldNames {
-			fields[name] = fieldTypes[i]
+func (N *NDJSONParser) parseTime(d *jx.Decoder) (int64, bool, error) {
+	switch d.Next() {
+	case jx.Null:
+		return 0, false, d.Null()
+	case jx.String:
+		s, err := d.Str()
+		if err != nil {
+			return 0, false, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, false, err
+		}
+		return t.UnixNano(), true, nil
+	case jx.Number:
+		n, err := d.Num()
+		if err != nil {
+			return 0, false, err
+		}
+		mul, err := precisionMultiplier(N.precision)
+		if err != nil {
+			return 0, false, err
 		}
-		return &NDJSONParser{fields: fields}
-	})*/
+		if n.IsInt() {
+			i, err := n.Int64()
+			return i * mul, true, err
+		}
+		f, err := n.Float64()
+		return int64(f * float64(mul)), true, err
+	}
+	return 0, false, fmt.Errorf("unexpected %s", d.Next())
+}
+
+func parseNDJSONValue(d *jx.Decoder) (ndjsonValue, bool, error) {
+	switch d.Next() {
+	case jx.Null:
+		return ndjsonValue{}, false, d.Null()
+	case jx.String:
+		s, err := d.Str()
+		return ndjsonValue{kind: ndjsonKindString, str: s}, true, err
+	case jx.Bool:
+		b, err := d.Bool()
+		return ndjsonValue{kind: ndjsonKindBool, b: b}, true, err
+	case jx.Number:
+		n, err := d.Num()
+		if err != nil {
+			return ndjsonValue{}, false, err
+		}
+		if n.IsInt() {
+			if i, err := n.Int64(); err == nil {
+				return ndjsonValue{kind: ndjsonKindNumber, i64: i, isInt: true}, true, nil
+			}
+		}
+		f, err := n.Float64()
+		return ndjsonValue{kind: ndjsonKindNumber, f64: f}, true, err
+	}
+	// Objects and arrays are kept as their raw JSON representation
+	raw, err := d.Raw()
+	return ndjsonValue{kind: ndjsonKindString, str: raw.String()}, true, err
+}
+
+func (b *ndjsonBatch) append(k string, v ndjsonValue) {
+	col, ok := b.data[k]
+	switch v.kind {
+	case ndjsonKindString:
+		if !ok {
+			col = []string{}
+		}
+		b.data[k] = append(col.([]string), v.str)
+	case ndjsonKindBool:
+		if !ok {
+			col = []bool{}
+		}
+		b.data[k] = append(col.([]bool), v.b)
+	case ndjsonKindNumber:
+		if !ok {
+			col = []int64{}
+		}
+		if ints, ok := col.([]int64); ok && v.isInt {
+			b.data[k] = append(ints, v.i64)
+			return
+		}
+		if ints, ok := col.([]int64); ok {
+			floats := make([]float64, len(ints), b.size+1)
+			for i, val := range ints {
+				floats[i] = float64(val)
+			}
+			col = floats
+		}
+		if v.isInt {
+			v.f64 = float64(v.i64)
+		}
+		b.data[k] = append(col.([]float64), v.f64)
+	}
+}
+
+func getNDJSONSchemaId(row map[string]ndjsonValue) uint64 {
+	determs := []uint64{0, 0, 1}
+	for k, v := range row {
+		hash := city.CH64(append([]byte(k), v.kind))
+		determs[0] = determs[0] + hash
+		determs[1] = determs[1] ^ hash
+		determs[2] = determs[2] * (1779033703 + 2*hash)
+	}
+	return city.CH64(unsafe.Slice((*byte)(unsafe.Pointer(&determs[0])), 24))
+}
+
+func precisionMultiplier(precision string) (int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return 1, nil
+	case "u", "us":
+		return int64(time.Microsecond), nil
+	case "ms":
+		return int64(time.Millisecond), nil
+	case "s":
+		return int64(time.Second), nil
+	case "m":
+		return int64(time.Minute), nil
+	case "h":
+		return int64(time.Hour), nil
+	}
+	return 0, fmt.Errorf("unsupported precision %q", precision)
+}
+
+var _ = func() int {
+	RegisterParser("application/x-ndjson", func(fieldNames []string, fieldTypes []string) IParser {
+		return &NDJSONParser{}
+	})
 	return 0
 }()
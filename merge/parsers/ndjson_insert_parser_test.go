@@ -0,0 +1,65 @@
+package parsers
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONParser(t *testing.T) {
+	input := `{"time": 1700000000000000000, "host": "a", "value": 1}
+{"time": "2023-11-14T22:13:20Z", "host": "b", "value": 1.5}
+
+{"host": "c", "msg": {"level": "info"}, "ok": true}
+`
+	parser, err := GetParser("application/x-ndjson; charset=utf-8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), "table", "logs")
+	res, err := parser.ParseReader(ctx, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []*ParserResponse
+	for r := range res {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		responses = append(responses, r)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(responses))
+	}
+
+	first := responses[0]
+	if first.Table != "logs" {
+		t.Fatalf("expected table logs, got %q", first.Table)
+	}
+	values, ok := first.Data["value"].([]float64)
+	if !ok || len(values) != 2 || values[0] != 1 || values[1] != 1.5 {
+		t.Fatalf("expected value to be widened to float64, got %#v", first.Data["value"])
+	}
+	times := first.Data["time"].([]int64)
+	if times[0] != 1700000000000000000 || times[1] != 1700000000000000000 {
+		t.Fatalf("unexpected time column %v", times)
+	}
+
+	second := responses[1]
+	if msg := second.Data["msg"].([]string); msg[0] != `{"level": "info"}` {
+		t.Fatalf("expected raw json object, got %q", msg[0])
+	}
+	if ok := second.Data["ok"].([]bool); !ok[0] {
+		t.Fatalf("expected bool column")
+	}
+	if len(second.Data["time"].([]int64)) != 1 {
+		t.Fatalf("expected auto-filled time column")
+	}
+}
+
+func TestNDJSONParserRequiresTable(t *testing.T) {
+	_, err := (&NDJSONParser{}).Parse([]byte(`{"a": 1}`))
+	if err == nil {
+		t.Fatal("expected error for missing table name")
+	}
+}
@@ -0,0 +1,614 @@
+package parsers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-faster/city"
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	OTLPSignalMetrics = "metrics"
+	OTLPSignalLogs    = "logs"
+	OTLPSignalTraces  = "traces"
+)
+
+// Tables written by the OTLP receiver. The schemas are documented in README.md
+const (
+	OTLPLogsTable                = "otel_logs"
+	OTLPTracesTable              = "otel_traces"
+	OTLPMetricsGaugeTable        = "otel_metrics_gauge"
+	OTLPMetricsSumTable          = "otel_metrics_sum"
+	OTLPMetricsHistogramTable    = "otel_metrics_histogram"
+	OTLPMetricsExpHistogramTable = "otel_metrics_exponential_histogram"
+	OTLPMetricsSummaryTable      = "otel_metrics_summary"
+)
+
+// prefixes of the attribute columns
+const (
+	otlpResourceAttrPrefix = "resource_attr_"
+	otlpScopeAttrPrefix    = "scope_attr_"
+	otlpAttrPrefix         = "attr_"
+)
+
+// OTLPParser decodes OTLP/HTTP export requests of one signal type
+// encoded either as protobuf or as JSON
+type OTLPParser struct {
+	Signal string
+	JSON   bool
+}
+
+func (o *OTLPParser) ParseReader(ctx context.Context, r io.Reader) (chan *ParserResponse, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return o.Parse(buf.Bytes())
+}
+
+func (o *OTLPParser) Parse(data []byte) (chan *ParserResponse, error) {
+	batches := newRowBatches()
+	switch o.Signal {
+	case OTLPSignalLogs:
+		req := &collectorlogs.ExportLogsServiceRequest{}
+		err := o.unmarshal(data, req)
+		if err != nil {
+			return nil, err
+		}
+		otlpLogsToRows(req, batches)
+	case OTLPSignalTraces:
+		req := &collectortrace.ExportTraceServiceRequest{}
+		err := o.unmarshal(data, req)
+		if err != nil {
+			return nil, err
+		}
+		otlpTracesToRows(req, batches)
+	case OTLPSignalMetrics:
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		err := o.unmarshal(data, req)
+		if err != nil {
+			return nil, err
+		}
+		otlpMetricsToRows(req, batches)
+	default:
+		return nil, fmt.Errorf("unknown OTLP signal %q", o.Signal)
+	}
+	return batches.send(), nil
+}
+
+func (o *OTLPParser) unmarshal(data []byte, msg proto.Message) error {
+	if !o.JSON {
+		err := proto.Unmarshal(data, msg)
+		if err != nil {
+			return fmt.Errorf("invalid OTLP protobuf payload: %w", err)
+		}
+		return nil
+	}
+	data, err := otlpJSONHexIdsToBase64(data)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP JSON payload: %w", err)
+	}
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP JSON payload: %w", err)
+	}
+	return nil
+}
+
+var otlpHexIdFields = map[string]bool{"traceId": true, "spanId": true, "parentSpanId": true}
+
+// otlpJSONHexIdsToBase64 converts the trace and span ids of OTLP/JSON from hex
+// (as the OTLP spec requires) to base64 (as the protobuf JSON mapping expects)
+func otlpJSONHexIdsToBase64(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch _v := v.(type) {
+		case map[string]any:
+			for k, val := range _v {
+				if s, ok := val.(string); ok && otlpHexIdFields[k] {
+					if b, err := hex.DecodeString(s); err == nil {
+						_v[k] = base64.StdEncoding.EncodeToString(b)
+					}
+					continue
+				}
+				walk(val)
+			}
+		case []any:
+			for _, val := range _v {
+				walk(val)
+			}
+		}
+	}
+	walk(doc)
+	return json.Marshal(doc)
+}
+
+type otlpRowBase map[string]any
+
+// newOTLPRowBase creates the columns of the resource and the instrumentation scope
+func newOTLPRowBase(res *resourcev1.Resource, scope *commonv1.InstrumentationScope) otlpRowBase {
+	row := otlpRowBase{}
+	if res != nil {
+		row.addAttributes(otlpResourceAttrPrefix, res.GetAttributes())
+	}
+	row["scope_name"] = scope.GetName()
+	row["scope_version"] = scope.GetVersion()
+	if scope != nil {
+		row.addAttributes(otlpScopeAttrPrefix, scope.GetAttributes())
+	}
+	return row
+}
+
+func (r otlpRowBase) addAttributes(prefix string, attrs []*commonv1.KeyValue) {
+	for _, attr := range attrs {
+		val := otlpAttrValue(attr.GetValue())
+		if val == nil {
+			continue
+		}
+		r[prefix+otlpColumnName(attr.GetKey())] = val
+	}
+}
+
+func (r otlpRowBase) copy(size int) otlpRowBase {
+	res := make(otlpRowBase, len(r)+size)
+	for k, v := range r {
+		res[k] = v
+	}
+	return res
+}
+
+var otlpColumnNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func otlpColumnName(key string) string {
+	return otlpColumnNameRe.ReplaceAllString(key, "_")
+}
+
+// otlpAttrValue converts an attribute to a column value.
+// Byte arrays are base64 encoded, arrays and maps are stored as JSON strings.
+func otlpAttrValue(v *commonv1.AnyValue) any {
+	switch _v := v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		return _v.StringValue
+	case *commonv1.AnyValue_BoolValue:
+		return _v.BoolValue
+	case *commonv1.AnyValue_IntValue:
+		return _v.IntValue
+	case *commonv1.AnyValue_DoubleValue:
+		return _v.DoubleValue
+	case *commonv1.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(_v.BytesValue)
+	case *commonv1.AnyValue_ArrayValue, *commonv1.AnyValue_KvlistValue:
+		return otlpToJSON(otlpAnyValueToNative(v))
+	}
+	return nil
+}
+
+func otlpAnyValueToNative(v *commonv1.AnyValue) any {
+	switch _v := v.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		return _v.StringValue
+	case *commonv1.AnyValue_BoolValue:
+		return _v.BoolValue
+	case *commonv1.AnyValue_IntValue:
+		return _v.IntValue
+	case *commonv1.AnyValue_DoubleValue:
+		return otlpJSONFloat(_v.DoubleValue)
+	case *commonv1.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(_v.BytesValue)
+	case *commonv1.AnyValue_ArrayValue:
+		res := make([]any, len(_v.ArrayValue.GetValues()))
+		for i, val := range _v.ArrayValue.GetValues() {
+			res[i] = otlpAnyValueToNative(val)
+		}
+		return res
+	case *commonv1.AnyValue_KvlistValue:
+		res := make(map[string]any, len(_v.KvlistValue.GetValues()))
+		for _, kv := range _v.KvlistValue.GetValues() {
+			res[kv.GetKey()] = otlpAnyValueToNative(kv.GetValue())
+		}
+		return res
+	}
+	return nil
+}
+
+func otlpAttributesToNative(attrs []*commonv1.KeyValue) map[string]any {
+	res := make(map[string]any, len(attrs))
+	for _, kv := range attrs {
+		res[kv.GetKey()] = otlpAnyValueToNative(kv.GetValue())
+	}
+	return res
+}
+
+// otlpJSONFloat returns nil for the values JSON can't represent
+func otlpJSONFloat(f float64) any {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil
+	}
+	return f
+}
+
+func otlpToJSON(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+func otlpTime(ts ...uint64) int64 {
+	for _, t := range ts {
+		if t != 0 {
+			return int64(t)
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+func otlpLogsToRows(req *collectorlogs.ExportLogsServiceRequest, batches *rowBatches) {
+	for _, rl := range req.GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			base := newOTLPRowBase(rl.GetResource(), sl.GetScope())
+			for _, l := range sl.GetLogRecords() {
+				row := base.copy(len(l.GetAttributes()) + 10)
+				row["time"] = otlpTime(l.GetTimeUnixNano(), l.GetObservedTimeUnixNano())
+				row["observed_time"] = otlpTime(l.GetObservedTimeUnixNano(), l.GetTimeUnixNano())
+				row["severity_number"] = int64(l.GetSeverityNumber())
+				row["severity_text"] = l.GetSeverityText()
+				row["body"] = otlpLogBody(l.GetBody())
+				row["trace_id"] = hex.EncodeToString(l.GetTraceId())
+				row["span_id"] = hex.EncodeToString(l.GetSpanId())
+				row["flags"] = int64(l.GetFlags())
+				row["event_name"] = l.GetEventName()
+				row.addAttributes(otlpAttrPrefix, l.GetAttributes())
+				batches.add(OTLPLogsTable, row)
+			}
+		}
+	}
+}
+
+func otlpLogBody(v *commonv1.AnyValue) string {
+	if s, ok := v.GetValue().(*commonv1.AnyValue_StringValue); ok {
+		return s.StringValue
+	}
+	if v.GetValue() == nil {
+		return ""
+	}
+	return otlpToJSON(otlpAnyValueToNative(v))
+}
+
+func otlpSpanKind(kind tracev1.Span_SpanKind) string {
+	return strings.ToLower(strings.TrimPrefix(kind.String(), "SPAN_KIND_"))
+}
+
+func otlpStatusCode(code tracev1.Status_StatusCode) string {
+	return strings.ToLower(strings.TrimPrefix(code.String(), "STATUS_CODE_"))
+}
+
+func otlpTracesToRows(req *collectortrace.ExportTraceServiceRequest, batches *rowBatches) {
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			base := newOTLPRowBase(rs.GetResource(), ss.GetScope())
+			for _, s := range ss.GetSpans() {
+				row := base.copy(len(s.GetAttributes()) + 16)
+				start := otlpTime(s.GetStartTimeUnixNano())
+				end := otlpTime(s.GetEndTimeUnixNano(), s.GetStartTimeUnixNano())
+				row["time"] = start
+				row["end_time"] = end
+				row["duration_ns"] = end - start
+				row["trace_id"] = hex.EncodeToString(s.GetTraceId())
+				row["span_id"] = hex.EncodeToString(s.GetSpanId())
+				row["parent_span_id"] = hex.EncodeToString(s.GetParentSpanId())
+				row["trace_state"] = s.GetTraceState()
+				row["flags"] = int64(s.GetFlags())
+				row["name"] = s.GetName()
+				row["kind"] = otlpSpanKind(s.GetKind())
+				row["status_code"] = otlpStatusCode(s.GetStatus().GetCode())
+				row["status_message"] = s.GetStatus().GetMessage()
+				row["events"] = otlpSpanEvents(s.GetEvents())
+				row["links"] = otlpSpanLinks(s.GetLinks())
+				row.addAttributes(otlpAttrPrefix, s.GetAttributes())
+				batches.add(OTLPTracesTable, row)
+			}
+		}
+	}
+}
+
+func otlpSpanEvents(events []*tracev1.Span_Event) string {
+	res := make([]map[string]any, len(events))
+	for i, e := range events {
+		res[i] = map[string]any{
+			"time":       int64(e.GetTimeUnixNano()),
+			"name":       e.GetName(),
+			"attributes": otlpAttributesToNative(e.GetAttributes()),
+		}
+	}
+	return otlpToJSON(res)
+}
+
+func otlpSpanLinks(links []*tracev1.Span_Link) string {
+	res := make([]map[string]any, len(links))
+	for i, l := range links {
+		res[i] = map[string]any{
+			"trace_id":    hex.EncodeToString(l.GetTraceId()),
+			"span_id":     hex.EncodeToString(l.GetSpanId()),
+			"trace_state": l.GetTraceState(),
+			"attributes":  otlpAttributesToNative(l.GetAttributes()),
+		}
+	}
+	return otlpToJSON(res)
+}
+
+func otlpTemporality(t metricsv1.AggregationTemporality) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "AGGREGATION_TEMPORALITY_"))
+}
+
+func otlpMetricsToRows(req *collectormetrics.ExportMetricsServiceRequest, batches *rowBatches) {
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			base := newOTLPRowBase(rm.GetResource(), sm.GetScope())
+			for _, m := range sm.GetMetrics() {
+				metricBase := base.copy(3)
+				metricBase["metric_name"] = m.GetName()
+				metricBase["metric_description"] = m.GetDescription()
+				metricBase["metric_unit"] = m.GetUnit()
+				otlpMetricToRows(m, metricBase, batches)
+			}
+		}
+	}
+}
+
+func otlpPointRow(base otlpRowBase, attrs []*commonv1.KeyValue, ts, startTs uint64, flags uint32,
+	exemplars []*metricsv1.Exemplar) otlpRowBase {
+	row := base.copy(len(attrs) + 16)
+	row["time"] = otlpTime(ts, startTs)
+	row["start_time"] = int64(startTs)
+	row["flags"] = int64(flags)
+	if len(exemplars) > 0 {
+		row["exemplars"] = otlpExemplars(exemplars)
+	}
+	row.addAttributes(otlpAttrPrefix, attrs)
+	return row
+}
+
+func otlpMetricToRows(m *metricsv1.Metric, base otlpRowBase, batches *rowBatches) {
+	switch data := m.GetData().(type) {
+	case *metricsv1.Metric_Gauge:
+		for _, p := range data.Gauge.GetDataPoints() {
+			row := otlpPointRow(base, p.GetAttributes(), p.GetTimeUnixNano(), p.GetStartTimeUnixNano(),
+				p.GetFlags(), p.GetExemplars())
+			row["value"] = otlpNumberValue(p)
+			batches.add(OTLPMetricsGaugeTable, row)
+		}
+	case *metricsv1.Metric_Sum:
+		for _, p := range data.Sum.GetDataPoints() {
+			row := otlpPointRow(base, p.GetAttributes(), p.GetTimeUnixNano(), p.GetStartTimeUnixNano(),
+				p.GetFlags(), p.GetExemplars())
+			row["value"] = otlpNumberValue(p)
+			row["aggregation_temporality"] = otlpTemporality(data.Sum.GetAggregationTemporality())
+			row["is_monotonic"] = data.Sum.GetIsMonotonic()
+			batches.add(OTLPMetricsSumTable, row)
+		}
+	case *metricsv1.Metric_Histogram:
+		for _, p := range data.Histogram.GetDataPoints() {
+			row := otlpPointRow(base, p.GetAttributes(), p.GetTimeUnixNano(), p.GetStartTimeUnixNano(),
+				p.GetFlags(), p.GetExemplars())
+			row["aggregation_temporality"] = otlpTemporality(data.Histogram.GetAggregationTemporality())
+			row["count"] = p.GetCount()
+			otlpOptionalFloats(row, p.Sum, p.Min, p.Max)
+			row["buckets"] = otlpExplicitBuckets(p.GetExplicitBounds(), p.GetBucketCounts())
+			batches.add(OTLPMetricsHistogramTable, row)
+		}
+	case *metricsv1.Metric_ExponentialHistogram:
+		for _, p := range data.ExponentialHistogram.GetDataPoints() {
+			row := otlpPointRow(base, p.GetAttributes(), p.GetTimeUnixNano(), p.GetStartTimeUnixNano(),
+				p.GetFlags(), p.GetExemplars())
+			row["aggregation_temporality"] = otlpTemporality(data.ExponentialHistogram.GetAggregationTemporality())
+			row["count"] = p.GetCount()
+			otlpOptionalFloats(row, p.Sum, p.Min, p.Max)
+			row["scale"] = int64(p.GetScale())
+			row["zero_count"] = p.GetZeroCount()
+			row["zero_threshold"] = p.GetZeroThreshold()
+			row["positive_buckets"] = otlpExponentialBuckets(p.GetScale(), p.GetPositive(), false)
+			row["negative_buckets"] = otlpExponentialBuckets(p.GetScale(), p.GetNegative(), true)
+			batches.add(OTLPMetricsExpHistogramTable, row)
+		}
+	case *metricsv1.Metric_Summary:
+		for _, p := range data.Summary.GetDataPoints() {
+			row := otlpPointRow(base, p.GetAttributes(), p.GetTimeUnixNano(), p.GetStartTimeUnixNano(),
+				p.GetFlags(), nil)
+			row["count"] = p.GetCount()
+			row["sum"] = p.GetSum()
+			quantiles := make([]map[string]any, len(p.GetQuantileValues()))
+			for i, q := range p.GetQuantileValues() {
+				quantiles[i] = map[string]any{
+					"quantile": otlpJSONFloat(q.GetQuantile()),
+					"value":    otlpJSONFloat(q.GetValue()),
+				}
+			}
+			row["quantiles"] = otlpToJSON(quantiles)
+			batches.add(OTLPMetricsSummaryTable, row)
+		}
+	}
+}
+
+func otlpNumberValue(p *metricsv1.NumberDataPoint) float64 {
+	if v, ok := p.GetValue().(*metricsv1.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return p.GetAsDouble()
+}
+
+func otlpOptionalFloats(row otlpRowBase, sum, _min, _max *float64) {
+	for name, v := range map[string]*float64{"sum": sum, "min": _min, "max": _max} {
+		if v != nil {
+			row[name] = *v
+		}
+	}
+}
+
+func otlpExemplars(exemplars []*metricsv1.Exemplar) string {
+	res := make([]map[string]any, len(exemplars))
+	for i, e := range exemplars {
+		var val any = otlpJSONFloat(e.GetAsDouble())
+		if v, ok := e.GetValue().(*metricsv1.Exemplar_AsInt); ok {
+			val = v.AsInt
+		}
+		res[i] = map[string]any{
+			"time":       int64(e.GetTimeUnixNano()),
+			"value":      val,
+			"trace_id":   hex.EncodeToString(e.GetTraceId()),
+			"span_id":    hex.EncodeToString(e.GetSpanId()),
+			"attributes": otlpAttributesToNative(e.GetFilteredAttributes()),
+		}
+	}
+	return otlpToJSON(res)
+}
+
+func otlpWriteBucket(buf *strings.Builder, lower, upper float64, count uint64) {
+	writeFloat := func(f float64) {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			buf.WriteString("null")
+			return
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	buf.WriteString(`{"lower":`)
+	writeFloat(lower)
+	buf.WriteString(`,"upper":`)
+	writeFloat(upper)
+	buf.WriteString(`,"count":`)
+	buf.WriteString(strconv.FormatUint(count, 10))
+	buf.WriteByte('}')
+}
+
+// otlpExplicitBuckets encodes the buckets in the same format
+// as the Prometheus native histograms: [{"lower": .., "upper": .., "count": ..}]
+func otlpExplicitBuckets(bounds []float64, counts []uint64) string {
+	var buf strings.Builder
+	buf.WriteByte('[')
+	for i, c := range counts {
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if i > 0 && i-1 < len(bounds) {
+			lower = bounds[i-1]
+		}
+		if i < len(bounds) {
+			upper = bounds[i]
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		otlpWriteBucket(&buf, lower, upper, c)
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+func otlpExponentialBuckets(scale int32, buckets *metricsv1.ExponentialHistogramDataPoint_Buckets,
+	negative bool) string {
+	var buf strings.Builder
+	buf.WriteByte('[')
+	for i, c := range buckets.GetBucketCounts() {
+		// OTLP bucket i covers (base^i, base^(i+1)], Prometheus bucket i covers (base^(i-1), base^i]
+		lower, upper := promBucketBounds(scale, nil, buckets.GetOffset()+int32(i)+1)
+		if negative {
+			lower, upper = -upper, -lower
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		otlpWriteBucket(&buf, lower, upper, c)
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+type rowBatch struct {
+	table string
+	data  map[string]any
+}
+
+// rowBatches converts rows into columns. Rows of the same table with the same
+// set of columns and types are collected together, so no batch has gaps.
+type rowBatches struct {
+	batches map[uint64]*rowBatch
+	order   []uint64
+}
+
+func newRowBatches() *rowBatches {
+	return &rowBatches{batches: make(map[uint64]*rowBatch)}
+}
+
+func (r *rowBatches) add(table string, row map[string]any) {
+	id := getRowSchemaId(table, row)
+	b, ok := r.batches[id]
+	if !ok {
+		b = &rowBatch{table: table, data: make(map[string]any, len(row))}
+		r.batches[id] = b
+		r.order = append(r.order, id)
+	}
+	for k, v := range row {
+		appendData(&b.data, k, v)
+	}
+}
+
+func (r *rowBatches) send() chan *ParserResponse {
+	res := make(chan *ParserResponse)
+	go func() {
+		defer close(res)
+		for _, id := range r.order {
+			res <- &ParserResponse{Table: r.batches[id].table, Data: r.batches[id].data}
+		}
+	}()
+	return res
+}
+
+func getRowSchemaId(table string, row map[string]any) uint64 {
+	determs := []uint64{city.CH64([]byte(table)), 0, 1}
+	for k, v := range row {
+		var tp byte
+		switch v.(type) {
+		case string:
+			tp = 1
+		case int64:
+			tp = 2
+		case float64:
+			tp = 3
+		case bool:
+			tp = 4
+		case uint64:
+			tp = 5
+		}
+		hash := city.CH64(append([]byte(k), tp))
+		determs[0] = determs[0] + hash
+		determs[1] = determs[1] ^ hash
+		determs[2] = determs[2] * (1779033703 + 2*hash)
+	}
+	return city.CH64(unsafe.Slice((*byte)(unsafe.Pointer(&determs[0])), 24))
+}
@@ -0,0 +1,46 @@
+package parsers
+
+import (
+	"testing"
+)
+
+func TestOTLPLogsJSON(t *testing.T) {
+	input := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+"scopeLogs":[{"scope":{"name":"lib","version":"1.0"},"logRecords":[
+{"timeUnixNano":"1700000000000000000","severityNumber":9,"severityText":"INFO",
+"body":{"stringValue":"hello"},"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174",
+"attributes":[{"key":"http.status","value":{"intValue":"200"}}]}]}]}]}`
+	res, err := (&OTLPParser{Signal: OTLPSignalLogs, JSON: true}).Parse([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []*ParserResponse
+	for r := range res {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		responses = append(responses, r)
+	}
+	if len(responses) != 1 || responses[0].Table != OTLPLogsTable {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+	data := responses[0].Data
+	if v := data["resource_attr_service_name"].([]string); v[0] != "api" {
+		t.Fatalf("unexpected resource attribute %v", v)
+	}
+	if v := data["attr_http_status"].([]int64); v[0] != 200 {
+		t.Fatalf("unexpected attribute %v", v)
+	}
+	if v := data["body"].([]string); v[0] != "hello" {
+		t.Fatalf("unexpected body %v", v)
+	}
+	if v := data["time"].([]int64); v[0] != 1700000000000000000 {
+		t.Fatalf("unexpected time %v", v)
+	}
+	if v := data["scope_name"].([]string); v[0] != "lib" {
+		t.Fatalf("unexpected scope %v", v)
+	}
+	if v := data["trace_id"].([]string); v[0] != "5b8efff798038103d269b633813fc60c" {
+		t.Fatalf("unexpected trace id %v", v)
+	}
+}
@@ -20,19 +20,30 @@ type ParserResponse struct {
 	Database string
 	Table    string
 	Data     map[string]any
-	Error    error
+	// Tags are the names of the columns parsed from tags or labels
+	Tags  []string
+	Error error
 }
 
 func RegisterParser(name string, parser ParserFactory) {
 	registry[name] = parser
 }
 
+// GetParser returns the parser registered for the longest prefix of the content type
 func GetParser(name string, fieldNames []string, fieldTypes []string) (IParser, error) {
+	var (
+		found  ParserFactory
+		prefix string
+	)
 	for _name, parser := range registry {
-		if strings.HasPrefix(name, _name) {
-			return parser(fieldNames, fieldTypes), nil
+		if _name != "" && strings.HasPrefix(name, _name) && len(_name) > len(prefix) {
+			found = parser
+			prefix = _name
 		}
 	}
+	if found != nil {
+		return found(fieldNames, fieldTypes), nil
+	}
 	if parser, ok := registry[""]; ok {
 		return parser(fieldNames, fieldTypes), nil
 	}
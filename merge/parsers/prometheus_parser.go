@@ -0,0 +1,546 @@
+package parsers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PromRemoteWriteParser decodes the (already decompressed) protobuf payload of
+// the Prometheus remote_write protocol v1.
+//
+// Every metric name becomes a table with a string column per label and
+// the `value` and `time` columns.
+// Native histograms go to the `<metric>_histogram` table and exemplars
+// to the `<metric>_exemplars` table.
+type PromRemoteWriteParser struct {
+}
+
+const (
+	promHistogramSuffix = "_histogram"
+	promExemplarsSuffix = "_exemplars"
+	promExemplarPrefix  = "exemplar_"
+	promLabelPrefix     = "label_"
+)
+
+// columns generated by the parser. Labels with the same names are prefixed with `label_`
+var promReservedColumns = map[string]bool{
+	"time":             true,
+	"value":            true,
+	"count":            true,
+	"sum":              true,
+	"schema":           true,
+	"zero_threshold":   true,
+	"zero_count":       true,
+	"reset_hint":       true,
+	"positive_buckets": true,
+	"negative_buckets": true,
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+type promExemplar struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64
+}
+
+type promBucketSpan struct {
+	offset int32
+	length uint32
+}
+
+type promHistogram struct {
+	count         float64
+	sum           float64
+	schema        int32
+	zeroThreshold float64
+	zeroCount     float64
+	negSpans      []promBucketSpan
+	negDeltas     []int64
+	negCounts     []float64
+	posSpans      []promBucketSpan
+	posDeltas     []int64
+	posCounts     []float64
+	resetHint     int32
+	timestamp     int64
+	customValues  []float64
+}
+
+type promTimeSeries struct {
+	labels     []promLabel
+	samples    []promSample
+	exemplars  []promExemplar
+	histograms []promHistogram
+}
+
+func (p *PromRemoteWriteParser) Parse(data []byte) (chan *ParserResponse, error) {
+	series, err := decodePromWriteRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	batches := newPromBatches()
+	for _, ts := range series {
+		err = batches.add(ts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := make(chan *ParserResponse)
+	go func() {
+		defer close(res)
+		for _, key := range batches.order {
+			b := batches.batches[key]
+			res <- &ParserResponse{Table: b.table, Data: b.data, Tags: b.tags}
+		}
+	}()
+	return res, nil
+}
+
+func (p *PromRemoteWriteParser) ParseReader(ctx context.Context, r io.Reader) (chan *ParserResponse, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.Parse(buf.Bytes())
+}
+
+type promBatch struct {
+	table string
+	data  map[string]any
+	tags  []string
+}
+
+// promBatches groups the rows by table and label set, so every batch has no gaps
+type promBatches struct {
+	batches map[string]*promBatch
+	order   []string
+}
+
+func newPromBatches() *promBatches {
+	return &promBatches{batches: make(map[string]*promBatch)}
+}
+
+func (p *promBatches) get(table string, labels []promLabel) *promBatch {
+	key := make([]string, len(labels)+1)
+	key[0] = table
+	for i, l := range labels {
+		key[i+1] = l.name
+	}
+	strKey := strings.Join(key, "\x00")
+	b, ok := p.batches[strKey]
+	if !ok {
+		b = &promBatch{table: table, data: make(map[string]any), tags: key[1:]}
+		p.batches[strKey] = b
+		p.order = append(p.order, strKey)
+	}
+	return b
+}
+
+var promTableNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func (p *promBatches) add(ts promTimeSeries) error {
+	var (
+		name   string
+		labels = make([]promLabel, 0, len(ts.labels))
+	)
+	for _, l := range ts.labels {
+		if l.name == "__name__" {
+			name = l.value
+			continue
+		}
+		if promReservedColumns[l.name] {
+			l.name = promLabelPrefix + l.name
+		}
+		labels = append(labels, l)
+	}
+	if name == "" {
+		return fmt.Errorf("time series without the __name__ label")
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	table := promTableNameRe.ReplaceAllString(name, "_")
+
+	if len(ts.samples) > 0 {
+		b := p.get(table, labels)
+		for _, s := range ts.samples {
+			b.appendLabels(labels)
+			appendData(&b.data, "value", s.value)
+			appendData(&b.data, "time", s.timestamp*1000000)
+		}
+	}
+
+	if len(ts.histograms) > 0 {
+		b := p.get(table+promHistogramSuffix, labels)
+		for _, h := range ts.histograms {
+			b.appendLabels(labels)
+			appendData(&b.data, "count", h.count)
+			appendData(&b.data, "sum", h.sum)
+			appendData(&b.data, "schema", int64(h.schema))
+			appendData(&b.data, "zero_threshold", h.zeroThreshold)
+			appendData(&b.data, "zero_count", h.zeroCount)
+			appendData(&b.data, "reset_hint", promResetHint(h.resetHint))
+			appendData(&b.data, "positive_buckets",
+				promBucketsJSON(h.schema, h.customValues, h.posSpans, h.posDeltas, h.posCounts, false))
+			appendData(&b.data, "negative_buckets",
+				promBucketsJSON(h.schema, h.customValues, h.negSpans, h.negDeltas, h.negCounts, true))
+			appendData(&b.data, "time", h.timestamp*1000000)
+		}
+	}
+
+	for _, e := range ts.exemplars {
+		exLabels := make([]promLabel, len(labels), len(labels)+len(e.labels))
+		copy(exLabels, labels)
+		for _, l := range e.labels {
+			exLabels = append(exLabels, promLabel{name: promExemplarPrefix + l.name, value: l.value})
+		}
+		sort.Slice(exLabels, func(i, j int) bool { return exLabels[i].name < exLabels[j].name })
+		b := p.get(table+promExemplarsSuffix, exLabels)
+		b.appendLabels(exLabels)
+		appendData(&b.data, "value", e.value)
+		appendData(&b.data, "time", e.timestamp*1000000)
+	}
+	return nil
+}
+
+func (b *promBatch) appendLabels(labels []promLabel) {
+	for _, l := range labels {
+		appendData(&b.data, l.name, l.value)
+	}
+}
+
+func promResetHint(hint int32) string {
+	switch hint {
+	case 1:
+		return "yes"
+	case 2:
+		return "no"
+	case 3:
+		return "gauge"
+	}
+	return "unknown"
+}
+
+// promCustomBucketsSchema is the schema of the histograms with custom bucket boundaries
+const promCustomBucketsSchema = -53
+
+// promBucketsJSON converts the sparse buckets of a native histogram into
+// a JSON array of {"lower": .., "upper": .., "count": ..} objects
+// with absolute counts. Infinite boundaries are encoded as null.
+func promBucketsJSON(schema int32, customValues []float64, spans []promBucketSpan,
+	deltas []int64, counts []float64, negative bool) string {
+	var (
+		buf   strings.Builder
+		idx   int32
+		n     int
+		count int64
+	)
+	writeFloat := func(f float64) {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			buf.WriteString("null")
+			return
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	buf.WriteByte('[')
+	for i, span := range spans {
+		if i == 0 {
+			idx = span.offset
+		} else {
+			idx += span.offset
+		}
+		for j := uint32(0); j < span.length; j++ {
+			var c float64
+			if len(counts) > 0 {
+				if n >= len(counts) {
+					break
+				}
+				c = counts[n]
+			} else {
+				if n >= len(deltas) {
+					break
+				}
+				count += deltas[n]
+				c = float64(count)
+			}
+			lower, upper := promBucketBounds(schema, customValues, idx)
+			if negative {
+				lower, upper = -upper, -lower
+			}
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(`{"lower":`)
+			writeFloat(lower)
+			buf.WriteString(`,"upper":`)
+			writeFloat(upper)
+			buf.WriteString(`,"count":`)
+			writeFloat(c)
+			buf.WriteByte('}')
+			n++
+			idx++
+		}
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+func promBucketBounds(schema int32, customValues []float64, idx int32) (float64, float64) {
+	if schema == promCustomBucketsSchema {
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if idx > 0 && int(idx-1) < len(customValues) {
+			lower = customValues[idx-1]
+		}
+		if idx >= 0 && int(idx) < len(customValues) {
+			upper = customValues[idx]
+		}
+		return lower, upper
+	}
+	bound := func(i int32) float64 {
+		return math.Exp2(float64(i) * math.Exp2(-float64(schema)))
+	}
+	return bound(idx - 1), bound(idx)
+}
+
+// walkProto calls fn for every field of the protobuf message.
+// Varint and fixed-width values are passed as v, length-delimited ones as val.
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var (
+			val []byte
+			v   uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.BytesType:
+			val, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		err := fn(num, typ, val, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendPackedDoubles reads repeated doubles in both packed and unpacked encodings
+func appendPackedDoubles(res []float64, typ protowire.Type, val []byte, v uint64) ([]float64, error) {
+	if typ == protowire.Fixed64Type {
+		return append(res, math.Float64frombits(v)), nil
+	}
+	for len(val) > 0 {
+		u, n := protowire.ConsumeFixed64(val)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		res = append(res, math.Float64frombits(u))
+		val = val[n:]
+	}
+	return res, nil
+}
+
+// appendPackedSint64 reads repeated sint64 in both packed and unpacked encodings
+func appendPackedSint64(res []int64, typ protowire.Type, val []byte, v uint64) ([]int64, error) {
+	if typ == protowire.VarintType {
+		return append(res, protowire.DecodeZigZag(v)), nil
+	}
+	for len(val) > 0 {
+		u, n := protowire.ConsumeVarint(val)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		res = append(res, protowire.DecodeZigZag(u))
+		val = val[n:]
+	}
+	return res, nil
+}
+
+func decodePromWriteRequest(b []byte) ([]promTimeSeries, error) {
+	var res []promTimeSeries
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		if num != 1 || typ != protowire.BytesType {
+			// metadata and unknown fields are skipped
+			return nil
+		}
+		ts, err := decodePromTimeSeries(val)
+		if err != nil {
+			return err
+		}
+		res = append(res, ts)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote write request: %w", err)
+	}
+	return res, nil
+}
+
+func decodePromTimeSeries(b []byte) (promTimeSeries, error) {
+	var res promTimeSeries
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		var err error
+		switch num {
+		case 1:
+			var l promLabel
+			l, err = decodePromLabel(val)
+			res.labels = append(res.labels, l)
+		case 2:
+			var s promSample
+			s, err = decodePromSample(val)
+			res.samples = append(res.samples, s)
+		case 3:
+			var e promExemplar
+			e, err = decodePromExemplar(val)
+			res.exemplars = append(res.exemplars, e)
+		case 4:
+			var h promHistogram
+			h, err = decodePromHistogram(val)
+			res.histograms = append(res.histograms, h)
+		}
+		return err
+	})
+	return res, err
+}
+
+func decodePromLabel(b []byte) (promLabel, error) {
+	var res promLabel
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		switch num {
+		case 1:
+			res.name = string(val)
+		case 2:
+			res.value = string(val)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func decodePromSample(b []byte) (promSample, error) {
+	var res promSample
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		switch num {
+		case 1:
+			res.value = math.Float64frombits(v)
+		case 2:
+			res.timestamp = int64(v)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func decodePromExemplar(b []byte) (promExemplar, error) {
+	var res promExemplar
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		switch num {
+		case 1:
+			l, err := decodePromLabel(val)
+			if err != nil {
+				return err
+			}
+			res.labels = append(res.labels, l)
+		case 2:
+			res.value = math.Float64frombits(v)
+		case 3:
+			res.timestamp = int64(v)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func decodePromBucketSpan(b []byte) (promBucketSpan, error) {
+	var res promBucketSpan
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		switch num {
+		case 1:
+			res.offset = int32(protowire.DecodeZigZag(v))
+		case 2:
+			res.length = uint32(v)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func decodePromHistogram(b []byte) (promHistogram, error) {
+	var res promHistogram
+	err := walkProto(b, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) error {
+		var (
+			err  error
+			span promBucketSpan
+		)
+		switch num {
+		case 1:
+			res.count = float64(v)
+		case 2:
+			res.count = math.Float64frombits(v)
+		case 3:
+			res.sum = math.Float64frombits(v)
+		case 4:
+			res.schema = int32(protowire.DecodeZigZag(v))
+		case 5:
+			res.zeroThreshold = math.Float64frombits(v)
+		case 6:
+			res.zeroCount = float64(v)
+		case 7:
+			res.zeroCount = math.Float64frombits(v)
+		case 8:
+			span, err = decodePromBucketSpan(val)
+			res.negSpans = append(res.negSpans, span)
+		case 9:
+			res.negDeltas, err = appendPackedSint64(res.negDeltas, typ, val, v)
+		case 10:
+			res.negCounts, err = appendPackedDoubles(res.negCounts, typ, val, v)
+		case 11:
+			span, err = decodePromBucketSpan(val)
+			res.posSpans = append(res.posSpans, span)
+		case 12:
+			res.posDeltas, err = appendPackedSint64(res.posDeltas, typ, val, v)
+		case 13:
+			res.posCounts, err = appendPackedDoubles(res.posCounts, typ, val, v)
+		case 14:
+			res.resetHint = int32(v)
+		case 15:
+			res.timestamp = int64(v)
+		case 16:
+			res.customValues, err = appendPackedDoubles(res.customValues, typ, val, v)
+		}
+		return err
+	})
+	return res, err
+}
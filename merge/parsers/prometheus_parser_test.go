@@ -0,0 +1,110 @@
+package parsers
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"testing"
+)
+
+func appendPromMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func promTestLabel(name, value string) []byte {
+	var b []byte
+	b = appendPromMessage(b, 1, []byte(name))
+	return appendPromMessage(b, 2, []byte(value))
+}
+
+func promTestDouble(b []byte, num protowire.Number, v float64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func promTestVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func TestPromRemoteWriteParser(t *testing.T) {
+	var counter []byte
+	counter = appendPromMessage(counter, 1, promTestLabel("__name__", "http_requests_total"))
+	counter = appendPromMessage(counter, 1, promTestLabel("job", "api"))
+	counter = appendPromMessage(counter, 1, promTestLabel("value", "x"))
+	for i, v := range []float64{1, 2} {
+		var sample []byte
+		sample = promTestDouble(sample, 1, v)
+		sample = promTestVarint(sample, 2, uint64(1700000000000+i))
+		counter = appendPromMessage(counter, 2, sample)
+	}
+	var exemplar []byte
+	exemplar = appendPromMessage(exemplar, 1, promTestLabel("trace_id", "abc"))
+	exemplar = promTestDouble(exemplar, 2, 0.5)
+	exemplar = promTestVarint(exemplar, 3, 1700000000000)
+	counter = appendPromMessage(counter, 3, exemplar)
+
+	var hist []byte
+	hist = promTestVarint(hist, 1, 3)
+	hist = promTestDouble(hist, 3, 1.75)
+	hist = promTestVarint(hist, 4, protowire.EncodeZigZag(0))
+	var span []byte
+	span = promTestVarint(span, 1, protowire.EncodeZigZag(0))
+	span = promTestVarint(span, 2, 2)
+	hist = appendPromMessage(hist, 11, span)
+	var deltas []byte
+	deltas = protowire.AppendVarint(deltas, protowire.EncodeZigZag(2))
+	deltas = protowire.AppendVarint(deltas, protowire.EncodeZigZag(-1))
+	hist = appendPromMessage(hist, 12, deltas)
+	hist = promTestVarint(hist, 15, 1700000000000)
+	var histSeries []byte
+	histSeries = appendPromMessage(histSeries, 1, promTestLabel("__name__", "rpc.duration"))
+	histSeries = appendPromMessage(histSeries, 4, hist)
+
+	var req []byte
+	req = appendPromMessage(req, 1, counter)
+	req = appendPromMessage(req, 1, histSeries)
+
+	res, err := (&PromRemoteWriteParser{}).Parse(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string]map[string]any{}
+	for r := range res {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		tables[r.Table] = r.Data
+	}
+
+	samples := tables["http_requests_total"]
+	if v := samples["value"].([]float64); len(v) != 2 || v[1] != 2 {
+		t.Fatalf("unexpected values %v", v)
+	}
+	if ts := samples["time"].([]int64); ts[0] != 1700000000000000000 {
+		t.Fatalf("unexpected time %v", ts)
+	}
+	if l := samples["label_value"].([]string); l[0] != "x" {
+		t.Fatalf("expected reserved label to be renamed, got %v", samples)
+	}
+
+	exemplars := tables["http_requests_total_exemplars"]
+	if l := exemplars["exemplar_trace_id"].([]string); l[0] != "abc" {
+		t.Fatalf("unexpected exemplars %v", exemplars)
+	}
+	if l := exemplars["job"].([]string); l[0] != "api" {
+		t.Fatalf("expected series labels in exemplars, got %v", exemplars)
+	}
+
+	histograms := tables["rpc_duration_histogram"]
+	if histograms == nil {
+		t.Fatalf("expected histogram table, got %v", tables)
+	}
+	expected := `[{"lower":0.5,"upper":1,"count":2},{"lower":1,"upper":2,"count":1}]`
+	if b := histograms["positive_buckets"].([]string); b[0] != expected {
+		t.Fatalf("unexpected buckets %s", b[0])
+	}
+	if c := histograms["count"].([]float64); c[0] != 3 {
+		t.Fatalf("unexpected count %v", c)
+	}
+}
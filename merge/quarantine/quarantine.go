@@ -0,0 +1,186 @@
+package quarantine
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a batch diverted from the table because of a column type conflict.
+// The batch is kept in <id>.gob next to the <id>.json entry.
+type Entry struct {
+	Id            string            `json:"id"`
+	Database      string            `json:"database"`
+	Table         string            `json:"table"`
+	Reason        string            `json:"reason"`
+	Column        string            `json:"column"`
+	ExpectedType  string            `json:"expected_type"`
+	ActualType    string            `json:"actual_type"`
+	Rows          int64             `json:"rows"`
+	Columns       map[string]string `json:"columns"`
+	SizeBytes     int64             `json:"size_bytes"`
+	QuarantinedAt time.Time         `json:"quarantined_at"`
+}
+
+func init() {
+	for _, v := range []any{[]int64{}, []uint64{}, []float64{}, []string{}, []bool{}} {
+		gob.Register(v)
+	}
+}
+
+var ErrNotFound = errors.New("quarantine entry not found")
+
+var idCheck = regexp.MustCompile(`^[a-f0-9-]+$`)
+
+// Dir is the quarantine folder of the table
+func Dir(database, table string) string {
+	return filepath.Join(config.Config.Gigapi.Root, database, table, "quarantine")
+}
+
+// Add stores the batch with its entry. Id, Rows, SizeBytes and QuarantinedAt of the entry are filled.
+func Add(entry *Entry, data map[string]any) error {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return err
+	}
+	entry.Id = id.String()
+	entry.QuarantinedAt = time.Now().UTC()
+
+	buf := bytes.NewBuffer(nil)
+	err = gob.NewEncoder(buf).Encode(data)
+	if err != nil {
+		return err
+	}
+	entry.SizeBytes = int64(buf.Len())
+
+	dir := Dir(entry.Database, entry.Table)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(dir, entry.Id+".gob"), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// the entry is visible once the json file is written
+	return writeFile(filepath.Join(dir, entry.Id+".json"), meta)
+}
+
+func writeFile(name string, data []byte) error {
+	err := os.WriteFile(name+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// List returns the entries of the table ordered by the quarantine time
+func List(database, table string) ([]*Entry, error) {
+	files, err := os.ReadDir(Dir(database, table))
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Entry, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		e, err := Get(database, table, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].QuarantinedAt.Before(res[j].QuarantinedAt)
+	})
+	return res, nil
+}
+
+func Get(database, table, id string) (*Entry, error) {
+	if !idCheck.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	meta, err := os.ReadFile(filepath.Join(Dir(database, table), id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	err = json.Unmarshal(meta, e)
+	if err != nil {
+		return nil, fmt.Errorf("quarantine entry %s: %w", id, err)
+	}
+	return e, nil
+}
+
+// GetData returns the quarantined batch
+func GetData(database, table, id string) (map[string]any, error) {
+	if !idCheck.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	payload, err := os.ReadFile(filepath.Join(Dir(database, table), id+".gob"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&data)
+	return data, err
+}
+
+// Remove deletes the entry and its batch
+func Remove(database, table, id string) error {
+	if !idCheck.MatchString(id) {
+		return ErrNotFound
+	}
+	dir := Dir(database, table)
+	err := os.Remove(filepath.Join(dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, id+".gob"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Purge deletes all the entries of the table
+func Purge(database, table string) (int, error) {
+	entries, err := List(database, table)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range entries {
+		err = Remove(database, table, e.Id)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
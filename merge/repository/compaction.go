@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	compactionPoliciesOnce sync.Once
+	compactionPolicies     map[string]*shared.CompactionPolicy
+)
+
+// configuredCompactionPolicies returns the policies of GIGAPI_COMPACTION_POLICIES.
+// The variable holds a JSON object, or the path of a JSON file, mapping "db.table", "db.*" or "*"
+// to a compaction policy.
+func configuredCompactionPolicies() map[string]*shared.CompactionPolicy {
+	compactionPoliciesOnce.Do(func() {
+		compactionPolicies = make(map[string]*shared.CompactionPolicy)
+		err := readJSONSetting("GIGAPI_COMPACTION_POLICIES", &compactionPolicies)
+		if err != nil {
+			fmt.Println(err)
+			compactionPolicies = make(map[string]*shared.CompactionPolicy)
+		}
+	})
+	return compactionPolicies
+}
+
+// readJSONSetting parses the variable holding a JSON value, or the path of a JSON file, into res.
+// An empty variable leaves res unchanged.
+func readJSONSetting(name string, res any) error {
+	value := strings.TrimSpace(utils.GetEnv(name, ""))
+	if value == "" {
+		return nil
+	}
+	data := []byte(value)
+	if !strings.HasPrefix(value, "{") {
+		var err error
+		data, err = os.ReadFile(value)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	err := json.Unmarshal(data, res)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// configuredCompactionPolicy returns the normalized policy configured for the table
+// or the default policy
+func configuredCompactionPolicy(db, name string) *shared.CompactionPolicy {
+	def := shared.DefaultCompactionPolicy(int64(config.Config.Gigapi.MergeTimeoutS))
+	policies := configuredCompactionPolicies()
+	for _, key := range []string{db + "." + name, db + ".*", "*"} {
+		policy, ok := policies[key]
+		if !ok || policy == nil {
+			continue
+		}
+		res := *policy
+		res.Levels = append([]shared.MergeLevel{}, policy.Levels...)
+		err := res.Normalize(def)
+		if err != nil {
+			fmt.Printf("GIGAPI_COMPACTION_POLICIES %q: %v\n", key, err)
+			continue
+		}
+		return &res
+	}
+	return def
+}
+
+// compactionPolicy returns the effective policy of the table: the settings of the table definition
+// completed with the configured policy
+func compactionPolicy(table *shared.Table) (*shared.CompactionPolicy, error) {
+	configured := configuredCompactionPolicy(table.Database, table.Name)
+	if table.Compaction == nil {
+		return configured, nil
+	}
+	res := *table.Compaction
+	res.Levels = append([]shared.MergeLevel{}, table.Compaction.Levels...)
+	err := res.Normalize(configured)
+	return &res, err
+}
+
+// configuredBloomFilterColumns returns the comma separated columns of GIGAPI_BLOOM_FILTER_COLUMNS,
+// indexed with bloom filters in the tables not setting bloom_filter_columns
+func configuredBloomFilterColumns() []string {
+	var res []string
+	for _, c := range strings.Split(utils.GetEnv("GIGAPI_BLOOM_FILTER_COLUMNS", ""), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// configuredWidenToString checks if GIGAPI_WIDEN_TO_STRING, comma separated "db.table", "db.*" or "*",
+// lets the numeric columns of the table widen to VARCHAR. The conflicting batches are quarantined otherwise.
+func configuredWidenToString(db, table string) bool {
+	for _, key := range strings.Split(utils.GetEnv("GIGAPI_WIDEN_TO_STRING", ""), ",") {
+		key = strings.TrimSpace(key)
+		if key == "*" || key == db+".*" || key == db+"."+table {
+			return true
+		}
+	}
+	return false
+}
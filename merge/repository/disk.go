@@ -0,0 +1,255 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCheckInterval = time.Second
+	// evictionInterval is the min interval between two evictions of a volume,
+	// for the usage to reflect the dropped partitions
+	evictionInterval = time.Minute
+)
+
+// DiskStatus is the state of the disk watermarks
+type DiskStatus struct {
+	LowWatermark  float64       `json:"low_watermark"`
+	HighWatermark float64       `json:"high_watermark"`
+	Eviction      bool          `json:"eviction"`
+	Full          bool          `json:"full"`
+	Volumes       []VolumeUsage `json:"volumes"`
+}
+
+var disk = struct {
+	sync.Mutex
+	// full is the volume above the high watermark, nil if none is
+	full    *VolumeUsage
+	volumes []VolumeUsage
+}{}
+
+// evictedAt are the times of the last evictions of the volumes, used by the disk monitor
+var evictedAt = make(map[uint64]time.Time)
+
+// RunDiskMonitor checks the usage of the volumes of the data and tmp folders every second
+func RunDiskMonitor() {
+	ticker := time.NewTicker(diskCheckInterval)
+	for ; true; <-ticker.C {
+		checkDisk()
+	}
+}
+
+// checkDisk updates the usage of the volumes. From the high watermark of a volume the merges are paused
+// and the writes refused until its usage falls below it. With GIGAPI_DISK_EVICTION the oldest partitions
+// of the volume are dropped down to the low watermark.
+func checkDisk() {
+	low, high := diskWatermarks()
+	volumes := volumesUsage(monitoredFolders())
+	full := fullVolume(volumes, high)
+	disk.Lock()
+	wasFull := disk.full != nil
+	disk.full, disk.volumes = full, volumes
+	disk.Unlock()
+	switch {
+	case full != nil && !wasFull:
+		fmt.Printf("Disk usage of %s is %.1f%%, above the high watermark %g%%: merges paused, writes refused\n",
+			full.Path, full.UsedPercent, high)
+	case full == nil && wasFull:
+		fmt.Printf("Disk usage below the high watermark %g%%: merges and writes resumed\n", high)
+	}
+	if full == nil || !diskEviction() {
+		return
+	}
+	for _, v := range volumes {
+		if v.UsedPercent < high || time.Since(evictedAt[v.id]) < evictionInterval {
+			continue
+		}
+		evictPartitions(v, low)
+		evictedAt[v.id] = time.Now()
+	}
+}
+
+// fullVolume returns the most used volume at or above the high watermark, nil if none is or if it is 0
+func fullVolume(volumes []VolumeUsage, high float64) *VolumeUsage {
+	var res *VolumeUsage
+	for i, v := range volumes {
+		if high > 0 && v.UsedPercent >= high && (res == nil || v.UsedPercent > res.UsedPercent) {
+			res = &volumes[i]
+		}
+	}
+	return res
+}
+
+// diskFull returns a 507 error if the usage of a volume reached the high watermark
+func diskFull() error {
+	disk.Lock()
+	defer disk.Unlock()
+	if disk.full == nil {
+		return nil
+	}
+	_, high := diskWatermarks()
+	return utils.NewGigapiError(http.StatusInsufficientStorage,
+		fmt.Sprintf("disk usage of %s is %.1f%%, above the high watermark %g%%: writes are refused",
+			disk.full.Path, disk.full.UsedPercent, high))
+}
+
+// GetDiskStatus returns the watermarks and the last usage of the volumes
+func GetDiskStatus() DiskStatus {
+	low, high := diskWatermarks()
+	disk.Lock()
+	defer disk.Unlock()
+	return DiskStatus{
+		LowWatermark:  low,
+		HighWatermark: high,
+		Eviction:      diskEviction(),
+		Full:          disk.full != nil,
+		Volumes:       append([]VolumeUsage{}, disk.volumes...),
+	}
+}
+
+type evictionCandidate struct {
+	table     *shared.Table
+	partition string
+	values    [][2]string
+	maxTime   int64
+	sizeBytes int64
+}
+
+// evictionCandidates returns the partitions of the table the eviction may drop, oldest first by max_time:
+// the partitions before the current hour with all their local files at the final merge level.
+// The local HiveMerge tables without retention policy keep their data forever and have none.
+func evictionCandidates(t *shared.Table, now time.Time) ([]evictionCandidate, error) {
+	if t.Engine != "HiveMerge" || strings.HasPrefix(t.Path, "s3://") || retentionPolicy(t) == nil {
+		return nil, nil
+	}
+	indexes, err := readPartitionIndexes(t, "")
+	if err != nil {
+		return nil, err
+	}
+	currentHour := now.Truncate(time.Hour).UnixNano()
+	suffix := service.FinalSuffix(t)
+	var res []evictionCandidate
+	for _, p := range indexes {
+		entries := p.idx.List()
+		maxTime, ok := partitionMaxTime(entries, t.GetTimestampField())
+		if !ok || maxTime >= currentHour {
+			continue
+		}
+		values, err := parsePartitionPath(p.rel)
+		if err != nil {
+			continue
+		}
+		c := evictionCandidate{table: t, partition: p.rel, values: values, maxTime: maxTime}
+		live := false
+		for _, e := range entries {
+			// the files tiered to S3 free no local space
+			if strings.HasPrefix(e.Path, "s3://") {
+				continue
+			}
+			live = live || !strings.HasSuffix(e.Path, suffix)
+			c.sizeBytes += e.SizeBytes
+		}
+		if !live && c.sizeBytes > 0 {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].maxTime < res[j].maxTime
+	})
+	return res, nil
+}
+
+// planEviction picks the partitions to drop to free toFree bytes from the candidates of every table:
+// the oldest partition of each table in turn, so the tables lose their history evenly.
+// It returns false and no partition if all the candidates free less than toFree.
+func planEviction(byTable [][]evictionCandidate, toFree int64) ([]evictionCandidate, bool) {
+	var total int64
+	for _, candidates := range byTable {
+		for _, c := range candidates {
+			total += c.sizeBytes
+		}
+	}
+	if total < toFree {
+		return nil, false
+	}
+	var res []evictionCandidate
+	var freed int64
+	for i := 0; freed < toFree; i++ {
+		var round []evictionCandidate
+		for _, candidates := range byTable {
+			if i < len(candidates) {
+				round = append(round, candidates[i])
+			}
+		}
+		sort.Slice(round, func(i, j int) bool {
+			return round[i].maxTime < round[j].maxTime
+		})
+		for _, c := range round {
+			if freed >= toFree {
+				break
+			}
+			res = append(res, c)
+			freed += c.sizeBytes
+		}
+	}
+	return res, true
+}
+
+// evictPartitions drops the oldest partitions, by max_time, of the local HiveMerge tables of the volume
+// with a retention policy, one table after the other, until the size of their local files brings the usage
+// of the volume below the low watermark. Nothing is dropped if the candidates can't reach the low watermark.
+func evictPartitions(v VolumeUsage, low float64) {
+	toFree := int64(v.UsedBytes) - int64(float64(v.UsedBytes+v.FreeBytes)*low/100)
+	registryMtx.Lock()
+	_tables := make([]*shared.Table, 0, len(tables))
+	for _, t := range tables {
+		_tables = append(_tables, t)
+	}
+	registryMtx.Unlock()
+	now := time.Now()
+	var byTable [][]evictionCandidate
+	for _, t := range _tables {
+		if !onVolume(t.Path, v) {
+			continue
+		}
+		candidates, err := evictionCandidates(t, now)
+		if err != nil {
+			fmt.Printf("Disk eviction: table %s.%s: %v\n", t.Database, t.Name, err)
+			continue
+		}
+		if len(candidates) > 0 {
+			byTable = append(byTable, candidates)
+		}
+	}
+	picked, ok := planEviction(byTable, toFree)
+	if !ok {
+		fmt.Printf("Disk eviction: the evictable partitions can't bring the usage of the volume of %s "+
+			"down to the low watermark %g%% (%d bytes to free): no partition dropped\n", v.Path, low, toFree)
+		return
+	}
+	var freed int64
+	for _, c := range picked {
+		// the folders are removed in place, so the next check sees the freed space
+		_, err := dropPartitions(c.table.Database, c.table.Name, [][][2]string{c.values}, os.RemoveAll)
+		if err != nil {
+			fmt.Printf("Disk eviction: table %s.%s: partition %s: %v\n", c.table.Database, c.table.Name, c.partition, err)
+			continue
+		}
+		freed += c.sizeBytes
+		fmt.Printf("Disk eviction: table %s.%s: dropped the partition %s, max_time %s, %d bytes\n",
+			c.table.Database, c.table.Name, c.partition, time.Unix(0, c.maxTime).UTC().Format(time.RFC3339),
+			c.sizeBytes)
+	}
+	if freed < toFree {
+		fmt.Printf("Disk eviction: %d bytes freed on the volume of %s, %d bytes to free for the low watermark %g%%\n",
+			freed, v.Path, toFree, low)
+	}
+}
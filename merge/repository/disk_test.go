@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiskWatermarks(t *testing.T) {
+	tests := []struct {
+		low, high string
+		expected  [2]float64
+	}{
+		{"", "", [2]float64{defaultDiskLowWatermark, defaultDiskHighWatermark}},
+		{"50", "60", [2]float64{50, 60}},
+		// the low watermark is at most the high one
+		{"90", "80", [2]float64{80, 80}},
+		{"x", "101", [2]float64{defaultDiskLowWatermark, defaultDiskHighWatermark}},
+		{"", "0", [2]float64{0, 0}},
+	}
+	for _, test := range tests {
+		t.Setenv("GIGAPI_DISK_LOW_WATERMARK", test.low)
+		t.Setenv("GIGAPI_DISK_HIGH_WATERMARK", test.high)
+		if low, high := diskWatermarks(); low != test.expected[0] || high != test.expected[1] {
+			t.Fatalf("%q, %q: expected the watermarks %v, got %g, %g", test.low, test.high, test.expected, low, high)
+		}
+	}
+}
+
+func TestFullVolume(t *testing.T) {
+	volumes := []VolumeUsage{
+		{Path: "/a", UsedPercent: 96},
+		{Path: "/b", UsedPercent: 98},
+		{Path: "/c", UsedPercent: 50},
+	}
+	if full := fullVolume(volumes, 95); full == nil || full.Path != "/b" {
+		t.Fatalf("expected /b to be the full volume, got %+v", full)
+	}
+	if full := fullVolume(volumes, 99); full != nil {
+		t.Fatalf("expected no full volume, got %+v", full)
+	}
+	if full := fullVolume(volumes, 0); full != nil {
+		t.Fatalf("expected the high watermark 0 to disable the check, got %+v", full)
+	}
+}
+
+func TestPlanEviction(t *testing.T) {
+	candidates := func(table string, maxTimes ...int64) []evictionCandidate {
+		var res []evictionCandidate
+		for _, maxTime := range maxTimes {
+			res = append(res, evictionCandidate{table: &shared.Table{Name: table}, maxTime: maxTime, sizeBytes: 10})
+		}
+		return res
+	}
+	byTable := [][]evictionCandidate{candidates("a", 1, 2, 3), candidates("b", 10, 11)}
+	names := func(picked []evictionCandidate) []string {
+		var res []string
+		for _, c := range picked {
+			res = append(res, fmt.Sprintf("%s@%d", c.table.Name, c.maxTime))
+		}
+		return res
+	}
+
+	// the tables lose their oldest partition in turn
+	picked, ok := planEviction(byTable, 25)
+	expected := []string{"a@1", "b@10", "a@2"}
+	if !ok || !slices.Equal(names(picked), expected) {
+		t.Fatalf("expected the partitions %v, got %v %v", expected, names(picked), ok)
+	}
+	picked, ok = planEviction(byTable, 50)
+	if !ok || len(picked) != 5 {
+		t.Fatalf("expected all the partitions, got %v %v", names(picked), ok)
+	}
+	// the candidates can't reach the low watermark: nothing is dropped
+	picked, ok = planEviction(byTable, 51)
+	if ok || len(picked) != 0 {
+		t.Fatalf("expected no partition, got %v %v", names(picked), ok)
+	}
+	picked, ok = planEviction(byTable, -10)
+	if !ok || len(picked) != 0 {
+		t.Fatalf("expected no partition below the low watermark, got %v %v", names(picked), ok)
+	}
+}
+
+// indexPartition indexes the files of the partition of the table, without the files
+func indexPartition(t *testing.T, table *shared.Table, partition string, maxTime int64, files ...string) {
+	values, err := parsePartitionPath(partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(table.Path, partition)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.NewJSONIndexForPartition(table, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	defer idx.Stop()
+	var entries []*shared.IndexEntry
+	for _, name := range files {
+		if filepath.Dir(name) == "." {
+			name = filepath.Join(dir, name)
+		}
+		entries = append(entries, &shared.IndexEntry{
+			Path:      name,
+			RowCount:  1,
+			SizeBytes: 100,
+			Min:       map[string]any{"time": maxTime - 1},
+			Max:       map[string]any{"time": maxTime},
+		})
+	}
+	_, err = idx.Batch(entries, nil).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvictionCandidates(t *testing.T) {
+	testRoot(t)
+	table := &shared.Table{
+		Database:       "db",
+		Name:           "metrics",
+		Path:           t.TempDir(),
+		Engine:         "HiveMerge",
+		TimestampField: "time",
+	}
+	final := "a" + service.FinalSuffix(table)
+	now := time.Date(2025, 4, 11, 10, 30, 0, 0, time.UTC)
+	day := time.Date(2025, 4, 10, 10, 0, 0, 0, time.UTC).UnixNano()
+	indexPartition(t, table, "date=2025-04-10/hour=10", day, final)
+	indexPartition(t, table, "date=2025-04-09/hour=10", day-int64(24*time.Hour), final)
+	// a file below the final level: the partition is live
+	indexPartition(t, table, "date=2025-04-10/hour=11", day+int64(time.Hour), final, "b.1.parquet")
+	// the partition of the current hour
+	indexPartition(t, table, "date=2025-04-11/hour=10", now.Add(-time.Minute).UnixNano(), final)
+	// the tiered files free no local space
+	indexPartition(t, table, "date=2025-04-08/hour=10", day-int64(48*time.Hour), "s3://bucket/db/metrics/"+final)
+
+	candidates, err := evictionCandidates(table, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 0 {
+		t.Fatalf("expected no candidate without retention policy, got %d", len(candidates))
+	}
+
+	table.Retention = &shared.RetentionPolicy{TTLS: 365 * 86400}
+	candidates, err = evictionCandidates(table, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partitions []string
+	for _, c := range candidates {
+		partitions = append(partitions, c.partition)
+	}
+	expected := []string{"date=2025-04-09/hour=10", "date=2025-04-10/hour=10"}
+	if !slices.Equal(partitions, expected) {
+		t.Fatalf("expected the candidates %v, got %v", expected, partitions)
+	}
+	if candidates[0].sizeBytes != 100 || candidates[1].maxTime != day {
+		t.Fatalf("unexpected candidate %+v", candidates[1])
+	}
+}
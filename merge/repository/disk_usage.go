@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDiskLowWatermark  = 85
+	defaultDiskHighWatermark = 95
+)
+
+// VolumeUsage is the usage of the volume of data or tmp folders
+type VolumeUsage struct {
+	Path       string `json:"path"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	// UsedPercent is the used part of the space available to gigapi, like df: the blocks reserved
+	// to root are neither used nor free
+	UsedPercent float64 `json:"used_percent"`
+	id          uint64
+}
+
+// diskWatermarks returns GIGAPI_DISK_LOW_WATERMARK and GIGAPI_DISK_HIGH_WATERMARK: the used percents
+// of a volume down to which the eviction drops partitions, and from which the merges are paused
+// and the writes refused. A high watermark of 0 disables them.
+func diskWatermarks() (float64, float64) {
+	watermark := func(name string, def float64) float64 {
+		v, err := strconv.ParseFloat(utils.GetEnv(name, ""), 64)
+		if err != nil || v < 0 || v > 100 {
+			return def
+		}
+		return v
+	}
+	high := watermark("GIGAPI_DISK_HIGH_WATERMARK", defaultDiskHighWatermark)
+	return min(watermark("GIGAPI_DISK_LOW_WATERMARK", defaultDiskLowWatermark), high), high
+}
+
+// diskEviction returns GIGAPI_DISK_EVICTION: drop the oldest partitions of a volume above the high watermark
+func diskEviction() bool {
+	return utils.GetEnv("GIGAPI_DISK_EVICTION", "false") == "true"
+}
+
+// monitoredFolders returns the root folder and the local data and tmp folders of the registered tables
+func monitoredFolders() []string {
+	res := []string{config.Config.Gigapi.Root}
+	registryMtx.Lock()
+	for _, t := range tables {
+		if !strings.HasPrefix(t.Path, "s3://") {
+			res = append(res, t.Path, filepath.Join(t.Path, "tmp"))
+		}
+	}
+	registryMtx.Unlock()
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// volumesUsage returns the usage of the volumes of the folders, one per volume
+func volumesUsage(folders []string) []VolumeUsage {
+	var res []VolumeUsage
+	seen := make(map[uint64]bool)
+	for _, folder := range folders {
+		v, err := utils.GetVolume(folder)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Printf("Failed to get the disk usage of %s: %v\n", folder, err)
+			}
+			continue
+		}
+		if seen[v.ID] || v.UsedBytes+v.FreeBytes == 0 {
+			continue
+		}
+		seen[v.ID] = true
+		res = append(res, VolumeUsage{
+			Path:        folder,
+			TotalBytes:  v.TotalBytes,
+			UsedBytes:   v.UsedBytes,
+			FreeBytes:   v.FreeBytes,
+			UsedPercent: float64(v.UsedBytes) * 100 / float64(v.UsedBytes+v.FreeBytes),
+			id:          v.ID,
+		})
+	}
+	return res
+}
+
+// onVolume checks if the folder is on the volume
+func onVolume(folder string, v VolumeUsage) bool {
+	_v, err := utils.GetVolume(folder)
+	return err == nil && _v.ID == v.id
+}
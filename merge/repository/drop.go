@@ -0,0 +1,324 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"github.com/google/uuid"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// trashPath is the folder the dropped folders are moved into before they are removed in the background.
+// Its leftovers are removed at startup.
+func trashPath() string {
+	return filepath.Join(config.Config.Gigapi.Root, ".trash")
+}
+
+// removeAsync moves the folder into the trash and removes it in the background.
+// A folder out of the filesystem of the trash is removed in place.
+func removeAsync(p string) error {
+	trash := filepath.Join(trashPath(), uuid.NewString())
+	err := os.MkdirAll(trashPath(), 0755)
+	if err == nil {
+		err = os.Rename(p, trash)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Failed to move %s into the trash, removing it in place: %v\n", p, err)
+		trash = p
+	}
+	go func() {
+		err := os.RemoveAll(trash)
+		if err != nil {
+			fmt.Printf("Failed to remove the dropped folder %s: %v\n", trash, err)
+		}
+	}()
+	return nil
+}
+
+// emptyTrash removes the dropped folders left by a restart
+func emptyTrash() {
+	entries, err := os.ReadDir(trashPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to empty the trash: %v\n", err)
+		return
+	}
+	for _, e := range entries {
+		err = os.RemoveAll(filepath.Join(trashPath(), e.Name()))
+		if err != nil {
+			fmt.Printf("Failed to remove the dropped folder %s: %v\n", e.Name(), err)
+		}
+	}
+}
+
+// stop stops the partition indexes and the Iceberg export of the table
+func (t *tableIndexes) stop() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, idx := range t.parts {
+		idx.Stop()
+	}
+	t.parts = make(map[string]shared.Index)
+	if t.exporter != nil {
+		t.exporter.Stop()
+		t.exporter = nil
+	}
+}
+
+// dropPartitions stops the indexes of the partitions in the folder of the values.
+// With the Iceberg export, the files of the partitions are removed from the indexes first,
+// so the export drops them.
+func (t *tableIndexes) dropPartitions(dir string, values [][2]string) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		_values := append([][2]string{}, values...)
+		if rel != "." {
+			for _, folder := range strings.Split(filepath.ToSlash(rel), "/") {
+				kv := strings.SplitN(folder, "=", 2)
+				if len(kv) < 2 {
+					return filepath.SkipDir
+				}
+				_values = append(_values, [2]string{kv[0], kv[1]})
+			}
+		}
+		name := indexName(_values)
+		idx, ok := t.parts[name]
+		if _, err := os.Stat(filepath.Join(p, "metadata.json")); t.exporter != nil && !ok && err == nil {
+			idx, err = t.get(_values)
+			if err != nil {
+				return err
+			}
+			ok = true
+		}
+		if !ok {
+			return nil
+		}
+		if t.exporter != nil {
+			var rm []string
+			for _, e := range idx.List() {
+				rm = append(rm, e.Path)
+			}
+			if len(rm) > 0 {
+				_, err = idx.Batch(nil, rm).Get()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		idx.Stop()
+		delete(t.parts, name)
+		return nil
+	})
+}
+
+// dropTable unregisters the table, removes its definition and its folders. The caller holds m.
+// It returns false if the table doesn't exist.
+func dropTable(db, name string) (bool, error) {
+	key := [2]string{db, name}
+	registryMtx.Lock()
+	svc := registry[key]
+	table := tables[key]
+	indexes := partitionIndexes[key]
+	delete(registry, key)
+	delete(mergeTicks, key)
+	delete(tables, key)
+	delete(partitionIndexes, key)
+	registryMtx.Unlock()
+
+	var defined bool
+	err := withCatalog(func(conn *sql.DB) error {
+		var err error
+		defined, err = DeleteTableMetadata(conn, db, name)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if svc != nil {
+		svc.Drop()
+	}
+	if indexes != nil {
+		indexes.stop()
+	}
+
+	folder := filepath.Join(config.Config.Gigapi.Root, db, name)
+	_, statErr := os.Stat(folder)
+	if svc == nil && !defined && statErr != nil {
+		return false, nil
+	}
+	err = removeAsync(folder)
+	if err != nil {
+		return true, err
+	}
+	if table != nil && table.Path != folder && !strings.HasPrefix(table.Path, "s3://") {
+		err = removeAsync(table.Path)
+	}
+	removeTiered(&shared.Table{Database: db, Name: name}, nil)
+	fmt.Printf("Table %s.%s dropped\n", db, name)
+	return true, err
+}
+
+// DropTable stops the services and the indexes of the table, removes it from the registry and the catalog
+// and deletes its data and its files tiered to S3 in the background. The objects of the s3 tables are kept.
+func DropTable(db, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	dropped, err := dropTable(db, name)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	return nil
+}
+
+// DropDatabase drops all the tables of the database and deletes its folder in the background.
+// It returns the dropped tables.
+func DropDatabase(db string) ([]string, error) {
+	if !tableNameCheck.MatchString(db) {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, fmt.Sprintf("invalid database name %q", db))
+	}
+	m.Lock()
+	defer m.Unlock()
+	names := make(map[string]bool)
+	registryMtx.Lock()
+	for key := range registry {
+		if key[0] == db {
+			names[key[1]] = true
+		}
+	}
+	registryMtx.Unlock()
+	err := withCatalog(func(conn *sql.DB) error {
+		defs, err := GetAllTableMetadata(conn)
+		for _, def := range defs {
+			if def.Database == db {
+				names[def.Name] = true
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	folder := filepath.Join(config.Config.Gigapi.Root, db)
+	entries, err := os.ReadDir(folder)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && tableNameCheck.MatchString(e.Name()) && isTableFolder(filepath.Join(folder, e.Name())) {
+			names[e.Name()] = true
+		}
+	}
+	if len(names) == 0 && entries == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("database %s not found", db))
+	}
+
+	res := make([]string, 0, len(names))
+	for name := range names {
+		_, err = dropTable(db, name)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res, removeAsync(folder)
+}
+
+// parsePartitionPath parses a partition folder path: <key>=<value>[/<key>=<value>...]
+func parsePartitionPath(p string) ([][2]string, error) {
+	var res [][2]string
+	for _, folder := range strings.Split(strings.Trim(p, "/"), "/") {
+		kv := strings.SplitN(folder, "=", 2)
+		if len(kv) < 2 || kv[0] == "" || kv[1] == "" || kv[1] == "." || kv[1] == ".." {
+			return nil, fmt.Errorf("invalid partition %q", p)
+		}
+		res = append(res, [2]string{kv[0], kv[1]})
+	}
+	return res, nil
+}
+
+// DropPartitions drops the hive partition folders of the table starting with the partitions
+// (e.g. date=2025-04-10): their indexes are stopped, their rows not saved yet discarded,
+// and their data deleted in the background. It returns the dropped folders.
+func DropPartitions(db, name string, partitions []string) ([]string, error) {
+	if len(partitions) == 0 {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, "no partition to drop")
+	}
+	prefixes := make([][][2]string, len(partitions))
+	for i, p := range partitions {
+		var err error
+		prefixes[i], err = parsePartitionPath(p)
+		if err != nil {
+			return nil, utils.NewGigapiError(http.StatusBadRequest, err.Error())
+		}
+	}
+	res, err := dropPartitions(db, name, prefixes, removeAsync)
+	if err == nil && len(res) > 0 {
+		fmt.Printf("Table %s.%s: dropped the partitions %s\n", db, name, strings.Join(res, ", "))
+	}
+	return res, err
+}
+
+// dropPartitions drops the hive partition folders of the table starting with the prefixes.
+// The folders are deleted with remove, their files tiered to S3 in the background.
+func dropPartitions(db, name string, prefixes [][][2]string, remove func(dir string) error) ([]string, error) {
+	key := [2]string{db, name}
+	registryMtx.Lock()
+	svc := registry[key]
+	table := tables[key]
+	indexes := partitionIndexes[key]
+	registryMtx.Unlock()
+	if svc == nil || table == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	if strings.HasPrefix(table.Path, "s3://") {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, "the partitions of the s3 tables can't be dropped")
+	}
+	res, err := svc.DropPartitions(prefixes, func(values [][2]string) error {
+		dir := filepath.Join(table.Path, indexName(values))
+		if indexes != nil {
+			err := indexes.dropPartitions(dir, values)
+			if err != nil {
+				return err
+			}
+		}
+		err := remove(dir)
+		if err != nil {
+			return err
+		}
+		removeTiered(table, values)
+		return nil
+	})
+	if errors.Is(err, service.ErrNotPartitioned) {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, err.Error())
+	}
+	return res, err
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testRoot points the root folder of the configuration to a temp folder with an empty catalog
+func testRoot(t *testing.T) string {
+	prev := config.Config
+	config.Config = &config.Configuration{Gigapi: config.GigapiConfiguration{Root: t.TempDir(), SaveTimeoutS: 1}}
+	t.Cleanup(func() {
+		config.Config = prev
+	})
+	err := withCatalog(func(conn *sql.DB) error {
+		return CreateDuckDBTablesTable(conn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Config.Gigapi.Root
+}
+
+// storeRow stores a row of the time and the value into the table and waits for its save
+func storeRow(t *testing.T, db, name string, ts time.Time, value any) {
+	_, err := Store(db, name, map[string]any{"time": []int64{ts.UnixNano()}, "value": value}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hourFiles returns the parquet files of the hour partition of the table
+func hourFiles(db, name string, ts time.Time) []string {
+	res, _ := filepath.Glob(filepath.Join(config.Config.Gigapi.Root, db, name, indexName(hourPartitions(
+		[]int64{ts.UnixNano()})[0].Values), "*.parquet"))
+	return res
+}
+
+// checkStatus checks that err is a GigapiError of the status
+func checkStatus(t *testing.T, err error, status int) {
+	var gErr *utils.GigapiError
+	if !errors.As(err, &gErr) || gErr.Code() != status {
+		t.Fatalf("expected the status %d, got %v", status, err)
+	}
+}
+
+func TestDropTableRecreate(t *testing.T) {
+	testRoot(t)
+	ts := time.Date(2025, 4, 10, 10, 0, 0, 0, time.UTC)
+	storeRow(t, "db", "metrics", ts, []int64{1})
+	if files := hourFiles("db", "metrics", ts); len(files) != 1 {
+		t.Fatalf("expected the saved file, got %v", files)
+	}
+
+	err := DropTable("db", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, DropTable("db", "metrics"), http.StatusNotFound)
+	if _, err := os.Stat(filepath.Join(config.Config.Gigapi.Root, "db", "metrics")); !os.IsNotExist(err) {
+		t.Fatalf("expected the table folder to be moved to the trash: %v", err)
+	}
+
+	// the table of the same name has a new schema and none of the files of the dropped one
+	storeRow(t, "db", "metrics", ts, []string{"a"})
+	defer DropTable("db", "metrics")
+	schema, err := GetTableSchema("db", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range schema {
+		if c.Name == "value" && c.Type != "VARCHAR" {
+			t.Fatalf("expected the value column of the new table to be VARCHAR, got %s", c.Type)
+		}
+	}
+	if files := hourFiles("db", "metrics", ts); len(files) != 1 {
+		t.Fatalf("expected the file of the new table only, got %v", files)
+	}
+}
+
+func TestDropPartitions(t *testing.T) {
+	testRoot(t)
+	ts := time.Date(2025, 4, 10, 10, 0, 0, 0, time.UTC)
+	storeRow(t, "db", "metrics", ts, []int64{1})
+	storeRow(t, "db", "metrics", ts.Add(time.Hour), []int64{2})
+	defer DropTable("db", "metrics")
+
+	_, err := DropPartitions("db", "metrics", []string{"date"})
+	checkStatus(t, err, http.StatusBadRequest)
+	_, err = DropPartitions("db", "missing", []string{"date=2025-04-10"})
+	checkStatus(t, err, http.StatusNotFound)
+
+	res, err := DropPartitions("db", "metrics", []string{"date=2025-04-10/hour=10/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res, []string{"date=2025-04-10/hour=10"}) {
+		t.Fatalf("expected the hour 10 to be dropped, got %v", res)
+	}
+	if files := hourFiles("db", "metrics", ts); len(files) != 0 {
+		t.Fatalf("expected the files of the dropped partition to be removed, got %v", files)
+	}
+	if files := hourFiles("db", "metrics", ts.Add(time.Hour)); len(files) != 1 {
+		t.Fatalf("expected the files of the hour 11 to be kept, got %v", files)
+	}
+	indexes := partitionIndexes[[2]string{"db", "metrics"}]
+	indexes.m.Lock()
+	_, stopped := indexes.parts["date=2025-04-10/hour=10"]
+	_, kept := indexes.parts["date=2025-04-10/hour=11"]
+	indexes.m.Unlock()
+	if stopped || !kept {
+		t.Fatal("expected the index of the dropped partition only to be stopped")
+	}
+
+	// the rows written after the drop go to a new partition
+	storeRow(t, "db", "metrics", ts, []int64{3})
+	if files := hourFiles("db", "metrics", ts); len(files) != 1 {
+		t.Fatalf("expected the file written after the drop, got %v", files)
+	}
+}
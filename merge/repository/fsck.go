@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsckResult sums up an fsck run
+type FsckResult struct {
+	Partitions int
+	// Damaged is the number of partitions with discrepancies
+	Damaged int
+	Rebuilt int
+}
+
+// Fsck checks the metadata.json of every partition of every table of GIGAPI_ROOT against its parquet files
+// and writes the discrepancies to out. If rebuild is set, the metadata.json of the damaged partitions
+// is rebuilt from the parquet footers. The server must not be running.
+func Fsck(rebuild bool, out io.Writer) (FsckResult, error) {
+	var res FsckResult
+	root := config.Config.Gigapi.Root
+	defs := make(map[[2]string]*shared.Table)
+	err := withCatalog(func(conn *sql.DB) error {
+		tables, err := GetAllTableMetadata(conn)
+		for _, t := range tables {
+			defs[[2]string{t.Database, t.Name}] = t
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(out, "The table definitions are not available, the default timestamp field is used: %v\n", err)
+	}
+
+	dbs, err := os.ReadDir(root)
+	if err != nil {
+		return res, err
+	}
+	for _, db := range dbs {
+		if !db.IsDir() || !tableNameCheck.MatchString(db.Name()) {
+			continue
+		}
+		names, err := os.ReadDir(filepath.Join(root, db.Name()))
+		if err != nil {
+			return res, err
+		}
+		for _, name := range names {
+			tablePath := filepath.Join(root, db.Name(), name.Name())
+			if !name.IsDir() || !tableNameCheck.MatchString(name.Name()) || !isTableFolder(tablePath) {
+				continue
+			}
+			t := defs[[2]string{db.Name(), name.Name()}]
+			if t == nil {
+				t = &shared.Table{Database: db.Name(), Name: name.Name(), TimestampField: DefaultTimestampField}
+			}
+			_t := *t
+			_t.Path = tablePath
+			err = fsckTable(&_t, rebuild, out, &res)
+			if err != nil {
+				return res, fmt.Errorf("%s.%s: %w", db.Name(), name.Name(), err)
+			}
+		}
+	}
+	fmt.Fprintf(out, "%d partitions checked, %d damaged, %d rebuilt\n", res.Partitions, res.Damaged, res.Rebuilt)
+	return res, nil
+}
+
+func fsckTable(t *shared.Table, rebuild bool, out io.Writer, res *FsckResult) error {
+	return filepath.WalkDir(t.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || p == t.Path {
+			return nil
+		}
+		rel := strings.TrimPrefix(p, t.Path+string(filepath.Separator))
+		var values [][2]string
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) < 2 {
+				return filepath.SkipDir
+			}
+			values = append(values, [2]string{kv[0], kv[1]})
+		}
+		problems, err := index.CheckPartition(t, p)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			if _, err := os.Stat(filepath.Join(p, "metadata.json")); err == nil {
+				res.Partitions++
+			}
+			return nil
+		}
+		res.Partitions++
+		res.Damaged++
+		partition := fmt.Sprintf("%s.%s/%s", t.Database, t.Name, rel)
+		for _, problem := range problems {
+			fmt.Fprintf(out, "%s: %s\n", partition, problem)
+		}
+		if !rebuild {
+			return nil
+		}
+		skipped, err := index.RebuildPartition(t, values)
+		for _, s := range skipped {
+			fmt.Fprintf(out, "%s: skipped the unreadable file %s\n", partition, s)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "%s: rebuild failed: %v\n", partition, err)
+			return nil
+		}
+		res.Rebuilt++
+		fmt.Fprintf(out, "%s: metadata.json rebuilt\n", partition)
+		return nil
+	})
+}
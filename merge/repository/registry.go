@@ -2,13 +2,17 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gigapi/gigapi-config/config"
 	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/iceberg"
 	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/quarantine"
 	"github.com/gigapi/gigapi/v2/merge/service"
 	"github.com/gigapi/gigapi/v2/merge/shared"
 	"github.com/gigapi/gigapi/v2/utils"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,15 +22,27 @@ import (
 	"time"
 )
 
-var conn *sql.DB
-
 var registry = make(map[[2]string]service.MergeService)
 var mergeTicker *time.Ticker
 var registryMtx sync.Mutex
 
-func InitRegistry(_conn *sql.DB) error {
+// mergeTicks are the intervals between the merge plannings of the tables
+var mergeTicks = make(map[[2]string]time.Duration)
+
+// tables are the effective definitions of the registered tables
+var tables = make(map[[2]string]*shared.Table)
+
+func InitRegistry() error {
+	go emptyTrash()
+	go RunDiskMonitor()
+	err := PopulateRegistry()
+	if err != nil {
+		return err
+	}
 	if !config.Config.Gigapi.NoMerges {
 		go RunMerge()
+		go RunRetention()
+		go RunTiering()
 	}
 	return nil
 }
@@ -39,19 +55,28 @@ func GetTable(db string, name string) (service.MergeService, error) {
 	return table, nil
 }
 
+// RunMerge plans and runs the merges of every table once the tick of its compaction policy passed
 func RunMerge() {
-	mergeTicker = time.NewTicker(time.Second * 10)
+	mergeTicker = time.NewTicker(time.Second)
+	lastMerge := make(map[[2]string]time.Time)
 	for range mergeTicker.C {
+		// the merges are paused while a volume is above the high watermark
+		if diskFull() != nil {
+			continue
+		}
 		_registry := make(map[[2]string]service.MergeService, len(registry))
 		func() {
 			registryMtx.Lock()
 			defer registryMtx.Unlock()
 			for k, v := range registry {
-				_registry[k] = v
+				if time.Since(lastMerge[k]) >= mergeTicks[k] {
+					_registry[k] = v
+				}
 			}
 		}()
 
-		for _, table := range _registry {
+		for k, table := range _registry {
+			lastMerge[k] = time.Now()
 			err := table.DoMerge()
 			if err != nil {
 				fmt.Println(err)
@@ -65,15 +90,23 @@ var tableNameCheck = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 var m sync.Mutex
 
 func Store(db string, name string, columns map[string]any) utils.Promise[int32] {
+	return StoreTagged(db, name, columns, nil)
+}
+
+// StoreTagged stores the data and records the columns parsed from tags in the schema registry of the table
+func StoreTagged(db string, name string, columns map[string]any, tags []string) utils.Promise[int32] {
 	if db == "" {
 		db = "default"
 	}
+	if err := diskFull(); err != nil {
+		return utils.Fulfilled(err, int32(0))
+	}
 	//TODO: add the thread id to the table name
 	//TODO: introduce Redis to synchronize several writers
 	m.Lock()
 	table := registry[[2]string{db, name}]
 	if table == nil {
-		err := RegisterSimpleTable(db, name)
+		err := registerTable(db, name)
 		if err != nil {
 			m.Unlock()
 			return utils.Fulfilled(err, int32(0))
@@ -81,80 +114,356 @@ func Store(db string, name string, columns map[string]any) utils.Promise[int32]
 		table = registry[[2]string{db, name}]
 	}
 	m.Unlock()
-	return table.Store(columns)
+	res := table.Store(columns)
+	if len(tags) > 0 {
+		table.MarkTags(tags)
+	}
+	return res
+}
+
+// GetTableSchema returns the columns of the table from its schema registry
+func GetTableSchema(db string, name string) ([]service.ColumnSchema, error) {
+	registryMtx.Lock()
+	table := registry[[2]string{db, name}]
+	registryMtx.Unlock()
+	if table == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	return table.GetSchema(), nil
+}
+
+// GetMergePlan returns the merges the planner would run now for the table, without running them
+func GetMergePlan(db string, name string) ([]service.LevelPlanReport, error) {
+	registryMtx.Lock()
+	table := registry[[2]string{db, name}]
+	registryMtx.Unlock()
+	if table == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	return table.DryRunPlan()
+}
+
+// DeleteRows deletes the rows of the table matching the request
+func DeleteRows(db string, name string, req service.DeleteRequest) ([]service.PartitionDeleteReport, error) {
+	if req.From >= req.To {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, "the time range is empty")
+	}
+	err := service.CheckPredicate(req.Predicate)
+	if err != nil {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, err.Error())
+	}
+	registryMtx.Lock()
+	table := registry[[2]string{db, name}]
+	registryMtx.Unlock()
+	if table == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	res, err := table.Delete(req)
+	if errors.Is(err, service.ErrInvalidPredicate) || errors.Is(err, service.ErrDeleteNotSupported) ||
+		errors.Is(err, service.ErrDeleteTiered) {
+		return nil, utils.NewGigapiError(http.StatusBadRequest, err.Error())
+	}
+	return res, err
+}
+
+// registerTable registers the table from its definition in the catalog
+// or as a simple table if it is not defined
+func registerTable(db, name string) error {
+	var def *shared.Table
+	err := withCatalog(func(conn *sql.DB) error {
+		var err error
+		def, err = GetTableMetadata(conn, db, name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if def == nil {
+		return RegisterSimpleTable(db, name)
+	}
+	def.IndexCreator = newIndexCreator(def)
+	return RegisterNewTable(def)
+}
+
+// CreateTable validates the table definition, stores it in the catalog and registers the table
+func CreateTable(table *shared.Table) error {
+	if table.Database == "" {
+		table.Database = "default"
+	}
+	err := normalizeTableDefinition(table)
+	if err != nil {
+		return utils.NewGigapiError(http.StatusBadRequest, err.Error())
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := registry[[2]string{table.Database, table.Name}]; ok {
+		return utils.NewGigapiError(http.StatusConflict,
+			fmt.Sprintf("table %s.%s already exists", table.Database, table.Name))
+	}
+	err = withCatalog(func(conn *sql.DB) error {
+		def, err := GetTableMetadata(conn, table.Database, table.Name)
+		if err != nil {
+			return err
+		}
+		if def != nil {
+			return utils.NewGigapiError(http.StatusConflict,
+				fmt.Sprintf("table %s.%s already exists", table.Database, table.Name))
+		}
+		return InsertTableMetadata(conn, table)
+	})
+	if err != nil {
+		return err
+	}
+	table.IndexCreator = newIndexCreator(table)
+	return RegisterNewTable(table)
+}
+
+// GetTableDefinitions returns the tables defined in the catalog for the database, or all of them if db is empty
+func GetTableDefinitions(db string) ([]*shared.Table, error) {
+	var tables []*shared.Table
+	err := withCatalog(func(conn *sql.DB) error {
+		var err error
+		tables, err = GetAllTableMetadata(conn)
+		return err
+	})
+	if err != nil || db == "" {
+		return tables, err
+	}
+	res := make([]*shared.Table, 0, len(tables))
+	for _, t := range tables {
+		if t.Database == db {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// normalizeTableDefinition fills the defaults of the table definition and validates it
+func normalizeTableDefinition(table *shared.Table) error {
+	if !tableNameCheck.MatchString(table.Name) {
+		return fmt.Errorf("invalid table name, only letters and _ are accepted: %q", table.Name)
+	}
+	if !tableNameCheck.MatchString(table.Database) {
+		return fmt.Errorf("invalid database name, only letters and _ are accepted: %q", table.Database)
+	}
+	if table.Engine == "" {
+		table.Engine = "HiveMerge"
+	}
+	if table.Engine != "HiveMerge" && table.Engine != "Merge" {
+		return fmt.Errorf("unknown engine %q", table.Engine)
+	}
+	if table.TimestampField == "" {
+		table.TimestampField = DefaultTimestampField
+	}
+	if len(table.OrderBy) == 0 {
+		table.OrderBy = []string{table.TimestampField}
+	}
+	if table.Engine == "HiveMerge" && len(table.PartitionExpressions) == 0 {
+		table.PartitionExpressions = [][2]string{
+			{"date", fmt.Sprintf("toDate(%s)", table.TimestampField)},
+			{"hour", fmt.Sprintf("toHour(%s)", table.TimestampField)},
+		}
+	}
+	if table.Engine == "Merge" && len(table.PartitionExpressions) > 0 {
+		return fmt.Errorf("partition_by is supported by the HiveMerge engine only")
+	}
+	if table.Path == "" {
+		table.Path = path.Join(config.Config.Gigapi.Root, table.Database, table.Name)
+	}
+	if _, err := compactionPolicy(table); err != nil {
+		return err
+	}
+	if table.Retention != nil {
+		if err := table.Retention.Validate(); err != nil {
+			return err
+		}
+		if table.Engine != "HiveMerge" && table.Retention.TTLS > 0 {
+			return fmt.Errorf("retention is supported by the HiveMerge engine only")
+		}
+	}
+
+	declared := make(map[string]string, len(table.Columns))
+	for i, c := range table.Columns {
+		builder, ok := data_types.DataTypes[c.Type]
+		if !ok {
+			return fmt.Errorf("column %q: unknown type %q", c.Name, c.Type)
+		}
+		if c.Name == "" {
+			return fmt.Errorf("column name is required")
+		}
+		if _, ok := declared[c.Name]; ok {
+			return fmt.Errorf("column %q is declared twice", c.Name)
+		}
+		col, err := builder(c.Name, nil, 0, 0)
+		if err != nil {
+			return err
+		}
+		table.Columns[i].Type = col.GetTypeName()
+		declared[c.Name] = col.GetTypeName()
+	}
+	if len(declared) > 0 {
+		if tp, ok := declared[table.TimestampField]; ok && tp != data_types.DATA_TYPE_NAME_INT64 {
+			return fmt.Errorf("timestamp field %q must be Int64", table.TimestampField)
+		}
+		for _, c := range table.OrderBy {
+			_, ok := declared[c]
+			if !ok && c != table.TimestampField && c != shared.ArrivalTimestampField {
+				return fmt.Errorf("order_by column %q is not declared", c)
+			}
+		}
+	}
+	// the type of an undeclared column is only known once written
+	for _, c := range table.BloomFilterColumns {
+		if c == "" {
+			return fmt.Errorf("bloom filter column name is required")
+		}
+		if tp, ok := declared[c]; !ok || tp != data_types.DATA_TYPE_NAME_STRING {
+			return fmt.Errorf("bloom filter column %q must be a declared String column", c)
+		}
+	}
+	return service.ValidatePartitionExpressions(table.PartitionExpressions)
 }
 
+// DefaultTimestampField is the event time column of the implicitly created tables.
+// It matches the time column produced by the line protocol parser.
+const DefaultTimestampField = "time"
+
 func RegisterSimpleTable(db, name string) error {
 	if db == "" {
 		db = "default"
 	}
 	table := &shared.Table{
-		Database: db,
-		Name:     name,
-		Engine:   "HiveMerge",
-		OrderBy:  []string{"__timestamp"},
-		Path:     path.Join(config.Config.Gigapi.Root, db, name),
+		Database:       db,
+		Name:           name,
+		Engine:         "HiveMerge",
+		OrderBy:        []string{DefaultTimestampField},
+		Path:           path.Join(config.Config.Gigapi.Root, db, name),
+		TimestampField: DefaultTimestampField,
 		PartitionBy: func(m map[string]data_types.IColumn) ([]shared.PartitionDesc, error) {
-			tsCol, ok := m["__timestamp"]
+			tsCol, ok := m[DefaultTimestampField]
 			if !ok {
-				return nil, fmt.Errorf("table %q does not have a '__timestamp' column", name)
+				return nil, fmt.Errorf("table %q does not have a '%s' column", name, DefaultTimestampField)
 			}
 			tsData, ok := tsCol.GetData().([]int64)
 			if !ok {
-				return nil, fmt.Errorf("column '__timestamp' has non-int64 data type")
+				return nil, fmt.Errorf("column '%s' has non-int64 data type", DefaultTimestampField)
 			}
+			return hourPartitions(tsData), nil
+		},
+		AutoTimestamp: true,
+	}
+	table.IndexCreator = newIndexCreator(table)
+	return RegisterNewTable(table)
+}
 
-			parts := make(map[int64]*shared.PartitionDesc)
-			lastPartId := int64(0)
-			var lastPart *shared.PartitionDesc
-			for i, ts := range tsData {
-				id := int64(ts / 86400000000000)
-				if lastPart == nil || lastPartId != id {
-					lastPartId = id
-					if _, ok := parts[id]; !ok {
-						parts[id] = &shared.PartitionDesc{
-							Values: [][2]string{
-								{"date", time.Unix(0, ts).UTC().Format("2006-01-02")},
-								{"hour", time.Unix(0, ts).UTC().Format("15")},
-							},
-							IndexMap: make([]byte, (len(tsData)+7)/8),
-						}
-					}
-					lastPart = parts[id]
+// hourPartitions splits the rows into date=YYYY-MM-DD/hour=HH partitions by their timestamps (ns)
+func hourPartitions(tsData []int64) []shared.PartitionDesc {
+	const hour = int64(time.Hour)
+	parts := make(map[int64]*shared.PartitionDesc)
+	lastPartId := int64(0)
+	var lastPart *shared.PartitionDesc
+	for i, ts := range tsData {
+		id := ts / hour
+		if ts%hour < 0 {
+			id--
+		}
+		if lastPart == nil || lastPartId != id {
+			lastPartId = id
+			if _, ok := parts[id]; !ok {
+				parts[id] = &shared.PartitionDesc{
+					Values: [][2]string{
+						{"date", time.Unix(0, ts).UTC().Format("2006-01-02")},
+						{"hour", time.Unix(0, ts).UTC().Format("15")},
+					},
+					IndexMap: make([]byte, (len(tsData)+7)/8),
 				}
-				lastPart.IndexMap[i/8] |= 1 << (uint(i) % 8)
-			}
-			res := make([]shared.PartitionDesc, 0, len(parts))
-			for _, desc := range parts {
-				res = append(res, *desc)
 			}
-			return res, nil
+			lastPart = parts[id]
+		}
+		lastPart.IndexMap[i/8] |= 1 << (uint(i) % 8)
+	}
+	res := make([]shared.PartitionDesc, 0, len(parts))
+	for _, desc := range parts {
+		res = append(res, *desc)
+	}
+	return res
+}
 
-		},
-		AutoTimestamp: true,
+// tableIndexes are the partition indexes of a table, one per partition folder
+type tableIndexes struct {
+	m        sync.Mutex
+	table    *shared.Table
+	parts    map[string]shared.Index
+	exporter *iceberg.Exporter
+}
+
+// partitionIndexes are the partition indexes of the tables
+var partitionIndexes = make(map[[2]string]*tableIndexes)
+
+// newIndexCreator returns the IndexCreator sharing one metadata.json index per partition folder.
+// With GIGAPI_ICEBERG_EXPORT the changes of the indexes of the local hive tables are exported as Iceberg metadata.
+func newIndexCreator(table *shared.Table) func(values [][2]string) (shared.Index, error) {
+	res := &tableIndexes{table: table, parts: make(map[string]shared.Index)}
+	registryMtx.Lock()
+	partitionIndexes[[2]string{table.Database, table.Name}] = res
+	registryMtx.Unlock()
+	return func(values [][2]string) (shared.Index, error) {
+		res.m.Lock()
+		defer res.m.Unlock()
+		return res.get(values)
+	}
+}
+
+func indexName(values [][2]string) string {
+	idxName := make([]string, len(values))
+	for i, v := range values {
+		idxName[i] = fmt.Sprintf("%s=%s", v[0], v[1])
+	}
+	return path.Join(idxName...)
+}
+
+func (t *tableIndexes) get(values [][2]string) (shared.Index, error) {
+	table := t.table
+	if t.exporter == nil && table.Engine == "HiveMerge" && !strings.HasPrefix(table.Path, "s3://") && iceberg.Enabled() {
+		t.exporter = iceberg.NewExporter(table, func() []shared.TableColumn {
+			return tableColumns(table)
+		})
+		t.exporter.Run()
 	}
-	m := sync.Mutex{}
-	parts := make(map[string]shared.Index)
-	table.IndexCreator = func(values [][2]string) (shared.Index, error) {
-		m.Lock()
-		defer m.Unlock()
-		idxName := make([]string, len(values))
-		for i, v := range values {
-			idxName[i] = fmt.Sprintf("%s=%s", v[0], v[1])
+	idx, ok := t.parts[indexName(values)]
+	if !ok {
+		idx, err := index.NewJSONIndexForPartition(table, values)
+		if err != nil {
+			return nil, err
 		}
-		idx, ok := parts[path.Join(idxName...)]
-		if !ok {
-			idx, err := index.NewJSONIndexForPartition(table, values)
-			if err != nil {
-				return nil, err
-			}
-			parts[path.Join(idxName...)] = idx
-			idx.Run()
-			return idx, nil
+		idx.Run()
+		if t.exporter != nil {
+			idx = t.exporter.WrapIndex(idx, values)
 		}
+		t.parts[indexName(values)] = idx
 		return idx, nil
 	}
-	return RegisterNewTable(table)
+	return idx, nil
+}
+
+// tableColumns returns the columns of the schema registry of the table, or its declared columns
+// if the table is not registered yet
+func tableColumns(table *shared.Table) []shared.TableColumn {
+	registryMtx.Lock()
+	svc := registry[[2]string{table.Database, table.Name}]
+	registryMtx.Unlock()
+	if svc == nil {
+		return table.Columns
+	}
+	schema := svc.GetSchema()
+	if len(schema) == 0 {
+		return table.Columns
+	}
+	res := make([]shared.TableColumn, len(schema))
+	for i, c := range schema {
+		res[i] = shared.TableColumn{Name: c.Name, Type: c.Type}
+	}
+	return res
 }
 
 func RegisterNewTable(table *shared.Table) error {
@@ -167,11 +476,24 @@ func RegisterNewTable(table *shared.Table) error {
 	if _, ok := registry[[2]string{table.Database, table.Name}]; ok {
 		return nil
 	}
+	policy, err := compactionPolicy(table)
+	if err != nil {
+		fmt.Printf("Table %s.%s: %v, using the configured compaction policy\n", table.Database, table.Name, err)
+		policy = configuredCompactionPolicy(table.Database, table.Name)
+	}
+	// the services use the effective settings, the definition keeps the settings of the DDL
+	svcTable := *table
+	svcTable.Compaction = policy
+	if svcTable.BloomFilterColumns == nil {
+		svcTable.BloomFilterColumns = configuredBloomFilterColumns()
+	}
+	svcTable.WidenToString = svcTable.WidenToString || configuredWidenToString(table.Database, table.Name)
+	table = &svcTable
 	_table := *table
 	if strings.HasPrefix(table.Path, "s3://") {
 		_table.Path = path.Join(config.Config.Gigapi.Root, table.Database, table.Name)
 	}
-	err := createTableFolders(&_table)
+	err = createTableFolders(&_table)
 	if err != nil {
 		return err
 	}
@@ -181,37 +503,85 @@ func RegisterNewTable(table *shared.Table) error {
 	}*/
 	registryMtx.Lock()
 	defer registryMtx.Unlock()
+	var svc service.MergeService
 	switch table.Engine {
 	case "Merge":
-		registry[[2]string{table.Database, table.Name}], err = service.NewMergeTreeService(table)
+		svc, err = service.NewMergeTreeService(table)
 	case "HiveMerge":
-		registry[[2]string{table.Database, table.Name}] =
-			service.NewMultithreadHiveMergeTreeService(0, table)
+		svc, err = service.NewMultithreadHiveMergeTreeService(0, table)
+	default:
+		err = fmt.Errorf("unknown engine %q", table.Engine)
 	}
 	if err != nil {
 		return err
 	}
-	registry[[2]string{table.Database, table.Name}].Run()
+	registry[[2]string{table.Database, table.Name}] = svc
+	mergeTicks[[2]string{table.Database, table.Name}] = policy.Tick()
+	tables[[2]string{table.Database, table.Name}] = table
+	svc.Run()
 	return nil
 }
 
+// PopulateRegistry registers the tables defined in the catalog and the tables found in the root folder
+// (<root>/<db>/<table>), so their merges and drop queues are handled without waiting for a write.
 func PopulateRegistry() error {
-	/*tables, err := GetAllTableMetadata(conn)
+	var tables []*shared.Table
+	err := withCatalog(func(conn *sql.DB) error {
+		var err error
+		tables, err = GetAllTableMetadata(conn)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+
+	m.Lock()
+	defer m.Unlock()
 	for _, table := range tables {
-		registryMtx.Lock()
-		registry[table.Name], err = service.NewMergeTreeService(table)
+		table.IndexCreator = newIndexCreator(table)
+		err = RegisterNewTable(table)
+		if err != nil {
+			fmt.Printf("Failed to register table %s.%s: %v\n", table.Database, table.Name, err)
+		}
+	}
+
+	dbs, err := os.ReadDir(config.Config.Gigapi.Root)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if !db.IsDir() || !tableNameCheck.MatchString(db.Name()) {
+			continue
+		}
+		names, err := os.ReadDir(filepath.Join(config.Config.Gigapi.Root, db.Name()))
 		if err != nil {
-			registryMtx.Unlock()
 			return err
 		}
-		registry[table.Name].Run()
-		registryMtx.Unlock()
-	}*/
+		for _, name := range names {
+			if !name.IsDir() || !tableNameCheck.MatchString(name.Name()) ||
+				!isTableFolder(filepath.Join(config.Config.Gigapi.Root, db.Name(), name.Name())) {
+				continue
+			}
+			if _, ok := registry[[2]string{db.Name(), name.Name()}]; ok {
+				continue
+			}
+			err = RegisterSimpleTable(db.Name(), name.Name())
+			if err != nil {
+				fmt.Printf("Failed to register table %s.%s: %v\n", db.Name(), name.Name(), err)
+			}
+		}
+	}
 	return nil
+}
 
+// isTableFolder checks if the folder has the layout created by createTableFolders
+func isTableFolder(p string) bool {
+	for _, sub := range []string{"tmp", "data"} {
+		if stat, err := os.Stat(filepath.Join(p, sub)); err == nil && stat.IsDir() {
+			return true
+		}
+	}
+	return false
 }
 
 func createTableFolders(table *shared.Table) error {
@@ -224,3 +594,51 @@ func createTableFolders(table *shared.Table) error {
 	}
 	return os.MkdirAll(filepath.Join(table.Path, "data"), 0755)
 }
+
+// ReplayQuarantined casts the columns of the quarantined batch to the types of the casts map
+// and stores it into the table. The entry is removed once the data is saved.
+func ReplayQuarantined(db, name, id string, casts map[string]string) error {
+	if err := diskFull(); err != nil {
+		return err
+	}
+	entry, err := quarantine.Get(db, name, id)
+	if err != nil {
+		return err
+	}
+	data, err := quarantine.GetData(db, name, id)
+	if err != nil {
+		return err
+	}
+	for column, tp := range casts {
+		colData, ok := data[column]
+		if !ok {
+			return utils.NewGigapiError(http.StatusBadRequest,
+				fmt.Sprintf("column %q is not in the quarantined batch", column))
+		}
+		data[column], err = data_types.Cast(colData, tp)
+		if err != nil {
+			return utils.NewGigapiError(http.StatusBadRequest,
+				fmt.Sprintf("failed to cast column %q to %s: %v", column, tp, err))
+		}
+	}
+
+	m.Lock()
+	table := registry[[2]string{db, name}]
+	if table == nil {
+		err = registerTable(db, name)
+		table = registry[[2]string{db, name}]
+	}
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	err = table.CheckTypes(data)
+	if err != nil {
+		return utils.NewGigapiError(http.StatusConflict, err.Error())
+	}
+	_, err = table.Store(data).Get()
+	if err != nil {
+		return err
+	}
+	return quarantine.Remove(db, name, entry.Id)
+}
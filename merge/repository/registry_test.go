@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHourPartitions(t *testing.T) {
+	day := time.Date(2025, 4, 10, 0, 0, 0, 0, time.UTC)
+	ts := []int64{
+		day.Add(10*time.Hour + time.Minute).UnixNano(),
+		day.Add(11*time.Hour + 59*time.Minute).UnixNano(),
+		day.Add(10*time.Hour + 30*time.Minute).UnixNano(),
+		day.Add(24*time.Hour + 10*time.Hour).UnixNano(),
+		day.Add(-time.Nanosecond).UnixNano(),
+		day.Add(11 * time.Hour).UnixNano(),
+	}
+	parts := hourPartitions(ts)
+	rows := make(map[string][]int)
+	for _, p := range parts {
+		name := p.Values[0][0] + "=" + p.Values[0][1] + "/" + p.Values[1][0] + "=" + p.Values[1][1]
+		for i := range ts {
+			if p.IndexMap[i/8]&(1<<(uint(i)%8)) != 0 {
+				rows[name] = append(rows[name], i)
+			}
+		}
+	}
+	expected := map[string][]int{
+		"date=2025-04-10/hour=10": {0, 2},
+		"date=2025-04-10/hour=11": {1, 5},
+		"date=2025-04-11/hour=10": {3},
+		"date=2025-04-09/hour=23": {4},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d partitions, got %v", len(expected), rows)
+	}
+	for name, idx := range expected {
+		if !slices.Equal(rows[name], idx) {
+			t.Fatalf("partition %s: expected the rows %v, got %v", name, idx, rows[name])
+		}
+	}
+	// every row is in the folder of its own hour
+	for _, p := range parts {
+		for i := range ts {
+			if p.IndexMap[i/8]&(1<<(uint(i)%8)) == 0 {
+				continue
+			}
+			hour := time.Unix(0, ts[i]).UTC().Format("2006-01-02/15")
+			if hour != strings.Join([]string{p.Values[0][1], p.Values[1][1]}, "/") {
+				t.Fatalf("row %d of %s is in the partition %v", i, hour, p.Values)
+			}
+		}
+	}
+	if len(hourPartitions(nil)) != 0 {
+		t.Fatal("expected no partition for no rows")
+	}
+}
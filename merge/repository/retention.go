@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetentionIntervalS = 300
+
+var (
+	retentionPoliciesOnce sync.Once
+	retentionPolicies     map[string]*shared.RetentionPolicy
+)
+
+// configuredRetentionPolicies returns the policies of GIGAPI_RETENTION_POLICIES.
+// The variable holds a JSON object, or the path of a JSON file, mapping "db.table", "db.*" or "*"
+// to a retention policy.
+func configuredRetentionPolicies() map[string]*shared.RetentionPolicy {
+	retentionPoliciesOnce.Do(func() {
+		retentionPolicies = make(map[string]*shared.RetentionPolicy)
+		err := readJSONSetting("GIGAPI_RETENTION_POLICIES", &retentionPolicies)
+		if err != nil {
+			fmt.Println(err)
+			retentionPolicies = make(map[string]*shared.RetentionPolicy)
+		}
+	})
+	return retentionPolicies
+}
+
+// retentionPolicy returns the retention policy of the table definition or the configured one.
+// It returns nil if the data of the table is kept forever.
+func retentionPolicy(table *shared.Table) *shared.RetentionPolicy {
+	policy := table.Retention
+	if policy == nil {
+		policies := configuredRetentionPolicies()
+		for _, key := range []string{table.Database + "." + table.Name, table.Database + ".*", "*"} {
+			if p, ok := policies[key]; ok && p != nil {
+				if err := p.Validate(); err != nil {
+					fmt.Printf("GIGAPI_RETENTION_POLICIES %q: %v\n", key, err)
+					continue
+				}
+				policy = p
+				break
+			}
+		}
+	}
+	if policy == nil || policy.TTLS == 0 {
+		return nil
+	}
+	return policy
+}
+
+// retentionInterval returns GIGAPI_RETENTION_INTERVAL_S: the interval between two runs of the retention
+func retentionInterval() time.Duration {
+	s, err := strconv.Atoi(utils.GetEnv("GIGAPI_RETENTION_INTERVAL_S", ""))
+	if err != nil || s <= 0 {
+		s = defaultRetentionIntervalS
+	}
+	return time.Duration(s) * time.Second
+}
+
+// RunRetention applies the retention policies of the tables every GIGAPI_RETENTION_INTERVAL_S
+func RunRetention() {
+	ticker := time.NewTicker(retentionInterval())
+	for range ticker.C {
+		ApplyRetention()
+	}
+}
+
+// ApplyRetention drops the partitions of the registered tables older than their retention policy
+// and trims the rows of the boundary partitions of the policies with row level precision.
+// The retention applies to the local HiveMerge tables.
+func ApplyRetention() {
+	svcs := make(map[[2]string]service.MergeService)
+	_tables := make(map[[2]string]*shared.Table)
+	registryMtx.Lock()
+	for k, svc := range registry {
+		if table := tables[k]; table != nil {
+			svcs[k], _tables[k] = svc, table
+		}
+	}
+	registryMtx.Unlock()
+	for k, table := range _tables {
+		policy := retentionPolicy(table)
+		if policy == nil || table.Engine != "HiveMerge" || strings.HasPrefix(table.Path, "s3://") {
+			continue
+		}
+		err := applyRetention(svcs[k], table, policy)
+		if err != nil {
+			fmt.Printf("Retention: table %s.%s: %v\n", table.Database, table.Name, err)
+		}
+	}
+}
+
+// partitionMaxTime returns the max_time of the indexed files of a partition.
+// It returns false if the partition is empty or a file has no time range.
+func partitionMaxTime(entries []*shared.IndexEntry, tsField string) (int64, bool) {
+	res := int64(math.MinInt64)
+	for _, e := range entries {
+		t, ok := e.Max[tsField].(int64)
+		if !ok {
+			return 0, false
+		}
+		res = max(res, t)
+	}
+	return res, len(entries) > 0
+}
+
+// applyRetention drops the partitions of the table whose max_time is older than the TTL,
+// then trims the older rows of the other partitions if the policy has row level precision
+func applyRetention(svc service.MergeService, table *shared.Table, policy *shared.RetentionPolicy) error {
+	cutoff := time.Now().Add(-policy.TTL()).UnixNano()
+	tsField := table.GetTimestampField()
+	indexes, err := readPartitionIndexes(table, "")
+	if err != nil {
+		return err
+	}
+	var expired [][][2]string
+	maxTimes := make(map[string]int64)
+	for _, p := range indexes {
+		maxTime, known := partitionMaxTime(p.idx.List(), tsField)
+		if !known || maxTime >= cutoff {
+			continue
+		}
+		values, err := parsePartitionPath(p.rel)
+		if err != nil {
+			return err
+		}
+		expired = append(expired, values)
+		maxTimes[p.rel] = maxTime
+	}
+	if len(expired) > 0 {
+		dropped, err := dropPartitions(table.Database, table.Name, expired, removeAsync)
+		for _, rel := range dropped {
+			fmt.Printf("Retention: table %s.%s: dropped the partition %s, max_time %s is older than the TTL %v\n",
+				table.Database, table.Name, rel, time.Unix(0, maxTimes[rel]).UTC().Format(time.RFC3339), policy.TTL())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !policy.RowLevel {
+		return nil
+	}
+	// the tiered files are dropped with their partition only.
+	// The trim of a partition folder waits for its running merges and tiering, on all the threads.
+	reports, err := svc.Delete(service.DeleteRequest{From: math.MinInt64, To: cutoff, SkipTiered: true})
+	for _, r := range reports {
+		fmt.Printf("Retention: table %s.%s: trimmed %d rows older than %s from the partition %s\n",
+			table.Database, table.Name, r.RowsDeleted, time.Unix(0, cutoff).UTC().Format(time.RFC3339), r.Partition)
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// retainedValues returns the values of the indexed rows of the table in order
+func retainedValues(t *testing.T, table *shared.Table) string {
+	indexes, err := readPartitionIndexes(table, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, p := range indexes {
+		for _, e := range p.idx.List() {
+			files = append(files, "'"+e.Path+"'")
+		}
+	}
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	var res string
+	err = conn.QueryRow(fmt.Sprintf("SELECT string_agg(value::VARCHAR, ',' ORDER BY value) FROM read_parquet([%s])",
+		strings.Join(files, ","))).Scan(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestRowRetentionDuringMerge(t *testing.T) {
+	testRoot(t)
+	defer DropTable("db", "metrics")
+	var kept []string
+	// the retention starts at different points of the merge, every round in an older hour
+	for i, delay := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond} {
+		hour := time.Now().Add(-10 * time.Hour).Truncate(time.Hour).Add(-time.Duration(i) * time.Hour)
+		cutoff := hour.Add(30 * time.Minute)
+		// the rows of the hour are saved into several level 1 files
+		var promises []interface{ Get() (int32, error) }
+		for _, m := range []int{5, 10, 50, 55} {
+			ts := hour.Add(time.Duration(m) * time.Minute)
+			value := int64(i*100 + m)
+			promises = append(promises, Store("db", "metrics", map[string]any{
+				"time": []int64{ts.UnixNano()}, "value": []int64{value}}))
+			if ts.After(cutoff) {
+				kept = append(kept, fmt.Sprint(value))
+			}
+		}
+		for _, p := range promises {
+			if _, err := p.Get(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		registryMtx.Lock()
+		svc, table := registry[[2]string{"db", "metrics"}], tables[[2]string{"db", "metrics"}]
+		registryMtx.Unlock()
+		policy := &shared.RetentionPolicy{TTLS: int64(time.Since(cutoff).Seconds()), RowLevel: true}
+
+		var wg sync.WaitGroup
+		var mergeErr, retentionErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mergeErr = svc.DoMerge()
+		}()
+		go func() {
+			defer wg.Done()
+			time.Sleep(delay)
+			retentionErr = applyRetention(svc, table, policy)
+		}()
+		wg.Wait()
+		if mergeErr != nil || retentionErr != nil {
+			t.Fatalf("merge: %v, retention: %v", mergeErr, retentionErr)
+		}
+		if values := retainedValues(t, table); values != strings.Join(kept, ",") {
+			t.Fatalf("delay %v: expected the rows %v to be kept once, got %s", delay, kept, values)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PartitionSnapshots are the retained snapshots of a partition, oldest first
+type PartitionSnapshots struct {
+	Partition string             `json:"partition"`
+	Version   uint64             `json:"version"`
+	Snapshots []*shared.Snapshot `json:"snapshots"`
+}
+
+// SnapshotFile is a file of a resolved snapshot
+type SnapshotFile struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	RowCount  int64  `json:"row_count"`
+	MinTime   any    `json:"min_time"`
+	MaxTime   any    `json:"max_time"`
+}
+
+// PartitionFiles are the files of the snapshot of a partition
+type PartitionFiles struct {
+	Partition string         `json:"partition"`
+	Version   uint64         `json:"version"`
+	Files     []SnapshotFile `json:"files"`
+}
+
+func getRegisteredTable(db, name string) (*shared.Table, error) {
+	registryMtx.Lock()
+	table := tables[[2]string{db, name}]
+	registryMtx.Unlock()
+	if table == nil {
+		return nil, utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("table %s.%s not found", db, name))
+	}
+	return table, nil
+}
+
+type partitionIndex struct {
+	rel string
+	idx shared.Index
+}
+
+// readPartitionIndexes reads the indexes of the partitions of the table, or of the partition folder if set
+func readPartitionIndexes(t *shared.Table, partition string) ([]partitionIndex, error) {
+	var res []partitionIndex
+	if strings.HasPrefix(t.Path, "s3://") {
+		return res, nil
+	}
+	err := filepath.WalkDir(t.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || p == t.Path {
+			return nil
+		}
+		rel, err := filepath.Rel(t.Path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !strings.Contains(d.Name(), "=") || (partition != "" && !strings.HasPrefix(partition+"/", rel+"/")) {
+			return filepath.SkipDir
+		}
+		if partition != "" && rel != partition {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "metadata.json")); err != nil {
+			if _, err := os.Stat(filepath.Join(p, "metadata.journal")); err != nil {
+				return nil
+			}
+		}
+		idx, err := index.ReadPartitionIndex(t, p)
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", rel, err)
+		}
+		res = append(res, partitionIndex{rel: rel, idx: idx})
+		return nil
+	})
+	if err == nil && partition != "" && len(res) == 0 {
+		err = utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("partition %s not found", partition))
+	}
+	return res, err
+}
+
+// GetSnapshots returns the retained snapshots of the partitions of the table, or of the partition if set
+func GetSnapshots(db, name, partition string) ([]PartitionSnapshots, error) {
+	t, err := getRegisteredTable(db, name)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := readPartitionIndexes(t, partition)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]PartitionSnapshots, len(indexes))
+	for i, p := range indexes {
+		snapshots := p.idx.Snapshots()
+		res[i] = PartitionSnapshots{
+			Partition: p.rel,
+			Version:   snapshots[len(snapshots)-1].Version,
+			Snapshots: snapshots,
+		}
+	}
+	return res, nil
+}
+
+// snapshotAt returns the version of the partition at the unix time in ns
+func snapshotAt(snapshots []*shared.Snapshot, at int64) (uint64, error) {
+	if at < snapshots[0].Time {
+		return 0, shared.ErrSnapshotExpired
+	}
+	i := sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i].Time > at
+	})
+	return snapshots[i-1].Version, nil
+}
+
+// ResolveSnapshot returns the files of the partitions of the table at the unix time in ns.
+// If the partition is set, only its files are returned, at the version if it is not nil.
+func ResolveSnapshot(db, name string, at int64, partition string, version *uint64) ([]PartitionFiles, error) {
+	t, err := getRegisteredTable(db, name)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := readPartitionIndexes(t, partition)
+	if err != nil {
+		return nil, err
+	}
+	tsField := t.GetTimestampField()
+	res := make([]PartitionFiles, 0, len(indexes))
+	for _, p := range indexes {
+		var v uint64
+		if version != nil {
+			v = *version
+		} else {
+			v, err = snapshotAt(p.idx.Snapshots(), at)
+		}
+		var entries []*shared.IndexEntry
+		if err == nil {
+			entries, err = p.idx.ResolveSnapshot(v)
+		}
+		if errors.Is(err, shared.ErrSnapshotExpired) {
+			return nil, utils.NewGigapiError(http.StatusGone, fmt.Sprintf("the snapshot of %s is not retained", p.rel))
+		}
+		if err != nil {
+			return nil, utils.NewGigapiError(http.StatusNotFound, err.Error())
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		files := make([]SnapshotFile, len(entries))
+		for i, e := range entries {
+			files[i] = SnapshotFile{
+				Path:      e.Path,
+				SizeBytes: e.SizeBytes,
+				RowCount:  e.RowCount,
+				MinTime:   e.Min[tsField],
+				MaxTime:   e.Max[tsField],
+			}
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		})
+		res = append(res, PartitionFiles{Partition: p.rel, Version: v, Files: files})
+	}
+	return res, nil
+}
+
+// PinSnapshot keeps the snapshot of the table at the unix time in ns resolvable and its files on disk for ttl.
+// It returns the id and the expiration time of the pin.
+func PinSnapshot(db, name string, at int64, ttl time.Duration) (string, time.Time, error) {
+	t, err := getRegisteredTable(db, name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	id, expires, err := index.Pin(t, at, ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// the snapshot must still be retained once pinned
+	indexes, err := readPartitionIndexes(t, "")
+	for _, p := range indexes {
+		if err != nil {
+			break
+		}
+		_, err = snapshotAt(p.idx.Snapshots(), at)
+		if errors.Is(err, shared.ErrSnapshotExpired) {
+			err = utils.NewGigapiError(http.StatusGone, fmt.Sprintf("the snapshot of %s is not retained", p.rel))
+		}
+	}
+	if err != nil {
+		index.Unpin(t, id)
+		return "", time.Time{}, err
+	}
+	return id, expires, nil
+}
+
+// UnpinSnapshot releases the pin of the table
+func UnpinSnapshot(db, name, id string) error {
+	t, err := getRegisteredTable(db, name)
+	if err != nil {
+		return err
+	}
+	if !index.Unpin(t, id) {
+		return utils.NewGigapiError(http.StatusNotFound, fmt.Sprintf("pin %s not found", id))
+	}
+	return nil
+}
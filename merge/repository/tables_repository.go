@@ -2,33 +2,75 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"path"
 	"sync"
 )
 
 var dbMtx sync.Mutex
 
-// TODO: Implement the incremental initialization of TablesTable
+// CatalogPath is the DuckDB database holding the `tables` catalog
+func CatalogPath() string {
+	return path.Join(config.Config.Gigapi.Root, "ddb.db")
+}
+
+// withCatalog runs fn with a connection to the catalog database.
+// The calls are serialized so only one DuckDB instance holds the file.
+func withCatalog(fn func(db *sql.DB) error) error {
+	dbMtx.Lock()
+	defer dbMtx.Unlock()
+	db, cancel, err := utils.ConnectDuckDB(CatalogPath())
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return fn(db)
+}
 
 func CreateDuckDBTablesTable(db *sql.DB) error {
+	// The first version of the catalog had no database column and was never written,
+	// so it is recreated.
+	var hasDatabase bool
+	err := db.QueryRow(`SELECT count(*) > 0 FROM information_schema.columns
+		WHERE table_name = 'tables' AND column_name = 'database'`).Scan(&hasDatabase)
+	if err != nil {
+		return fmt.Errorf("failed to inspect 'tables' table in DuckDB: %v", err)
+	}
+	if !hasDatabase {
+		_, err = db.Exec("DROP TABLE IF EXISTS tables")
+		if err != nil {
+			return fmt.Errorf("failed to drop outdated 'tables' table in DuckDB: %v", err)
+		}
+	}
+
 	// Adjusted schema using DuckDB's ARRAY type
 	query := `
 	CREATE TABLE IF NOT EXISTS tables (
-		name VARCHAR PRIMARY KEY, 
+		database VARCHAR,
+		name VARCHAR,
 		path VARCHAR,
-		field_names  VARCHAR[],     
-		field_types VARCHAR[],     
-		order_by VARCHAR[],       
-		engine VARCHAR,     
-		timestamp_field VARCHAR,    
+		field_names  VARCHAR[],
+		field_types VARCHAR[],
+		order_by VARCHAR[],
+		engine VARCHAR,
+		timestamp_field VARCHAR,
 		timestamp_precision VARCHAR,
 		partition_by VARCHAR,
 		auto_timestamp BOOLEAN DEFAULT FALSE,
+		compaction VARCHAR,
+		bloom_filter_columns VARCHAR[],
+		retention VARCHAR,
+		PRIMARY KEY (database, name)
 	);
 	`
 
 	// Execute the query to create the table if it doesn't exist
-	_, err := db.Exec(query)
+	_, err = db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("failed to create 'tables' table in DuckDB: %v", err)
 	}
@@ -36,42 +78,147 @@ func CreateDuckDBTablesTable(db *sql.DB) error {
 	return nil
 }
 
-/*func InsertTableMetadata(db *sql.DB, table *shared.Table) error {
-	orderByJSON, err := json.Marshal(table.OrderBy)
+// InsertTableMetadata stores the table definition. It fails if the table is already defined.
+func InsertTableMetadata(db *sql.DB, table *shared.Table) error {
+	fieldNames := make([]string, len(table.Columns))
+	fieldTypes := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		fieldNames[i], fieldTypes[i] = c.Name, c.Type
+	}
+	var arrays [4][]byte
+	for i, arr := range [][]string{fieldNames, fieldTypes, table.OrderBy, table.BloomFilterColumns} {
+		if arr == nil {
+			arr = []string{}
+		}
+		var err error
+		arrays[i], err = json.Marshal(arr)
+		if err != nil {
+			return err
+		}
+	}
+	partitionBy, err := json.Marshal(table.PartitionExpressions)
 	if err != nil {
 		return err
 	}
+	var compaction sql.NullString
+	if table.Compaction != nil {
+		data, err := json.Marshal(table.Compaction)
+		if err != nil {
+			return err
+		}
+		compaction = sql.NullString{String: string(data), Valid: true}
+	}
+	var retention sql.NullString
+	if table.Retention != nil {
+		data, err := json.Marshal(table.Retention)
+		if err != nil {
+			return err
+		}
+		retention = sql.NullString{String: string(data), Valid: true}
+	}
 
 	query := `INSERT INTO tables (
-        name, path, order_by, engine, timestamp_field, timestamp_precision, partition_by, auto_timestamp
-    ) SELECT ?, ?, ?::JSON::VARCHAR[], ?, ?, ?, ?, ? ON CONFLICT DO NOTHING`
+        database, name, path, field_names, field_types, order_by, engine, timestamp_field, partition_by, auto_timestamp,
+        compaction, bloom_filter_columns, retention
+    ) SELECT ?, ?, ?, ?::JSON::VARCHAR[], ?::JSON::VARCHAR[], ?::JSON::VARCHAR[], ?, ?, ?, ?, ?, ?::JSON::VARCHAR[], ?`
 	_, err = db.Exec(query,
-		table.Name, table.Path, string(orderByJSON),
-		table.Engine, table.TimestampField, table.TimestampPrecision, table.PartitionBy, table.AutoTimestamp)
-
+		table.Database, table.Name, table.Path, string(arrays[0]), string(arrays[1]), string(arrays[2]),
+		table.Engine, table.TimestampField, string(partitionBy), table.AutoTimestamp, compaction, string(arrays[3]), retention)
 	return err
 }
 
+const selectTableMetadata = `SELECT database, name, path, field_names, field_types, order_by, engine,
+	timestamp_field, partition_by, auto_timestamp, compaction, bloom_filter_columns, retention FROM tables`
+
 func GetAllTableMetadata(db *sql.DB) ([]*shared.Table, error) {
-	query := `SELECT name, path, order_by, engine, timestamp_field, timestamp_precision, partition_by, auto_timestamp FROM tables;`
-	rows, err := db.Query(query)
+	rows, err := db.Query(selectTableMetadata + " ORDER BY database, name")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	tables := make([]*shared.Table, 0)
 	for rows.Next() {
-		var table shared.Table
-		var orderBy []any
-		err := rows.Scan(&table.Name, &table.Path, &orderBy, &table.Engine, &table.TimestampField,
-			&table.TimestampPrecision, &table.PartitionBy, &table.AutoTimestamp)
+		table, err := scanTableMetadata(rows)
 		if err != nil {
 			return nil, err
 		}
-		for _, v := range orderBy {
-			table.OrderBy = append(table.OrderBy, v.(string))
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// GetTableMetadata returns the table definition or nil if the table is not defined
+func GetTableMetadata(db *sql.DB, database, name string) (*shared.Table, error) {
+	rows, err := db.Query(selectTableMetadata+" WHERE database = ? AND name = ?", database, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanTableMetadata(rows)
+}
+
+func scanTableMetadata(rows *sql.Rows) (*shared.Table, error) {
+	var (
+		table                            shared.Table
+		fieldNames, fieldTypes, orderBy  []any
+		bloomFilterColumns               []any
+		_path, timestampField, partition sql.NullString
+		compaction, retention            sql.NullString
+	)
+	err := rows.Scan(&table.Database, &table.Name, &_path, &fieldNames, &fieldTypes, &orderBy, &table.Engine,
+		&timestampField, &partition, &table.AutoTimestamp, &compaction, &bloomFilterColumns, &retention)
+	if err != nil {
+		return nil, err
+	}
+	table.Path = _path.String
+	table.TimestampField = timestampField.String
+	if len(fieldNames) != len(fieldTypes) {
+		return nil, errors.New("corrupted table definition: field_names and field_types differ in length")
+	}
+	for i := range fieldNames {
+		table.Columns = append(table.Columns, shared.TableColumn{
+			Name: fieldNames[i].(string),
+			Type: fieldTypes[i].(string),
+		})
+	}
+	for _, v := range orderBy {
+		table.OrderBy = append(table.OrderBy, v.(string))
+	}
+	for _, v := range bloomFilterColumns {
+		table.BloomFilterColumns = append(table.BloomFilterColumns, v.(string))
+	}
+	if partition.String != "" {
+		err = json.Unmarshal([]byte(partition.String), &table.PartitionExpressions)
+		if err != nil {
+			return nil, fmt.Errorf("corrupted partition_by of table %s.%s: %w", table.Database, table.Name, err)
+		}
+	}
+	if compaction.String != "" {
+		table.Compaction = &shared.CompactionPolicy{}
+		err = json.Unmarshal([]byte(compaction.String), table.Compaction)
+		if err != nil {
+			return nil, fmt.Errorf("corrupted compaction of table %s.%s: %w", table.Database, table.Name, err)
 		}
-		tables = append(tables, &table)
 	}
-	return tables, nil
-}*/
+	if retention.String != "" {
+		table.Retention = &shared.RetentionPolicy{}
+		err = json.Unmarshal([]byte(retention.String), table.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("corrupted retention of table %s.%s: %w", table.Database, table.Name, err)
+		}
+	}
+	return &table, nil
+}
+
+// DeleteTableMetadata removes the table definition. It returns false if the table was not defined.
+func DeleteTableMetadata(db *sql.DB, database, name string) (bool, error) {
+	res, err := db.Exec("DELETE FROM tables WHERE database = ? AND name = ?", database, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/service"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTieringAgeS      = 86400
+	defaultTieringIntervalS = 300
+)
+
+// tieringTarget returns GIGAPI_TIERING_S3: the S3 URL the cold partitions are moved to,
+// s3://<key>:<secret>@<host>/<bucket>/<path>?secure=false&region=<region>. Empty disables the tiering.
+func tieringTarget() string {
+	return utils.GetEnv("GIGAPI_TIERING_S3", "")
+}
+
+// tieringAge returns GIGAPI_TIERING_AGE_S: the age of the newest row of a partition to move it to S3
+func tieringAge() time.Duration {
+	s, err := strconv.Atoi(utils.GetEnv("GIGAPI_TIERING_AGE_S", ""))
+	if err != nil || s < 0 {
+		s = defaultTieringAgeS
+	}
+	return time.Duration(s) * time.Second
+}
+
+// tieringInterval returns GIGAPI_TIERING_INTERVAL_S: the interval between two runs of the tiering
+func tieringInterval() time.Duration {
+	s, err := strconv.Atoi(utils.GetEnv("GIGAPI_TIERING_INTERVAL_S", ""))
+	if err != nil || s <= 0 {
+		s = defaultTieringIntervalS
+	}
+	return time.Duration(s) * time.Second
+}
+
+// RunTiering moves the cold partitions to S3 every GIGAPI_TIERING_INTERVAL_S if GIGAPI_TIERING_S3 is set
+func RunTiering() {
+	if tieringTarget() == "" {
+		return
+	}
+	ticker := time.NewTicker(tieringInterval())
+	for range ticker.C {
+		ApplyTiering()
+	}
+}
+
+// ApplyTiering moves the files of the fully compacted partitions older than GIGAPI_TIERING_AGE_S
+// of the registered tables to GIGAPI_TIERING_S3. The tiering applies to the local HiveMerge tables.
+func ApplyTiering() {
+	target := tieringTarget()
+	if target == "" {
+		return
+	}
+	svcs := make(map[[2]string]service.MergeService)
+	_tables := make(map[[2]string]*shared.Table)
+	registryMtx.Lock()
+	for k, svc := range registry {
+		if table := tables[k]; table != nil {
+			svcs[k], _tables[k] = svc, table
+		}
+	}
+	registryMtx.Unlock()
+	before := time.Now().Add(-tieringAge()).UnixNano()
+	for k, table := range _tables {
+		if table.Engine != "HiveMerge" || strings.HasPrefix(table.Path, "s3://") {
+			continue
+		}
+		reports, err := svcs[k].Tier(target, before)
+		for _, r := range reports {
+			fmt.Printf("Tiering: table %s.%s: moved %d files (%d bytes) of the partition %s to %s\n",
+				table.Database, table.Name, r.Files, r.Bytes, r.Partition, r.Location)
+		}
+		if err != nil {
+			fmt.Printf("Tiering: table %s.%s: %v\n", table.Database, table.Name, err)
+		}
+	}
+}
+
+// removeTiered removes in the background the files of the table tiered to S3,
+// only the files of the partition if values are set
+func removeTiered(table *shared.Table, values [][2]string) {
+	target := tieringTarget()
+	if target == "" {
+		return
+	}
+	go func() {
+		err := service.RemoveTiered(target, table, values)
+		if err != nil {
+			fmt.Printf("Failed to remove the tiered files of the table %s.%s: %v\n", table.Database, table.Name, err)
+		}
+	}()
+}
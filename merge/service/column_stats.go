@@ -0,0 +1,112 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"strconv"
+	"strings"
+)
+
+// bloomFilterBitsPerValue is the size of the bloom filters per distinct value, about 1% of false positives
+const bloomFilterBitsPerValue = 10
+
+// minBloomFilterBits is the size of the bloom filters of the files of a few distinct values
+const minBloomFilterBits = 64
+
+// bloomFilterBits returns the maximal size of the bloom filters: GIGAPI_BLOOM_FILTER_BITS
+func bloomFilterBits() uint32 {
+	bits, err := strconv.ParseUint(utils.GetEnv("GIGAPI_BLOOM_FILTER_BITS", ""), 10, 32)
+	if err != nil || bits == 0 {
+		return shared.DefaultBloomFilterBits
+	}
+	return uint32(bits)
+}
+
+// bloomFilterSize returns the size of the bloom filter of a column of distinct values:
+// the power of two of at least bloomFilterBitsPerValue bits per value, at most GIGAPI_BLOOM_FILTER_BITS
+func bloomFilterSize(distinct int) uint32 {
+	limit := bloomFilterBits()
+	res := uint64(minBloomFilterBits)
+	for res < uint64(distinct)*bloomFilterBitsPerValue && res < uint64(limit) {
+		res *= 2
+	}
+	return uint32(min(res, uint64(limit)))
+}
+
+// fillColumnStats sets the min/max and the null counts of all the columns of the saved data.
+// The bloom filters are built by the merges, see fillBloomFilters.
+func fillColumnStats(store map[string]data_types.IColumn, entry *shared.IndexEntry) {
+	entry.Min = make(map[string]any, len(store))
+	entry.Max = make(map[string]any, len(store))
+	entry.NullCounts = make(map[string]int64, len(store))
+	for name, col := range store {
+		var nulls int64
+		for _, valid := range col.GetValids() {
+			if !valid {
+				nulls++
+			}
+		}
+		entry.NullCounts[name] = nulls
+		_min, _max := col.GetMinMax()
+		if _min != nil {
+			entry.Min[name], entry.Max[name] = _min, _max
+		}
+	}
+}
+
+// fillBloomFilters sets the bloom filters of the String columns of t.BloomFilterColumns of the merged file,
+// sized from the distinct values of the column. The level 1 files have none: their filters would be
+// rebuilt by the first merge anyway, and sizing them for the merged files would bloat metadata.json.
+func fillBloomFilters(t *shared.Table, name string, entry *shared.IndexEntry) error {
+	entry.BloomFilters = nil
+	// metadata.json lists the bloom filters with the null counts
+	if len(t.BloomFilterColumns) == 0 || entry.NullCounts == nil {
+		return nil
+	}
+	types, err := fileColumnTypes([]string{name})
+	if err != nil {
+		return err
+	}
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for _, c := range t.BloomFilterColumns {
+		if types[0][c] != data_types.DATA_TYPE_NAME_STRING {
+			// the column is not in the file or is of another type in a table of GIGAPI_BLOOM_FILTER_COLUMNS
+			continue
+		}
+		ident := `"` + strings.ReplaceAll(c, `"`, `""`) + `"`
+		rows, err := conn.Query(fmt.Sprintf("SELECT DISTINCT %s FROM read_parquet('%s') WHERE %s IS NOT NULL",
+			ident, strings.ReplaceAll(name, "'", "''"), ident))
+		if err != nil {
+			return err
+		}
+		var values []string
+		for rows.Next() {
+			var v string
+			err = rows.Scan(&v)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			values = append(values, v)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		bloom := shared.NewBloomFilter(bloomFilterSize(len(values)))
+		for _, v := range values {
+			bloom.Add(v)
+		}
+		if entry.BloomFilters == nil {
+			entry.BloomFilters = make(map[string]*shared.BloomFilter)
+		}
+		entry.BloomFilters[c] = bloom
+	}
+	return nil
+}
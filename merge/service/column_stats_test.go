@@ -0,0 +1,109 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"path/filepath"
+	"testing"
+)
+
+func statsEntry(rows int64, columns ...data_types.IColumn) *shared.IndexEntry {
+	store := make(map[string]data_types.IColumn)
+	for _, c := range columns {
+		store[c.GetName()] = c
+	}
+	entry := &shared.IndexEntry{RowCount: rows}
+	fillColumnStats(store, entry)
+	return entry
+}
+
+func TestMergeIndexStats(t *testing.T) {
+	col := func(name string, data any) data_types.IColumn {
+		tp := "Int64"
+		if _, ok := data.([]string); ok {
+			tp = "String"
+		}
+		c, err := data_types.DataTypes[tp](name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	hosts := col("host", []string{"b", "c"})
+	hosts.AppendNulls(1)
+	a := statsEntry(3, col("time", []int64{10, 20, 30}), hosts)
+	b := statsEntry(2, col("time", []int64{5, 15}), col("host", []string{"a", "b"}),
+		col("value", []int64{7, 8}))
+	if a.Min["host"] != "b" || a.NullCounts["host"] != 1 {
+		t.Fatalf("unexpected stats: %v %v", a.Min, a.NullCounts)
+	}
+
+	merged := &shared.IndexEntry{RowCount: 5}
+	shared.MergeIndexStats(merged, []*shared.IndexEntry{a, b}, "time")
+	if merged.Min["time"] != int64(5) || merged.Max["time"] != int64(30) ||
+		merged.Min["host"] != "a" || merged.Max["host"] != "c" {
+		t.Fatalf("unexpected min/max: %v %v", merged.Min, merged.Max)
+	}
+	if merged.NullCounts["host"] != 1 || merged.NullCounts["value"] != 3 {
+		t.Fatalf("unexpected null counts: %v", merged.NullCounts)
+	}
+	if a.BloomFilters != nil || merged.BloomFilters != nil {
+		t.Fatal("expected the bloom filters to be built by the merges only")
+	}
+
+	// the statistics of the other columns are dropped if a source has the time range only
+	legacy := &shared.IndexEntry{RowCount: 1, Min: map[string]any{"time": int64(1)}, Max: map[string]any{"time": int64(1)}}
+	shared.MergeIndexStats(merged, []*shared.IndexEntry{a, legacy}, "time")
+	if merged.NullCounts != nil || merged.Min["time"] != int64(1) || len(merged.Min) != 1 {
+		t.Fatalf("unexpected stats of a legacy merge: %v %v", merged.Min, merged.NullCounts)
+	}
+}
+
+func TestBloomFilterSize(t *testing.T) {
+	tests := []struct {
+		distinct int
+		expected uint32
+	}{
+		{0, 64},
+		{6, 64},
+		{7, 128},
+		{1000, 16384},
+		{1000000, shared.DefaultBloomFilterBits},
+	}
+	for _, test := range tests {
+		if size := bloomFilterSize(test.distinct); size != test.expected {
+			t.Fatalf("%d distinct values: expected %d bits, got %d", test.distinct, test.expected, size)
+		}
+	}
+}
+
+func TestFillBloomFilters(t *testing.T) {
+	table := &shared.Table{TimestampField: "time", BloomFilterColumns: []string{"host", "value", "missing"}}
+	name := filepath.Join(t.TempDir(), "a.2.parquet")
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	_, err = conn.Exec(fmt.Sprintf(`COPY (SELECT i::BIGINT AS time, CASE WHEN i %% 10 = 0 THEN NULL ELSE 'host' || (i %% 50) END AS host,
+		i AS value FROM range(1, 1000) t(i)) TO '%s' (FORMAT 'parquet')`, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &shared.IndexEntry{NullCounts: map[string]int64{"time": 0, "host": 99, "value": 0}}
+	err = fillBloomFilters(table, name, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.BloomFilters) != 1 {
+		t.Fatalf("expected the bloom filter of the string column only, got %v", entry.BloomFilters)
+	}
+	// 45 distinct hosts
+	bloom := entry.BloomFilters["host"]
+	if bloom == nil || bloom.M != 512 || !bloom.MayContain("host1") || !bloom.MayContain("host49") ||
+		bloom.MayContain("host50") {
+		t.Fatalf("unexpected bloom filter: %v", bloom)
+	}
+}
@@ -1,7 +1,6 @@
 package service
 
 import (
-	"fmt"
 	"github.com/apache/arrow/go/v14/arrow"
 	"github.com/apache/arrow/go/v14/arrow/array"
 	"github.com/gigapi/gigapi/v2/merge/data_types"
@@ -33,22 +32,62 @@ func (uds *unorderedDataStore) VerifyData(data map[string]data_types.IColumn) er
 	uds.mtx.Lock()
 	defer uds.mtx.Unlock()
 	for k, field := range data {
-		dataCol, ok := data[k]
+		storeCol, ok := uds.store[k]
 		if !ok {
 			continue
 		}
-		if uds.store[k].GetTypeName() != field.GetTypeName() {
-			return fmt.Errorf("column `%s` type mismatch: expected %s, got %s",
-				k, field.GetTypeName(), dataCol.GetTypeName())
+		if _, ok := data_types.WidenType(storeCol.GetTypeName(), field.GetTypeName()); !ok {
+			return &TypeConflictError{Column: k, Expected: storeCol.GetTypeName(), Actual: field.GetTypeName()}
 		}
 	}
 	return nil
 }
 
+// widen reconciles the column types of the data with the stored columns.
+// The stored columns are converted in place, the data is copied before the conversion.
+func (uds *unorderedDataStore) widen(data map[string]data_types.IColumn) (map[string]data_types.IColumn, error) {
+	res := data
+	copied := false
+	for k, field := range data {
+		storeCol, ok := uds.store[k]
+		if !ok || storeCol.GetTypeName() == field.GetTypeName() {
+			continue
+		}
+		tp, ok := data_types.WidenType(storeCol.GetTypeName(), field.GetTypeName())
+		if !ok {
+			return nil, &TypeConflictError{Column: k, Expected: storeCol.GetTypeName(), Actual: field.GetTypeName()}
+		}
+		var err error
+		uds.store[k], err = data_types.CastColumn(storeCol, tp)
+		if err != nil {
+			return nil, err
+		}
+		if tp == field.GetTypeName() {
+			continue
+		}
+		if !copied {
+			res = make(map[string]data_types.IColumn, len(data))
+			for name, col := range data {
+				res[name] = col
+			}
+			copied = true
+		}
+		res[k], err = data_types.CastColumn(field, tp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
 func (uds *unorderedDataStore) AppendByMask(data map[string]data_types.IColumn, mask []byte) error {
 	uds.mtx.Lock()
 	defer uds.mtx.Unlock()
-	err := uds.normalizeSchema(data)
+	data, err := uds.widen(data)
+	if err != nil {
+		return err
+	}
+	err = uds.normalizeSchema(data)
 	if err != nil {
 		return err
 	}
@@ -110,13 +149,16 @@ func (uds *unorderedDataStore) AppendData(data map[string]data_types.IColumn) er
 	//TODO: remove the logic of dynamic schema and flush parquet immediately when schema changes
 	uds.mtx.Lock()
 	defer uds.mtx.Unlock()
+	data, err := uds.widen(data)
+	if err != nil {
+		return err
+	}
 	var sz int64
 	for _, c := range data {
 		sz = c.GetLength()
 		break
 	}
 	storeSize := int64(uds.getSize())
-	var err error
 	cols := uds.MergeColumns(data)
 	for _, k := range cols {
 		_, ok := uds.store[k]
@@ -0,0 +1,513 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"github.com/google/uuid"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrDeleteNotSupported is returned for the tables without a partition index
+var ErrDeleteNotSupported = errors.New("delete is supported by the local HiveMerge tables only")
+
+// ErrInvalidPredicate is returned if the predicate of a delete can't be evaluated
+var ErrInvalidPredicate = errors.New("invalid predicate")
+
+// DeleteRequest selects the rows to delete: the rows of the time range [From, To) in ns
+// matching the Predicate, a DuckDB SQL boolean expression. All the rows of the range are deleted
+// if the predicate is empty.
+type DeleteRequest struct {
+	From      int64
+	To        int64
+	Predicate string
+	// SkipTiered leaves the files tiered to S3 out instead of failing the delete
+	SkipTiered bool
+}
+
+// PartitionDeleteReport is the result of a delete in a partition
+type PartitionDeleteReport struct {
+	Partition      string `json:"partition"`
+	RowsDeleted    int64  `json:"rows_deleted"`
+	FilesRewritten int    `json:"files_rewritten"`
+	FilesRemoved   int    `json:"files_removed"`
+}
+
+// predicateClasses are the classes of the expressions allowed in the predicates of the deletes
+var predicateClasses = map[string]bool{
+	"COLUMN_REF":  true,
+	"CONSTANT":    true,
+	"COMPARISON":  true,
+	"CONJUNCTION": true,
+	"OPERATOR":    true,
+	"BETWEEN":     true,
+	"CASE":        true,
+	"CAST":        true,
+	"FUNCTION":    true,
+}
+
+// predicateFunctions are the functions allowed in the predicates of the deletes: the operators
+// and the scalar functions of the strings, the numbers and the times. The table and the system functions are not.
+var predicateFunctions = func() map[string]bool {
+	res := make(map[string]bool)
+	for _, name := range []string{
+		"+", "-", "*", "/", "//", "%", "**", "^", "||",
+		"~~", "!~~", "~~*", "!~~*", "~~~", "!~~~", "like_escape", "not_like_escape", "ilike_escape", "not_ilike_escape",
+		"list_value", "lower", "upper", "lcase", "ucase", "length", "strlen", "concat", "substring", "substr",
+		"trim", "ltrim", "rtrim", "replace", "left", "right", "starts_with", "ends_with", "prefix", "suffix",
+		"contains", "regexp_matches", "regexp_full_match", "abs", "round", "floor", "ceil", "ceiling", "sign",
+		"greatest", "least", "nullif", "ifnull", "isnan", "isinf", "epoch", "epoch_ms", "epoch_us", "epoch_ns",
+		"to_timestamp", "make_timestamp", "date_part", "date_trunc", "strftime", "strptime",
+	} {
+		res[name] = true
+	}
+	return res
+}()
+
+// CheckPredicate rejects the predicates that are not a single expression of the columns, the constants,
+// the operators and the scalar functions of predicateFunctions: a ';' or a comment outside of the quotes,
+// unbalanced parentheses, subqueries, table and system functions. The expression is parsed by DuckDB.
+func CheckPredicate(predicate string) error {
+	var quote rune
+	depth := 0
+	for i, c := range predicate {
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("%w: unbalanced parentheses", ErrInvalidPredicate)
+			}
+		case c == ';':
+			return fmt.Errorf("%w: ';' is not allowed", ErrInvalidPredicate)
+		case strings.HasPrefix(predicate[i:], "--") || strings.HasPrefix(predicate[i:], "/*"):
+			return fmt.Errorf("%w: comments are not allowed", ErrInvalidPredicate)
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return fmt.Errorf("%w: unterminated quote or parenthesis", ErrInvalidPredicate)
+	}
+	if strings.TrimSpace(predicate) == "" {
+		return nil
+	}
+	return checkPredicateExpression(predicate)
+}
+
+// checkPredicateExpression checks the expressions of the predicate serialized by json_serialize_sql
+func checkPredicateExpression(predicate string) error {
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	var serialized string
+	// the balanced parentheses keep the predicate in the WHERE clause
+	err = conn.QueryRow("SELECT json_serialize_sql(?::VARCHAR)::VARCHAR",
+		"SELECT * FROM t WHERE ("+predicate+")").Scan(&serialized)
+	if err != nil {
+		return err
+	}
+	var parsed struct {
+		Error        bool   `json:"error"`
+		ErrorMessage string `json:"error_message"`
+		Statements   []struct {
+			Node struct {
+				Type        string `json:"type"`
+				WhereClause any    `json:"where_clause"`
+			} `json:"node"`
+		} `json:"statements"`
+	}
+	err = json.Unmarshal([]byte(serialized), &parsed)
+	if err != nil {
+		return err
+	}
+	if parsed.Error {
+		return fmt.Errorf("%w: %s", ErrInvalidPredicate, parsed.ErrorMessage)
+	}
+	if len(parsed.Statements) != 1 || parsed.Statements[0].Node.Type != "SELECT_NODE" {
+		return fmt.Errorf("%w: not a single expression", ErrInvalidPredicate)
+	}
+	return checkPredicateNode(parsed.Statements[0].Node.WhereClause)
+}
+
+// checkPredicateNode checks the serialized expression and its children
+func checkPredicateNode(node any) error {
+	switch n := node.(type) {
+	case []any:
+		for _, child := range n {
+			err := checkPredicateNode(child)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if class, ok := n["class"].(string); ok {
+			if !predicateClasses[class] {
+				return fmt.Errorf("%w: %s expressions are not allowed", ErrInvalidPredicate, strings.ToLower(class))
+			}
+			switch class {
+			case "COLUMN_REF":
+				if names, _ := n["column_names"].([]any); len(names) != 1 {
+					return fmt.Errorf("%w: qualified column names are not allowed", ErrInvalidPredicate)
+				}
+			case "FUNCTION":
+				name, _ := n["function_name"].(string)
+				if !predicateFunctions[strings.ToLower(name)] {
+					return fmt.Errorf("%w: function %s is not allowed", ErrInvalidPredicate, name)
+				}
+			}
+		}
+		for _, child := range n {
+			err := checkPredicateNode(child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sqlIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (f *fsMergeService) deleteCondition(req DeleteRequest) string {
+	tsField := sqlIdent(f.table.GetTimestampField())
+	res := fmt.Sprintf("%s >= %d AND %s < %d", tsField, req.From, tsField, req.To)
+	if req.Predicate != "" {
+		res += " AND (" + req.Predicate + ")"
+	}
+	return res
+}
+
+// deleteSource returns the rows of the file with the missing columns of the table as NULL,
+// so the predicate can use the columns added after the file was written. It returns the added columns.
+func (f *fsMergeService) deleteSource(name string) (string, []string, error) {
+	source := fmt.Sprintf("read_parquet('%s', hive_partitioning = false)", name)
+	if f.schema == nil {
+		return source, nil, nil
+	}
+	fileTypes, err := fileColumnTypes([]string{name})
+	if err != nil {
+		return "", nil, err
+	}
+	var missing, nulls []string
+	for _, c := range f.schema.Columns() {
+		if _, ok := fileTypes[0][c.Name]; ok {
+			continue
+		}
+		missing = append(missing, sqlIdent(c.Name))
+		nulls = append(nulls, fmt.Sprintf("NULL::%s AS %s", c.Type, sqlIdent(c.Name)))
+	}
+	if len(missing) == 0 {
+		return source, nil, nil
+	}
+	return fmt.Sprintf("(SELECT *, %s FROM %s)", strings.Join(nulls, ", "), source), missing, nil
+}
+
+// deleteRows rewrites the indexed files of the partition in the time range without the matching rows.
+// A file is swapped with its rewrite in the index like the sources of a merge with its result,
+// and is removed once no retained snapshot references it. The delete fails before any rewrite
+// if a file of the range was tiered to S3, unless the request skips the tiered files.
+func (f *fsMergeService) deleteRows(req DeleteRequest) (PartitionDeleteReport, error) {
+	var res PartitionDeleteReport
+	if f.index == nil {
+		return res, ErrDeleteNotSupported
+	}
+	err := CheckPredicate(req.Predicate)
+	if err != nil {
+		return res, err
+	}
+	tsField := f.table.GetTimestampField()
+	entries := f.index.List()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	inRange := entries[:0]
+	for _, entry := range entries {
+		if minTime, ok := entry.Min[tsField].(int64); ok && minTime >= req.To {
+			continue
+		}
+		if maxTime, ok := entry.Max[tsField].(int64); ok && maxTime < req.From {
+			continue
+		}
+		if isTiered(entry.Path) {
+			if req.SkipTiered {
+				continue
+			}
+			return res, ErrDeleteTiered
+		}
+		inRange = append(inRange, entry)
+	}
+	for _, entry := range inRange {
+		deleted, rewritten, err := f.deleteFromFile(entry, req)
+		if err != nil {
+			return res, err
+		}
+		res.RowsDeleted += deleted
+		switch {
+		case deleted == 0:
+		case rewritten:
+			res.FilesRewritten++
+		default:
+			res.FilesRemoved++
+		}
+	}
+	return res, nil
+}
+
+// deleteFromFile deletes the matching rows of the file. The file is removed from the index
+// if all its rows match, rewritten through the tmp folder otherwise.
+func (f *fsMergeService) deleteFromFile(entry *shared.IndexEntry, req DeleteRequest) (int64, bool, error) {
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		return 0, false, err
+	}
+	defer cancel()
+	source, missing, err := f.deleteSource(entry.Path)
+	if err != nil {
+		return 0, false, err
+	}
+	condition := f.deleteCondition(req)
+	var deleted int64
+	err = conn.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s WHERE %s", source, condition)).Scan(&deleted)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %v", ErrInvalidPredicate, err)
+	}
+	if deleted == 0 {
+		return 0, false, nil
+	}
+	if deleted >= entry.RowCount {
+		prom := f.index.Batch(nil, []string{entry.Path})
+		f.index.AddToDropQueue([]string{entry.Path})
+		_, err = prom.Get()
+		return deleted, false, err
+	}
+
+	// the rewrite stays at the level of the file: <uuid>.<level>.parquet
+	uid, _ := uuid.NewUUID()
+	to := uid.String() + path.Ext(strings.TrimSuffix(entry.Path, ".parquet")) + ".parquet"
+	tmpFilePath := filepath.Join(f.tmpPath, to)
+	finalFilePath := filepath.Join(f.dataPath, to)
+	columns := "*"
+	if len(missing) > 0 {
+		columns = "* EXCLUDE (" + strings.Join(missing, ", ") + ")"
+	}
+	_, err = conn.Exec(fmt.Sprintf("COPY(SELECT %s FROM %s WHERE (%s) IS NOT TRUE)TO '%s' (FORMAT 'parquet')",
+		columns, source, condition, tmpFilePath))
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return 0, false, err
+	}
+	err = writeIntent(f.dataPath, to, []string{entry.Path}, true)
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return 0, false, err
+	}
+	err = os.Rename(tmpFilePath, finalFilePath)
+	if err == nil {
+		err = f.indexRewrite(entry, finalFilePath)
+	}
+	if _, statErr := os.Stat(finalFilePath); err != nil && statErr == nil {
+		// the rewrite is rolled back at startup
+		return 0, false, err
+	}
+	os.Remove(mergeIntentPath(f.dataPath, to))
+	return deleted, true, err
+}
+
+// indexRewrite swaps the file with its rewrite in the index. The column statistics of the file
+// still bound the rewrite, the row count, the time range and the null counts are read from its footer.
+func (f *fsMergeService) indexRewrite(entry *shared.IndexEntry, name string) error {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	tsField := f.table.GetTimestampField()
+	rewrite, err := index.ParquetEntry(abs, tsField)
+	if err != nil {
+		return err
+	}
+	rewrite.ChunkTime = time.Now().UnixNano()
+	rewrite.WALSequence = entry.WALSequence
+	rewrite.BloomFilters = entry.BloomFilters
+	for name, v := range entry.Min {
+		if _, ok := rewrite.Min[name]; !ok {
+			rewrite.Min[name], rewrite.Max[name] = v, entry.Max[name]
+		}
+	}
+	if entry.NullCounts != nil {
+		rewrite.NullCounts, err = parquetNullCounts(abs)
+		if err != nil {
+			return err
+		}
+	}
+	prom := f.index.Batch([]*shared.IndexEntry{rewrite}, []string{entry.Path})
+	f.index.AddToDropQueue([]string{entry.Path})
+	_, err = prom.Get()
+	return err
+}
+
+// parquetNullCounts returns the null counts of the columns from the statistics of the parquet file.
+// The columns without null counts in some row group are left out.
+func parquetNullCounts(name string) (map[string]int64, error) {
+	reader, err := file.OpenParquetFile(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	meta := reader.MetaData()
+	res := make(map[string]int64, meta.Schema.NumColumns())
+	for col := 0; col < meta.Schema.NumColumns(); col++ {
+		var nulls int64
+		known := true
+		for i := 0; i < reader.NumRowGroups() && known; i++ {
+			chunk, err := meta.RowGroup(i).ColumnChunk(col)
+			if err != nil {
+				return nil, err
+			}
+			stats, err := chunk.Statistics()
+			if err != nil {
+				return nil, err
+			}
+			known = stats != nil && stats.HasNullCount()
+			if known {
+				nulls += stats.NullCount()
+			}
+		}
+		if known {
+			res[meta.Schema.Column(col).Name()] = nulls
+		}
+	}
+	return res, nil
+}
+
+// Delete saves the buffered rows and deletes the matching rows from the files of the partition.
+// It waits for the running merges of the partition folder, on all the threads.
+func (p *Partition) Delete(req DeleteRequest) (PartitionDeleteReport, error) {
+	p.Save()
+	p.mergeMtx.Lock()
+	defer p.mergeMtx.Unlock()
+	f, ok := p.mergeService.(*fsMergeService)
+	if !ok {
+		return PartitionDeleteReport{}, ErrDeleteNotSupported
+	}
+	if p.isDropped() {
+		return PartitionDeleteReport{Partition: p.name()}, nil
+	}
+	res, err := f.deleteRows(req)
+	res.Partition = p.name()
+	return res, err
+}
+
+func (s *MergeTreeService) Delete(req DeleteRequest) ([]PartitionDeleteReport, error) {
+	return nil, ErrDeleteNotSupported
+}
+
+// getPartition returns the partition of the values, loaded if the service doesn't have it
+func (h *HiveMergeTreeService) getPartition(values [][2]string) (*Partition, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	id := h.calculatePartitionHash(values)
+	if part, ok := h.partitions[id]; ok {
+		return part, nil
+	}
+	part, err := NewPartition(values, path.Join(h.Table.Path, "tmp"), h.getDataPath(values), h.Table, h.wal)
+	if err != nil {
+		return nil, err
+	}
+	h.partitions[id] = part
+	return part, nil
+}
+
+// deletePartitions returns the partitions having indexed files in the time range,
+// including the partitions of compacted files only, which are loaded for the delete
+func (m *MultithreadHiveMergeTreeService) deletePartitions(req DeleteRequest) ([]*Partition, error) {
+	h := m.svcs[0]
+	loaded := m.partitions()
+	tsField := h.Table.GetTimestampField()
+	var res []*Partition
+	err := filepath.WalkDir(h.Table.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "metadata.json")); err != nil {
+			return nil
+		}
+		values, ok := h.partitionValuesOf(p)
+		if !ok {
+			return filepath.SkipDir
+		}
+		if part, ok := loaded[h.calculatePartitionHash(values)]; ok {
+			res = append(res, part)
+			return filepath.SkipDir
+		}
+		idx, err := index.ReadPartitionIndex(h.Table, p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range idx.List() {
+			minTime, minOk := entry.Min[tsField].(int64)
+			maxTime, maxOk := entry.Max[tsField].(int64)
+			if (minOk && minTime >= req.To) || (maxOk && maxTime < req.From) {
+				continue
+			}
+			part, err := h.getPartition(values)
+			if err != nil {
+				return err
+			}
+			res = append(res, part)
+			break
+		}
+		return filepath.SkipDir
+	})
+	return res, err
+}
+
+// Delete deletes the matching rows from every partition of the table. The rows stored
+// before the delete are saved first, the merges running in a partition complete before its delete.
+func (m *MultithreadHiveMergeTreeService) Delete(req DeleteRequest) ([]PartitionDeleteReport, error) {
+	for _, h := range m.svcs {
+		h.flush()
+	}
+	partitions, err := m.deletePartitions(req)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]PartitionDeleteReport, 0, len(partitions))
+	for _, part := range partitions {
+		report, err := part.Delete(req)
+		if err != nil {
+			return res, fmt.Errorf("partition %s: %w", report.Partition, err)
+		}
+		if report.RowsDeleted > 0 {
+			res = append(res, report)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Partition < res[j].Partition
+	})
+	return res, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckPredicate(t *testing.T) {
+	valid := []string{
+		"",
+		"value = 1",
+		"value IN (1, 2) AND time BETWEEN 1 AND 5",
+		`"host" LIKE 'web-%' OR host IS NULL`,
+		"lower(host) = 'a;b' AND NOT (value > 2)",
+		"CASE WHEN value > 1 THEN true ELSE false END",
+		"value::VARCHAR = '1' AND time % 2 = 0",
+		"starts_with(host, '--') AND epoch_ns(ts) > 0",
+	}
+	for _, predicate := range valid {
+		if err := CheckPredicate(predicate); err != nil {
+			t.Fatalf("expected %q to be valid: %v", predicate, err)
+		}
+	}
+	invalid := []string{
+		"(SELECT count(*) FROM read_text('/etc/shadow')) > 0",
+		"value IN (SELECT 1)",
+		"EXISTS (SELECT 1)",
+		"getenv('HOME') = ''",
+		"length(read_text('/etc/passwd')[1].content) > 0",
+		"list_filter([1], x -> x > 0) = [1]",
+		"t.value = 1",
+		"value = 1; DROP TABLE t",
+		"value = 1 -- comment",
+		"value = 1 /* comment */",
+		"value = 1) UNION (SELECT 1",
+		"(value = 1",
+		"host = 'a",
+		"value = = 1",
+	}
+	for _, predicate := range invalid {
+		if err := CheckPredicate(predicate); !errors.Is(err, ErrInvalidPredicate) {
+			t.Fatalf("expected %q to be invalid, got %v", predicate, err)
+		}
+	}
+}
+
+func TestDeleteRows(t *testing.T) {
+	table := testTable(t)
+	a := writePartitionParquet(t, table, "a.1.parquet", 1, 2, 3)
+	b := writePartitionParquet(t, table, "b.1.parquet", 8, 9)
+	c := writePartitionParquet(t, table, "c.1.parquet", 20)
+	updateTestIndex(t, table, []string{a, b, c}, nil)
+	idx, err := table.IndexCreator(testPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	defer idx.Stop()
+	f := &fsMergeService{
+		dataPath: testPartitionPath(table),
+		tmpPath:  t.TempDir(),
+		table:    table,
+		index:    idx,
+	}
+
+	_, err = f.deleteRows(DeleteRequest{From: 1, To: 100, Predicate: "getenv('HOME') IS NOT NULL"})
+	if !errors.Is(err, ErrInvalidPredicate) {
+		t.Fatalf("expected the predicate to be rejected, got %v", err)
+	}
+
+	// the rows 1 and 2 of a are rewritten, all the rows of b are removed, c is out of the range
+	res, err := f.deleteRows(DeleteRequest{From: 1, To: 10, Predicate: "value <= 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PartitionDeleteReport{RowsDeleted: 4, FilesRewritten: 1, FilesRemoved: 1}
+	if res != expected {
+		t.Fatalf("expected the report %+v, got %+v", expected, res)
+	}
+	var rewrite string
+	var indexed []string
+	for _, e := range idx.List() {
+		indexed = append(indexed, e.Path)
+		if e.Path != c {
+			rewrite = e.Path
+		}
+	}
+	if len(indexed) != 2 || !slices.Contains(indexed, c) || rewrite == a || !strings.HasSuffix(rewrite, ".1.parquet") {
+		t.Fatalf("expected c and the rewrite of a to be indexed, got %v", indexed)
+	}
+	if dq := idx.GetDropQueue(); !slices.Contains(dq, a) || !slices.Contains(dq, b) {
+		t.Fatalf("expected a and b in the drop queue, got %v", dq)
+	}
+
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	var times string
+	err = conn.QueryRow(fmt.Sprintf("SELECT string_agg(time::VARCHAR, ',' ORDER BY time) FROM read_parquet('%s')",
+		rewrite)).Scan(&times)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times != "3" {
+		t.Fatalf("expected the rewrite to keep the row 3, got %s", times)
+	}
+	for _, e := range idx.List() {
+		if e.Path == rewrite && e.RowCount != 1 {
+			t.Fatalf("expected 1 row in the rewrite entry, got %d", e.RowCount)
+		}
+	}
+}
+
+func TestDeleteDuringMerge(t *testing.T) {
+	testConfig(t)
+	for i := 0; i < 5; i++ {
+		table := testTable(t)
+		table.PartitionExpressions = [][2]string{{"date", "toDate(time)"}}
+		runIndexes(t, table)
+		a := writePartitionParquet(t, table, "a.1.parquet", 1, 2, 3)
+		b := writePartitionParquet(t, table, "b.1.parquet", 8, 9)
+		svc, err := NewMultithreadHiveMergeTreeService(2, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the partitions of the two threads are distinct objects of the same folder
+		merging, err := svc.svcs[0].getPartition(testPartition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleting, err := svc.svcs[1].getPartition(testPartition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []*shared.IndexEntry
+		for _, name := range []string{a, b} {
+			entry, err := index.ParquetEntry(name, table.GetTimestampField())
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		if _, err = merging.index.Batch(entries, nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var mergeErr, deleteErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mergeErr = merging.DoMerge([]PlanMerge{{From: []string{a, b}, To: "c.2.parquet", Iteration: 2}})
+		}()
+		go func() {
+			defer wg.Done()
+			_, deleteErr = deleting.Delete(DeleteRequest{From: 1, To: 10, Predicate: "value = 2"})
+		}()
+		wg.Wait()
+		if mergeErr != nil || deleteErr != nil {
+			t.Fatalf("merge: %v, delete: %v", mergeErr, deleteErr)
+		}
+
+		// the rows 2 and 9 are deleted once, whichever runs first
+		var files []string
+		for _, e := range merging.index.List() {
+			files = append(files, "'"+e.Path+"'")
+		}
+		conn, cancel, err := utils.ConnectDuckDB("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var times string
+		err = conn.QueryRow(fmt.Sprintf("SELECT string_agg(time::VARCHAR, ',' ORDER BY time) FROM read_parquet([%s])",
+			strings.Join(files, ","))).Scan(&times)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if times != "1,3,8" {
+			t.Fatalf("expected the rows 1,3,8, got %s", times)
+		}
+		svc.Stop()
+	}
+}
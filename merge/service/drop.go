@@ -0,0 +1,161 @@
+package service
+
+import (
+	"errors"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrTableStopped is returned for the writes into a stopped table
+	ErrTableStopped = errors.New("the table is stopped")
+	// ErrTableDropped is returned for the rows not saved yet of a dropped table
+	ErrTableDropped = errors.New("the table was dropped")
+	// ErrPartitionDropped is returned for the rows not saved yet of a dropped partition
+	ErrPartitionDropped = errors.New("the partition was dropped")
+	// ErrNotPartitioned is returned for the partition drops of the tables without hive partitions
+	ErrNotPartitioned = errors.New("the table has no hive partitions")
+)
+
+// partitionName returns the folder of the partition values in the table folder
+func partitionName(values [][2]string) string {
+	res := make([]string, len(values))
+	for i, v := range values {
+		res[i] = v[0] + "=" + v[1]
+	}
+	return strings.Join(res, "/")
+}
+
+func (p *Partition) name() string {
+	return partitionName(p.Values)
+}
+
+func (p *Partition) isDropped() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.dropped
+}
+
+// drop discards the rows of the partition not saved yet, once its running save and merges completed.
+// The partition is not saved nor merged anymore.
+func (p *Partition) drop(err error) {
+	p.saveMtx.Lock()
+	defer p.saveMtx.Unlock()
+	p.mergeMtx.Lock()
+	defer p.mergeMtx.Unlock()
+	p.m.Lock()
+	p.dropped = true
+	promises := p.promises
+	p.promises = nil
+	walSeqs := p.walSeqs
+	p.walSeqs = nil
+	p.unordered = newUnorderedDataStore()
+	p.m.Unlock()
+	// the discarded rows are not replayed from the WAL
+	p.ackWAL(walSeqs)
+	for _, prom := range promises {
+		prom.Done(0, err)
+	}
+}
+
+// releaseTableSchema forgets the schema registry of the table, so a new table of the same name starts empty
+func releaseTableSchema(t *shared.Table) {
+	tableSchemasMtx.Lock()
+	defer tableSchemasMtx.Unlock()
+	delete(tableSchemas, t.Database+"."+t.Name)
+}
+
+// Drop stops the service and discards the rows not saved yet
+func (s *MergeTreeService) Drop() {
+	s.Stop()
+	s.mtx.Lock()
+	promises := s.promises
+	s.promises = nil
+	s.unorderedDataStore = newUnorderedDataStore()
+	s.mtx.Unlock()
+	for _, p := range promises {
+		p.Done(0, ErrTableDropped)
+	}
+	releaseTableSchema(s.Table)
+}
+
+func (s *MergeTreeService) DropPartitions(prefixes [][][2]string, drop func(values [][2]string) error) ([]string, error) {
+	return nil, ErrNotPartitioned
+}
+
+// Drop stops the service and discards the rows not saved yet. The running saves and merges complete first.
+func (m *MultithreadHiveMergeTreeService) Drop() {
+	m.Stop()
+	for _, h := range m.svcs {
+		h.mtx.Lock()
+		for _, part := range h.partitions {
+			part.drop(ErrTableDropped)
+		}
+		h.partitions = make(map[uint64]*Partition)
+		h.mtx.Unlock()
+	}
+	releaseTableSchema(m.svcs[0].Table)
+}
+
+// hasPrefix checks if the partition values start with the prefix
+func hasPrefix(values [][2]string, prefix [][2]string) bool {
+	return len(values) >= len(prefix) && slices.Equal(values[:len(prefix)], prefix)
+}
+
+// DropPartitions drops the partition folders (<key>=<value>/...) starting with one of the prefixes.
+// The partitions of the folders lose their rows not saved yet, once their running saves and merges completed,
+// and drop is called for every folder to remove it. The writes into the table wait for the drop.
+// It returns the dropped folders.
+func (m *MultithreadHiveMergeTreeService) DropPartitions(prefixes [][][2]string,
+	drop func(values [][2]string) error) ([]string, error) {
+	for _, h := range m.svcs {
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+	}
+	h := m.svcs[0]
+	res := make([]string, 0)
+	err := filepath.WalkDir(h.Table.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == h.Table.Path {
+			return nil
+		}
+		if !strings.Contains(d.Name(), "=") {
+			return filepath.SkipDir
+		}
+		values, ok := h.partitionValuesOf(p)
+		if !ok {
+			return filepath.SkipDir
+		}
+		matches, parent := false, false
+		for _, prefix := range prefixes {
+			matches = matches || hasPrefix(values, prefix)
+			parent = parent || hasPrefix(prefix, values)
+		}
+		if !matches {
+			if parent {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		for _, svc := range m.svcs {
+			for id, part := range svc.partitions {
+				if hasPrefix(part.Values, values) {
+					part.drop(ErrPartitionDropped)
+					delete(svc.partitions, id)
+				}
+			}
+		}
+		err = drop(values)
+		if err != nil {
+			return err
+		}
+		res = append(res, partitionName(values))
+		return filepath.SkipDir
+	})
+	return res, err
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig points the root folder of the configuration to a temp folder for the test
+func testConfig(t *testing.T) {
+	prev := config.Config
+	config.Config = &config.Configuration{Gigapi: config.GigapiConfiguration{Root: t.TempDir()}}
+	t.Cleanup(func() {
+		config.Config = prev
+	})
+}
+
+// runIndexes makes the index creator of the table run the indexes it creates until the end of the test.
+// The partitions of a folder share its index, like in the repository.
+func runIndexes(t *testing.T, table *shared.Table) {
+	var m sync.Mutex
+	indexes := map[string]shared.Index{}
+	table.IndexCreator = func(values [][2]string) (shared.Index, error) {
+		m.Lock()
+		defer m.Unlock()
+		if idx, ok := indexes[partitionName(values)]; ok {
+			return idx, nil
+		}
+		idx, err := index.NewJSONIndexForPartition(table, values)
+		if err != nil {
+			return nil, err
+		}
+		idx.Run()
+		t.Cleanup(idx.Stop)
+		indexes[partitionName(values)] = idx
+		return idx, nil
+	}
+}
+
+func TestDropPartitions(t *testing.T) {
+	testConfig(t)
+	table := testTable(t)
+	table.PartitionExpressions = [][2]string{{"date", "toDate(time)"}, {"hour", "toHour(time)"}}
+	runIndexes(t, table)
+	svc, err := NewMultithreadHiveMergeTreeService(1, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop()
+	day := time.Date(2025, 4, 10, 10, 0, 0, 0, time.UTC)
+	store := func(ts time.Time) utils.Promise[int32] {
+		return svc.Store(map[string]any{"time": []int64{ts.UnixNano()}, "value": []int64{1}})
+	}
+	var dropped [][][2]string
+	drop := func(values [][2]string) error {
+		dropped = append(dropped, values)
+		return os.RemoveAll(filepath.Join(table.Path, partitionName(values)))
+	}
+
+	// the rows are buffered: the flush loop is not running
+	hour10 := store(day)
+	hour11 := store(day.Add(time.Hour))
+	nextDay := store(day.Add(24 * time.Hour))
+
+	for _, test := range []struct {
+		prefixes [][][2]string
+		expected []string
+	}{
+		// the prefix starts with the first key
+		{[][][2]string{{{"hour", "10"}}}, []string{}},
+		{[][][2]string{{{"date", "2025-04-1"}}}, []string{}},
+		{[][][2]string{{{"date", "2025-04-10"}, {"hour", "10"}}}, []string{"date=2025-04-10/hour=10"}},
+		{[][][2]string{{{"date", "2025-04-10"}}, {{"date", "2025-04-12"}}}, []string{"date=2025-04-10"}},
+	} {
+		dropped = nil
+		res, err := svc.DropPartitions(test.prefixes, drop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(res, test.expected) || len(dropped) != len(test.expected) {
+			t.Fatalf("prefixes %v: expected the drops %v, got %v", test.prefixes, test.expected, res)
+		}
+	}
+
+	for _, prom := range []utils.Promise[int32]{hour10, hour11} {
+		if _, err := prom.Get(); !errors.Is(err, ErrPartitionDropped) {
+			t.Fatalf("expected the buffered rows of the dropped partitions to fail, got %v", err)
+		}
+	}
+	if len(svc.partitions()) != 1 {
+		t.Fatalf("expected the partition of the next day only, got %d partitions", len(svc.partitions()))
+	}
+	svc.svcs[0].flush()
+	if _, err := nextDay.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(table.Path, "date=2025-04-10")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dropped folder to be removed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(table.Path, "date=2025-04-11", "hour=10", "*.parquet"))
+	if len(files) != 1 {
+		t.Fatalf("expected the rows of the next day to be saved, got %v", files)
+	}
+
+	// the rows of a dropped partition written after the drop are saved into a new partition
+	again := store(day)
+	svc.svcs[0].flush()
+	if _, err := again.Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDropReleasesSchema(t *testing.T) {
+	testConfig(t)
+	table := testTable(t)
+	table.PartitionExpressions = [][2]string{{"date", "toDate(time)"}}
+	runIndexes(t, table)
+	svc, err := NewMultithreadHiveMergeTreeService(1, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := svc.Store(map[string]any{"time": []int64{1}, "value": []int64{1}})
+	schema := getTableSchema(table)
+	svc.Drop()
+	if _, err := pending.Get(); !errors.Is(err, ErrTableDropped) {
+		t.Fatalf("expected the buffered rows to fail with the drop, got %v", err)
+	}
+	os.RemoveAll(table.Path)
+
+	// a table of the same name starts with an empty schema
+	recreated := testTable(t)
+	runIndexes(t, recreated)
+	if s := getTableSchema(recreated); s == schema || len(s.Columns()) != 0 {
+		t.Fatalf("expected a new empty schema, got %+v", s.Columns())
+	}
+	svc, err = NewMultithreadHiveMergeTreeService(1, recreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop()
+	err = svc.CheckTypes(map[string]any{"time": []int64{1}, "value": []string{"a"}})
+	if err != nil {
+		t.Fatalf("expected the new table to accept the new type of value: %v", err)
+	}
+}
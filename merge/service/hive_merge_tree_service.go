@@ -10,7 +10,9 @@ import (
 	"github.com/expr-lang/expr/vm"
 	"github.com/gigapi/gigapi-config/config"
 	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/index"
 	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/wal"
 	"github.com/gigapi/gigapi/v2/utils"
 	"github.com/go-faster/city"
 	"golang.org/x/sync/errgroup"
@@ -20,7 +22,9 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -138,32 +142,45 @@ type HiveMergeTreeService struct {
 	*MergeTreeService
 
 	partitions map[uint64]*Partition
+	wal        *wal.WAL
+
+	partitionExpressions []*vm.Program
+	requiredColumns      []string
 
-	storeTicker *time.Ticker
 	mergeTicker *time.Ticker
 
 	flushCtx context.Context
 	doFlush  context.CancelFunc
+	stopCtx  context.Context
+	stop     context.CancelFunc
+	// done is closed once the flush loop returned
+	done chan struct{}
 }
 
-func NewHiveMergeTreeService(t *shared.Table) (*HiveMergeTreeService, error) {
+func NewHiveMergeTreeService(t *shared.Table, w *wal.WAL) (*HiveMergeTreeService, error) {
 	res := &HiveMergeTreeService{
 		MergeTreeService: &MergeTreeService{
-			Table: t,
+			Table:  t,
+			schema: getTableSchema(t),
 		},
 		partitions: make(map[uint64]*Partition),
+		wal:        w,
 	}
 	res.flushCtx, res.doFlush = context.WithTimeout(context.Background(), time.Second)
-	err := res.discoverPartitions()
+	res.stopCtx, res.stop = context.WithCancel(context.Background())
+	err := res.parsePartitionInfo()
+	if err != nil {
+		return nil, err
+	}
+	err = res.discoverPartitions()
 	if err != nil {
 		return nil, err
 	}
-	//err := res.parsePartitionInfo()
 	return res, nil
 }
 
 func (h *HiveMergeTreeService) discoverPartitions() error {
-	lastSuffix := fmt.Sprintf(".%d.parquet", MERGE_ITERATIONS+1)
+	lastSuffix := FinalSuffix(h.Table)
 	err := filepath.Walk(h.Table.Path, func(p string, info fs.FileInfo, err error) error {
 		if !info.IsDir() {
 			return nil
@@ -188,26 +205,19 @@ func (h *HiveMergeTreeService) discoverPartitions() error {
 			}
 		}
 
-		strPartitionPath := strings.TrimPrefix(p, h.Table.Path+string(filepath.Separator))
 		if !isLivePartition {
 			return filepath.SkipDir
 		}
-		arrPartitionPath := strings.Split(strPartitionPath, string(filepath.Separator))
-		values := make([][2]string, 0, len(arrPartitionPath))
-		for _, p := range arrPartitionPath {
-			kv := strings.SplitN(p, "=", 2)
-			if len(kv) < 2 {
-				fmt.Println("Invalid partition path: " + strPartitionPath)
-				return nil
-			}
-			values = append(values, [2]string{kv[0], kv[1]})
+		values, ok := h.partitionValuesOf(p)
+		if !ok {
+			return nil
 		}
 		id := h.calculatePartitionHash(values)
 		if _, ok := h.partitions[id]; !ok {
 			h.partitions[id], err = NewPartition(values,
 				path.Join(h.Table.Path, "tmp"),
 				h.getDataPath(values),
-				h.Table)
+				h.Table, h.wal)
 			if err != nil {
 				return err
 			}
@@ -217,16 +227,32 @@ func (h *HiveMergeTreeService) discoverPartitions() error {
 	return err
 }
 
-/*func (h *HiveMergeTreeService) parsePartitionInfo() error {
-	h.partitionExressions = make([]*vm.Program, len(h.Table.PartitionBy))
+// partitionValuesOf returns the partition values of the partition folder of the table
+func (h *HiveMergeTreeService) partitionValuesOf(dir string) ([][2]string, bool) {
+	strPartitionPath := strings.TrimPrefix(dir, h.Table.Path+string(filepath.Separator))
+	arrPartitionPath := strings.Split(strPartitionPath, string(filepath.Separator))
+	values := make([][2]string, 0, len(arrPartitionPath))
+	for _, p := range arrPartitionPath {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) < 2 {
+			fmt.Println("Invalid partition path: " + strPartitionPath)
+			return nil, false
+		}
+		values = append(values, [2]string{kv[0], kv[1]})
+	}
+	return values, true
+}
+
+func (h *HiveMergeTreeService) parsePartitionInfo() error {
+	h.partitionExpressions = make([]*vm.Program, len(h.Table.PartitionExpressions))
 	idents := make(map[string]bool)
 
-	for i, partition := range h.Table.PartitionBy {
-		prog, identifiers, err := h.parsePartitionExpression(partition)
+	for i, partition := range h.Table.PartitionExpressions {
+		prog, identifiers, err := parsePartitionExpression(partition)
 		if err != nil {
 			return err
 		}
-		h.partitionExressions[i] = prog
+		h.partitionExpressions[i] = prog
 		for _, id := range identifiers {
 			idents[id] = true
 		}
@@ -237,7 +263,45 @@ func (h *HiveMergeTreeService) discoverPartitions() error {
 		h.requiredColumns = append(h.requiredColumns, id)
 	}
 	return nil
-}*/
+}
+
+// partitionFunctions are the functions available in the partition expressions.
+// The timestamps are int64 nanoseconds.
+var partitionFunctions = map[string]func(params ...any) (any, error){
+	"toDate": func(params ...any) (any, error) {
+		return formatPartitionTime(params, "2006-01-02")
+	},
+	"toHour": func(params ...any) (any, error) {
+		return formatPartitionTime(params, "15")
+	},
+	"formatTime": func(params ...any) (any, error) {
+		if len(params) != 2 {
+			return nil, fmt.Errorf("formatTime(timestamp, layout) expects 2 arguments")
+		}
+		layout, ok := params[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("formatTime: layout must be a string")
+		}
+		return formatPartitionTime(params[:1], layout)
+	},
+}
+
+func formatPartitionTime(params []any, layout string) (any, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("expected 1 timestamp argument")
+	}
+	switch ts := params[0].(type) {
+	case int64:
+		return time.Unix(0, ts).UTC().Format(layout), nil
+	case uint64:
+		return time.Unix(0, int64(ts)).UTC().Format(layout), nil
+	case float64:
+		return time.Unix(0, int64(ts)).UTC().Format(layout), nil
+	case nil:
+		return nil, fmt.Errorf("timestamp is null")
+	}
+	return nil, fmt.Errorf("unsupported timestamp type %T", params[0])
+}
 
 type ExprParserHelper struct {
 	Identifiers []string
@@ -248,6 +312,9 @@ func (e *ExprParserHelper) Visit(node *ast.Node) {
 	if !ok {
 		return
 	}
+	if _, ok := partitionFunctions[n.Value]; ok || n.Value == "getValue" {
+		return
+	}
 	ast.Patch(node, &ast.CallNode{
 		Callee:    &ast.IdentifierNode{Value: "getValue"},
 		Arguments: []ast.Node{&ast.StringNode{Value: n.String()}},
@@ -255,31 +322,131 @@ func (e *ExprParserHelper) Visit(node *ast.Node) {
 	e.Identifiers = append(e.Identifiers, n.Value)
 }
 
-func (h *HiveMergeTreeService) parsePartitionExpression(expression [2]string) (*vm.Program, []string, error) {
+func parsePartitionExpression(expression [2]string) (*vm.Program, []string, error) {
 	helper := ExprParserHelper{}
-	prog, err := expr.Compile(expression[1], expr.Patch(&helper))
+	opts := []expr.Option{expr.Patch(&helper)}
+	for name, fn := range partitionFunctions {
+		opts = append(opts, expr.Function(name, fn))
+	}
+	prog, err := expr.Compile(expression[1], opts...)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("partition %q: %w", expression[0], err)
 	}
 	return prog, helper.Identifiers, nil
 }
 
+// ValidatePartitionExpressions checks that the [folder name, expression] pairs compile
+func ValidatePartitionExpressions(expressions [][2]string) error {
+	for _, e := range expressions {
+		if !partitionNameCheck.MatchString(e[0]) {
+			return fmt.Errorf("invalid partition name %q", e[0])
+		}
+		_, _, err := parsePartitionExpression(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var partitionNameCheck = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// partitionBy splits the rows by the partition expressions of the table or by its PartitionBy function
+func (h *HiveMergeTreeService) partitionBy(columns map[string]data_types.IColumn) ([]shared.PartitionDesc, error) {
+	if len(h.partitionExpressions) == 0 {
+		return h.Table.PartitionBy(columns)
+	}
+	var size int64
+	for _, col := range columns {
+		size = col.GetLength()
+		break
+	}
+
+	cols := make([]data_types.IColumn, len(h.requiredColumns))
+	for i, name := range h.requiredColumns {
+		cols[i] = columns[name]
+	}
+	row := make(map[string]any, len(h.requiredColumns))
+	env := map[string]any{
+		"getValue": func(name string) any {
+			return row[name]
+		},
+	}
+
+	parts := make(map[string]*shared.PartitionDesc)
+	var res []*shared.PartitionDesc
+	machine := vm.VM{}
+	values := make([][2]string, len(h.partitionExpressions))
+	for i := int64(0); i < size; i++ {
+		for j, name := range h.requiredColumns {
+			if cols[j] == nil {
+				row[name] = nil
+				continue
+			}
+			row[name] = cols[j].GetVal(i)
+		}
+		key := strings.Builder{}
+		for j, prog := range h.partitionExpressions {
+			v, err := machine.Run(prog, env)
+			if err != nil {
+				return nil, fmt.Errorf("partition %q: %w", h.Table.PartitionExpressions[j][0], err)
+			}
+			values[j] = [2]string{h.Table.PartitionExpressions[j][0], sanitizePartitionValue(fmt.Sprint(v))}
+			key.WriteString(values[j][1])
+			key.WriteByte(0)
+		}
+		part, ok := parts[key.String()]
+		if !ok {
+			part = &shared.PartitionDesc{
+				Values:   append([][2]string{}, values...),
+				IndexMap: make([]byte, (size+7)/8),
+			}
+			parts[key.String()] = part
+			res = append(res, part)
+		}
+		part.IndexMap[i/8] |= 1 << (uint(i) % 8)
+	}
+	_res := make([]shared.PartitionDesc, len(res))
+	for i, part := range res {
+		_res[i] = *part
+	}
+	return _res, nil
+}
+
+// sanitizePartitionValue keeps the partition value a single folder name
+func sanitizePartitionValue(v string) string {
+	if v == "" || v == "." || v == ".." {
+		return "_" + v
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", "=", "_").Replace(v)
+}
+
 func (h *HiveMergeTreeService) Run() {
+	h.done = make(chan struct{})
 	go func() {
+		defer close(h.done)
 		for {
 			select {
 			case <-h.flushCtx.Done():
 				h.flushCtx, h.doFlush = context.WithTimeout(context.Background(),
 					time.Duration(config.Config.Gigapi.SaveTimeoutS)*time.Second)
 				h.flush()
+			case <-h.stopCtx.Done():
+				return
 			}
 		}
 	}()
 }
 
 func (h *HiveMergeTreeService) flush() {
-	wg := sync.WaitGroup{}
+	h.mtx.Lock()
+	partitions := make([]*Partition, 0, len(h.partitions))
 	for _, part := range h.partitions {
+		partitions = append(partitions, part)
+	}
+	h.mtx.Unlock()
+	wg := sync.WaitGroup{}
+	for _, part := range partitions {
 		wg.Add(1)
 		go func(part *Partition) {
 			defer wg.Done()
@@ -289,21 +456,12 @@ func (h *HiveMergeTreeService) flush() {
 	wg.Wait()
 }
 
+// Stop stops the flush loop once the running flush completed. The rows not saved yet are kept.
 func (h *HiveMergeTreeService) Stop() {
-	h.storeTicker.Stop()
-}
-
-func (h *HiveMergeTreeService) calculateSchema() map[string]string {
-	h.mtx.Lock()
-	defer h.mtx.Unlock()
-
-	schema := make(map[string]string)
-	for _, part := range h.partitions {
-		for c, tp := range part.GetSchema() {
-			schema[c] = tp
-		}
+	h.stop()
+	if h.done != nil {
+		<-h.done
 	}
-	return schema
 }
 
 func (h *HiveMergeTreeService) validateData(columns map[string]data_types.IColumn) error {
@@ -311,21 +469,20 @@ func (h *HiveMergeTreeService) validateData(columns map[string]data_types.IColum
 	if err != nil {
 		return err
 	}
+	return h.schema.Widen(columns)
+}
 
-	schema := h.calculateSchema()
-	for name, col := range columns {
-		if _, ok := schema[name]; !ok {
-			continue
-		}
-		//TODO: check how merge operation in parquet works for column collision
-		//TODO: log this failure well
-		//TODO: if the merge operation fails because of this then consider the eralier type as "right" and later type as "wrong"
-		//TODO: move the "wrong" batches elsewhere
-		if col.GetTypeName() != schema[name] {
-			return fmt.Errorf("column %s has different data type", name)
-		}
+// CheckTypes checks the data against the column types of the table
+func (h *HiveMergeTreeService) CheckTypes(columns map[string]any) error {
+	_columns, err := h.wrapColumns(columns)
+	if err != nil {
+		return err
 	}
-	return nil
+	err = h.checkDeclaredColumns(_columns)
+	if err != nil {
+		return err
+	}
+	return h.schema.Check(_columns)
 }
 
 func (h *HiveMergeTreeService) calculatePartitionHash(values [][2]string) uint64 {
@@ -350,7 +507,7 @@ func (h *HiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32
 		return utils.Fulfilled[int32](err, 0)
 	}
 
-	err = h.validateData(_columns)
+	err = h.checkDeclaredColumns(_columns)
 	if err != nil {
 		return utils.Fulfilled[int32](err, 0)
 	}
@@ -360,12 +517,59 @@ func (h *HiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32
 		return utils.Fulfilled[int32](err, 0)
 	}
 
+	err = h.validateData(_columns)
+	var conflict *TypeConflictError
+	if errors.As(err, &conflict) {
+		return h.quarantineBatch(_columns, conflict)
+	}
+	if err != nil {
+		return utils.Fulfilled[int32](err, 0)
+	}
+	return h.store(_columns)
+}
+
+// replay stores a batch read from the WAL. The batch is logged again under a new sequence.
+func (h *HiveMergeTreeService) replay(payload []byte) error {
+	columns, err := decodeWALRecord(payload)
+	if err != nil {
+		return err
+	}
+	_columns, err := h.wrapColumns(columns)
+	if err != nil {
+		return err
+	}
+	err = h.schema.Widen(_columns)
+	var conflict *TypeConflictError
+	if errors.As(err, &conflict) {
+		_, err = h.quarantineBatch(_columns, conflict).Get()
+		var quarantined *QuarantinedError
+		if errors.As(err, &quarantined) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	h.store(_columns)
+	return nil
+}
+
+func (h *HiveMergeTreeService) store(_columns map[string]data_types.IColumn) utils.Promise[int32] {
 	//TODO: copy data to partitions right away
-	partsDesc, err := h.Table.PartitionBy(_columns)
+	partsDesc, err := h.partitionBy(_columns)
 	if err != nil {
 		return utils.Fulfilled[int32](err, 0)
 	}
 
+	var walRecord []byte
+	if h.wal != nil {
+		walRecord, err = encodeWALRecord(_columns)
+		if err != nil {
+			return utils.Fulfilled[int32](err, 0)
+		}
+	}
+
 	var promises []utils.Promise[int32]
 	h.mtx.Lock()
 	for _, part := range partsDesc {
@@ -374,7 +578,7 @@ func (h *HiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32
 			h.partitions[id], err = NewPartition(part.Values,
 				path.Join(h.Table.Path, "tmp"),
 				h.getDataPath(part.Values),
-				h.Table)
+				h.Table, h.wal)
 			if err != nil {
 				h.mtx.Unlock()
 				return utils.Fulfilled[int32](err, 0)
@@ -382,9 +586,19 @@ func (h *HiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32
 		}
 	}
 
+	// the record is synced outside of the lock, so the concurrent writes share the fsync
+	var walSeq uint64
+	if h.wal != nil {
+		walSeq, err = h.wal.Write(walRecord, len(partsDesc))
+		if err != nil {
+			h.mtx.Unlock()
+			return utils.Fulfilled[int32](err, 0)
+		}
+	}
+
 	for _, part := range partsDesc {
 		id := h.calculatePartitionHash(part.Values)
-		promises = append(promises, h.partitions[id].StoreByMask(_columns, part.IndexMap))
+		promises = append(promises, h.partitions[id].StoreByMask(_columns, part.IndexMap, walSeq))
 	}
 
 	s := int64(0)
@@ -397,6 +611,12 @@ func (h *HiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32
 	}
 	h.mtx.Unlock()
 
+	if walSeq != 0 {
+		err = h.wal.Sync(walSeq)
+		if err != nil {
+			return utils.Fulfilled[int32](err, 0)
+		}
+	}
 	return utils.NewWaitForAll(promises)
 }
 
@@ -434,6 +654,29 @@ func (h *HiveMergeTreeService) Merge(plan map[uint64][]PlanMerge) error {
 	return err
 }
 
+func (h *HiveMergeTreeService) DryRunPlan() ([]LevelPlanReport, error) {
+	return dryRunPartitions(h.partitions)
+}
+
+// dryRunPartitions returns the merge plans of the partitions ordered by partition and level
+func dryRunPartitions(partitions map[uint64]*Partition) ([]LevelPlanReport, error) {
+	res := make([]LevelPlanReport, 0)
+	for _, part := range partitions {
+		plan, err := part.DryRunPlan()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, plan...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Partition != res[j].Partition {
+			return res[i].Partition < res[j].Partition
+		}
+		return res[i].Level < res[j].Level
+	})
+	return res, nil
+}
+
 func (h *HiveMergeTreeService) DoMerge() error {
 	plan, err := h.PlanMerge()
 	if err != nil {
@@ -450,17 +693,42 @@ type mtHiveStoreReq struct {
 type MultithreadHiveMergeTreeService struct {
 	svcs    []*HiveMergeTreeService
 	channel chan *mtHiveStoreReq
+	wal     *wal.WAL
+	// stopMtx guards the channel against the writes after Stop
+	stopMtx sync.RWMutex
+	stopped bool
 }
 
-func NewMultithreadHiveMergeTreeService(numThreads int, t *shared.Table) *MultithreadHiveMergeTreeService {
+func NewMultithreadHiveMergeTreeService(numThreads int, t *shared.Table) (*MultithreadHiveMergeTreeService, error) {
 	if numThreads <= 0 {
 		numThreads = runtime.NumCPU()
 	}
 	m := &MultithreadHiveMergeTreeService{
 		channel: make(chan *mtHiveStoreReq, numThreads),
 	}
+	walSeq, err := index.GetWALSequence(t.Path)
+	if err == nil {
+		m.wal, err = wal.Open(path.Join(t.Path, "wal"), walSeq)
+	}
+	if err != nil {
+		fmt.Printf("Table %s.%s: WAL disabled: %v\n", t.Database, t.Name, err)
+	}
+	err = recoverTable(t, m.wal != nil)
+	if err != nil {
+		if m.wal != nil {
+			m.wal.Close()
+		}
+		return nil, fmt.Errorf("table %s.%s: recovery failed: %w", t.Database, t.Name, err)
+	}
 	for i := 0; i < numThreads; i++ {
-		h, _ := NewHiveMergeTreeService(t)
+		h, err := NewHiveMergeTreeService(t, m.wal)
+		if err != nil {
+			close(m.channel)
+			if m.wal != nil {
+				m.wal.Close()
+			}
+			return nil, err
+		}
 		m.svcs = append(m.svcs, h)
 
 		go func() {
@@ -469,7 +737,30 @@ func NewMultithreadHiveMergeTreeService(numThreads int, t *shared.Table) *Multit
 			}
 		}()
 	}
-	return m
+	if m.wal != nil {
+		m.replayWAL(walSeq)
+	}
+	return m, nil
+}
+
+// replayWAL stores the batches of the WAL that were not saved before the restart
+func (m *MultithreadHiveMergeTreeService) replayWAL(fromSeq uint64) {
+	replayed := 0
+	err := m.wal.Replay(fromSeq, func(seq uint64, payload []byte) error {
+		err := m.svcs[replayed%len(m.svcs)].replay(payload)
+		if err != nil {
+			fmt.Printf("WAL record %d: %v\n", seq, err)
+			return nil
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		fmt.Println("WAL replay error: ", err)
+	}
+	if replayed > 0 {
+		fmt.Printf("Table %s.%s: replayed %d WAL records\n", m.svcs[0].Table.Database, m.svcs[0].Table.Name, replayed)
+	}
 }
 
 func (m *MultithreadHiveMergeTreeService) Run() {
@@ -479,13 +770,27 @@ func (m *MultithreadHiveMergeTreeService) Run() {
 }
 
 func (m *MultithreadHiveMergeTreeService) Stop() {
+	m.stopMtx.Lock()
+	defer m.stopMtx.Unlock()
+	if m.stopped {
+		return
+	}
+	m.stopped = true
 	for _, _m := range m.svcs {
 		_m.Stop()
 	}
 	close(m.channel)
+	if m.wal != nil {
+		m.wal.Close()
+	}
 }
 
 func (m *MultithreadHiveMergeTreeService) Store(columns map[string]any) utils.Promise[int32] {
+	m.stopMtx.RLock()
+	defer m.stopMtx.RUnlock()
+	if m.stopped {
+		return utils.Fulfilled[int32](ErrTableStopped, 0)
+	}
 	req := &mtHiveStoreReq{
 		data: columns,
 		res:  make(chan utils.Promise[int32]),
@@ -495,13 +800,36 @@ func (m *MultithreadHiveMergeTreeService) Store(columns map[string]any) utils.Pr
 	return <-req.res
 }
 
-func (m *MultithreadHiveMergeTreeService) DoMerge() error {
+func (m *MultithreadHiveMergeTreeService) CheckTypes(columns map[string]any) error {
+	return m.svcs[0].CheckTypes(columns)
+}
+
+func (m *MultithreadHiveMergeTreeService) GetSchema() []ColumnSchema {
+	return m.svcs[0].GetSchema()
+}
+
+func (m *MultithreadHiveMergeTreeService) MarkTags(names []string) {
+	m.svcs[0].MarkTags(names)
+}
+
+func (m *MultithreadHiveMergeTreeService) partitions() map[uint64]*Partition {
 	partitions := map[uint64]*Partition{}
 	for _, _m := range m.svcs {
+		_m.mtx.Lock()
 		for id, part := range _m.partitions {
 			partitions[id] = part
 		}
+		_m.mtx.Unlock()
 	}
+	return partitions
+}
+
+func (m *MultithreadHiveMergeTreeService) DryRunPlan() ([]LevelPlanReport, error) {
+	return dryRunPartitions(m.partitions())
+}
+
+func (m *MultithreadHiveMergeTreeService) DoMerge() error {
+	partitions := m.partitions()
 
 	mergeByPartition := make(map[uint64][]PlanMerge)
 	for id, part := range partitions {
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"fmt"
 	"github.com/gigapi/gigapi/v2/merge/data_types"
 	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/wal"
 	"github.com/gigapi/gigapi/v2/utils"
 	"os"
 	"path/filepath"
@@ -17,23 +19,51 @@ type Partition struct {
 	saveService       saveService
 	mergeService      mergeService
 	promises          []utils.Promise[int32]
+	wal               *wal.WAL
+	walSeqs           []uint64
 	m                 sync.Mutex
 	table             *shared.Table
 	lastStore         time.Time
 	lastSave          time.Time
-	lastIterationTime [MERGE_ITERATIONS]time.Time
+	lastIterationTime []time.Time
 	dataPath          string
+	// mergeMtx serializes the merges, the deletes and the tiering of the partition folder.
+	// It is shared by the partitions of the folder of all the threads.
+	mergeMtx *sync.Mutex
+	// saveMtx serializes the saves and the drop of the partition
+	saveMtx sync.Mutex
+	// dropped is set once the partition is dropped, it is not saved nor merged anymore
+	dropped bool
 }
 
-func NewPartition(values [][2]string, tmpPath, dataPath string, t *shared.Table) (*Partition, error) {
+var (
+	folderLocksMtx sync.Mutex
+	folderLocks    = map[string]*sync.Mutex{}
+)
+
+// getFolderLock returns the merge lock of the partition folder, the same for all the threads of the table
+func getFolderLock(dataPath string) *sync.Mutex {
+	folderLocksMtx.Lock()
+	defer folderLocksMtx.Unlock()
+	key := filepath.Clean(dataPath)
+	if l, ok := folderLocks[key]; ok {
+		return l
+	}
+	l := &sync.Mutex{}
+	folderLocks[key] = l
+	return l
+}
+
+func NewPartition(values [][2]string, tmpPath, dataPath string, t *shared.Table, w *wal.WAL) (*Partition, error) {
 	res := &Partition{
 		Values:    values,
 		unordered: newUnorderedDataStore(),
 		table:     t,
 		dataPath:  dataPath,
-	}
-	for i := range res.lastIterationTime {
-		res.lastIterationTime[i] = time.Now()
+		wal:       w,
+		mergeMtx:  getFolderLock(dataPath),
+
+		lastIterationTime: newLevelTimes(t),
 	}
 	if t.IndexCreator != nil {
 		var err error
@@ -41,14 +71,6 @@ func NewPartition(values [][2]string, tmpPath, dataPath string, t *shared.Table)
 		if err != nil {
 			return nil, err
 		}
-		dropQueue := res.index.GetDropQueue()
-		go func() {
-			time.Sleep(time.Second * 10)
-			for _, file := range dropQueue {
-				os.Remove(filepath.Join(res.dataPath, file))
-			}
-			res.index.RmFromDropQueue(dropQueue)
-		}()
 	}
 	err := res.initServices(tmpPath, dataPath, t)
 	return res, err
@@ -73,24 +95,35 @@ func (p *Partition) initServices(tmpPath, dataPath string, t *shared.Table) erro
 		tmpPath:  tmpPath,
 		table:    t,
 		index:    p.index,
+		schema:   getTableSchema(t),
 	}
 	return nil
 }
 
+// GetSchema returns the types of the buffered columns
 func (p *Partition) GetSchema() map[string]string {
-	//TODO: create map[columnName]columnTypename
-	return nil
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.unordered.GetSchema()
 }
 
-func (p *Partition) StoreByMask(data map[string]data_types.IColumn, mask []byte) utils.Promise[int32] {
+// StoreByMask appends the masked rows to the partition.
+// walSeq is the sequence of the WAL record of the data, released once the data is saved. 0 if not logged.
+func (p *Partition) StoreByMask(data map[string]data_types.IColumn, mask []byte, walSeq uint64) utils.Promise[int32] {
 	p.m.Lock()
 	defer p.m.Unlock()
 	err := p.unordered.AppendByMask(data, mask)
 	if err != nil {
+		if walSeq != 0 {
+			p.ackWAL([]uint64{walSeq})
+		}
 		return utils.Fulfilled(err, int32(0))
 	}
 	res := utils.New[int32]()
 	p.promises = append(p.promises, res)
+	if walSeq != 0 {
+		p.walSeqs = append(p.walSeqs, walSeq)
+	}
 	p.lastStore = time.Now()
 	return res
 }
@@ -114,15 +147,25 @@ func (p *Partition) Size() int64 {
 }
 
 func (p *Partition) Save() {
+	p.saveMtx.Lock()
+	defer p.saveMtx.Unlock()
 	p.m.Lock()
+	if p.dropped {
+		p.m.Unlock()
+		return
+	}
 	promises := p.promises
 	p.promises = nil
+	walSeqs := p.walSeqs
+	p.walSeqs = nil
 	unordered := p.unordered
 	p.unordered = newUnorderedDataStore()
 	p.lastSave = time.Now()
 	p.m.Unlock()
 
 	onErr := func(err error) {
+		// The records are released even if the save failed, as the writers get the error.
+		p.ackWAL(walSeqs)
 		for _, p := range promises {
 			p.Done(0, err)
 		}
@@ -138,13 +181,6 @@ func (p *Partition) Save() {
 		return
 	}
 
-	_min := make(map[string]any)
-	_max := make(map[string]any)
-
-	if col, ok := unordered.store[p.table.OrderBy[0]]; ok {
-		_min[p.table.OrderBy[0]], _max[p.table.OrderBy[0]] = col.GetMinMax()
-	}
-
 	if p.index != nil {
 		absDataPath, err := filepath.Abs(fName)
 		if err != nil {
@@ -159,14 +195,20 @@ func (p *Partition) Save() {
 
 		size := unordered.GetSize()
 
-		prom := p.index.Batch([]*shared.IndexEntry{{
-			Path:      absDataPath,
-			SizeBytes: stat.Size(),
-			RowCount:  size,
-			ChunkTime: time.Now().UnixNano(),
-			Min:       _min,
-			Max:       _max,
-		}}, nil)
+		var walSequence uint64
+		if p.wal != nil {
+			walSequence = p.wal.Watermark(walSeqs)
+		}
+
+		entry := &shared.IndexEntry{
+			Path:        absDataPath,
+			SizeBytes:   stat.Size(),
+			RowCount:    size,
+			ChunkTime:   time.Now().UnixNano(),
+			WALSequence: walSequence,
+		}
+		fillColumnStats(unordered.store, entry)
+		prom := p.index.Batch([]*shared.IndexEntry{entry}, nil)
 		_, err = prom.Get()
 		if err != nil {
 			onErr(err)
@@ -176,24 +218,51 @@ func (p *Partition) Save() {
 	onErr(nil)
 }
 
+func (p *Partition) ackWAL(seqs []uint64) {
+	if p.wal == nil || len(seqs) == 0 {
+		return
+	}
+	err := p.wal.Ack(seqs)
+	if err != nil {
+		fmt.Println("WAL truncation error: ", err)
+	}
+}
+
 func (p *Partition) PlanMerge() ([]PlanMerge, error) {
-	var res []PlanMerge
+	return planMerge(p.table, p.mergeService, p.lastIterationTime)
+}
 
-	configurations := getMergeConfigurations()
-	for _, conf := range configurations {
-		if time.Now().Sub(p.lastIterationTime[conf[2]-1]).Seconds() > float64(conf[0]) {
-			files, err := p.mergeService.GetFilesToMerge(int(conf[2]))
-			if err != nil {
-				return nil, err
-			}
-			plans := p.mergeService.PlanMerge(files, conf[1], int(conf[2]))
-			res = append(res, plans...)
-			p.lastIterationTime[conf[2]-1] = time.Now()
-		}
-	}
-	return res, nil
+func (p *Partition) DryRunPlan() ([]LevelPlanReport, error) {
+	return dryRunPlan(p.table, p.mergeService, p.lastIterationTime, p.Values)
 }
 
 func (p *Partition) DoMerge(plan []PlanMerge) error {
+	p.mergeMtx.Lock()
+	defer p.mergeMtx.Unlock()
+	if p.isDropped() {
+		return nil
+	}
+	if p.index != nil {
+		plan = p.currentMerges(plan)
+	}
 	return p.mergeService.DoMerge(plan)
 }
+
+// currentMerges leaves out the merges of the files a delete rewrote since the planning
+func (p *Partition) currentMerges(plan []PlanMerge) []PlanMerge {
+	var res []PlanMerge
+	for _, m := range plan {
+		current := true
+		for _, from := range m.From {
+			abs, err := filepath.Abs(from)
+			if err != nil || p.index.Get(abs) == nil {
+				current = false
+				break
+			}
+		}
+		if current {
+			res = append(res, m)
+		}
+	}
+	return res
+}
@@ -0,0 +1,386 @@
+package service
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"io"
+	"os"
+	"strconv"
+)
+
+// errUnsupportedMerge is returned by kwayMerge for the files it can't merge natively
+var errUnsupportedMerge = errors.New("unsupported files for the native merge")
+
+const (
+	// rows read at once from every input
+	kwayReadBatchSize = 8192
+	// rows of a row group of the output
+	kwayWriteBatchSize = 65536
+)
+
+type kwayInput struct {
+	idx     int
+	file    *file.Reader
+	records pqarrow.RecordReader
+	rec     arrow.Record
+	row     int
+	// keyCols are the columns of the order by keys in the input, -1 if absent
+	keyCols []int
+	// cols are the columns of the output fields in the input, -1 if absent
+	cols []int
+}
+
+func (in *kwayInput) close() {
+	if in.records != nil {
+		in.records.Release()
+	}
+	in.file.Close()
+}
+
+// next moves to the next row. false means the input is over.
+func (in *kwayInput) next() (bool, error) {
+	in.row++
+	for in.rec == nil || in.row >= int(in.rec.NumRows()) {
+		if !in.records.Next() {
+			err := in.records.Err()
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return false, err
+		}
+		in.rec = in.records.Record()
+		in.row = 0
+	}
+	return true, nil
+}
+
+func (in *kwayInput) key(i int) (arrow.Array, int) {
+	if in.keyCols[i] < 0 {
+		return nil, 0
+	}
+	return in.rec.Column(in.keyCols[i]), in.row
+}
+
+// kwayHeap orders the inputs by their current row
+type kwayHeap []*kwayInput
+
+func (h kwayHeap) Len() int { return len(h) }
+func (h kwayHeap) Less(i, j int) bool {
+	for k := range h[i].keyCols {
+		a, ai := h[i].key(k)
+		b, bi := h[j].key(k)
+		if c := compareValues(a, ai, b, bi); c != 0 {
+			return c < 0
+		}
+	}
+	return h[i].idx < h[j].idx
+}
+func (h kwayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *kwayHeap) Push(x any)   { *h = append(*h, x.(*kwayInput)) }
+func (h *kwayHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// kwayMerge merges the parquet files sorted by orderBy into one sorted file.
+// The rows are streamed, so the memory is bounded by the read batches of the inputs and one output row group.
+// The columns are converted to the types (the current types of the table) if they are set.
+// errUnsupportedMerge is returned if a column type can't be merged natively.
+func kwayMerge(from []string, to string, orderBy []string, types map[string]string) error {
+	inputs := make([]*kwayInput, 0, len(from))
+	defer func() {
+		for _, in := range inputs {
+			in.close()
+		}
+	}()
+	for i, name := range from {
+		pf, err := file.OpenParquetFile(name, false)
+		if err != nil {
+			return err
+		}
+		in := &kwayInput{idx: i, file: pf, row: -1}
+		inputs = append(inputs, in)
+		fr, err := pqarrow.NewFileReader(pf,
+			pqarrow.ArrowReadProperties{BatchSize: kwayReadBatchSize}, memory.DefaultAllocator)
+		if err != nil {
+			return err
+		}
+		in.records, err = fr.GetRecordReader(context.Background(), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	schema, err := kwayOutputSchema(inputs, types)
+	if err != nil {
+		return err
+	}
+	for _, in := range inputs {
+		inSchema := in.records.Schema()
+		in.cols = make([]int, schema.NumFields())
+		for i, field := range schema.Fields() {
+			in.cols[i] = fieldIndex(inSchema, field.Name)
+		}
+		in.keyCols = make([]int, len(orderBy))
+		for i, key := range orderBy {
+			in.keyCols[i] = fieldIndex(inSchema, key)
+		}
+	}
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer, err := pqarrow.NewFileWriter(schema, out,
+		parquet.NewWriterProperties(parquet.WithMaxRowGroupLength(kwayWriteBatchSize)),
+		pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	rows := 0
+	flush := func() error {
+		rec := builder.NewRecord()
+		defer rec.Release()
+		rows = 0
+		return writer.Write(rec)
+	}
+
+	h := make(kwayHeap, 0, len(inputs))
+	for _, in := range inputs {
+		ok, err := in.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, in)
+		}
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		in := h[0]
+		for i, col := range in.cols {
+			if col < 0 {
+				builder.Field(i).AppendNull()
+				continue
+			}
+			err = appendValue(builder.Field(i), in.rec.Column(col), in.row)
+			if err != nil {
+				return err
+			}
+		}
+		rows++
+		if rows >= kwayWriteBatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+		ok, err := in.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	if rows > 0 {
+		err = flush()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func fieldIndex(schema *arrow.Schema, name string) int {
+	idx := schema.FieldIndices(name)
+	if len(idx) == 0 {
+		return -1
+	}
+	return idx[0]
+}
+
+// kwayOutputSchema returns the union of the input columns with the current types of the table
+func kwayOutputSchema(inputs []*kwayInput, types map[string]string) (*arrow.Schema, error) {
+	var fields []arrow.Field
+	seen := make(map[string]int)
+	for _, in := range inputs {
+		for _, field := range in.records.Schema().Fields() {
+			tp, ok := data_types.ArrowTypeName(field.Type)
+			if !ok {
+				return nil, fmt.Errorf("%w: column %s of type %s", errUnsupportedMerge, field.Name, field.Type)
+			}
+			if i, ok := seen[field.Name]; ok {
+				outTp, _ := data_types.ArrowTypeName(fields[i].Type)
+				widened, ok := data_types.WidenType(outTp, tp)
+				if !ok {
+					return nil, fmt.Errorf("%w: column %s is %s and %s", errUnsupportedMerge, field.Name, outTp, tp)
+				}
+				if widened != outTp {
+					fields[i].Type = data_types.DataTypeOf(widened)
+				}
+				continue
+			}
+			if current, ok := types[field.Name]; ok {
+				widened, ok := data_types.WidenType(current, tp)
+				if !ok || widened != current {
+					return nil, fmt.Errorf("%w: column %s is %s, the table has %s",
+						errUnsupportedMerge, field.Name, tp, current)
+				}
+				tp = current
+			}
+			seen[field.Name] = len(fields)
+			fields = append(fields, arrow.Field{Name: field.Name, Type: data_types.DataTypeOf(tp), Nullable: true})
+		}
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+// appendValue appends the i-th value of the array converting it to the type of the builder
+func appendValue(b array.Builder, arr arrow.Array, i int) error {
+	if arr.IsNull(i) {
+		b.AppendNull()
+		return nil
+	}
+	switch b := b.(type) {
+	case *array.Int64Builder:
+		if a, ok := arr.(*array.Int64); ok {
+			b.Append(a.Value(i))
+			return nil
+		}
+	case *array.Uint64Builder:
+		if a, ok := arr.(*array.Uint64); ok {
+			b.Append(a.Value(i))
+			return nil
+		}
+	case *array.Float64Builder:
+		switch a := arr.(type) {
+		case *array.Float64:
+			b.Append(a.Value(i))
+			return nil
+		case *array.Int64:
+			b.Append(float64(a.Value(i)))
+			return nil
+		case *array.Uint64:
+			b.Append(float64(a.Value(i)))
+			return nil
+		}
+	case *array.StringBuilder:
+		switch a := arr.(type) {
+		case *array.String:
+			b.Append(a.Value(i))
+			return nil
+		case *array.LargeString:
+			b.Append(a.Value(i))
+			return nil
+		case *array.Int64:
+			b.Append(strconv.FormatInt(a.Value(i), 10))
+			return nil
+		case *array.Uint64:
+			b.Append(strconv.FormatUint(a.Value(i), 10))
+			return nil
+		case *array.Float64:
+			b.Append(strconv.FormatFloat(a.Value(i), 'g', -1, 64))
+			return nil
+		}
+	case *array.BooleanBuilder:
+		if a, ok := arr.(*array.Boolean); ok {
+			b.Append(a.Value(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: can't convert %s to %s", errUnsupportedMerge, arr.DataType(), b.Type())
+}
+
+// keyValue returns the i-th value of the key column, nil for null
+func keyValue(arr arrow.Array, i int) any {
+	if arr == nil || arr.IsNull(i) {
+		return nil
+	}
+	switch a := arr.(type) {
+	case *array.Int64:
+		return a.Value(i)
+	case *array.Uint64:
+		return a.Value(i)
+	case *array.Float64:
+		return a.Value(i)
+	case *array.String:
+		return a.Value(i)
+	case *array.LargeString:
+		return a.Value(i)
+	case *array.Boolean:
+		return a.Value(i)
+	}
+	return nil
+}
+
+// compareValues compares the values of the key columns.
+// Nulls go last as in the files sorted by DuckDB.
+func compareValues(a arrow.Array, ai int, b arrow.Array, bi int) int {
+	x, y := keyValue(a, ai), keyValue(b, bi)
+	switch {
+	case x == nil && y == nil:
+		return 0
+	case x == nil:
+		return 1
+	case y == nil:
+		return -1
+	}
+	switch x := x.(type) {
+	case int64:
+		if y, ok := y.(int64); ok {
+			return cmp.Compare(x, y)
+		}
+	case uint64:
+		if y, ok := y.(uint64); ok {
+			return cmp.Compare(x, y)
+		}
+	case string:
+		if y, ok := y.(string); ok {
+			return cmp.Compare(x, y)
+		}
+	case bool:
+		if y, ok := y.(bool); ok {
+			return cmp.Compare(boolToInt(x), boolToInt(y))
+		}
+	}
+	return cmp.Compare(toFloat(x), toFloat(y))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	case bool:
+		return float64(boolToInt(v))
+	}
+	return 0
+}
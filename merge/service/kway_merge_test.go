@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"github.com/apache/arrow/go/v14/arrow"
+	"github.com/apache/arrow/go/v14/arrow/array"
+	"github.com/apache/arrow/go/v14/arrow/memory"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestParquet(t *testing.T, name string, columns map[string]any) {
+	t.Helper()
+	var fields []arrow.Field
+	var arrays []arrow.Array
+	for _, colName := range []string{"time", "value", "host"} {
+		data, ok := columns[colName]
+		if !ok {
+			continue
+		}
+		col, err := data_types.WrapToColumn(colName, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields = append(fields, arrow.Field{Name: colName, Type: col.ArrowDataType(), Nullable: true})
+		b := array.NewBuilder(memory.DefaultAllocator, col.ArrowDataType())
+		err = col.WriteToBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arrays = append(arrays, b.NewArray())
+	}
+	schema := arrow.NewSchema(fields, nil)
+	rec := array.NewRecord(schema, arrays, int64(arrays[0].Len()))
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := pqarrow.NewFileWriter(schema, f, nil, pqarrow.DefaultWriterProps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKWayMerge(t *testing.T) {
+	dir := t.TempDir()
+	from := []string{
+		filepath.Join(dir, "a.2.parquet"),
+		filepath.Join(dir, "b.2.parquet"),
+		filepath.Join(dir, "c.2.parquet"),
+	}
+	writeTestParquet(t, from[0], map[string]any{
+		"time":  []int64{1, 4, 7},
+		"value": []int64{1, 4, 7},
+		"host":  []string{"a", "a", "a"},
+	})
+	writeTestParquet(t, from[1], map[string]any{
+		"time":  []int64{2, 4, 8},
+		"value": []float64{2.5, 4.5, 8.5},
+	})
+	writeTestParquet(t, from[2], map[string]any{
+		"time":  []int64{3},
+		"value": []int64{3},
+		"host":  []string{"c"},
+	})
+	to := filepath.Join(dir, "d.3.parquet")
+	err := kwayMerge(from, to, []string{"time"}, map[string]string{"value": data_types.DATA_TYPE_NAME_FLOAT64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := file.OpenParquetFile(to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := fr.ReadTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Release()
+	if tbl.NumRows() != 7 {
+		t.Fatalf("expected 7 rows, got %d", tbl.NumRows())
+	}
+	rec := array.NewTableReader(tbl, tbl.NumRows())
+	defer rec.Release()
+	rec.Next()
+	times := rec.Record().Column(0).(*array.Int64).Int64Values()
+	values := rec.Record().Column(1).(*array.Float64).Float64Values()
+	hosts := rec.Record().Column(2).(*array.String)
+	expectedTimes := []int64{1, 2, 3, 4, 4, 7, 8}
+	expectedValues := []float64{1, 2.5, 3, 4, 4.5, 7, 8.5}
+	for i := range expectedTimes {
+		if times[i] != expectedTimes[i] || values[i] != expectedValues[i] {
+			t.Fatalf("row %d: expected (%d, %v), got (%d, %v)",
+				i, expectedTimes[i], expectedValues[i], times[i], values[i])
+		}
+	}
+	if !hosts.IsNull(1) || hosts.Value(2) != "c" {
+		t.Fatalf("unexpected host column: %v", hosts)
+	}
+}
+
+func TestKWayMergeUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	from := []string{filepath.Join(dir, "a.2.parquet"), filepath.Join(dir, "b.2.parquet")}
+	writeTestParquet(t, from[0], map[string]any{"time": []int64{1}, "value": []bool{true}})
+	writeTestParquet(t, from[1], map[string]any{"time": []int64{2}, "value": []int64{1}})
+	err := kwayMerge(from, filepath.Join(dir, "c.3.parquet"), []string{"time"}, nil)
+	if err == nil {
+		t.Fatal("expected errUnsupportedMerge")
+	}
+}
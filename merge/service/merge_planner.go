@@ -0,0 +1,235 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/google/uuid"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The reasons of the planner decisions reported by the dry-run plan API
+const (
+	// the files have overlapping time ranges
+	mergeReasonOverlap = "overlap"
+	// the files have adjacent time ranges and fit the size target together
+	mergeReasonAdjacent = "adjacent"
+	// the file is moved to the next level alone
+	mergeReasonPromote = "promote"
+	// the file is larger than the size target and moved to the next level without rewriting
+	mergeReasonOversize = "oversize"
+
+	// the group has less than MinFiles files
+	skipReasonMinFiles = "min_files"
+)
+
+// mergeGroup is a merge being planned
+type mergeGroup struct {
+	files   []FileDesc
+	size    int64
+	overlap bool
+	maxTime int64
+	// oversize is set for a file larger than the size target
+	oversize bool
+}
+
+func (g *mergeGroup) add(f FileDesc) {
+	if len(g.files) > 0 && f.hasRange && f.minTime <= g.maxTime {
+		g.overlap = true
+	}
+	if len(g.files) == 0 || f.maxTime > g.maxTime {
+		g.maxTime = f.maxTime
+	}
+	g.files = append(g.files, f)
+	g.size += f.size
+}
+
+func (g *mergeGroup) reason() string {
+	switch {
+	case g.oversize:
+		return mergeReasonOversize
+	case len(g.files) == 1:
+		return mergeReasonPromote
+	case g.overlap:
+		return mergeReasonOverlap
+	}
+	return mergeReasonAdjacent
+}
+
+// planLevel groups the files of the level into merges never exceeding level.MaxSizeBytes.
+// The files are ordered by their time range (from the index) and the files with overlapping
+// ranges are grouped first. The groups of adjacent ranges are joined while they fit the size target.
+// A file larger than the target is moved to the next level alone: renamed from the level 2 on,
+// sorted at the level 1 as the level 1 files are unsorted.
+// The groups of less than level.MinFiles files wait for more files and are returned as skipped.
+func planLevel(files []FileDesc, level shared.MergeLevel, iteration int) ([]PlanMerge, []FileDesc) {
+	files = append([]FileDesc{}, files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].hasRange != files[j].hasRange {
+			return files[i].hasRange
+		}
+		if !files[i].hasRange {
+			return files[i].size > files[j].size
+		}
+		if files[i].minTime != files[j].minTime {
+			return files[i].minTime < files[j].minTime
+		}
+		return files[i].name < files[j].name
+	})
+
+	// clusters of the files with overlapping time ranges
+	var clusters [][]FileDesc
+	var clusterMax int64
+	for _, f := range files {
+		n := len(clusters)
+		if n > 0 && f.hasRange && clusters[n-1][0].hasRange && f.minTime <= clusterMax {
+			clusters[n-1] = append(clusters[n-1], f)
+			clusterMax = max(clusterMax, f.maxTime)
+			continue
+		}
+		clusters = append(clusters, []FileDesc{f})
+		clusterMax = f.maxTime
+	}
+
+	var groups []*mergeGroup
+	for _, cluster := range clusters {
+		var cur *mergeGroup
+		for _, f := range cluster {
+			if f.size > level.MaxSizeBytes {
+				groups = append(groups, &mergeGroup{files: []FileDesc{f}, size: f.size, maxTime: f.maxTime,
+					oversize: true})
+				continue
+			}
+			if cur == nil || cur.size+f.size > level.MaxSizeBytes {
+				cur = &mergeGroup{}
+				groups = append(groups, cur)
+			}
+			cur.add(f)
+		}
+	}
+
+	// join the adjacent groups fitting the size target together
+	var joined []*mergeGroup
+	for _, g := range groups {
+		n := len(joined)
+		if n > 0 && !g.oversize && !joined[n-1].oversize && joined[n-1].size+g.size <= level.MaxSizeBytes {
+			for _, f := range g.files {
+				joined[n-1].add(f)
+			}
+			continue
+		}
+		joined = append(joined, g)
+	}
+
+	var (
+		res     []PlanMerge
+		skipped []FileDesc
+	)
+	for _, g := range joined {
+		if !g.oversize && len(g.files) < level.MinFiles {
+			for _, f := range g.files {
+				f.skipped = skipReasonMinFiles
+				skipped = append(skipped, f)
+			}
+			continue
+		}
+		uid, _ := uuid.NewUUID()
+		p := PlanMerge{
+			To:        path.Join(fmt.Sprintf("%s.%d.parquet", uid.String(), iteration+1)),
+			Iteration: iteration,
+			Reason:    g.reason(),
+			files:     g.files,
+		}
+		for _, f := range g.files {
+			p.From = append(p.From, f.name)
+		}
+		res = append(res, p)
+	}
+	return res, skipped
+}
+
+// MergeFileReport describes a file considered by the merge planner
+type MergeFileReport struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+	MinTime   *int64 `json:"min_time,omitempty"`
+	MaxTime   *int64 `json:"max_time,omitempty"`
+	// Skipped is the reason the file is not merged
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// MergeReport describes a planned merge
+type MergeReport struct {
+	To        string            `json:"to"`
+	Reason    string            `json:"reason"`
+	SizeBytes int64             `json:"size_bytes"`
+	From      []MergeFileReport `json:"from"`
+}
+
+// LevelPlanReport is the dry-run plan of a merge level of a partition
+type LevelPlanReport struct {
+	Partition    string `json:"partition,omitempty"`
+	Level        int    `json:"level"`
+	MaxSizeBytes int64  `json:"max_size_bytes"`
+	MinFiles     int    `json:"min_files"`
+	// Due is true if the delay of the level passed, so the plan runs on the next tick
+	Due     bool              `json:"due"`
+	NextRun time.Time         `json:"next_run"`
+	Merges  []MergeReport     `json:"merges"`
+	Skipped []MergeFileReport `json:"skipped"`
+}
+
+func fileReport(f FileDesc) MergeFileReport {
+	res := MergeFileReport{Name: path.Base(f.name), SizeBytes: f.size, Skipped: f.skipped}
+	if f.hasRange {
+		minTime, maxTime := f.minTime, f.maxTime
+		res.MinTime, res.MaxTime = &minTime, &maxTime
+	}
+	return res
+}
+
+// dryRunPlan plans the merges of all the levels without running them
+func dryRunPlan(t *shared.Table, merge mergeService, lastIterationTime []time.Time,
+	partition [][2]string) ([]LevelPlanReport, error) {
+	var partitionName []string
+	for _, v := range partition {
+		partitionName = append(partitionName, v[0]+"="+v[1])
+	}
+	var res []LevelPlanReport
+	for i, level := range compactionPolicy(t).Levels {
+		if i >= len(lastIterationTime) {
+			break
+		}
+		files, err := merge.GetFilesToMerge(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		plans, skipped := merge.PlanMerge(files, level, i+1)
+		nextRun := lastIterationTime[i].Add(time.Duration(level.DelayS) * time.Second)
+		report := LevelPlanReport{
+			Partition:    strings.Join(partitionName, "/"),
+			Level:        i + 1,
+			MaxSizeBytes: level.MaxSizeBytes,
+			MinFiles:     level.MinFiles,
+			Due:          time.Now().After(nextRun),
+			NextRun:      nextRun.UTC(),
+			Merges:       make([]MergeReport, 0, len(plans)),
+			Skipped:      make([]MergeFileReport, 0, len(skipped)),
+		}
+		for _, p := range plans {
+			m := MergeReport{To: p.To, Reason: p.Reason, From: make([]MergeFileReport, 0, len(p.files))}
+			for _, f := range p.files {
+				m.From = append(m.From, fileReport(f))
+				m.SizeBytes += f.size
+			}
+			report.Merges = append(report.Merges, m)
+		}
+		for _, f := range skipped {
+			report.Skipped = append(report.Skipped, fileReport(f))
+		}
+		res = append(res, report)
+	}
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"slices"
+	"testing"
+)
+
+func rangeFile(name string, size, minTime, maxTime int64) FileDesc {
+	return FileDesc{name: name, size: size, minTime: minTime, maxTime: maxTime, hasRange: true}
+}
+
+func TestPlanLevel(t *testing.T) {
+	files := []FileDesc{
+		rangeFile("a", 40, 0, 10),
+		rangeFile("b", 40, 100, 110),
+		rangeFile("c", 40, 5, 15),
+		rangeFile("d", 40, 105, 120),
+		rangeFile("big", 500, 200, 300),
+		rangeFile("e", 10, 400, 410),
+	}
+	plans, skipped := planLevel(files, shared.MergeLevel{MaxSizeBytes: 100, MinFiles: 2}, 2)
+	if len(plans) != 3 {
+		t.Fatalf("expected 3 merges, got %d: %v", len(plans), plans)
+	}
+	expected := []struct {
+		from   []string
+		reason string
+	}{
+		{[]string{"a", "c"}, mergeReasonOverlap},
+		{[]string{"b", "d"}, mergeReasonOverlap},
+		{[]string{"big"}, mergeReasonOversize},
+	}
+	for i, e := range expected {
+		if !slices.Equal(plans[i].From, e.from) || plans[i].Reason != e.reason {
+			t.Fatalf("merge %d: expected %v (%s), got %v (%s)", i, e.from, e.reason, plans[i].From, plans[i].Reason)
+		}
+		var size int64
+		for _, f := range plans[i].files {
+			size += f.size
+		}
+		if len(plans[i].From) > 1 && size > 100 {
+			t.Fatalf("merge %d exceeds the size target: %d", i, size)
+		}
+	}
+	if len(skipped) != 1 || skipped[0].name != "e" || skipped[0].skipped != skipReasonMinFiles {
+		t.Fatalf("expected e to be skipped, got %v", skipped)
+	}
+}
+
+func TestPlanLevelAdjacent(t *testing.T) {
+	files := []FileDesc{
+		rangeFile("b", 10, 20, 30),
+		rangeFile("a", 10, 0, 10),
+		rangeFile("c", 90, 40, 50),
+	}
+	plans, _ := planLevel(files, shared.MergeLevel{MaxSizeBytes: 100, MinFiles: 1}, 1)
+	if len(plans) != 2 || !slices.Equal(plans[0].From, []string{"a", "b"}) ||
+		plans[0].Reason != mergeReasonAdjacent || plans[1].Reason != mergeReasonPromote {
+		t.Fatalf("unexpected plans: %v", plans)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
 	"github.com/gigapi/gigapi/v2/merge/shared"
 	"github.com/gigapi/gigapi/v2/merge/utils"
-	"github.com/google/uuid"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 	"html/template"
@@ -28,7 +31,8 @@ const CHSQL_EXT_URL = "community"
 
 type mergeService interface {
 	GetFilesToMerge(iteration int) ([]FileDesc, error)
-	PlanMerge([]FileDesc, int64, int) []PlanMerge
+	// PlanMerge returns the merges of the files and the files left out with the reason
+	PlanMerge(files []FileDesc, level shared.MergeLevel, iteration int) ([]PlanMerge, []FileDesc)
 	DoMerge([]PlanMerge) error
 }
 
@@ -37,6 +41,7 @@ type fsMergeService struct {
 	tmpPath  string
 	table    *shared.Table
 	index    shared.Index
+	schema   *tableSchema
 }
 
 func (f *fsMergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
@@ -46,7 +51,7 @@ func (f *fsMergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 		return nil, err
 	}
 	var parquetFiles []FileDesc
-	suffix := fmt.Sprintf("%d.parquet", iteration)
+	suffix := fmt.Sprintf(".%d.parquet", iteration)
 	for _, file := range files {
 		if !strings.HasSuffix(file.Name(), suffix) {
 			continue
@@ -56,6 +61,7 @@ func (f *fsMergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 		if err != nil {
 			return nil, err
 		}
+		desc := FileDesc{name: name, size: stat.Size()}
 		if f.index != nil {
 			abs, err := filepath.Abs(name)
 			if err != nil {
@@ -65,12 +71,15 @@ func (f *fsMergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 			if entry == nil {
 				continue
 			}
+			tsField := f.table.GetTimestampField()
+			minTime, minOk := entry.Min[tsField].(int64)
+			maxTime, maxOk := entry.Max[tsField].(int64)
+			if minOk && maxOk {
+				desc.minTime, desc.maxTime, desc.hasRange = minTime, maxTime, true
+			}
 		}
 
-		parquetFiles = append(parquetFiles, struct {
-			name string
-			size int64
-		}{name, stat.Size()})
+		parquetFiles = append(parquetFiles, desc)
 	}
 	sort.Slice(parquetFiles, func(a, b int) bool {
 		return parquetFiles[a].size > parquetFiles[b].size
@@ -78,31 +87,8 @@ func (f *fsMergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 	return parquetFiles, nil
 }
 
-func (f *fsMergeService) PlanMerge(files []FileDesc, maxResSize int64, iteration int) []PlanMerge {
-	var res []PlanMerge
-	mergeSize := int64(0)
-	uid, _ := uuid.NewUUID()
-	_res := PlanMerge{
-		To:        path.Join(fmt.Sprintf("%s.%d.parquet", uid.String(), iteration+1)),
-		Iteration: iteration,
-	}
-	for _, file := range files {
-		mergeSize += file.size
-		_res.From = append(_res.From, file.name)
-		if mergeSize > maxResSize {
-			res = append(res, _res)
-			uid, _ := uuid.NewUUID()
-			_res = PlanMerge{
-				To:        path.Join(fmt.Sprintf("%s.%d.parquet", uid.String(), iteration+1)),
-				Iteration: iteration,
-			}
-			mergeSize = 0
-		}
-	}
-	if len(_res.From) > 0 {
-		res = append(res, _res)
-	}
-	return res
+func (f *fsMergeService) PlanMerge(files []FileDesc, level shared.MergeLevel, iteration int) ([]PlanMerge, []FileDesc) {
+	return planLevel(files, level, iteration)
 }
 
 var tmpl = func() *template.Template {
@@ -206,18 +192,13 @@ func (f *fsMergeService) mergeFirstIteration(p PlanMerge) error {
 	defer firstIterationSemaphore.Release(1)
 	tmpFilePath := filepath.Join(f.tmpPath, p.To)
 	finalFilePath := filepath.Join(f.dataPath, p.To)
-	conn, cancel, err := utils.ConnectDuckDB("?allow_unsigned_extensions=1")
+	_, columns, err := f.convergeColumns(p.From)
 	if err != nil {
 		return err
 	}
-	defer cancel()
-	createTableSQL := fmt.Sprintf(
-		`COPY(FROM read_parquet(ARRAY['%s'], hive_partitioning = false, union_by_name = true) ORDER BY %s)TO '%s' (FORMAT 'parquet')`,
-		strings.Join(p.From, "','"),
-		strings.Join(f.table.OrderBy, " ASC,")+" ASC", tmpFilePath)
-	_, err = conn.Exec(createTableSQL)
+	// the first level files are not sorted
+	err = f.duckdbMerge(p.From, tmpFilePath, columns, false)
 	if err != nil {
-		fmt.Println("Error read_parquet_mergetree: ", err)
 		return err
 	}
 
@@ -238,46 +219,194 @@ func (f *fsMergeService) mergeFirstIteration(p PlanMerge) error {
 	return nil
 }
 
+// mergeEngine returns the engine merging the sorted files: native (default) or duckdb
+func mergeEngine() string {
+	return utils.GetEnv("GIGAPI_MERGE_ENGINE", "native")
+}
+
+// mergeSorted merges the sorted local files into the file to.
+// The files are merged natively unless GIGAPI_MERGE_ENGINE=duckdb.
+// DuckDB is used as well for the files the native merge doesn't support.
+func (f *fsMergeService) mergeSorted(from []string, to string, types map[string]string, columns string) error {
+	if mergeEngine() == "duckdb" {
+		return f.duckdbMerge(from, to, columns, columns == "*")
+	}
+	err := kwayMerge(from, to, f.table.OrderBy, types)
+	if !errors.Is(err, errUnsupportedMerge) {
+		return err
+	}
+	fmt.Printf("Native merge of %s: %v, merging with DuckDB\n", to, err)
+	os.Remove(to)
+	return f.duckdbMerge(from, to, columns, false)
+}
+
+// duckdbMerge merges the files with DuckDB selecting the columns list.
+// chsql uses read_parquet_mergetree of the chsql extension for the sorted files of the same schema,
+// otherwise the rows are sorted by the table order.
+func (f *fsMergeService) duckdbMerge(from []string, to string, columns string, chsql bool) error {
+	conn, cancel, err := utils.ConnectDuckDB("?allow_unsigned_extensions=1")
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	createTableSQL := fmt.Sprintf(
+		`COPY(SELECT %s FROM read_parquet(ARRAY['%s'], hive_partitioning = false, union_by_name = true) ORDER BY %s)TO '%s' (FORMAT 'parquet')`,
+		columns, strings.Join(from, "','"),
+		strings.Join(f.table.OrderBy, " ASC,")+" ASC", to)
+	if chsql {
+		err = installChSql(conn)
+		if err != nil {
+			return err
+		}
+		createTableSQL = fmt.Sprintf(
+			`COPY(SELECT * FROM read_parquet_mergetree(ARRAY['%s'], '%s'))TO '%s' (FORMAT 'parquet')`,
+			strings.Join(from, "','"),
+			strings.Join(f.table.OrderBy, ","), to)
+	}
+	_, err = conn.Exec(createTableSQL)
+	if err != nil {
+		fmt.Println("Error read_parquet_mergetree: ", err)
+	}
+	return err
+}
+
+// fileColumnTypes returns the column types of every file read from the parquet footers
+func fileColumnTypes(files []string) ([]map[string]string, error) {
+	res := make([]map[string]string, len(files))
+	for i, name := range files {
+		reader, err := file.OpenParquetFile(name, false)
+		if err != nil {
+			return nil, err
+		}
+		meta := reader.MetaData()
+		schema, err := pqarrow.FromParquet(meta.Schema, nil, meta.KeyValueMetadata())
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		res[i] = make(map[string]string)
+		for _, field := range schema.Fields() {
+			if tp, ok := data_types.ArrowTypeName(field.Type); ok {
+				res[i][field.Name] = tp
+			}
+		}
+	}
+	return res, nil
+}
+
+// convergeColumns widens the current types of the table with the column types of the files.
+// It returns the current types of the columns and the select list converting the columns
+// of a type narrower than the current one. The list is "*" if all the files have the current types.
+func (f *fsMergeService) convergeColumns(files []string) (map[string]string, string, error) {
+	if f.schema == nil {
+		return nil, "*", nil
+	}
+	fileTypes, err := fileColumnTypes(files)
+	if err != nil {
+		return nil, "", err
+	}
+	types := f.schema.WidenTypes(fileTypes...)
+	var casts []string
+	for name, tp := range types {
+		for _, _types := range fileTypes {
+			fileType, ok := _types[name]
+			if !ok || fileType == tp {
+				continue
+			}
+			if widened, ok := data_types.WidenType(fileType, tp); ok && widened == tp {
+				ident := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+				casts = append(casts, fmt.Sprintf("CAST(%s AS %s) AS %s", ident, tp, ident))
+				break
+			}
+		}
+	}
+	if len(casts) == 0 {
+		return types, "*", nil
+	}
+	sort.Strings(casts)
+	return types, "* REPLACE (" + strings.Join(casts, ", ") + ")", nil
+}
+
+// cleanup removes the merged files after 30s. The files of an indexed partition are left in its drop queue,
+// the index removes them once no retained snapshot references them.
 func (f *fsMergeService) cleanup(p PlanMerge) {
+	if f.index != nil {
+		return
+	}
 	for _, file := range p.From {
 		_file := file
 		go func() {
 			<-time.After(time.Second * 30)
 			os.Remove(_file)
-			if f.index != nil {
-				f.index.RmFromDropQueue([]string{_file})
-			}
 		}()
 	}
 }
 
-func (f *fsMergeService) mergeMany(p PlanMerge, tmpFilePath, finalFilePath string) error {
-	conn, cancel, err := utils.ConnectDuckDB("?allow_unsigned_extensions=1")
+// promote gives the single source of a merge the name of its result. The source is hard-linked,
+// or copied through the tmp folder, and stays in place: it is removed like the sources of a merge,
+// once no retained snapshot references it.
+func promote(from, tmpFilePath, finalFilePath string) error {
+	if os.Link(from, finalFilePath) == nil {
+		return nil
+	}
+	src, err := os.Open(from)
 	if err != nil {
 		return err
 	}
-	defer cancel()
-	err = installChSql(conn)
+	defer src.Close()
+	dst, err := os.Create(tmpFilePath)
 	if err != nil {
 		return err
 	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return err
+	}
+	return os.Rename(tmpFilePath, finalFilePath)
+}
 
-	createTableSQL := fmt.Sprintf(
-		`COPY(SELECT * FROM read_parquet_mergetree(ARRAY['%s'], '%s'))TO '%s' (FORMAT 'parquet')`,
-		strings.Join(p.From, "','"),
-		strings.Join(f.table.OrderBy, ","), tmpFilePath)
-	_, err = conn.Exec(createTableSQL)
-
+func (f *fsMergeService) mergeMany(p PlanMerge, tmpFilePath, finalFilePath string) error {
+	types, columns, err := f.convergeColumns(p.From)
+	if err != nil {
+		return err
+	}
+	if len(p.From) == 1 && columns == "*" {
+		return promote(p.From[0], tmpFilePath, finalFilePath)
+	}
+	err = f.mergeSorted(p.From, tmpFilePath, types, columns)
 	if err != nil {
-		fmt.Println("Error read_parquet_mergetree: ", err)
 		return err
 	}
+	return os.Rename(tmpFilePath, finalFilePath)
+}
 
-	err = os.Rename(tmpFilePath, finalFilePath)
+// merge runs the merge under a merge intent, so it is completed or discarded at startup if interrupted
+func (f *fsMergeService) merge(p PlanMerge) error {
+	err := writeMergeIntent(f.dataPath, p)
+	if err != nil {
+		return err
+	}
+	err = f.mergeFiles(p)
+	if _, statErr := os.Stat(filepath.Join(f.dataPath, p.To)); err != nil && statErr == nil {
+		// the result is in place but the index is not updated: the merge is completed at startup
+		return err
+	}
+	os.Remove(mergeIntentPath(f.dataPath, p.To))
+	if err != nil {
+		// the result failing halfway, e.g. on a full disk, is not left in tmp
+		os.Remove(filepath.Join(f.tmpPath, p.To))
+	}
 	return err
 }
 
-func (f *fsMergeService) merge(p PlanMerge) error {
+func (f *fsMergeService) mergeFiles(p PlanMerge) error {
 	if p.Iteration == 1 {
 		return f.mergeFirstIteration(p)
 	}
@@ -293,13 +422,7 @@ func (f *fsMergeService) merge(p PlanMerge) error {
 		fmt.Printf("  Data path: %s\n", finalFilePath)
 	*/
 
-	var err error
-
-	if len(p.From) == 1 {
-		err = os.Rename(p.From[0], finalFilePath)
-	} else {
-		err = f.mergeMany(p, tmpFilePath, finalFilePath)
-	}
+	err := f.mergeMany(p, tmpFilePath, finalFilePath)
 	if err != nil {
 		return err
 	}
@@ -316,25 +439,20 @@ func (f *fsMergeService) merge(p PlanMerge) error {
 }
 
 func (f *fsMergeService) updateIndex(merge PlanMerge) error {
-	_min := make(map[string]any)
-	_max := make(map[string]any)
 	var rowCount int64
 	toDelete := make([]string, len(merge.From))
+	from := make([]*shared.IndexEntry, len(merge.From))
 	for i, file := range merge.From {
 		path, err := filepath.Abs(file)
 		if err != nil {
 			return err
 		}
 		toDelete[i] = path
-		fromIdx := f.index.Get(path)
-		if i == 0 {
-			_min["__timestamp"] = fromIdx.Min["__timestamp"]
-			_max["__timestamp"] = fromIdx.Max["__timestamp"]
-		} else {
-			_min["__timestamp"] = min(_min["__timestamp"].(int64), fromIdx.Min["__timestamp"].(int64))
-			_max["__timestamp"] = max(_max["__timestamp"].(int64), fromIdx.Max["__timestamp"].(int64))
+		from[i] = f.index.Get(path)
+		if from[i] == nil {
+			return fmt.Errorf("merged file %s is not indexed", path)
 		}
-		rowCount += fromIdx.RowCount
+		rowCount += from[i].RowCount
 	}
 	path, err := filepath.Abs(path.Join(f.dataPath, merge.To))
 	if err != nil {
@@ -349,8 +467,11 @@ func (f *fsMergeService) updateIndex(merge PlanMerge) error {
 		SizeBytes: stat.Size(),
 		RowCount:  rowCount,
 		ChunkTime: time.Now().UnixNano(),
-		Min:       _min,
-		Max:       _max,
+	}
+	shared.MergeIndexStats(newIdx, from, f.table.GetTimestampField())
+	err = fillBloomFilters(f.table, path, newIdx)
+	if err != nil {
+		fmt.Printf("Failed to build the bloom filters of %s: %v\n", path, err)
 	}
 	prom := f.index.Batch([]*shared.IndexEntry{newIdx}, toDelete)
 	f.index.AddToDropQueue(merge.From)
@@ -3,7 +3,7 @@ package service
 import (
 	"context"
 	"fmt"
-	"github.com/gigapi/gigapi/v2/merge/utils"
+	"github.com/gigapi/gigapi/v2/merge/shared"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"golang.org/x/sync/errgroup"
@@ -15,7 +15,6 @@ import (
 type s3MergeService struct {
 	fsMergeService
 	s3Config
-	tmpPath string
 }
 
 func (s *s3MergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
@@ -36,7 +35,7 @@ func (s *s3MergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 			StartAfter: snapshot,
 		})
 	snapshot = "a"
-	suffix := fmt.Sprintf("%d.parquet", iteration)
+	suffix := fmt.Sprintf(".%d.parquet", iteration)
 	for snapshot != "" {
 		snapshot = ""
 		for obj := range c {
@@ -62,77 +61,61 @@ func (s *s3MergeService) GetFilesToMerge(iteration int) ([]FileDesc, error) {
 	return res, nil
 }
 
-func (s *s3MergeService) PlanMerge(descs []FileDesc, maxSize int64, iteration int) []PlanMerge {
-	return s.fsMergeService.PlanMerge(descs, maxSize, iteration)
-}
-
-func escapeString(s string) string {
-	return strings.Replace(s, "'", "''", -1)
+func (s *s3MergeService) PlanMerge(descs []FileDesc, level shared.MergeLevel, iteration int) ([]PlanMerge, []FileDesc) {
+	return s.fsMergeService.PlanMerge(descs, level, iteration)
 }
 
 func (s *s3MergeService) merge(p PlanMerge) error {
 	// Create a temporary merged file
 	tmpFilePath := filepath.Join(s.tmpPath, p.To)
 
-	conn, cancel, err := utils.ConnectDuckDB("?allow_unsigned_extensions=1")
-	if err != nil {
-		return err
-	}
-	defer cancel()
-	_, err = conn.Exec("INSTALL chsql FROM community")
-	if err != nil {
-		fmt.Println("Error loading chsql extension: ", err)
-		return err
+	saveSvc := s3SaveService{
+		fsSaveService: fsSaveService{},
+		s3Config:      s.s3Config,
 	}
-	_, err = conn.Exec("LOAD chsql")
+	minioClient, err := saveSvc.createMinioClient()
 	if err != nil {
-		fmt.Println("Error loading chsql extension: ", err)
 		return err
 	}
-	defer conn.Close()
 
+	// the files are merged locally
 	from := make([]string, len(p.From))
-	for i, file := range p.From {
-		from[i] = fmt.Sprintf("s3://%s/%s", s.bucket, file)
+	defer func() {
+		for _, f := range from {
+			if f != "" {
+				os.Remove(f)
+			}
+		}
+	}()
+	for i, key := range p.From {
+		local := filepath.Join(s.tmpPath, fmt.Sprintf("%s.from.%d", p.To, i))
+		err = minioClient.FGetObject(context.Background(), s.bucket, key, local, minio.GetObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", key, err)
+		}
+		from[i] = local
 	}
 
-	createSecret := fmt.Sprintf(`CREATE SECRET (
-  TYPE S3, 
-  KEY_ID '%s', 
-  SECRET '%s', 
-  ENDPOINT '%s', 
-  USE_SSL %t, 
-  URL_STYLE 'path'
-);`, escapeString(s.key), escapeString(s.secret), escapeString(s.url), s.secure)
-	fmt.Println(createSecret)
-
-	_, err = conn.Exec(createSecret)
+	types, columns, err := s.convergeColumns(from)
 	if err != nil {
 		return err
 	}
-	createTableSQL := fmt.Sprintf(
-		`COPY(SELECT * FROM read_parquet_mergetree(ARRAY['%s'], '%s'))TO '%s' (FORMAT 'parquet')`,
-		strings.Join(from, "','"),
-		strings.Join(s.table.OrderBy, ","), tmpFilePath)
-	fmt.Println(createTableSQL)
-	_, err = conn.Exec(createTableSQL)
+	if p.Iteration == 1 {
+		// the first level files are not sorted
+		err = s.duckdbMerge(from, tmpFilePath, columns, false)
+	} else {
+		err = s.mergeSorted(from, tmpFilePath, types, columns)
+	}
 	if err != nil {
-		fmt.Println("Error read_parquet_mergetree: ", err)
 		return err
 	}
 	defer os.Remove(tmpFilePath)
 
-	saveSvc := s3SaveService{
-		fsSaveService: fsSaveService{},
-		s3Config:      s.s3Config,
-	}
-
 	err = saveSvc.uploadToS3(tmpFilePath)
 	if err != nil {
 		return err
 	}
 
-	minioClient, err := saveSvc.createMinioClient()
 	eg := errgroup.Group{}
 	for _, f := range p.From {
 		_f := f
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/gigapi/gigapi-config/config"
 	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/quarantine"
 	"github.com/gigapi/gigapi/v2/merge/shared"
 	"github.com/gigapi/gigapi/v2/utils"
 	_ "github.com/marcboeker/go-duckdb/v2"
+	"net/http"
 	url2 "net/url"
 	"path"
 	"path/filepath"
@@ -32,20 +34,25 @@ type MergeTreeService struct {
 	mtx                sync.Mutex
 	save               saveService
 	merge              mergeService
-	lastIterationTime  [MERGE_ITERATIONS]time.Time
+	lastIterationTime  []time.Time
 	unorderedDataStore *unorderedDataStore
+	schema             *tableSchema
 
 	less func(store any, i int32, j int32) bool
 }
 
 func NewMergeTreeService(t *shared.Table) (*MergeTreeService, error) {
+	err := recoverTable(t, false)
+	if err != nil {
+		return nil, fmt.Errorf("table %s.%s: recovery failed: %w", t.Database, t.Name, err)
+	}
 	res := &MergeTreeService{
 		Table:    t,
 		working:  0,
 		promises: nil,
+		schema:   getTableSchema(t),
 	}
 	res.unorderedDataStore = newUnorderedDataStore()
-	var err error
 	tablePath := t.Path
 	if tablePath == "" {
 		tablePath = filepath.Join(config.Config.Gigapi.Root, t.Name)
@@ -55,9 +62,7 @@ func NewMergeTreeService(t *shared.Table) (*MergeTreeService, error) {
 		return nil, err
 	}
 	res.merge, err = res.newMergeService()
-	for i := range res.lastIterationTime {
-		res.lastIterationTime[i] = time.Now()
-	}
+	res.lastIterationTime = newLevelTimes(t)
 	return res, err
 }
 
@@ -73,11 +78,12 @@ func (s *MergeTreeService) newFileMergeService() (mergeService, error) {
 		dataPath: path.Join(s.Table.Path, "data"),
 		tmpPath:  path.Join(s.Table.Path, "tmp"),
 		table:    s.Table,
+		schema:   s.schema,
 	}, nil
 }
 
 func (s *MergeTreeService) newS3MergeService() (mergeService, error) {
-	s3Conf, err := s.getS3Config(s.Table.Path)
+	s3Conf, err := parseS3Config(s.Table.Path)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +91,7 @@ func (s *MergeTreeService) newS3MergeService() (mergeService, error) {
 		fsMergeService: fsMergeService{
 			tmpPath: path.Join(config.Config.Gigapi.Root, s.Table.Name, "tmp"),
 			table:   s.Table,
+			schema:  s.schema,
 		},
 		s3Config: s3Conf,
 	}, nil
@@ -105,7 +112,7 @@ func (s *MergeTreeService) newFileSaveService(dataPath, tmpPath string) (saveSer
 }
 
 func (s *MergeTreeService) newS3SaveService(dataPath string) (saveService, error) {
-	s3Conf, err := s.getS3Config(dataPath)
+	s3Conf, err := parseS3Config(dataPath)
 	if err != nil {
 		return nil, err
 	}
@@ -119,7 +126,8 @@ func (s *MergeTreeService) newS3SaveService(dataPath string) (saveService, error
 	return res, nil
 }
 
-func (s *MergeTreeService) getS3Config(path string) (s3Config, error) {
+// parseS3Config parses an S3 URL: s3://<key>:<secret>@<host>/<bucket>/<path>?secure=false&region=<region>
+func parseS3Config(path string) (s3Config, error) {
 	url, err := url2.Parse(path)
 	if err != nil {
 		return s3Config{}, err
@@ -129,6 +137,12 @@ func (s *MergeTreeService) getS3Config(path string) (s3Config, error) {
 	}
 	pass, _ := url.User.Password()
 	bucketPath := strings.SplitN(strings.TrimPrefix(url.Path, "/"), "/", 2)
+	if bucketPath[0] == "" {
+		return s3Config{}, errors.New("invalid S3 URL: no bucket")
+	}
+	if len(bucketPath) < 2 {
+		bucketPath = append(bucketPath, "")
+	}
 	secure := !(url.Query().Get("secure") == "false")
 	region := ""
 	if url.Query().Get("region") != "" {
@@ -246,6 +260,10 @@ func (s *MergeTreeService) validateData(columns map[string]data_types.IColumn) e
 	if err != nil {
 		return err
 	}
+	err = s.schema.Widen(columns)
+	if err != nil {
+		return err
+	}
 
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -265,8 +283,65 @@ func (s *MergeTreeService) wrapColumns(columns map[string]any) (map[string]data_
 	return _columns, nil
 }
 
+// checkDeclaredColumns validates the columns against the declared columns of the table.
+// Integer columns declared as Float64 are converted.
+func (s *MergeTreeService) checkDeclaredColumns(columns map[string]data_types.IColumn) error {
+	if len(s.Table.Columns) == 0 {
+		return nil
+	}
+	for name, col := range columns {
+		var declared *shared.TableColumn
+		for i := range s.Table.Columns {
+			if s.Table.Columns[i].Name == name {
+				declared = &s.Table.Columns[i]
+				break
+			}
+		}
+		if declared == nil {
+			return utils.NewGigapiError(http.StatusBadRequest,
+				fmt.Sprintf("column %q is not declared in table %s.%s", name, s.Table.Database, s.Table.Name))
+		}
+		if col.GetTypeName() == declared.Type {
+			continue
+		}
+		if declared.Type == data_types.DATA_TYPE_NAME_FLOAT64 {
+			var floats []float64
+			switch data := col.GetData().(type) {
+			case []int64:
+				floats = intsToFloats(data)
+			case []uint64:
+				floats = intsToFloats(data)
+			}
+			if floats != nil {
+				var err error
+				columns[name], err = data_types.WrapToColumn(name, floats)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return utils.NewGigapiError(http.StatusBadRequest,
+			fmt.Sprintf("column %q of table %s.%s is declared as %s, got %s",
+				name, s.Table.Database, s.Table.Name, declared.Type, col.GetTypeName()))
+	}
+	return nil
+}
+
+func intsToFloats[T int64 | uint64](data []T) []float64 {
+	res := make([]float64, len(data))
+	for i, v := range data {
+		res[i] = float64(v)
+	}
+	return res
+}
+
+// AutoTimestamp adds the arrival time column if the table requires it
+// and fills the event time column with the arrival time if it is absent
 func (s *MergeTreeService) AutoTimestamp(columns map[string]data_types.IColumn) (map[string]data_types.IColumn, error) {
-	if !s.Table.AutoTimestamp {
+	tsField := s.Table.GetTimestampField()
+	_, hasTs := columns[tsField]
+	if !s.Table.AutoTimestamp && hasTs {
 		return columns, nil
 	}
 
@@ -277,15 +352,26 @@ func (s *MergeTreeService) AutoTimestamp(columns map[string]data_types.IColumn)
 	}
 
 	tsData := make([]int64, sz)
+	now := time.Now().UnixNano()
 	for i := range tsData {
-		tsData[i] = time.Now().UnixNano()
+		tsData[i] = now
 	}
 
-	tsCol, err := data_types.WrapToColumn("__timestamp", tsData)
-	if err != nil {
-		return nil, err
+	// the arrival time of a replayed batch is kept
+	if _, ok := columns[shared.ArrivalTimestampField]; s.Table.AutoTimestamp && !ok {
+		tsCol, err := data_types.WrapToColumn(shared.ArrivalTimestampField, tsData)
+		if err != nil {
+			return nil, err
+		}
+		columns[shared.ArrivalTimestampField] = tsCol
+	}
+	if !hasTs {
+		tsCol, err := data_types.WrapToColumn(tsField, tsData)
+		if err != nil {
+			return nil, err
+		}
+		columns[tsField] = tsCol
 	}
-	columns["__timestamp"] = tsCol
 	return columns, nil
 }
 
@@ -295,7 +381,7 @@ func (s *MergeTreeService) Store(columns map[string]any) utils.Promise[int32] {
 		return utils.Fulfilled(err, int32(0))
 	}
 
-	err = s.validateData(_columns)
+	err = s.checkDeclaredColumns(_columns)
 	if err != nil {
 		return utils.Fulfilled(err, int32(0))
 	}
@@ -305,6 +391,15 @@ func (s *MergeTreeService) Store(columns map[string]any) utils.Promise[int32] {
 		return utils.Fulfilled(err, int32(0))
 	}
 
+	err = s.validateData(_columns)
+	var conflict *TypeConflictError
+	if errors.As(err, &conflict) {
+		return s.quarantineBatch(_columns, conflict)
+	}
+	if err != nil {
+		return utils.Fulfilled(err, int32(0))
+	}
+
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -318,49 +413,151 @@ func (s *MergeTreeService) Store(columns map[string]any) utils.Promise[int32] {
 	return p
 }
 
+// CheckTypes checks the data against the column types of the table
+func (s *MergeTreeService) CheckTypes(columns map[string]any) error {
+	_columns, err := s.wrapColumns(columns)
+	if err != nil {
+		return err
+	}
+	err = s.checkDeclaredColumns(_columns)
+	if err != nil {
+		return err
+	}
+	err = s.schema.Check(_columns)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.unorderedDataStore.VerifyData(_columns)
+}
+
+// GetSchema returns the columns of the table from the schema registry
+func (s *MergeTreeService) GetSchema() []ColumnSchema {
+	return s.schema.Columns()
+}
+
+// MarkTags records the columns parsed from tags or labels
+func (s *MergeTreeService) MarkTags(names []string) {
+	s.schema.MarkTags(names)
+}
+
+// QuarantinedError resolves the promise of a batch diverted to the quarantine folder of the table.
+// The rows of the batch are kept, but not stored into the table.
+type QuarantinedError struct {
+	Database string
+	Table    string
+	// Id is the id of the batch in the quarantine of the table
+	Id     string
+	Reason string
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("the batch was quarantined as %s/%s/%s: %s", e.Database, e.Table, e.Id, e.Reason)
+}
+
+// quarantineBatch diverts the batch conflicting with the column types of the table
+// to the quarantine folder of the table. The promise is fulfilled with a QuarantinedError.
+func (s *MergeTreeService) quarantineBatch(columns map[string]data_types.IColumn,
+	conflict *TypeConflictError) utils.Promise[int32] {
+	entry := &quarantine.Entry{
+		Database:     s.Table.Database,
+		Table:        s.Table.Name,
+		Reason:       conflict.Error(),
+		Column:       conflict.Column,
+		ExpectedType: conflict.Expected,
+		ActualType:   conflict.Actual,
+		Columns:      make(map[string]string, len(columns)),
+	}
+	data := make(map[string]any, len(columns))
+	for name, col := range columns {
+		data[name] = col.GetData()
+		entry.Columns[name] = col.GetTypeName()
+		entry.Rows = col.GetLength()
+	}
+	err := quarantine.Add(entry, data)
+	if err != nil {
+		return utils.Fulfilled(err, int32(0))
+	}
+	fmt.Printf("Table %s.%s: %d rows quarantined as %s: %s\n",
+		s.Table.Database, s.Table.Name, entry.Rows, entry.Id, entry.Reason)
+	return utils.Fulfilled[int32](&QuarantinedError{
+		Database: s.Table.Database,
+		Table:    s.Table.Name,
+		Id:       entry.Id,
+		Reason:   entry.Reason,
+	}, 0)
+}
+
 type PlanMerge struct {
 	From      []string
 	To        string
 	Iteration int
+	// Reason is the planner decision grouping the files
+	Reason string
+	files  []FileDesc
 }
 
 type FileDesc struct {
 	name string
 	size int64
+	// minTime and maxTime are the time range of the file from the index if hasRange is set
+	minTime  int64
+	maxTime  int64
+	hasRange bool
+	// skipped is the reason the planner left the file out
+	skipped string
 }
 
-const MERGE_ITERATIONS = 4
+// compactionPolicy returns the merge policy of the table
+func compactionPolicy(t *shared.Table) *shared.CompactionPolicy {
+	if t.Compaction != nil {
+		return t.Compaction
+	}
+	return shared.DefaultCompactionPolicy(int64(config.Config.Gigapi.MergeTimeoutS))
+}
 
-// get merge configurations from the overall configuration
-// Each merge configuration is [3]int64 array {timeout in seconds, max result bytes, iteration id}
-func getMergeConfigurations() [][3]int64 {
-	timeoutS := int64(config.Config.Gigapi.MergeTimeoutS)
-	return [][3]int64{
-		{timeoutS, 100 * 1024 * 1024, 1},
-		{timeoutS * 10, 400 * 1024 * 1024, 2},
-		{timeoutS * 100, 4000 * 1024 * 1024, 3},
-		{timeoutS * 420, 4000 * 1024 * 1024, 4},
+// newLevelTimes returns the last run times of the merge levels of the table
+func newLevelTimes(t *shared.Table) []time.Time {
+	res := make([]time.Time, len(compactionPolicy(t).Levels))
+	for i := range res {
+		res[i] = time.Now()
 	}
+	return res
 }
 
-func (s *MergeTreeService) PlanMerge() ([]PlanMerge, error) {
+// planMerge plans the merges of the levels due according to the compaction policy of the table.
+// A level is due once its delay passed since its last planned merge.
+func planMerge(t *shared.Table, merge mergeService, lastIterationTime []time.Time) ([]PlanMerge, error) {
 	var res []PlanMerge
-	// configuration - timeout_s - max_res_size_bytes - iteration_id
-	configurations := getMergeConfigurations()
-	for _, conf := range configurations {
-		if time.Now().Sub(s.lastIterationTime[conf[2]-1]).Seconds() > float64(conf[0]) {
-			files, err := s.merge.GetFilesToMerge(int(conf[2]))
-			if err != nil {
-				return nil, err
-			}
-			plans := s.merge.PlanMerge(files, conf[1], int(conf[2]))
-			res = append(res, plans...)
-			s.lastIterationTime[conf[2]-1] = time.Now()
+	for i, level := range compactionPolicy(t).Levels {
+		if i >= len(lastIterationTime) ||
+			time.Now().Sub(lastIterationTime[i]).Seconds() <= float64(level.DelayS) {
+			continue
 		}
+		files, err := merge.GetFilesToMerge(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		plans, _ := merge.PlanMerge(files, level, i+1)
+		if len(plans) == 0 {
+			// the level is planned again on the next tick once it has enough files
+			continue
+		}
+		res = append(res, plans...)
+		lastIterationTime[i] = time.Now()
 	}
 	return res, nil
 }
 
+func (s *MergeTreeService) PlanMerge() ([]PlanMerge, error) {
+	return planMerge(s.Table, s.merge, s.lastIterationTime)
+}
+
+func (s *MergeTreeService) DryRunPlan() ([]LevelPlanReport, error) {
+	return dryRunPlan(s.Table, s.merge, s.lastIterationTime, nil)
+}
+
 // Merge method implementation
 func (s *MergeTreeService) Merge(plan []PlanMerge) error {
 	return s.merge.DoMerge(plan)
@@ -379,6 +576,22 @@ type MergeService interface {
 	Stop()
 	Store(columns map[string]any) utils.Promise[int32]
 	DoMerge() error
+	// CheckTypes validates the data against the column types of the table without storing it
+	CheckTypes(columns map[string]any) error
+	// GetSchema returns the columns of the table from the schema registry
+	GetSchema() []ColumnSchema
+	// MarkTags records the columns parsed from tags or labels
+	MarkTags(names []string)
+	// DryRunPlan returns the merges the planner would run now, without running them
+	DryRunPlan() ([]LevelPlanReport, error)
+	// Delete deletes the rows matching the request, it returns the partitions with deleted rows
+	Delete(req DeleteRequest) ([]PartitionDeleteReport, error)
+	// Drop stops the service and discards the rows not saved yet
+	Drop()
+	// DropPartitions drops the partition folders starting with the prefixes, calling drop to remove every folder
+	DropPartitions(prefixes [][][2]string, drop func(values [][2]string) error) ([]string, error)
+	// Tier moves the files of the fully compacted partitions older than before to the S3 URL target
+	Tier(target string, before int64) ([]TierReport, error)
 	/*PlanMerge() ([]PlanMerge, error)
 	Merge(plan []PlanMerge) error*/
 }
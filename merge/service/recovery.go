@@ -0,0 +1,480 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/utils"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mergeIntentSuffix is the suffix of the merge intents. The intent <to>.merge.json is written
+// into the partition folder before the merge and removed once the index is updated,
+// so a merge interrupted by a crash is completed or discarded at startup.
+const mergeIntentSuffix = ".merge.json"
+
+type mergeIntent struct {
+	From []string `json:"from"`
+	To   string   `json:"to"`
+	// Rewrite is set for the rewrite of a file without the deleted rows, rolled back if interrupted
+	Rewrite bool `json:"rewrite,omitempty"`
+}
+
+func mergeIntentPath(dataPath, to string) string {
+	return filepath.Join(dataPath, to+mergeIntentSuffix)
+}
+
+func writeMergeIntent(dataPath string, p PlanMerge) error {
+	return writeIntent(dataPath, p.To, p.From, false)
+}
+
+func writeIntent(dataPath string, to string, from []string, rewrite bool) error {
+	intent := mergeIntent{To: filepath.Join(dataPath, to), Rewrite: rewrite}
+	for _, from := range from {
+		abs, err := filepath.Abs(from)
+		if err != nil {
+			return err
+		}
+		intent.From = append(intent.From, abs)
+	}
+	abs, err := filepath.Abs(intent.To)
+	if err != nil {
+		return err
+	}
+	intent.To = abs
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	name := mergeIntentPath(dataPath, to)
+	err = os.WriteFile(name+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// recovery repairs the files of a table left inconsistent by a crash
+type recovery struct {
+	table *shared.Table
+	// walEnabled is set if the unsaved data of the table is replayed from the WAL
+	walEnabled bool
+	repaired   int
+}
+
+func (r *recovery) logf(format string, args ...any) {
+	r.repaired++
+	fmt.Printf("Recovery %s.%s: %s\n", r.table.Database, r.table.Name, fmt.Sprintf(format, args...))
+}
+
+// recoverTable reconciles the files on disk, the metadata.json indexes and their drop queues
+// of every partition of the table. It runs at startup before the partitions are loaded
+// and the WAL is replayed:
+//   - the files of the tmp folder are removed,
+//   - the interrupted merges are completed if their result was moved into the partition, discarded otherwise,
+//     the interrupted delete rewrites are rolled back,
+//   - the index entries of the missing files are removed,
+//   - the files of the drop queue are removed, except the files of the retained snapshots,
+//   - the parquet files missing from the index are added to it, except the level 1 files
+//     of a table with the WAL, as their rows are replayed from the WAL,
+//   - a lost or unreadable metadata.json is rebuilt from the footers of the parquet files.
+func recoverTable(t *shared.Table, walEnabled bool) error {
+	if strings.HasPrefix(t.Path, "s3://") {
+		return nil
+	}
+	r := &recovery{table: t, walEnabled: walEnabled}
+	err := r.cleanTmp(filepath.Join(t.Path, "tmp"))
+	if err != nil {
+		return err
+	}
+	if t.Engine == "Merge" {
+		err = r.recoverPartition(filepath.Join(t.Path, "data"), nil)
+	} else {
+		err = r.recoverPartitions()
+	}
+	if err != nil {
+		return err
+	}
+	if r.repaired > 0 {
+		fmt.Printf("Recovery %s.%s: %d repairs\n", t.Database, t.Name, r.repaired)
+	}
+	return nil
+}
+
+func (r *recovery) cleanTmp(tmpPath string) error {
+	entries, err := os.ReadDir(tmpPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		err = os.Remove(filepath.Join(tmpPath, e.Name()))
+		if err != nil {
+			return err
+		}
+		r.logf("removed the stale tmp file %s", e.Name())
+	}
+	return nil
+}
+
+// recoverPartitions recovers the partition folders (<key>=<value>/...) of a hive table
+func (r *recovery) recoverPartitions() error {
+	err := filepath.WalkDir(r.table.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || p == r.table.Path {
+			return nil
+		}
+		rel := strings.TrimPrefix(p, r.table.Path+string(filepath.Separator))
+		var values [][2]string
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) < 2 {
+				return filepath.SkipDir
+			}
+			values = append(values, [2]string{kv[0], kv[1]})
+		}
+		err = r.recoverPartition(p, values)
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", rel, err)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *recovery) recoverPartition(dataPath string, values [][2]string) error {
+	dataPath, err := filepath.Abs(dataPath)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var (
+		files   = make(map[string]bool)
+		intents []string
+		hasIdx  bool
+	)
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+		case strings.HasSuffix(e.Name(), ".parquet"):
+			files[filepath.Join(dataPath, e.Name())] = true
+		case strings.HasSuffix(e.Name(), mergeIntentSuffix):
+			intents = append(intents, filepath.Join(dataPath, e.Name()))
+		case strings.HasSuffix(e.Name(), mergeIntentSuffix+".tmp"):
+			err = os.Remove(filepath.Join(dataPath, e.Name()))
+			if err != nil {
+				return err
+			}
+			r.logf("removed the incomplete merge intent %s", e.Name())
+		case e.Name() == "metadata.json" || e.Name() == "metadata.journal":
+			hasIdx = true
+		}
+	}
+	if len(files) == 0 && len(intents) == 0 && !hasIdx {
+		return nil
+	}
+
+	var idx shared.Index
+	// rebuilt is set if the index is rebuilt from the parquet files
+	rebuilt := !hasIdx
+	if r.table.IndexCreator != nil && values != nil {
+		idx, err = index.NewJSONIndexForPartition(r.table, values)
+		if err != nil {
+			r.logf("unreadable index of %s: %v", filepath.Base(dataPath), err)
+			for _, name := range []string{"metadata.json", "metadata.journal", "metadata.history.json"} {
+				corrupted := filepath.Join(dataPath, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+				err = os.Rename(filepath.Join(dataPath, name), corrupted)
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				r.logf("moved %s of %s to %s, the index is rebuilt",
+					name, filepath.Base(dataPath), filepath.Base(corrupted))
+			}
+			rebuilt = true
+			idx, err = index.NewJSONIndexForPartition(r.table, values)
+			if err != nil {
+				return err
+			}
+		}
+		idx.Run()
+	}
+	p := &partitionRecovery{recovery: r, files: files, idx: idx, rebuilt: rebuilt}
+	for _, intent := range intents {
+		err = p.resumeMerge(intent)
+		if err != nil {
+			break
+		}
+	}
+	if idx == nil {
+		return err
+	}
+	if err == nil {
+		err = p.reconcileIndex()
+	}
+	if err == nil {
+		err = p.wait()
+	}
+	idx.Stop()
+	if err != nil || !p.retained {
+		return err
+	}
+	// the partition is loaded to remove the dropped files once their snapshots expire
+	_, err = r.table.IndexCreator(values)
+	return err
+}
+
+type partitionRecovery struct {
+	*recovery
+	// files are the parquet files of the partition
+	files map[string]bool
+	idx   shared.Index
+	// rebuilt is set if metadata.json was lost, so all the files are indexed again
+	rebuilt bool
+	// retained is set if the drop queue keeps files of retained snapshots
+	retained bool
+	promises []utils.Promise[int32]
+}
+
+// rel returns the path of the file in the table folder for the logs
+func (p *partitionRecovery) rel(name string) string {
+	tablePath, err := filepath.Abs(p.table.Path)
+	if err != nil {
+		return name
+	}
+	if rel, err := filepath.Rel(tablePath, name); err == nil {
+		return rel
+	}
+	return name
+}
+
+func (p *partitionRecovery) removeFile(name string) error {
+	err := os.Remove(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(p.files, name)
+	return nil
+}
+
+func (p *partitionRecovery) indexed(name string) bool {
+	return p.idx != nil && p.idx.Get(name) != nil
+}
+
+// resumeMerge completes the merge of the intent if its result was moved into the partition
+// and its sources are still in place, discards it otherwise. A rewrite not indexed yet is discarded.
+// A single source renamed into the result is indexed under its new name.
+func (p *partitionRecovery) resumeMerge(intentPath string) error {
+	data, err := os.ReadFile(intentPath)
+	if err != nil {
+		return err
+	}
+	var intent mergeIntent
+	err = json.Unmarshal(data, &intent)
+	if err != nil {
+		p.logf("removed the corrupted merge intent %s: %v", p.rel(intentPath), err)
+		return os.Remove(intentPath)
+	}
+
+	switch {
+	case !p.files[intent.To]:
+		p.logf("discarded the interrupted merge into %s", p.rel(intent.To))
+	case intent.Rewrite && !p.indexed(intent.To):
+		// the rows of the interrupted delete are still in the source
+		err = p.removeFile(intent.To)
+		if err != nil {
+			return err
+		}
+		p.logf("rolled back the interrupted delete rewrite into %s", p.rel(intent.To))
+	case p.idx == nil || p.indexed(intent.To):
+		// the index was updated (or there is no index): only the sources are left to remove
+		err = p.dropSources(intent)
+		if err != nil {
+			return err
+		}
+	case !intent.Rewrite && len(intent.From) == 1 && !p.files[intent.From[0]] && p.indexed(intent.From[0]):
+		// a single source promoted by a rename: the result is the only copy of its rows
+		stat, err := os.Stat(intent.To)
+		if err != nil {
+			return err
+		}
+		entry := *p.idx.Get(intent.From[0])
+		entry.Path = intent.To
+		entry.SizeBytes = stat.Size()
+		p.promises = append(p.promises, p.idx.Batch([]*shared.IndexEntry{&entry}, intent.From))
+		p.logf("completed the interrupted promotion of %s into %s", p.rel(intent.From[0]), p.rel(intent.To))
+	default:
+		var sources []*shared.IndexEntry
+		for _, from := range intent.From {
+			if entry := p.idx.Get(from); entry != nil && p.files[from] {
+				sources = append(sources, entry)
+			}
+		}
+		if len(sources) < len(intent.From) {
+			// the sources were merged again or removed meanwhile, so the result is stale
+			err = p.removeFile(intent.To)
+			if err != nil {
+				return err
+			}
+			p.logf("removed the stale merge result %s, its sources changed", p.rel(intent.To))
+			break
+		}
+		stat, err := os.Stat(intent.To)
+		if err != nil {
+			return err
+		}
+		entry := &shared.IndexEntry{
+			Path:      intent.To,
+			SizeBytes: stat.Size(),
+			ChunkTime: time.Now().UnixNano(),
+		}
+		for _, src := range sources {
+			entry.RowCount += src.RowCount
+		}
+		shared.MergeIndexStats(entry, sources, p.table.GetTimestampField())
+		err = fillBloomFilters(p.table, intent.To, entry)
+		if err != nil {
+			p.logf("failed to build the bloom filters of %s: %v", p.rel(intent.To), err)
+		}
+		p.promises = append(p.promises, p.idx.Batch([]*shared.IndexEntry{entry}, intent.From))
+		err = p.dropSources(intent)
+		if err != nil {
+			return err
+		}
+		p.logf("completed the interrupted merge of %d files into %s", len(intent.From), p.rel(intent.To))
+	}
+	return os.Remove(intentPath)
+}
+
+// dropSources removes the sources of the merge left on disk. With an index, they are added to its drop queue
+// and removed once no retained snapshot references them.
+func (p *partitionRecovery) dropSources(intent mergeIntent) error {
+	var dropped []string
+	for _, from := range intent.From {
+		if !p.files[from] {
+			continue
+		}
+		if p.idx != nil {
+			dropped = append(dropped, from)
+			continue
+		}
+		err := p.removeFile(from)
+		if err != nil {
+			return err
+		}
+		p.logf("removed the merged source %s of %s", p.rel(from), p.rel(intent.To))
+	}
+	if len(dropped) > 0 {
+		p.promises = append(p.promises, p.idx.AddToDropQueue(dropped))
+	}
+	return nil
+}
+
+// reconcileIndex makes the index, its drop queue and the files of the partition match
+func (p *partitionRecovery) reconcileIndex() error {
+	var rm []string
+	for _, entry := range p.idx.List() {
+		// the files tiered to S3 are not in the partition folder
+		if !p.files[entry.Path] && !isTiered(entry.Path) {
+			rm = append(rm, entry.Path)
+			p.logf("removed the index entry of the missing file %s", p.rel(entry.Path))
+		}
+	}
+	if len(rm) > 0 {
+		p.promises = append(p.promises, p.idx.Batch(nil, rm))
+	}
+
+	// the dropped files of the retained snapshots are removed by the index once they expire
+	referenced := make(map[string]bool)
+	for _, s := range p.idx.Snapshots() {
+		for _, name := range s.Removed {
+			referenced[name] = true
+		}
+	}
+	var dropped []string
+	queued := make(map[string]bool)
+	for _, name := range p.idx.GetDropQueue() {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		if referenced[abs] && !p.indexed(abs) {
+			p.retained = true
+			queued[abs] = true
+			continue
+		}
+		if p.files[abs] && !p.indexed(abs) {
+			err = p.removeFile(abs)
+			if err != nil {
+				return err
+			}
+			p.logf("removed the dropped file %s", p.rel(abs))
+		}
+		dropped = append(dropped, name)
+	}
+	if len(dropped) > 0 {
+		p.promises = append(p.promises, p.idx.RmFromDropQueue(dropped))
+	}
+
+	var add []*shared.IndexEntry
+	for name := range p.files {
+		if p.indexed(name) || queued[name] {
+			continue
+		}
+		// the WAL has the rows of the level 1 files saved just before the crash,
+		// but not the rows of the files of a lost index
+		if p.walEnabled && !p.rebuilt && strings.HasSuffix(name, ".1.parquet") {
+			err := p.removeFile(name)
+			if err != nil {
+				return err
+			}
+			p.logf("removed the unindexed file %s, its rows are replayed from the WAL", p.rel(name))
+			continue
+		}
+		entry, err := index.ParquetEntry(name, p.table.GetTimestampField())
+		if err != nil {
+			p.logf("failed to read the unindexed file %s: %v", p.rel(name), err)
+			continue
+		}
+		add = append(add, entry)
+		p.logf("added the unindexed file %s to the index", p.rel(name))
+	}
+	if len(add) > 0 {
+		p.promises = append(p.promises, p.idx.Batch(add, nil))
+	}
+	return nil
+}
+
+func (p *partitionRecovery) wait() error {
+	for _, prom := range p.promises {
+		_, err := prom.Get()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/gigapi/gigapi/v2/merge/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testPartition = [][2]string{{"date", "2025-01-01"}}
+
+// testTable returns a hive table in a temp folder with the metadata.json index
+func testTable(t *testing.T) *shared.Table {
+	table := &shared.Table{
+		Database:       "db",
+		Name:           "test",
+		Path:           t.TempDir(),
+		Engine:         "HiveMerge",
+		TimestampField: "time",
+	}
+	table.IndexCreator = func(values [][2]string) (shared.Index, error) {
+		return index.NewJSONIndexForPartition(table, values)
+	}
+	return table
+}
+
+func testPartitionPath(table *shared.Table) string {
+	return filepath.Join(table.Path, partitionName(testPartition))
+}
+
+// writePartitionParquet writes a parquet file of the time and value columns into the partition folder
+func writePartitionParquet(t *testing.T, table *shared.Table, name string, times ...int64) string {
+	dir := testPartitionPath(table)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, cancel, err := utils.ConnectDuckDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	values := make([]string, len(times))
+	for i, ts := range times {
+		values[i] = fmt.Sprint(ts)
+	}
+	res := filepath.Join(dir, name)
+	_, err = conn.Exec(fmt.Sprintf(
+		"COPY (SELECT unnest([%s])::BIGINT AS time, time %% 7 AS value) TO '%s' (FORMAT 'parquet')",
+		strings.Join(values, ","), res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// updateTestIndex adds the files to the index of the partition and removes the rm ones
+func updateTestIndex(t *testing.T, table *shared.Table, add []string, rm []string) {
+	idx, err := table.IndexCreator(testPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	defer idx.Stop()
+	var entries []*shared.IndexEntry
+	for _, name := range add {
+		entry, err := index.ParquetEntry(name, table.GetTimestampField())
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	_, err = idx.Batch(entries, rm).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// indexedFiles returns the base names of the indexed files of the partition
+func indexedFiles(t *testing.T, table *shared.Table) []string {
+	entries, err := index.ReadPartition(table, testPartitionPath(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, e := range entries {
+		res = append(res, filepath.Base(e.Path))
+	}
+	slices.Sort(res)
+	return res
+}
+
+// partitionParquetFiles returns the base names of the parquet files of the partition folder
+func partitionParquetFiles(t *testing.T, table *shared.Table) []string {
+	names, err := filepath.Glob(filepath.Join(testPartitionPath(table), "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, name := range names {
+		res = append(res, filepath.Base(name))
+	}
+	slices.Sort(res)
+	return res
+}
+
+func TestRecoverMergeIntents(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare writes the files and the index of the partition and returns the intent
+		prepare func(t *testing.T, table *shared.Table) (to string, from []string, rewrite bool)
+		indexed []string
+		files   []string
+	}{
+		{
+			name: "result missing",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+				b := writePartitionParquet(t, table, "b.1.parquet", 3)
+				updateTestIndex(t, table, []string{a, b}, nil)
+				return "c.2.parquet", []string{a, b}, false
+			},
+			indexed: []string{"a.1.parquet", "b.1.parquet"},
+			files:   []string{"a.1.parquet", "b.1.parquet"},
+		},
+		{
+			name: "result not indexed",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+				b := writePartitionParquet(t, table, "b.1.parquet", 3)
+				updateTestIndex(t, table, []string{a, b}, nil)
+				writePartitionParquet(t, table, "c.2.parquet", 1, 2, 3)
+				return "c.2.parquet", []string{a, b}, false
+			},
+			indexed: []string{"c.2.parquet"},
+			// the sources are queued for drop, the snapshot of the merge still references them
+			files: []string{"a.1.parquet", "b.1.parquet", "c.2.parquet"},
+		},
+		{
+			name: "result already indexed",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+				b := writePartitionParquet(t, table, "b.1.parquet", 3)
+				c := writePartitionParquet(t, table, "c.2.parquet", 1, 2, 3)
+				updateTestIndex(t, table, []string{c}, nil)
+				return "c.2.parquet", []string{a, b}, false
+			},
+			indexed: []string{"c.2.parquet"},
+			files:   []string{"c.2.parquet"},
+		},
+		{
+			name: "sources changed",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+				b := writePartitionParquet(t, table, "b.1.parquet", 3)
+				updateTestIndex(t, table, []string{a}, nil)
+				writePartitionParquet(t, table, "c.2.parquet", 1, 2, 3)
+				return "c.2.parquet", []string{a, b}, false
+			},
+			// b is not indexed: it is indexed again as the table has no WAL
+			indexed: []string{"a.1.parquet", "b.1.parquet"},
+			files:   []string{"a.1.parquet", "b.1.parquet"},
+		},
+		{
+			name: "interrupted promotion",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+				updateTestIndex(t, table, []string{a}, nil)
+				err := os.Rename(a, filepath.Join(testPartitionPath(table), "b.2.parquet"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return "b.2.parquet", []string{a}, false
+			},
+			indexed: []string{"b.2.parquet"},
+			files:   []string{"b.2.parquet"},
+		},
+		{
+			name: "interrupted rewrite",
+			prepare: func(t *testing.T, table *shared.Table) (string, []string, bool) {
+				a := writePartitionParquet(t, table, "a.2.parquet", 1, 2, 3)
+				updateTestIndex(t, table, []string{a}, nil)
+				writePartitionParquet(t, table, "b.2.parquet", 1, 3)
+				return "b.2.parquet", []string{a}, true
+			},
+			indexed: []string{"a.2.parquet"},
+			files:   []string{"a.2.parquet"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := testTable(t)
+			to, from, rewrite := test.prepare(t, table)
+			dir := testPartitionPath(table)
+			err := writeIntent(dir, to, from, rewrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = recoverTable(table, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if indexed := indexedFiles(t, table); !slices.Equal(indexed, test.indexed) {
+				t.Fatalf("expected the indexed files %v, got %v", test.indexed, indexed)
+			}
+			if files := partitionParquetFiles(t, table); !slices.Equal(files, test.files) {
+				t.Fatalf("expected the files %v, got %v", test.files, files)
+			}
+			if intents, _ := filepath.Glob(filepath.Join(dir, "*"+mergeIntentSuffix)); len(intents) > 0 {
+				t.Fatalf("expected the intent to be removed, got %v", intents)
+			}
+		})
+	}
+}
+
+func TestRecoverUnindexedFiles(t *testing.T) {
+	for _, walEnabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal %v", walEnabled), func(t *testing.T) {
+			table := testTable(t)
+			a := writePartitionParquet(t, table, "a.2.parquet", 1, 2)
+			updateTestIndex(t, table, []string{a}, nil)
+			writePartitionParquet(t, table, "b.1.parquet", 3)
+			writePartitionParquet(t, table, "c.2.parquet", 4)
+			err := recoverTable(table, walEnabled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"a.2.parquet", "b.1.parquet", "c.2.parquet"}
+			if walEnabled {
+				// the rows of the level 1 file are replayed from the WAL
+				expected = []string{"a.2.parquet", "c.2.parquet"}
+			}
+			if indexed := indexedFiles(t, table); !slices.Equal(indexed, expected) {
+				t.Fatalf("expected the indexed files %v, got %v", expected, indexed)
+			}
+			if files := partitionParquetFiles(t, table); !slices.Equal(files, expected) {
+				t.Fatalf("expected the files %v, got %v", expected, files)
+			}
+		})
+	}
+}
+
+func TestRecoverLostIndexKeepsLevel1Files(t *testing.T) {
+	table := testTable(t)
+	writePartitionParquet(t, table, "a.1.parquet", 1, 2)
+	writePartitionParquet(t, table, "b.2.parquet", 3)
+	err := recoverTable(table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the WAL doesn't have the rows of the files of a lost index
+	expected := []string{"a.1.parquet", "b.2.parquet"}
+	if indexed := indexedFiles(t, table); !slices.Equal(indexed, expected) {
+		t.Fatalf("expected the indexed files %v, got %v", expected, indexed)
+	}
+}
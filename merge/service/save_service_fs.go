@@ -37,7 +37,9 @@ func (fs *fsSaveService) shouldRecreateSchema(fields []fieldDesc) bool {
 		found := false
 		for _, _f := range fs.schema.Fields() {
 			if _f.Name == f.GetName() {
-				found = true
+				// the column may have been widened
+				col, err := data_types.DataTypes[f.GetType()](f.GetName(), nil, 0, 0)
+				found = err == nil && arrow.TypeEqual(_f.Type, col.ArrowDataType())
 			}
 		}
 		if !found {
@@ -107,6 +109,8 @@ func (fs *fsSaveService) Save(fields []fieldDesc, unorderedData dataStore) (stri
 	*/
 	err = fs.saveTmpFile(tmpFileName, fields, unorderedData)
 	if err != nil {
+		// a file failing halfway, e.g. on a full disk, is not left in tmp
+		os.Remove(tmpFileName)
 		return "", err
 	}
 	return fileName, os.Rename(tmpFileName, fileName)
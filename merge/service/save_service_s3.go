@@ -42,11 +42,19 @@ func (s *s3SaveService) Save(fields []fieldDesc, unorderedData dataStore) (strin
 	return fName, s.uploadToS3(tmpFileName)
 }
 
-func (s *s3SaveService) createMinioClient() (*minio.Client, error) {
-	minioClient, err := minio.New(s.url, &minio.Options{
-		Creds:  credentials.NewStaticV4(s.key, s.secret, ""),
-		Secure: s.secure,
-		Region: s.region,
+// endpoint returns the URL of the S3 endpoint: http(s)://<host>
+func (c s3Config) endpoint() string {
+	if c.secure {
+		return "https://" + c.url
+	}
+	return "http://" + c.url
+}
+
+func (c s3Config) createMinioClient() (*minio.Client, error) {
+	minioClient, err := minio.New(c.url, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.key, c.secret, ""),
+		Secure: c.secure,
+		Region: c.region,
 	})
 	return minioClient, err
 }
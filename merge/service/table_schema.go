@@ -0,0 +1,411 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/v14/parquet/file"
+	"github.com/apache/arrow/go/v14/parquet/pqarrow"
+	"github.com/gigapi/gigapi-config/config"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TypeConflictError is returned if a column of a batch has a type
+// that can't be reconciled with the type already accepted by the table
+type TypeConflictError struct {
+	Column   string
+	Expected string
+	Actual   string
+}
+
+func (e *TypeConflictError) Error() string {
+	return fmt.Sprintf("column `%s` type mismatch: expected %s, got %s", e.Column, e.Expected, e.Actual)
+}
+
+const (
+	ColumnOriginField = "field"
+	ColumnOriginTag   = "tag"
+)
+
+// ColumnSchema describes a column of a table in the schema registry
+type ColumnSchema struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Nullable  bool      `json:"nullable"`
+	// Origin is ColumnOriginTag for the columns parsed from tags or labels
+	Origin string `json:"origin"`
+}
+
+// schemaSaveInterval limits the rewrites of schema.json caused by the last seen time only
+const schemaSaveInterval = time.Minute
+
+// tableSchema is the schema registry of a table. It holds the current type of every column.
+// The types only widen along data_types.WidenType, so the files of the table
+// converge to one schema. The registry is kept in <table>/schema.json.
+// It is shared by all the threads and partitions of the table.
+type tableSchema struct {
+	m       sync.Mutex
+	path    string
+	columns map[string]*ColumnSchema
+	savedAt time.Time
+	// widenToString accepts the numeric + VARCHAR widening for the batches, see shared.Table.WidenToString
+	widenToString bool
+}
+
+var (
+	tableSchemasMtx sync.Mutex
+	tableSchemas    = map[string]*tableSchema{}
+)
+
+// getTableSchema returns the schema of the table. It is loaded on the first call,
+// from the parquet footers of the table if the schema was never saved.
+func getTableSchema(t *shared.Table) *tableSchema {
+	tableSchemasMtx.Lock()
+	defer tableSchemasMtx.Unlock()
+	key := t.Database + "." + t.Name
+	if s, ok := tableSchemas[key]; ok {
+		return s
+	}
+	tablePath := filepath.Join(config.Config.Gigapi.Root, t.Database, t.Name)
+	s := newTableSchema(filepath.Join(tablePath, "schema.json"))
+	s.widenToString = t.WidenToString
+	loaded, err := s.load()
+	if err == nil && !loaded && !strings.HasPrefix(t.Path, "s3://") {
+		err = s.loadFooters(t.Path)
+	}
+	if err != nil {
+		fmt.Printf("Table %s.%s: failed to load the schema: %v\n", t.Database, t.Name, err)
+	}
+	for _, c := range t.Columns {
+		if tp, ok := data_types.NormalizeTypeName(c.Type); ok {
+			if _, ok := s.columns[c.Name]; !ok {
+				s.columns[c.Name] = &ColumnSchema{Name: c.Name, Type: tp, Origin: ColumnOriginField}
+			}
+		}
+	}
+	tableSchemas[key] = s
+	return s
+}
+
+func newTableSchema(path string) *tableSchema {
+	return &tableSchema{path: path, columns: make(map[string]*ColumnSchema)}
+}
+
+func (s *tableSchema) load() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var columns []*ColumnSchema
+	err = json.Unmarshal(data, &columns)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range columns {
+		s.columns[c.Name] = c
+	}
+	s.savedAt = time.Now()
+	return true, nil
+}
+
+// loadFooters fills the schema from the footers of the parquet files of the table
+func (s *tableSchema) loadFooters(tablePath string) error {
+	var files int
+	err := filepath.WalkDir(tablePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != tablePath && (d.Name() == "tmp" || d.Name() == "wal" || d.Name() == "quarantine") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, ".parquet") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		err = s.addFooter(p, info.ModTime())
+		if err != nil {
+			fmt.Printf("failed to read the footer of %s: %v\n", p, err)
+			return nil
+		}
+		files++
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil || files == 0 {
+		return err
+	}
+	return s.save()
+}
+
+func (s *tableSchema) addFooter(name string, modTime time.Time) error {
+	reader, err := file.OpenParquetFile(name, false)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	meta := reader.MetaData()
+	arrowSchema, err := pqarrow.FromParquet(meta.Schema, nil, meta.KeyValueMetadata())
+	if err != nil {
+		return err
+	}
+
+	nulls := make(map[string]bool)
+	for i := 0; i < reader.NumRowGroups(); i++ {
+		rowGroup := meta.RowGroup(i)
+		for j := 0; j < rowGroup.NumColumns(); j++ {
+			chunk, err := rowGroup.ColumnChunk(j)
+			if err != nil {
+				return err
+			}
+			stats, err := chunk.Statistics()
+			if err == nil && stats != nil && stats.HasNullCount() && stats.NullCount() > 0 {
+				nulls[chunk.PathInSchema().String()] = true
+			}
+		}
+	}
+
+	known := len(s.columns) > 0
+	seen := make(map[string]bool)
+	for _, field := range arrowSchema.Fields() {
+		tp, ok := data_types.ArrowTypeName(field.Type)
+		if !ok {
+			continue
+		}
+		seen[field.Name] = true
+		col, ok := s.columns[field.Name]
+		if !ok {
+			s.columns[field.Name] = &ColumnSchema{
+				Name:      field.Name,
+				Type:      tp,
+				FirstSeen: modTime,
+				LastSeen:  modTime,
+				Nullable:  nulls[field.Name] || known,
+				Origin:    ColumnOriginField,
+			}
+			continue
+		}
+		if widened, ok := data_types.WidenType(col.Type, tp); ok {
+			col.Type = widened
+		}
+		if modTime.Before(col.FirstSeen) {
+			col.FirstSeen = modTime
+		}
+		if modTime.After(col.LastSeen) {
+			col.LastSeen = modTime
+		}
+		col.Nullable = col.Nullable || nulls[field.Name]
+	}
+	for name, col := range s.columns {
+		if !seen[name] {
+			col.Nullable = true
+		}
+	}
+	return nil
+}
+
+func (s *tableSchema) save() error {
+	if s.path == "" {
+		return nil
+	}
+	columns := s.list()
+	data, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(s.path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	s.savedAt = time.Now()
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+func (s *tableSchema) list() []ColumnSchema {
+	columns := make([]ColumnSchema, 0, len(s.columns))
+	for _, c := range s.columns {
+		columns = append(columns, *c)
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].Name < columns[j].Name
+	})
+	return columns
+}
+
+func (s *tableSchema) maybeSave(changed bool) {
+	if !changed && time.Since(s.savedAt) < schemaSaveInterval {
+		return
+	}
+	err := s.save()
+	if err != nil {
+		fmt.Printf("failed to save the schema %s: %v\n", s.path, err)
+	}
+}
+
+// widen returns the type of the column able to hold the values of type tp.
+// A numeric column and a batch of strings (or the reverse) conflict unless widenToString is set.
+func (s *tableSchema) widen(name, tp string) (string, error) {
+	col, ok := s.columns[name]
+	if !ok {
+		return tp, nil
+	}
+	res, ok := data_types.WidenType(col.Type, tp)
+	if ok && res == data_types.DATA_TYPE_NAME_STRING && col.Type != tp && !s.widenToString {
+		ok = false
+	}
+	if !ok {
+		return "", &TypeConflictError{Column: name, Expected: col.Type, Actual: tp}
+	}
+	return res, nil
+}
+
+func (s *tableSchema) check(columns map[string]data_types.IColumn) (map[string]string, error) {
+	types := make(map[string]string, len(columns))
+	for name, col := range columns {
+		tp, err := s.widen(name, col.GetTypeName())
+		if err != nil {
+			return nil, err
+		}
+		types[name] = tp
+	}
+	return types, nil
+}
+
+// Check validates the column types without accepting the new columns
+func (s *tableSchema) Check(columns map[string]data_types.IColumn) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.check(columns)
+	return err
+}
+
+// Widen validates the column types of a batch, records the columns, widens the current types
+// if needed and converts the columns of the batch to the current types
+func (s *tableSchema) Widen(columns map[string]data_types.IColumn) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	types, err := s.check(columns)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	changed := false
+	known := len(s.columns) > 0
+	for name, col := range s.columns {
+		if _, ok := columns[name]; !ok && !col.Nullable {
+			col.Nullable = true
+			changed = true
+		}
+	}
+	for name, data := range columns {
+		col, ok := s.columns[name]
+		if !ok {
+			col = &ColumnSchema{
+				Name:      name,
+				Type:      types[name],
+				FirstSeen: now,
+				// the rows stored before have no value
+				Nullable: known,
+				Origin:   ColumnOriginField,
+			}
+			s.columns[name] = col
+			changed = true
+		}
+		col.LastSeen = now
+		if col.Type != types[name] {
+			col.Type = types[name]
+			changed = true
+		}
+		if !col.Nullable && slices.Contains(data.GetValids(), false) {
+			col.Nullable = true
+			changed = true
+		}
+		if col.Type != data.GetTypeName() {
+			columns[name], err = data_types.CastColumn(data, col.Type)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	s.maybeSave(changed)
+	return nil
+}
+
+// WidenTypes widens the current types with the column types of the files of the table
+// and returns the current types of the columns. The conflicting types are left as is.
+func (s *tableSchema) WidenTypes(files ...map[string]string) map[string]string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now().UTC()
+	changed := false
+	res := make(map[string]string)
+	for _, types := range files {
+		for name, tp := range types {
+			col, ok := s.columns[name]
+			if !ok {
+				col = &ColumnSchema{Name: name, Type: tp, FirstSeen: now, LastSeen: now, Nullable: true,
+					Origin: ColumnOriginField}
+				s.columns[name] = col
+				changed = true
+			}
+			if widened, ok := data_types.WidenType(col.Type, tp); ok && widened != col.Type {
+				col.Type = widened
+				changed = true
+			}
+			res[name] = col.Type
+		}
+	}
+	s.maybeSave(changed)
+	return res
+}
+
+// MarkTags records the columns parsed from tags or labels
+func (s *tableSchema) MarkTags(names []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	changed := false
+	for _, name := range names {
+		if col, ok := s.columns[name]; ok && col.Origin != ColumnOriginTag {
+			col.Origin = ColumnOriginTag
+			changed = true
+		}
+	}
+	if changed {
+		s.maybeSave(true)
+	}
+}
+
+// Columns returns the columns of the table ordered by name
+func (s *tableSchema) Columns() []ColumnSchema {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.list()
+}
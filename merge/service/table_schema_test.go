@@ -0,0 +1,39 @@
+package service
+
+import (
+	"errors"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+	"testing"
+)
+
+func TestWidenToString(t *testing.T) {
+	batch := func(values any) map[string]data_types.IColumn {
+		col, err := data_types.WrapToColumn("value", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]data_types.IColumn{"value": col}
+	}
+	for _, widenToString := range []bool{false, true} {
+		s := newTableSchema("")
+		s.widenToString = widenToString
+		if err := s.Widen(batch([]int64{12})); err != nil {
+			t.Fatal(err)
+		}
+		// the numeric types widen in any case
+		if err := s.Widen(batch([]float64{1.5})); err != nil || s.columns["value"].Type != "FLOAT8" {
+			t.Fatalf("expected the column to widen to FLOAT8, got %s, %v", s.columns["value"].Type, err)
+		}
+		err := s.Widen(batch([]string{"12"}))
+		var conflict *TypeConflictError
+		if widenToString {
+			if err != nil || s.columns["value"].Type != "VARCHAR" {
+				t.Fatalf("expected the column to widen to VARCHAR, got %s, %v", s.columns["value"].Type, err)
+			}
+			continue
+		}
+		if !errors.As(err, &conflict) || s.columns["value"].Type != "FLOAT8" {
+			t.Fatalf("expected a type conflict keeping FLOAT8, got %s, %v", s.columns["value"].Type, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/gigapi/gigapi/v2/merge/shared"
+	"github.com/minio/minio-go/v7"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrDeleteTiered is returned for the deletes of rows in the files tiered to S3
+var ErrDeleteTiered = errors.New("the rows of the files tiered to S3 can't be deleted")
+
+// TierReport is the result of the tiering of a partition
+type TierReport struct {
+	Partition string `json:"partition"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	// Location is the S3 folder of the tiered files
+	Location string `json:"location"`
+}
+
+// isTiered checks if the indexed file was moved to S3
+func isTiered(name string) bool {
+	return strings.HasPrefix(name, "s3://")
+}
+
+// FinalSuffix returns the suffix of the files of the final merge level, which are never merged again
+func FinalSuffix(t *shared.Table) string {
+	return fmt.Sprintf(".%d.parquet", len(compactionPolicy(t).Levels)+1)
+}
+
+// tieredKey returns the S3 key of the table folder, or of the partition folder if values are set
+func tieredKey(c s3Config, t *shared.Table, values [][2]string) string {
+	res := path.Join(c.path, t.Database, t.Name)
+	if len(values) > 0 {
+		res = path.Join(res, partitionName(values))
+	}
+	return res
+}
+
+// tier uploads the files of the partition to S3 and swaps them with their S3 copies in the index
+// if all its files are of the final merge level and older than before. The local files are removed
+// once no retained snapshot references them. The merges of the partition folder wait for the tiering,
+// on all the threads.
+func (p *Partition) tier(c s3Config, before int64) (TierReport, error) {
+	p.mergeMtx.Lock()
+	defer p.mergeMtx.Unlock()
+	key := tieredKey(c, p.table, p.Values)
+	res := TierReport{Partition: p.name(), Location: fmt.Sprintf("s3://%s/%s", c.bucket, key)}
+	if p.index == nil || p.isDropped() {
+		return res, nil
+	}
+	suffix := FinalSuffix(p.table)
+	tsField := p.table.GetTimestampField()
+	var local []*shared.IndexEntry
+	for _, entry := range p.index.List() {
+		if isTiered(entry.Path) {
+			continue
+		}
+		maxTime, ok := entry.Max[tsField].(int64)
+		if !strings.HasSuffix(entry.Path, suffix) || !ok || maxTime >= before {
+			// the partition is not fully compacted or received recent rows meanwhile
+			return res, nil
+		}
+		local = append(local, entry)
+	}
+	if len(local) == 0 {
+		return res, nil
+	}
+	sort.Slice(local, func(i, j int) bool {
+		return local[i].Path < local[j].Path
+	})
+	client, err := c.createMinioClient()
+	if err != nil {
+		return res, fmt.Errorf("failed to create minio client: %w", err)
+	}
+	add := make([]*shared.IndexEntry, 0, len(local))
+	rm := make([]string, 0, len(local))
+	for _, entry := range local {
+		objectKey := path.Join(key, filepath.Base(entry.Path))
+		_, err = client.FPutObject(context.Background(), c.bucket, objectKey, entry.Path, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+		})
+		if err != nil {
+			return res, fmt.Errorf("failed to upload %s to S3: %w", filepath.Base(entry.Path), err)
+		}
+		tiered := *entry
+		tiered.Path = fmt.Sprintf("s3://%s/%s", c.bucket, objectKey)
+		tiered.Endpoint = c.endpoint()
+		add = append(add, &tiered)
+		rm = append(rm, entry.Path)
+		res.Bytes += entry.SizeBytes
+	}
+	prom := p.index.Batch(add, rm)
+	p.index.AddToDropQueue(rm)
+	_, err = prom.Get()
+	if err != nil {
+		return res, err
+	}
+	res.Files = len(add)
+	return res, nil
+}
+
+// tierPartitions returns the fully compacted partitions with local files older than before,
+// loading the partitions of compacted files only
+func (m *MultithreadHiveMergeTreeService) tierPartitions(before int64) ([]*Partition, error) {
+	h := m.svcs[0]
+	loaded := m.partitions()
+	tsField := h.Table.GetTimestampField()
+	suffix := FinalSuffix(h.Table)
+	var res []*Partition
+	err := filepath.WalkDir(h.Table.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(p, "metadata.json")); err != nil {
+			return nil
+		}
+		values, ok := h.partitionValuesOf(p)
+		if !ok {
+			return filepath.SkipDir
+		}
+		idx, err := index.ReadPartitionIndex(h.Table, p)
+		if err != nil {
+			return err
+		}
+		hasLocal := false
+		for _, entry := range idx.List() {
+			maxTime, ok := entry.Max[tsField].(int64)
+			if !ok || maxTime >= before || (!isTiered(entry.Path) && !strings.HasSuffix(entry.Path, suffix)) {
+				return filepath.SkipDir
+			}
+			hasLocal = hasLocal || !isTiered(entry.Path)
+		}
+		if !hasLocal {
+			return filepath.SkipDir
+		}
+		part, ok := loaded[h.calculatePartitionHash(values)]
+		if !ok {
+			part, err = h.getPartition(values)
+			if err != nil {
+				return err
+			}
+		}
+		res = append(res, part)
+		return filepath.SkipDir
+	})
+	return res, err
+}
+
+// Tier moves the files of the fully compacted partitions whose rows are older than before (ns)
+// to the S3 URL target: s3://<key>:<secret>@<host>/<bucket>/<path>?secure=false&region=<region>.
+// The files are uploaded to <path>/<database>/<table>/<partition>/ and the index of the partition
+// references their s3://<bucket>/... copies with the endpoint of the bucket. It returns the tiered partitions.
+func (m *MultithreadHiveMergeTreeService) Tier(target string, before int64) ([]TierReport, error) {
+	c, err := parseS3Config(target)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := m.tierPartitions(before)
+	if err != nil {
+		return nil, err
+	}
+	var res []TierReport
+	for _, part := range partitions {
+		report, err := part.tier(c, before)
+		if err != nil {
+			return res, fmt.Errorf("partition %s: %w", report.Partition, err)
+		}
+		if report.Files > 0 {
+			res = append(res, report)
+		}
+	}
+	return res, nil
+}
+
+func (s *MergeTreeService) Tier(target string, before int64) ([]TierReport, error) {
+	return nil, ErrNotPartitioned
+}
+
+// RemoveTiered removes the files of the table tiered to the S3 URL target,
+// only the files of the partition folder if values are set
+func RemoveTiered(target string, t *shared.Table, values [][2]string) error {
+	c, err := parseS3Config(target)
+	if err != nil {
+		return err
+	}
+	client, err := c.createMinioClient()
+	if err != nil {
+		return fmt.Errorf("failed to create minio client: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{
+		Prefix:    tieredKey(c, t, values) + "/",
+		Recursive: true,
+	})
+	var listErr error
+	toRemove := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(toRemove)
+		for obj := range objects {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			toRemove <- obj
+		}
+	}()
+	var errs []error
+	for res := range client.RemoveObjects(ctx, c.bucket, toRemove, minio.RemoveObjectsOptions{}) {
+		errs = append(errs, fmt.Errorf("%s: %w", res.ObjectName, res.Err))
+	}
+	// the removal completes once the listing is over
+	return errors.Join(append(errs, listErr)...)
+}
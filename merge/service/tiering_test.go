@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/gigapi/gigapi/v2/merge/index"
+	"github.com/minio/minio-go/v7"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTierMinIO tiers a partition to the S3 URL of GIGAPI_TEST_S3, e.g. a local MinIO:
+// s3://minioadmin:minioadmin@localhost:9000/gigapi/test?secure=false&region=us-east-1
+func TestTierMinIO(t *testing.T) {
+	target := os.Getenv("GIGAPI_TEST_S3")
+	if target == "" {
+		t.Skip("GIGAPI_TEST_S3 is not set")
+	}
+	c, err := parseS3Config(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConfig(t)
+	table := testTable(t)
+	table.PartitionExpressions = [][2]string{{"date", "toDate(time)"}}
+	err = RemoveTiered(target, table, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveTiered(target, table, nil)
+	compacted := writePartitionParquet(t, table, "a"+FinalSuffix(table), 1, 2, 3)
+	updateTestIndex(t, table, []string{compacted}, nil)
+	runIndexes(t, table)
+	svc, err := NewMultithreadHiveMergeTreeService(1, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop()
+
+	reports, err := svc.Tier(target, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := tieredKey(c, table, testPartition)
+	if len(reports) != 1 || reports[0].Files != 1 || reports[0].Location != "s3://"+c.bucket+"/"+key {
+		t.Fatalf("expected the partition to be tiered to %s, got %+v", key, reports)
+	}
+
+	// the index references the S3 copy and its endpoint, the local file waits in the drop queue
+	entries, err := index.ReadPartition(table, testPartitionPath(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := path.Join(key, path.Base(compacted))
+	if len(entries) != 1 || entries[0].Path != "s3://"+c.bucket+"/"+object || entries[0].Endpoint != c.endpoint() {
+		t.Fatalf("expected the entry of the S3 copy, got %+v", entries)
+	}
+	if !strings.HasPrefix(c.endpoint(), "http") || entries[0].RowCount != 3 {
+		t.Fatalf("unexpected entry %+v", entries[0])
+	}
+	part := svc.partitions()[svc.svcs[0].calculatePartitionHash(testPartition)]
+	if part == nil {
+		t.Fatal("expected the tiered partition to be loaded")
+	}
+	if dq := part.index.(*index.JSONIndex).GetDropQueue(); !slices.Contains(dq, compacted) {
+		t.Fatalf("expected the local file in the drop queue, got %v", dq)
+	}
+	client, err := c.createMinioClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for obj := range client.ListObjects(context.Background(), c.bucket, minio.ListObjectsOptions{Prefix: key, Recursive: true}) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		found = found || obj.Key == object
+	}
+	if !found {
+		t.Fatalf("expected the object %s in the bucket %s", object, c.bucket)
+	}
+
+	_, err = svc.Delete(DeleteRequest{From: 1, To: 10})
+	if !errors.Is(err, ErrDeleteTiered) {
+		t.Fatalf("expected the delete of the tiered rows to fail, got %v", err)
+	}
+	deleted, err := svc.Delete(DeleteRequest{From: 1, To: 10, SkipTiered: true})
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("expected the tiered files to be skipped, got %+v, %v", deleted, err)
+	}
+}
+
+// TestTierDuringMerge tiers a partition to the S3 URL of GIGAPI_TEST_S3 while another thread merges its files
+func TestTierDuringMerge(t *testing.T) {
+	target := os.Getenv("GIGAPI_TEST_S3")
+	if target == "" {
+		t.Skip("GIGAPI_TEST_S3 is not set")
+	}
+	c, err := parseS3Config(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConfig(t)
+	table := testTable(t)
+	table.PartitionExpressions = [][2]string{{"date", "toDate(time)"}}
+	err = RemoveTiered(target, table, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveTiered(target, table, nil)
+	a := writePartitionParquet(t, table, "a"+FinalSuffix(table), 1, 2)
+	b := writePartitionParquet(t, table, "b"+FinalSuffix(table), 3)
+	updateTestIndex(t, table, []string{a, b}, nil)
+	runIndexes(t, table)
+	svc, err := NewMultithreadHiveMergeTreeService(2, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop()
+	merging, err := svc.svcs[0].getPartition(testPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiering, err := svc.svcs[1].getPartition(testPartition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mergeErr, tierErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mergeErr = merging.DoMerge([]PlanMerge{{
+			From:      []string{a, b},
+			To:        "c" + FinalSuffix(table),
+			Iteration: len(compactionPolicy(table).Levels) + 1,
+		}})
+	}()
+	go func() {
+		defer wg.Done()
+		_, tierErr = tiering.tier(c, time.Now().UnixNano())
+	}()
+	wg.Wait()
+	if mergeErr != nil || tierErr != nil {
+		t.Fatalf("merge: %v, tier: %v", mergeErr, tierErr)
+	}
+
+	// the rows are either tiered in their merged file or in their sources, not both
+	var rows int64
+	for _, e := range merging.index.List() {
+		rows += e.RowCount
+	}
+	if rows != 3 {
+		t.Fatalf("expected 3 indexed rows, got %d", rows)
+	}
+}
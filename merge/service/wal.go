@@ -0,0 +1,31 @@
+package service
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/gigapi/gigapi/v2/merge/data_types"
+)
+
+func init() {
+	for _, v := range []any{[]int64{}, []uint64{}, []float64{}, []string{}, []bool{}} {
+		gob.Register(v)
+	}
+}
+
+// encodeWALRecord serializes the columns of a stored batch for the WAL.
+// The batch is logged after AutoTimestamp, so a replay restores the same timestamps.
+func encodeWALRecord(columns map[string]data_types.IColumn) ([]byte, error) {
+	data := make(map[string]any, len(columns))
+	for name, col := range columns {
+		data[name] = col.GetData()
+	}
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(data)
+	return buf.Bytes(), err
+}
+
+func decodeWALRecord(payload []byte) (map[string]any, error) {
+	var data map[string]any
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&data)
+	return data, err
+}
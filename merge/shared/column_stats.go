@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"cmp"
+	"hash/fnv"
+)
+
+// DefaultBloomFilterBits is the maximal size of the bloom filters if GIGAPI_BLOOM_FILTER_BITS is not set
+const DefaultBloomFilterBits = 65536
+
+// bloomFilterHashes is the number of the positions set per value
+const bloomFilterHashes = 4
+
+// BloomFilter is a bloom filter of the values of a string column of a file.
+// The positions of a value are (h1 + i*h2) mod M for i in [0, K), where h1 and h2 are the low and the high
+// 32 bits of the FNV-1a 64 hash of the value. Position p is the bit p%8 of Bits[p/8].
+type BloomFilter struct {
+	M    uint32 `json:"m"`
+	K    uint32 `json:"k"`
+	Bits []byte `json:"bits"`
+}
+
+func NewBloomFilter(bits uint32) *BloomFilter {
+	bits = max((bits+7)/8*8, 8)
+	return &BloomFilter{M: bits, K: bloomFilterHashes, Bits: make([]byte, bits/8)}
+}
+
+func (b *BloomFilter) positions(value string, fn func(pos uint32) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	for i := uint32(0); i < b.K; i++ {
+		if !fn((h1 + i*h2) % b.M) {
+			return
+		}
+	}
+}
+
+func (b *BloomFilter) Add(value string) {
+	b.positions(value, func(pos uint32) bool {
+		b.Bits[pos/8] |= 1 << (pos % 8)
+		return true
+	})
+}
+
+// MayContain returns false if the value is surely not in the file
+func (b *BloomFilter) MayContain(value string) bool {
+	res := true
+	b.positions(value, func(pos uint32) bool {
+		res = b.Bits[pos/8]&(1<<(pos%8)) != 0
+		return res
+	})
+	return res
+}
+
+// compareStats compares two min/max values. ok is false if they are of different types.
+func compareStats(a, b any) (res int, ok bool) {
+	switch a := a.(type) {
+	case int64:
+		b, ok := b.(int64)
+		return cmp.Compare(a, b), ok
+	case uint64:
+		b, ok := b.(uint64)
+		return cmp.Compare(a, b), ok
+	case float64:
+		b, ok := b.(float64)
+		return cmp.Compare(a, b), ok
+	case string:
+		b, ok := b.(string)
+		return cmp.Compare(a, b), ok
+	case bool:
+		b, ok := b.(bool)
+		if !ok || a == b {
+			return 0, ok
+		}
+		if !a {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// MergeIndexStats fills the min/max and the null counts of the entry of a merged file
+// from the entries of its sources. The min/max time is always merged. The other statistics are merged
+// only if all the sources have them, and a statistic is left out if it can't be derived exactly:
+// different types after a type widening or unknown min/max.
+// A column missing from a source is null in all its rows.
+func MergeIndexStats(res *IndexEntry, from []*IndexEntry, tsField string) {
+	res.Min, res.Max = make(map[string]any), make(map[string]any)
+	res.NullCounts, res.BloomFilters = nil, nil
+	columns := map[string]bool{tsField: true}
+	full := len(from) > 0
+	for _, e := range from {
+		if e.NullCounts == nil {
+			full = false
+		}
+		for c := range e.NullCounts {
+			columns[c] = true
+		}
+	}
+	if full {
+		res.NullCounts = make(map[string]int64)
+	} else {
+		columns = map[string]bool{tsField: true}
+	}
+
+	for c := range columns {
+		var (
+			_min, _max any
+			nulls      int64
+		)
+		hasMinMax := true
+		for _, e := range from {
+			n, known := e.NullCounts[c]
+			if full && !known {
+				nulls += e.RowCount
+				continue
+			}
+			nulls += n
+			if full && n == e.RowCount {
+				continue
+			}
+			eMin, minOk := e.Min[c]
+			eMax, maxOk := e.Max[c]
+			if !hasMinMax || !minOk || !maxOk {
+				hasMinMax = false
+				continue
+			}
+			if _min == nil {
+				_min, _max = eMin, eMax
+				continue
+			}
+			cMin, ok1 := compareStats(eMin, _min)
+			cMax, ok2 := compareStats(eMax, _max)
+			if !ok1 || !ok2 {
+				hasMinMax = false
+				continue
+			}
+			if cMin < 0 {
+				_min = eMin
+			}
+			if cMax > 0 {
+				_max = eMax
+			}
+		}
+		if hasMinMax && _min != nil {
+			res.Min[c], res.Max[c] = _min, _max
+		}
+		if full {
+			res.NullCounts[c] = nulls
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxMergeLevels limits the number of the merge levels of a compaction policy
+const MaxMergeLevels = 16
+
+// MergeLevel configures the merge of the .<level>.parquet files into .<level+1>.parquet
+type MergeLevel struct {
+	// MaxSizeBytes is the size target of the merged files
+	MaxSizeBytes int64 `json:"max_size_bytes"`
+	// MinFiles is the minimal number of files merged at once
+	MinFiles int `json:"min_files,omitempty"`
+	// DelayS is the delay between two runs of the level (in seconds)
+	DelayS int64 `json:"delay_s"`
+}
+
+// CompactionPolicy configures the merges of a table
+type CompactionPolicy struct {
+	Levels []MergeLevel `json:"levels,omitempty"`
+	// TickS is the interval between two merge plannings of the table (in seconds)
+	TickS int64 `json:"tick_s,omitempty"`
+}
+
+// DefaultMergeTickS is the default interval between two merge plannings
+const DefaultMergeTickS = 10
+
+// DefaultCompactionPolicy returns the default policy for the base merge timeout:
+// four levels running every 1x/10x/100x/420x of the timeout and merging files up to 100MB/400MB/4GB/4GB.
+func DefaultCompactionPolicy(mergeTimeoutS int64) *CompactionPolicy {
+	return &CompactionPolicy{
+		Levels: []MergeLevel{
+			{MaxSizeBytes: 100 * 1024 * 1024, MinFiles: 1, DelayS: mergeTimeoutS},
+			{MaxSizeBytes: 400 * 1024 * 1024, MinFiles: 1, DelayS: mergeTimeoutS * 10},
+			{MaxSizeBytes: 4000 * 1024 * 1024, MinFiles: 1, DelayS: mergeTimeoutS * 100},
+			{MaxSizeBytes: 4000 * 1024 * 1024, MinFiles: 1, DelayS: mergeTimeoutS * 420},
+		},
+		TickS: DefaultMergeTickS,
+	}
+}
+
+// Normalize fills the omitted settings of the policy from the default one and validates it
+func (p *CompactionPolicy) Normalize(def *CompactionPolicy) error {
+	if len(p.Levels) == 0 {
+		p.Levels = append([]MergeLevel{}, def.Levels...)
+	}
+	if p.TickS == 0 {
+		p.TickS = def.TickS
+	}
+	if len(p.Levels) > MaxMergeLevels {
+		return fmt.Errorf("compaction: at most %d levels are supported", MaxMergeLevels)
+	}
+	if p.TickS < 0 {
+		return fmt.Errorf("compaction: invalid tick_s %d", p.TickS)
+	}
+	for i := range p.Levels {
+		l := &p.Levels[i]
+		if l.MaxSizeBytes <= 0 {
+			return fmt.Errorf("compaction: level %d: max_size_bytes must be positive", i+1)
+		}
+		if l.MinFiles == 0 {
+			l.MinFiles = 1
+		}
+		if l.MinFiles < 0 || l.DelayS < 0 {
+			return fmt.Errorf("compaction: level %d: min_files and delay_s must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+// Tick returns the interval between two merge plannings
+func (p *CompactionPolicy) Tick() time.Duration {
+	return time.Duration(p.TickS) * time.Second
+}
@@ -0,0 +1,28 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy configures the age based deletion of the data of a table
+type RetentionPolicy struct {
+	// TTLS is the age after which the data is deleted, by the timestamp field (in seconds).
+	// 0 keeps the data forever.
+	TTLS int64 `json:"ttl_s"`
+	// RowLevel trims the rows older than the TTL from the partitions not expired as a whole
+	RowLevel bool `json:"row_level,omitempty"`
+}
+
+// Validate checks the settings of the policy
+func (p *RetentionPolicy) Validate() error {
+	if p.TTLS < 0 {
+		return fmt.Errorf("retention: invalid ttl_s %d", p.TTLS)
+	}
+	return nil
+}
+
+// TTL returns the age after which the data is deleted, 0 if it is kept forever
+func (p *RetentionPolicy) TTL() time.Duration {
+	return time.Duration(p.TTLS) * time.Second
+}
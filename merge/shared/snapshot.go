@@ -0,0 +1,16 @@
+package shared
+
+import "errors"
+
+// ErrSnapshotExpired is returned for a snapshot older than the retained ones
+var ErrSnapshotExpired = errors.New("snapshot expired")
+
+// Snapshot is a version of the files of a partition index
+type Snapshot struct {
+	Version uint64 `json:"version"`
+	// Time is the unix time in ns the version was committed at
+	Time int64 `json:"time"`
+	// Added and Removed are the files added and removed by the version
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
@@ -15,27 +15,81 @@ type IndexEntry struct {
 	SizeBytes int64
 	RowCount  int64
 	ChunkTime int64
-	Min       map[string]any
-	Max       map[string]any
+	// Min and Max are the min/max values of the columns. The nulls are not counted.
+	Min map[string]any
+	Max map[string]any
+	// NullCounts are the null counts of all the columns of the file.
+	// nil if the entry has the statistics of the timestamp field only.
+	NullCounts map[string]int64
+	// BloomFilters are the bloom filters of the Table.BloomFilterColumns columns
+	BloomFilters map[string]*BloomFilter
+	// WALSequence is the WAL sequence up to which all the records of the table are saved
+	// once the entry is registered. 0 if the entry doesn't come from the WAL.
+	WALSequence uint64
+	// Endpoint is the S3 endpoint of a file tiered to S3 (http(s)://<host>), empty for a local file
+	Endpoint string
 }
 
 type Index interface {
 	Batch(add []*IndexEntry, rm []string) utils.Promise[int32]
 	Get(path string) *IndexEntry
+	// List returns all the entries of the index
+	List() []*IndexEntry
 	Run()
 	Stop()
 	AddToDropQueue(files []string) utils.Promise[int32]
 	RmFromDropQueue(files []string) utils.Promise[int32]
 	GetDropQueue() []string
+	// Snapshots returns the retained snapshots of the index, oldest first.
+	// The first one is the oldest version that can be resolved.
+	Snapshots() []*Snapshot
+	// ResolveSnapshot returns the entries of the version of the index
+	ResolveSnapshot(version uint64) ([]*IndexEntry, error)
 }
 
+// TableColumn is a declared column of a table.
+// Type is one of the data_types.DataTypes names.
+type TableColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ArrivalTimestampField is the column filled with the time the row was received
+// if the table has AutoTimestamp enabled
+const ArrivalTimestampField = "__timestamp"
+
 type Table struct {
-	Database      string
-	Name          string
-	Path          string
-	Engine        string
-	OrderBy       []string
-	PartitionBy   func(map[string]data_types.IColumn) ([]PartitionDesc, error)
+	Database string
+	Name     string
+	Path     string
+	Engine   string
+	OrderBy  []string
+	// TimestampField is the event time column (int64 nanoseconds).
+	// It drives the partitioning and the min/max time of the index.
+	// Rows without it get the arrival time.
+	TimestampField string
+	PartitionBy    func(map[string]data_types.IColumn) ([]PartitionDesc, error)
+	// PartitionExpressions are the [folder name, expr-lang expression] pairs
+	// evaluated for every row. They take precedence over PartitionBy.
+	PartitionExpressions [][2]string
+	// Columns are the declared columns. If set, the stored data must match them.
+	Columns []TableColumn
+	// AutoTimestamp adds the arrival time as the ArrivalTimestampField column
 	AutoTimestamp bool
+	// Compaction is the merge policy of the table. The default policy is used if nil.
+	Compaction *CompactionPolicy
+	// Retention is the retention policy of the table. The configured policy is used if nil.
+	Retention *RetentionPolicy
+	// BloomFilterColumns are the string columns indexed with bloom filters
+	BloomFilterColumns []string
+	// WidenToString widens a numeric column to VARCHAR on a batch of strings instead of quarantining the batch
+	WidenToString bool
 	IndexCreator  func(values [][2]string) (Index, error)
 }
+
+func (t *Table) GetTimestampField() string {
+	if t.TimestampField == "" {
+		return ArrivalTimestampField
+	}
+	return t.TimestampField
+}
@@ -0,0 +1,17 @@
+package utils
+
+// Volume is the usage of the volume of a path
+type Volume struct {
+	// ID is the device of the volume
+	ID         uint64
+	TotalBytes uint64
+	// UsedBytes are the bytes in use, without the blocks reserved to root
+	UsedBytes uint64
+	// FreeBytes are the bytes available to the process
+	FreeBytes uint64
+}
+
+// GetVolume returns the usage of the volume of the path
+func GetVolume(path string) (Volume, error) {
+	return statVolume(path)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+func statVolume(path string) (Volume, error) {
+	return Volume{}, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func statVolume(path string) (Volume, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Volume{}, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Volume{}, errors.New("unsupported file info")
+	}
+	var fs syscall.Statfs_t
+	err = syscall.Statfs(path, &fs)
+	if err != nil {
+		return Volume{}, err
+	}
+	return Volume{
+		ID:         uint64(stat.Dev),
+		TotalBytes: uint64(fs.Blocks) * uint64(fs.Bsize),
+		UsedBytes:  (uint64(fs.Blocks) - uint64(fs.Bfree)) * uint64(fs.Bsize),
+		FreeBytes:  uint64(fs.Bavail) * uint64(fs.Bsize),
+	}, nil
+}
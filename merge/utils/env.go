@@ -0,0 +1,12 @@
+package utils
+
+import "os"
+
+// GetEnv returns the environment variable or def if it is not set.
+// Used for the settings not covered by gigapi-config.
+func GetEnv(name string, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return def
+}
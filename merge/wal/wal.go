@@ -0,0 +1,367 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxSegmentSize is the size of the active segment after which a new segment is started
+var MaxSegmentSize int64 = 64 * 1024 * 1024
+
+const segmentSuffix = ".wal"
+
+// record header: payload length (4 bytes), crc32 of seq + payload (4 bytes), seq (8 bytes)
+const headerSize = 16
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type segment struct {
+	path    string
+	lastSeq uint64
+}
+
+// WAL is an append-only log of the acknowledged but not yet saved data of a table.
+// Every record has a sequence number and a reference counter set on Append.
+// The counter is decreased by Ack, and the segments which contain only
+// acknowledged records are removed from the disk.
+type WAL struct {
+	dir string
+	m   sync.Mutex
+	// syncMtx serializes the fsyncs, the records written meanwhile share the next one
+	syncMtx sync.Mutex
+	// synced is the greatest sequence on the disk
+	synced uint64
+
+	seq     uint64
+	f       *os.File
+	fSize   int64
+	active  *segment
+	closed  []*segment
+	replay  []*segment
+	pending map[uint64]int
+	buf     []byte
+}
+
+// Open opens the WAL in the dir folder. The existing segments are kept for Replay.
+// The new records get sequence numbers greater than minSeq and the sequences found in the folder.
+func Open(dir string, minSeq uint64) (*WAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	res := &WAL{
+		dir:     dir,
+		seq:     minSeq,
+		pending: make(map[uint64]int),
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentSuffix) {
+			continue
+		}
+		seg := &segment{path: filepath.Join(dir, e.Name())}
+		err = readSegment(seg.path, func(seq uint64, payload []byte) error {
+			seg.lastSeq = seq
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if seg.lastSeq == 0 {
+			// the segment was rotated in but nothing was written
+			err = os.Remove(seg.path)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		res.seq = max(res.seq, seg.lastSeq)
+		res.replay = append(res.replay, seg)
+	}
+	sort.Slice(res.replay, func(i, j int) bool {
+		return res.replay[i].path < res.replay[j].path
+	})
+	return res, nil
+}
+
+// Replay calls fn for every record of the segments found by Open with the sequence greater than fromSeq.
+// The segments are removed once all their records are replayed.
+func (w *WAL) Replay(fromSeq uint64, fn func(seq uint64, payload []byte) error) error {
+	w.m.Lock()
+	segments := w.replay
+	w.replay = nil
+	w.m.Unlock()
+	for _, seg := range segments {
+		err := readSegment(seg.path, func(seq uint64, payload []byte) error {
+			if seq <= fromSeq {
+				return nil
+			}
+			return fn(seq, payload)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, seg := range segments {
+		err := os.Remove(seg.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append writes the payload to the disk and returns its sequence number.
+// The record is kept until Ack is called refs times for its sequence number.
+func (w *WAL) Append(payload []byte, refs int) (uint64, error) {
+	seq, err := w.Write(payload, refs)
+	if err != nil {
+		return 0, err
+	}
+	return seq, w.Sync(seq)
+}
+
+// Write writes the payload to the active segment without syncing it and returns its sequence number.
+// The record is durable once Sync returned for its sequence number.
+// The record is kept until Ack is called refs times for its sequence number.
+func (w *WAL) Write(payload []byte, refs int) (uint64, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(payload) > math.MaxUint32 {
+		return 0, fmt.Errorf("wal record is too large: %d bytes", len(payload))
+	}
+	if w.f == nil || w.fSize >= MaxSegmentSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	seq := w.seq + 1
+	w.buf = w.buf[:0]
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(len(payload)))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, 0)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, seq)
+	w.buf = append(w.buf, payload...)
+	binary.LittleEndian.PutUint32(w.buf[4:8], crc32.Checksum(w.buf[8:], crcTable))
+	_, err := w.f.Write(w.buf)
+	if err != nil {
+		// the tail of the segment may be torn, so the next record goes to a new one
+		w.closeActive(true)
+		return 0, err
+	}
+	w.seq = seq
+	w.fSize += int64(len(w.buf))
+	w.active.lastSeq = seq
+	if refs > 0 {
+		w.pending[seq] = refs
+	}
+	return seq, nil
+}
+
+// Sync flushes the records up to seq to the disk. The records written by the concurrent
+// callers are flushed by a single fsync.
+func (w *WAL) Sync(seq uint64) error {
+	w.syncMtx.Lock()
+	defer w.syncMtx.Unlock()
+	w.m.Lock()
+	f, last := w.f, w.seq
+	synced := w.synced >= seq
+	w.m.Unlock()
+	if synced {
+		return nil
+	}
+	var err error
+	if f != nil {
+		err = f.Sync()
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	switch {
+	case w.synced >= seq:
+		// the segment was synced when it was closed meanwhile
+		return nil
+	case f == nil || errors.Is(err, os.ErrClosed):
+		return fmt.Errorf("wal record %d: the segment was closed before it was synced", seq)
+	case err != nil:
+		return err
+	}
+	w.synced = max(w.synced, last)
+	return nil
+}
+
+// Ack releases one reference of each of the sequences and removes
+// the segments that don't hold unreleased records anymore
+func (w *WAL) Ack(seqs []uint64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	for _, seq := range seqs {
+		if refs, ok := w.pending[seq]; ok {
+			if refs <= 1 {
+				delete(w.pending, seq)
+			} else {
+				w.pending[seq] = refs - 1
+			}
+		}
+	}
+	return w.truncate()
+}
+
+// Watermark returns the greatest sequence number such that all the records
+// up to it are released, as if the seqs were released as well.
+func (w *WAL) Watermark(seqs []uint64) uint64 {
+	w.m.Lock()
+	defer w.m.Unlock()
+	acked := make(map[uint64]int, len(seqs))
+	for _, seq := range seqs {
+		acked[seq]++
+	}
+	res := w.seq
+	for seq, refs := range w.pending {
+		if refs > acked[seq] && seq <= res {
+			res = seq - 1
+		}
+	}
+	return res
+}
+
+func (w *WAL) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if err == nil && w.active != nil {
+		w.synced = max(w.synced, w.active.lastSeq)
+	}
+	err = errors.Join(err, w.f.Close())
+	w.f = nil
+	return err
+}
+
+func (w *WAL) watermark() uint64 {
+	res := w.seq
+	for seq := range w.pending {
+		if seq <= res {
+			res = seq - 1
+		}
+	}
+	return res
+}
+
+func (w *WAL) truncate() error {
+	watermark := w.watermark()
+	if w.active != nil && w.fSize > 0 && w.active.lastSeq <= watermark {
+		// the records are saved, they don't need to be synced
+		w.synced = max(w.synced, w.active.lastSeq)
+		w.closeActive(false)
+	}
+	var rest []*segment
+	var errs []error
+	for _, seg := range w.closed {
+		if seg.lastSeq > watermark {
+			rest = append(rest, seg)
+			continue
+		}
+		err := os.Remove(seg.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			rest = append(rest, seg)
+		}
+	}
+	w.closed = rest
+	return errors.Join(errs...)
+}
+
+// closeActive closes the active segment, synced first if sync is set
+func (w *WAL) closeActive(sync bool) {
+	if w.f != nil {
+		if sync && w.active != nil && w.f.Sync() == nil {
+			w.synced = max(w.synced, w.active.lastSeq)
+		}
+		w.f.Close()
+		w.f = nil
+	}
+	if w.active != nil {
+		w.closed = append(w.closed, w.active)
+		w.active = nil
+	}
+}
+
+func (w *WAL) rotate() error {
+	w.closeActive(true)
+	name := filepath.Join(w.dir, fmt.Sprintf("%020d%s", w.seq+1, segmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.fSize = 0
+	w.active = &segment{path: name, lastSeq: w.seq}
+	return nil
+}
+
+// readSegment reads the records of the segment until the end of the file or the first torn record.
+// A record longer than the rest of the file is torn: its length is not covered by the checksum.
+func readSegment(name string, fn func(seq uint64, payload []byte) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	left := stat.Size()
+	header := make([]byte, headerSize)
+	for {
+		_, err = io.ReadFull(f, header)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		left -= headerSize
+		size := binary.LittleEndian.Uint32(header[0:4])
+		crc := binary.LittleEndian.Uint32(header[4:8])
+		if int64(size) > left {
+			fmt.Printf("WAL segment %s: torn record of %d bytes, skipping the rest of the segment\n", name, size)
+			return nil
+		}
+		left -= int64(size)
+		body := make([]byte, 8+int(size))
+		copy(body, header[8:])
+		_, err = io.ReadFull(f, body[8:])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(body, crcTable) != crc {
+			fmt.Printf("WAL segment %s: checksum mismatch, skipping the rest of the segment\n", name)
+			return nil
+		}
+		err = fn(binary.LittleEndian.Uint64(body[:8]), body[8:])
+		if err != nil {
+			return err
+		}
+	}
+}
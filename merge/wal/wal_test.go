@@ -0,0 +1,150 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWALReplayAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "b", "c"} {
+		if _, err := w.Append([]byte(payload), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Ack([]uint64{1, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if wm := w.Watermark(nil); wm != 1 {
+		t.Fatalf("expected watermark 1, got %d", wm)
+	}
+	if wm := w.Watermark([]uint64{2}); wm != 2 {
+		t.Fatalf("expected watermark 2, got %d", wm)
+	}
+	w.Close()
+
+	w, err = Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	err = w.Replay(1, func(seq uint64, payload []byte) error {
+		replayed = append(replayed, string(payload))
+		_, err := w.Append(payload, 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0] != "b" || replayed[1] != "c" {
+		t.Fatalf("unexpected replay %v", replayed)
+	}
+	if err := w.Ack([]uint64{4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected the acknowledged segments to be removed, got %d files", len(entries))
+	}
+}
+
+func TestWALConcurrentSync(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MaxSegmentSize = 64
+	defer func() { MaxSegmentSize = 64 * 1024 * 1024 }()
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seq, err := w.Write([]byte(fmt.Sprintf("record %d", i)), 1)
+			if err == nil {
+				err = w.Sync(seq)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	w, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := make(map[string]bool)
+	err = w.Replay(0, func(seq uint64, payload []byte) error {
+		replayed[string(payload)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 100 {
+		t.Fatalf("expected 100 records, got %d", len(replayed))
+	}
+}
+
+func TestWALTornLength(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "b"} {
+		if _, err := w.Append([]byte(payload), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// the length of the second record is garbage
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one segment, got %v %v", entries, err)
+	}
+	name := filepath.Join(dir, entries[0].Name())
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[headerSize+1:], 0xfffffff0)
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var replayed []string
+	err = w.Replay(0, func(seq uint64, payload []byte) error {
+		replayed = append(replayed, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 1 || replayed[0] != "a" {
+		t.Fatalf("expected the records before the torn one, got %v", replayed)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"github.com/gigapi/gigapi/v2/merge/repository"
 	"github.com/gigapi/gigapi/v2/merge/utils"
 	"io"
 	"os"
@@ -13,10 +14,17 @@ import (
 // Currently used to initialize docker build
 
 func Init() {
-	var useStdin bool
+	var useStdin, fsck, fsckRebuild bool
 	flag.BoolVar(&useStdin, "stdin", false, "Use stdin as input")
+	flag.BoolVar(&fsck, "fsck", false, "Check the metadata.json files of GIGAPI_ROOT against the parquet files and exit")
+	flag.BoolVar(&fsckRebuild, "fsck-rebuild", false,
+		"Check the metadata.json files of GIGAPI_ROOT and rebuild the damaged ones, then exit")
 	flag.Parse()
 
+	if fsck || fsckRebuild {
+		runFsck(fsckRebuild)
+	}
+
 	if !useStdin {
 		return
 	}
@@ -26,6 +34,19 @@ func Init() {
 	os.Exit(0)
 }
 
+// runFsck checks GIGAPI_ROOT offline. The exit code is 1 if damaged partitions are left.
+func runFsck(rebuild bool) {
+	res, err := repository.Fsck(rebuild, os.Stdout)
+	if err != nil {
+		fmt.Printf("Fsck failed: %v\n", err)
+		os.Exit(2)
+	}
+	if res.Damaged > res.Rebuilt {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func processStdin() {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -17,3 +17,7 @@ func (g *GigapiError) Error() string {
 func (g *GigapiError) Code() int {
 	return g.code
 }
+
+func NewGigapiError(code int, message string) *GigapiError {
+	return &GigapiError{message: message, code: code}
+}